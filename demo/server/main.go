@@ -3,9 +3,9 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
 	"net/http"
 	"os"
@@ -27,6 +27,15 @@ const (
 	APP_NAME      string        = "Vectoria"
 	READ_TIMEOUT  time.Duration = 10 * time.Second
 	WRITE_TIMEOUT time.Duration = 10 * time.Second
+
+	// Neighbors returned by /get at most, whatever k is, to bound response sizes.
+	MAX_RESULTS uint32 = 1000
+
+	// Items accepted by /add_batch at most, to bound request sizes.
+	MAX_BATCH_SIZE int = 1000
+
+	// Environment variable used as the default of the --path flag.
+	PATH_ENV string = "VECTORIA_PATH"
 )
 
 type entrypoint struct {
@@ -45,6 +54,21 @@ type addReq struct {
 
 type addRes struct{}
 
+type addBatchItem struct {
+	ItemID  string    `json:"item_id"`
+	ItemVec []float64 `json:"item_vec"`
+}
+
+type addBatchReq struct {
+	IndexName string         `json:"index_name"`
+	Items     []addBatchItem `json:"items"`
+}
+
+type addBatchRes struct {
+	// IDs of the items that couldn't be added, so that clients can retry them. Empty when all were added.
+	FailedIDs []string `json:"failed_ids"`
+}
+
 type getReq struct {
 	IndexName string    `json:"index_name"`
 	Query     []float64 `json:"query"`
@@ -54,6 +78,9 @@ type getReq struct {
 
 type getRes struct {
 	IDs []string `json:"ids"`
+
+	// Whether IDs was cut to the DB's MaxResults.
+	Truncated bool `json:"truncated"`
 }
 
 type Captions struct {
@@ -114,12 +141,22 @@ func (entry *entrypoint) registerRoutes() {
 
 	entry.app.Post("/new", entry.new).
 		Post("/add", entry.add).
+		Post("/add_batch", entry.addBatch).
 		Post("/get", entry.get)
 }
 
+type healthRes struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
 func (entry *entrypoint) health(ctx *fiber.Ctx) error {
-	// TODO
-	return nil
+	if err := entry.db.Ping(); err != nil {
+		entry.logger.Error("health check failed", "function", "health", "error", err.Error())
+		return ctx.Status(http.StatusServiceUnavailable).JSON(&healthRes{Status: "unavailable", Error: err.Error()})
+	}
+
+	return ctx.Status(http.StatusOK).JSON(&healthRes{Status: "ok"})
 }
 
 func (entry *entrypoint) add(ctx *fiber.Ctx) error {
@@ -131,6 +168,11 @@ func (entry *entrypoint) add(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString("{}")
 	}
 
+	if len(payload.ItemVec) > int(entry.db.MaxSpaceDim()) {
+		logDebug.Error("item vector is too large", "len", len(payload.ItemVec))
+		return ctx.Status(http.StatusBadRequest).SendString("{}")
+	}
+
 	err := entry.db.Add(payload.ItemID, payload.ItemVec, payload.IndexName)
 	if err != nil {
 		logDebug.Error("unable to add data to database", "error", err.Error())
@@ -140,6 +182,50 @@ func (entry *entrypoint) add(ctx *fiber.Ctx) error {
 	return ctx.Status(http.StatusOK).JSON(&addRes{})
 }
 
+// addBatch adds the items in a single write. When it fails, the items are added one by one instead,
+// so that only the failing ones are reported.
+func (entry *entrypoint) addBatch(ctx *fiber.Ctx) error {
+	logDebug := entry.logger.With("function", "addBatch")
+	payload := &addBatchReq{}
+
+	if err := ctx.BodyParser(payload); err != nil {
+		logDebug.Error("unable to parse payload data", "error", err.Error())
+		return ctx.Status(http.StatusBadRequest).SendString("{}")
+	}
+
+	if len(payload.Items) > MAX_BATCH_SIZE {
+		logDebug.Error("batch is too large", "len", len(payload.Items))
+		return ctx.Status(http.StatusBadRequest).SendString("{}")
+	}
+
+	for _, item := range payload.Items {
+		if len(item.ItemVec) > int(entry.db.MaxSpaceDim()) {
+			logDebug.Error("item vector is too large", "item_id", item.ItemID, "len", len(item.ItemVec))
+			return ctx.Status(http.StatusBadRequest).SendString("{}")
+		}
+	}
+
+	items := make([]vectoria.Item, len(payload.Items))
+	for i, item := range payload.Items {
+		items[i] = vectoria.Item{ID: item.ItemID, Vec: item.ItemVec}
+	}
+
+	failedIDs := []string{}
+
+	if err := entry.db.AddBatch(items, payload.IndexName); err != nil {
+		logDebug.Error("unable to add batch to database, adding items one by one", "error", err.Error())
+
+		for _, item := range items {
+			if err := entry.db.Add(item.ID, item.Vec, payload.IndexName); err != nil {
+				logDebug.Error("unable to add data to database", "item_id", item.ID, "error", err.Error())
+				failedIDs = append(failedIDs, item.ID)
+			}
+		}
+	}
+
+	return ctx.Status(http.StatusOK).JSON(&addBatchRes{FailedIDs: failedIDs})
+}
+
 func (entry *entrypoint) get(ctx *fiber.Ctx) error {
 	logDebug := entry.logger.With("function", "get")
 	payload := &getReq{}
@@ -149,13 +235,23 @@ func (entry *entrypoint) get(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString("{}")
 	}
 
-	res, err := entry.db.Get(payload.Query, payload.Threshold, payload.K, payload.IndexName)
+	if len(payload.Query) > int(entry.db.MaxSpaceDim()) {
+		logDebug.Error("query vector is too large", "len", len(payload.Query))
+		return ctx.Status(http.StatusBadRequest).SendString("{}")
+	}
+
+	ids, truncated, err := entry.db.GetCapped(payload.Query, payload.Threshold, payload.K, payload.IndexName)
 	if err != nil {
 		logDebug.Error("unable to get data from database", "error", err.Error())
 		return ctx.Status(http.StatusInternalServerError).SendString("{}")
 	}
 
-	return ctx.Status(http.StatusOK).JSON(&getRes{IDs: res[payload.IndexName]})
+	// Clients expect an empty list, not null, when nothing matches.
+	if ids == nil {
+		ids = []string{}
+	}
+
+	return ctx.Status(http.StatusOK).JSON(&getRes{IDs: ids, Truncated: truncated})
 }
 
 func (entry *entrypoint) new(ctx *fiber.Ctx) error {
@@ -187,9 +283,17 @@ func (entry *entrypoint) new(ctx *fiber.Ctx) error {
 	return ctx.Status(http.StatusOK).Send(res)
 }
 
+// writeToDB adds the captions in batches, so that each write transaction covers many of them.
 func (entry *entrypoint) writeToDB(data []Captions) error {
-	for _, caption := range data {
-		if err := entry.db.Add(caption.URL, caption.Embedding); err != nil {
+	for start := 0; start < len(data); start += vectoria.IMPORT_BATCH_SIZE {
+		batch := data[start:min(start+vectoria.IMPORT_BATCH_SIZE, len(data))]
+
+		items := make([]vectoria.Item, len(batch))
+		for i, caption := range batch {
+			items[i] = vectoria.Item{ID: caption.URL, Vec: caption.Embedding}
+		}
+
+		if err := entry.db.AddBatch(items); err != nil {
 			entry.logger.Error("unable to wtite item to database", "function", "writeToDB", "error", err.Error())
 			return err
 		}
@@ -198,6 +302,55 @@ func (entry *entrypoint) writeToDB(data []Captions) error {
 	return nil
 }
 
+// hasData reports whether any index already holds items, as is the case when reopening an on-disk DB.
+func (entry *entrypoint) hasData() (bool, error) {
+	overview, err := entry.db.Overview()
+	if err != nil {
+		return false, err
+	}
+
+	for _, idx := range overview {
+		if idx.NumItems > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// populate downloads the dataset and writes it to the DB, unless the DB already has data.
+func (entry *entrypoint) populate(remoteDatasetPath string) error {
+	logDebug := entry.logger.With("function", "populate")
+
+	populated, err := entry.hasData()
+	if err != nil {
+		logDebug.Error("unable to check for existing data", "error", err.Error())
+		return err
+	}
+
+	if populated {
+		entry.logger.Info("database already has data, skipping ingestion", "path", entry.path)
+		return nil
+	}
+
+	data, err := entry.getData(remoteDatasetPath)
+	if err != nil {
+		logDebug.Error("unable to get data", "error", err.Error())
+		return err
+	}
+	runtime.GC()
+
+	entry.logger.Info("writing to database")
+	if err := entry.writeToDB(data); err != nil {
+		logDebug.Error("unable to write to database", "error", err.Error())
+		return err
+	}
+	entry.logger.Info("finished writing to database")
+	runtime.GC()
+
+	return nil
+}
+
 func (entry *entrypoint) listen() error {
 	entry.registerRoutes()
 
@@ -308,18 +461,20 @@ func main() {
 	slog.SetDefault(logger)
 
 	var (
-		path              string = ""
+		path              string
 		addr              string = "127.0.0.1:8558"
 		remoteDatasetPath string = "https://github.com/mastrasec/vectoria/releases/download/demo_dataset_v0/sbu_captions_embeddings.parquet"
 		embeddingLen      uint32 = 384
 	)
 
-	log.Println(path)
+	flag.StringVar(&path, "path", os.Getenv(PATH_ENV), "directory of the on-disk database; empty keeps it in memory (env "+PATH_ENV+")")
+	flag.Parse()
 
-	logger.Info("launching vector database")
+	logger.Info("launching vector database", "path", path)
 	entry, err := newEntrypoint(logger, addr, true,
 		vectoria.DBConfig{
-			Path: path,
+			Path:       path,
+			MaxResults: MAX_RESULTS,
 			LSH: []vectoria.LSHConfig{{
 				IndexName:      "demo",
 				NumRounds:      50,
@@ -334,20 +489,10 @@ func main() {
 	}
 	logger.Info("vector database is up")
 
-	data, err := entry.getData(remoteDatasetPath)
-	if err != nil {
-		logDebug.Error("unable to get data", "error", err.Error())
-		return
-	}
-	runtime.GC()
-
-	logger.Info("writing to database")
-	if err := entry.writeToDB(data); err != nil {
-		logDebug.Error("unable to write to database", "error", err.Error())
+	if err := entry.populate(remoteDatasetPath); err != nil {
+		logDebug.Error("unable to populate database", "error", err.Error())
 		return
 	}
-	logger.Info("finished writing to database")
-	runtime.GC()
 
 	if err := entry.listen(); err != nil {
 		logDebug.Error("unable to listen to server", "error", err.Error())
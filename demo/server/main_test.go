@@ -2,9 +2,11 @@ package main
 
 import (
 	_ "embed"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,6 +67,10 @@ func TestRegisterRoutes(t *testing.T) {
 			Method: "POST",
 			Path:   "/add",
 		},
+		{
+			Method: "POST",
+			Path:   "/add_batch",
+		},
 	}
 
 	logger := slog.New(slog.NewTextHandler(nil, nil))
@@ -145,6 +151,49 @@ func TestGet(t *testing.T) {
 		End()
 }
 
+func TestMaxSpaceDim(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false,
+		vectoria.DBConfig{
+			Path:        "",
+			MaxSpaceDim: 3,
+			LSH: []vectoria.LSHConfig{{
+				IndexName: "demo",
+				SpaceDim:  3,
+			}},
+		},
+	)
+	assert.NoError(t, err)
+
+	entry.registerRoutes()
+
+	testCases := []struct {
+		path string
+		body string
+	}{
+		{"/add", `{"index_name": "demo", "item_id": "a", "item_vec": [1, 2, 3, 4]}`},
+		{"/get", `{"index_name": "demo", "query": [1, 2, 3, 4], "threshold": 0.9, "k": 1}`},
+		{"/add_batch", `{"index_name": "demo", "items": [{"item_id": "a", "item_vec": [1, 2, 3, 4]}]}`},
+		{"/add_batch", `{"index_name": "demo", "items": [` +
+			strings.Repeat(`{"item_id": "a", "item_vec": [1, 2, 3]},`, MAX_BATCH_SIZE) +
+			`{"item_id": "a", "item_vec": [1, 2, 3]}]}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			apitest.New().
+				HandlerFunc(FiberToHandlerFunc(entry.app)).
+				Post(tc.path).
+				Header("Content-Type", "application/json").
+				Body(tc.body).
+				Expect(t).
+				Status(http.StatusBadRequest).
+				End()
+		})
+	}
+}
+
 // ---------------------------- INSTRUMENTATION ----------------------------
 
 func FiberToHandlerFunc(app *fiber.App) http.HandlerFunc {
@@ -168,3 +217,194 @@ func FiberToHandlerFunc(app *fiber.App) http.HandlerFunc {
 		}
 	}
 }
+
+func TestGet_Truncated(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false,
+		vectoria.DBConfig{
+			Path:       "",
+			MaxResults: 2,
+			LSH: []vectoria.LSHConfig{{
+				IndexName: "demo",
+				SpaceDim:  3,
+			}},
+		},
+	)
+	assert.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		err = entry.db.Add(id, []float64{1, 2, 3}, "demo")
+		assert.NoError(t, err)
+	}
+
+	entry.registerRoutes()
+
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Post("/get").
+		Header("Content-Type", "application/json").
+		Body(`{"index_name": "demo", "query": [1, 2, 3], "threshold": 0.9, "k": 0}`).
+		Expect(t).
+		Assert(func(res *http.Response, _ *http.Request) error {
+			got := &getRes{}
+			if err := json.NewDecoder(res.Body).Decode(got); err != nil {
+				return err
+			}
+
+			assert.Len(t, got.IDs, 2)
+			assert.True(t, got.Truncated)
+
+			return nil
+		}).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestPopulate_SkipsExistingData(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := t.TempDir()
+
+	dbConfig := vectoria.DBConfig{
+		Path: path,
+		LSH: []vectoria.LSHConfig{{
+			IndexName: "demo",
+			SpaceDim:  3,
+		}},
+	}
+
+	db, err := vectoria.New(dbConfig)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Add("a", []float64{1, 2, 3}, "demo"))
+	assert.NoError(t, db.Close())
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false, dbConfig)
+	assert.NoError(t, err)
+	defer entry.db.Close()
+
+	// Any download attempt would fail, so no error means ingestion was skipped.
+	err = entry.populate("http://127.0.0.1:0/dataset.parquet")
+	assert.NoError(t, err)
+
+	ids, err := entry.db.Get([]float64{1, 2, 3}, 0.9, 1, "demo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids["demo"])
+}
+
+func TestGet_NoMatches(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false,
+		vectoria.DBConfig{
+			Path: "",
+			LSH: []vectoria.LSHConfig{{
+				IndexName: "demo",
+				SpaceDim:  3,
+			}},
+		},
+	)
+	assert.NoError(t, err)
+
+	err = entry.db.Add("a", []float64{-1, -2, -3}, "demo")
+	assert.NoError(t, err)
+
+	entry.registerRoutes()
+
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Post("/get").
+		Header("Content-Type", "application/json").
+		Body(`{"index_name": "demo", "query": [1, 2, 3], "threshold": 0.9, "k": 10}`).
+		Expect(t).
+		Body(`{"ids":[],"truncated":false}`).
+		Status(http.StatusOK).
+		End()
+
+	// Every other Get variant serializes no neighbors as [] too.
+	pq, err := entry.db.Prepare([]float64{1, 2, 3})
+	assert.NoError(t, err)
+	prepared, err := entry.db.GetPrepared(pq, 0.9, 10, "demo")
+	assert.NoError(t, err)
+
+	rounds, err := entry.db.GetRounds([]float64{1, 2, 3}, []int{0}, 0.9, 10, "demo")
+	assert.NoError(t, err)
+
+	similar, err := entry.db.GetSimilarToID("a", 0.9, 10, "demo")
+	assert.NoError(t, err)
+
+	for _, ids := range [][]string{prepared["demo"], rounds, similar} {
+		data, err := json.Marshal(map[string][]string{"ids": ids})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"ids":[]}`, string(data))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false, vectoria.DBConfig{})
+	assert.NoError(t, err)
+
+	entry.registerRoutes()
+
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Get("/system/health").
+		Expect(t).
+		Body(`{"status":"ok"}`).
+		Status(http.StatusOK).
+		End()
+
+	assert.NoError(t, entry.db.Close())
+
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Get("/system/health").
+		Expect(t).
+		Body(`{"status":"unavailable","error":"database closed."}`).
+		Status(http.StatusServiceUnavailable).
+		End()
+}
+
+func TestAddBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	entry, err := newEntrypoint(logger, gofakeit.URL(), false,
+		vectoria.DBConfig{
+			Path: "",
+			LSH: []vectoria.LSHConfig{{
+				IndexName: "demo",
+				SpaceDim:  3,
+			}},
+		},
+	)
+	assert.NoError(t, err)
+	defer entry.db.Close()
+
+	entry.registerRoutes()
+
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Post("/add_batch").
+		Header("Content-Type", "application/json").
+		Body(`{"index_name":"demo","items":[{"item_id":"a","item_vec":[1,2,3]},{"item_id":"b","item_vec":[4,5,6]}]}`).
+		Expect(t).
+		Body(`{"failed_ids":[]}`).
+		Status(http.StatusOK).
+		End()
+
+	// The wrong length fails the batch, but only that item is reported.
+	apitest.New().
+		HandlerFunc(FiberToHandlerFunc(entry.app)).
+		Post("/add_batch").
+		Header("Content-Type", "application/json").
+		Body(`{"index_name":"demo","items":[{"item_id":"c","item_vec":[1,2]},{"item_id":"d","item_vec":[-1,-2,-3]}]}`).
+		Expect(t).
+		Body(`{"failed_ids":["c"]}`).
+		Status(http.StatusOK).
+		End()
+
+	count, err := entry.db.Count("demo")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), count)
+}
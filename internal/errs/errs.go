@@ -0,0 +1,91 @@
+// Package errs defines the error kinds vectoria exposes. Errors of the other internal packages
+// unwrap to them, so that callers can match them with errors.Is and errors.As.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinels matched by errors.Is, each by the error type of the same kind.
+var (
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+	ErrEmptyVector       = errors.New("empty vector")
+	ErrInvalidThreshold  = errors.New("invalid threshold")
+	ErrNotFound          = errors.New("not found")
+	ErrAlreadyExists     = errors.New("already exists")
+)
+
+// Kinds of resource reported by NotFoundError and AlreadyExistsError.
+const (
+	KindIndex = "index"
+	KindItem  = "item"
+)
+
+// DimensionMismatchError reports a vector whose length differs from the expected one.
+type DimensionMismatchError struct {
+	Expected int
+	Got      int
+}
+
+func (e *DimensionMismatchError) Error() string {
+	return fmt.Sprintf("dimension mismatch (expected: %d, got: %d)", e.Expected, e.Got)
+}
+
+func (e *DimensionMismatchError) Is(target error) bool {
+	return target == ErrDimensionMismatch
+}
+
+// EmptyVectorError reports a vector without values.
+type EmptyVectorError struct{}
+
+func (e *EmptyVectorError) Error() string {
+	return "vector cannot be empty"
+}
+
+func (e *EmptyVectorError) Is(target error) bool {
+	return target == ErrEmptyVector
+}
+
+// InvalidThresholdError reports a threshold the index's metric rejects, such as a cosine similarity outside [0, 1].
+type InvalidThresholdError struct {
+	// Range the metric accepts, such as "between 0 and 1" or "non-negative".
+	Expected string
+	Got      float64
+}
+
+func (e *InvalidThresholdError) Error() string {
+	return fmt.Sprintf("expected threshold to be %s, but got: %v", e.Expected, e.Got)
+}
+
+func (e *InvalidThresholdError) Is(target error) bool {
+	return target == ErrInvalidThreshold
+}
+
+// NotFoundError reports a missing resource of the given kind, such as KindIndex.
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s does not exist", e.Kind, e.Name)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// AlreadyExistsError reports a resource of the given kind, such as KindIndex, that can't be created twice.
+type AlreadyExistsError struct {
+	Kind string
+	Name string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists", e.Kind, e.Name)
+}
+
+func (e *AlreadyExistsError) Is(target error) bool {
+	return target == ErrAlreadyExists
+}
@@ -0,0 +1,106 @@
+package flat
+
+import (
+	"fmt"
+
+	"github.com/mastrasec/vectoria/internal/errs"
+)
+
+type invalidIDLenError struct {
+	idLen int
+}
+
+func (e *invalidIDLenError) Error() string {
+	return fmt.Sprintf("invalid ID length: %d", e.idLen)
+}
+
+type embeddingLenError struct {
+	expected uint32
+	got      uint32
+}
+
+func (e *embeddingLenError) Error() string {
+	return fmt.Sprintf("embedding length must match space dimension (expected: %v, got: %v)", e.expected, e.got)
+}
+
+func (e *embeddingLenError) Unwrap() error {
+	return &errs.DimensionMismatchError{Expected: int(e.expected), Got: int(e.got)}
+}
+
+type invalidThresholdError struct {
+	got float64
+}
+
+func (e *invalidThresholdError) Error() string {
+	return fmt.Sprintf("expected threshold to be between 0 and 1, but got: %v", e.got)
+}
+
+func (e *invalidThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "between 0 and 1", Got: e.got}
+}
+
+type invalidDistanceThresholdError struct {
+	got float64
+}
+
+func (e *invalidDistanceThresholdError) Error() string {
+	return fmt.Sprintf("expected distance threshold to be non-negative, but got: %v", e.got)
+}
+
+func (e *invalidDistanceThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "non-negative", Got: e.got}
+}
+
+type invalidL1ThresholdError struct {
+	got float64
+}
+
+func (e *invalidL1ThresholdError) Error() string {
+	return fmt.Sprintf("expected L1 threshold to be non-positive, but got: %v", e.got)
+}
+
+func (e *invalidL1ThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "non-positive", Got: e.got}
+}
+
+type itemDoesNotExistError struct {
+	id string
+}
+
+func (e *itemDoesNotExistError) Error() string {
+	return fmt.Sprintf("item %s does not exist", e.id)
+}
+
+func (e *itemDoesNotExistError) Unwrap() error {
+	return &errs.NotFoundError{Kind: errs.KindItem, Name: e.id}
+}
+
+type spaceDimTooSmallError struct {
+	min uint32
+	got uint32
+}
+
+func (e *spaceDimTooSmallError) Error() string {
+	return fmt.Sprintf("space dimension must be at least %d, but got: %d", e.min, e.got)
+}
+
+type corruptEncodingError struct {
+	dataLen     int
+	expectedLen int
+}
+
+func (e *corruptEncodingError) Error() string {
+	return fmt.Sprintf("corrupt encoding: data length %d is not a multiple of %d", e.dataLen, e.expectedLen)
+}
+
+type indexDroppedError struct {
+	indexName string
+}
+
+func (e *indexDroppedError) Error() string {
+	return fmt.Sprintf("index %s was dropped", e.indexName)
+}
+
+func (e *indexDroppedError) Unwrap() error {
+	return &errs.NotFoundError{Kind: errs.KindIndex, Name: e.indexName}
+}
@@ -0,0 +1,1092 @@
+// Package flat implements an exact index: queries are compared with every stored embedding, without bucketing.
+// Recall is always 100%, at the cost of a full scan per query, so it suits small collections.
+package flat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"maps"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/mastrasec/vectoria/internal/semantic"
+	"github.com/mastrasec/vectoria/internal/storage"
+)
+
+const (
+	MIN_SPACE_DIM uint32 = 2
+
+	// Bytes taken by an encoded float64.
+	FLOAT64_SIZE int = 8
+)
+
+type Flat struct {
+	indexName string
+	keyPrefix string
+	kv        storage.Contract
+	sem       semantic.Contract
+
+	spaceDim uint32
+
+	// Whether New stored a new index, rather than reopening one.
+	created bool
+
+	// How queries are scored. Defaults to semantic.Cosine.
+	metric semantic.Metric
+
+	// Logs errors. Nil uses slog's default logger.
+	logger *slog.Logger
+
+	// Serializes read-modify-write operations (Update, Delete, AddBatchIfAbsent and Drop), which hold it exclusively.
+	// Other operations share it.
+	mu sync.RWMutex
+
+	// Set by Drop, under mu, so that writes racing it fail instead of storing keys under a dropped index.
+	dropped bool
+
+	// Whether Get, GetPrepared and GetWithScores score block instead of reading every embedding from storage.
+	columnar bool
+
+	// Every stored embedding, when columnar. Nil until loaded by the first Get, and after PurgeBlock.
+	block *semantic.Block
+
+	// Guards block. Writes hold it exclusively from their storage write to their block update, so that both
+	// apply in the same order. Locked after mu.
+	blockMu sync.RWMutex
+}
+
+type Option func(*Flat)
+
+// WithKeyPrefix namespaces every storage key of the index under keyPrefix.
+func WithKeyPrefix(keyPrefix string) Option {
+	return func(f *Flat) {
+		f.keyPrefix = keyPrefix
+	}
+}
+
+type Item struct {
+	ID        string
+	Embedding []float64
+
+	// Opaque payload stored along with the item, returned by Meta. Nil stores none, leaving the metadata
+	// of a replaced item in place.
+	Meta []byte
+}
+
+// WithMetric sets how stored embeddings are scored against queries. Defaults to semantic.Cosine.
+// For semantic.Euclidean, thresholds are maximum distances and results are sorted by ascending distance.
+// For semantic.L1, scores are negated distances, so thresholds are non-positive.
+func WithMetric(metric semantic.Metric) Option {
+	return func(f *Flat) {
+		f.metric = metric
+	}
+}
+
+// WithColumnar keeps every embedding in memory, in a single contiguous block maintained on writes, which Get,
+// GetPrepared and GetWithScores score instead of reading them from storage. It speeds up exact search on large
+// indexes, where scoring streams linearly through memory, at the cost of holding the whole index in it.
+func WithColumnar(columnar bool) Option {
+	return func(f *Flat) {
+		f.columnar = columnar
+	}
+}
+
+// WithLogger sets the logger errors are logged with, including the scoring ones. Nil keeps the default,
+// slog's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(f *Flat) {
+		f.logger = logger
+	}
+}
+
+// New opens the index, creating it unless it is already stored. An existing index keeps its stored
+// space dimension. Zero uses MIN_SPACE_DIM.
+func New(indexName string, kv storage.Contract, spaceDim uint32, opts ...Option) (f *Flat, err error) {
+	f = &Flat{
+		indexName: indexName,
+		kv:        kv,
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	f.sem = semantic.NewWithMetric(f.metric, semantic.WithLogger(f.logger))
+
+	spaceDimKey := getSpaceDimKey(f.keyPrefix, f.indexName)
+
+	exists, err := f.kv.KeyExists(spaceDimKey)
+	if err != nil {
+		logErr(f.logger, err, "New")
+		return nil, err
+	}
+
+	if exists {
+		encodedSpaceDim, err := f.kv.Get(spaceDimKey)
+		if err != nil {
+			logErr(f.logger, err, "New")
+			return nil, err
+		}
+
+		f.spaceDim = binary.LittleEndian.Uint32(encodedSpaceDim)
+
+		return f, nil
+	}
+
+	if spaceDim == 0 {
+		spaceDim = MIN_SPACE_DIM
+	}
+
+	if spaceDim < MIN_SPACE_DIM {
+		err := &spaceDimTooSmallError{MIN_SPACE_DIM, spaceDim}
+		logErr(f.logger, err, "New")
+		return nil, err
+	}
+
+	f.spaceDim = spaceDim
+
+	err = f.kv.Add(map[string][]byte{
+		getIndexKey(f.keyPrefix, f.indexName): []byte(""),
+		spaceDimKey:                           binary.LittleEndian.AppendUint32(nil, spaceDim),
+	})
+	if err != nil {
+		logErr(f.logger, err, "New")
+		return nil, err
+	}
+
+	f.created = true
+
+	return f, nil
+}
+
+// StoredIndexNames returns the names of the flat indexes found in kv under keyPrefix, to be reopened with New.
+// It scans every key of those indexes, without reading values.
+func StoredIndexNames(kv storage.Contract, keyPrefix string) (names []string, err error) {
+	root := getIndexKey(keyPrefix, "")
+
+	// Every index has a key at its root, the only one of its keys without a separator after the name.
+	err = kv.IterateKeysWithPrefix(root, func(key string) error {
+		if name := strings.TrimPrefix(key, root); !strings.Contains(name, KEY_SEPARATOR) {
+			names = append(names, unescapeKey(name))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (f *Flat) SpaceDim() uint32 {
+	return f.spaceDim
+}
+
+// Created tells whether New stored a new index, rather than reopening one.
+func (f *Flat) Created() bool {
+	return f.created
+}
+
+func (f *Flat) Metric() semantic.Metric {
+	return f.metric
+}
+
+func (f *Flat) Add(id string, embedding []float64) error {
+	return f.AddBatch([]Item{{ID: id, Embedding: embedding}})
+}
+
+// AddBatch writes every item in a single transaction. Items already stored are replaced.
+func (f *Flat) AddBatch(items []Item) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if err := f.checkNotDropped(); err != nil {
+		logErr(f.logger, err, "AddBatch")
+		return err
+	}
+
+	data := make(map[string][]byte, len(items))
+
+	for _, item := range items {
+		itemData, err := f.prepareItem(item)
+		if err != nil {
+			logErr(f.logger, err, "AddBatch")
+			return err
+		}
+
+		maps.Copy(data, itemData)
+	}
+
+	f.lockBlock()
+	defer f.unlockBlock()
+
+	if err := f.kv.Add(data); err != nil {
+		logErr(f.logger, err, "AddBatch")
+		return err
+	}
+
+	f.addToBlock(items...)
+
+	return nil
+}
+
+// AddBatchIfAbsent writes, in a single transaction, only the items whose ID isn't stored yet.
+// It returns how many items were written.
+func (f *Flat) AddBatchIfAbsent(items []Item) (inserted int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkNotDropped(); err != nil {
+		logErr(f.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = getEmbeddingKey(f.keyPrefix, f.indexName, item.ID)
+	}
+
+	exists, err := f.kv.KeysExist(keys...)
+	if err != nil {
+		logErr(f.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	data := make(map[string][]byte)
+	absent := make([]Item, 0, len(items))
+
+	for i, item := range items {
+		if exists[keys[i]] {
+			continue
+		}
+		exists[keys[i]] = true
+
+		itemData, err := f.prepareItem(item)
+		if err != nil {
+			logErr(f.logger, err, "AddBatchIfAbsent")
+			return 0, err
+		}
+
+		maps.Copy(data, itemData)
+		absent = append(absent, item)
+	}
+
+	if len(absent) == 0 {
+		return 0, nil
+	}
+
+	f.lockBlock()
+	defer f.unlockBlock()
+
+	if err := f.kv.Add(data); err != nil {
+		logErr(f.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	f.addToBlock(absent...)
+
+	return len(absent), nil
+}
+
+// Update replaces the embedding of an existing item.
+func (f *Flat) Update(id string, embedding []float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkNotDropped(); err != nil {
+		logErr(f.logger, err, "Update")
+		return err
+	}
+
+	data, err := f.prepareItem(Item{ID: id, Embedding: embedding})
+	if err != nil {
+		logErr(f.logger, err, "Update")
+		return err
+	}
+
+	if err := f.checkItemExists(id); err != nil {
+		logErr(f.logger, err, "Update")
+		return err
+	}
+
+	f.lockBlock()
+	defer f.unlockBlock()
+
+	if err := f.kv.Add(data); err != nil {
+		logErr(f.logger, err, "Update")
+		return err
+	}
+
+	f.addToBlock(Item{ID: id, Embedding: embedding})
+
+	return nil
+}
+
+func (f *Flat) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkNotDropped(); err != nil {
+		logErr(f.logger, err, "Delete")
+		return err
+	}
+
+	if err := f.checkItemExists(id); err != nil {
+		logErr(f.logger, err, "Delete")
+		return err
+	}
+
+	f.lockBlock()
+	defer f.unlockBlock()
+
+	if err := f.kv.Del(getEmbeddingKey(f.keyPrefix, f.indexName, id), getMetaKey(f.keyPrefix, f.indexName, id)); err != nil {
+		logErr(f.logger, err, "Delete")
+		return err
+	}
+
+	if f.block != nil {
+		f.block.Delete(id)
+	}
+
+	return nil
+}
+
+// Drop deletes every key of the index, its root key last. Writes to the index fail afterwards.
+func (f *Flat) Drop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropped = true
+
+	root := getIndexKey(f.keyPrefix, f.indexName)
+
+	f.PurgeBlock()
+
+	if err := f.kv.DelWithPrefix(key(root, "")); err != nil {
+		logErr(f.logger, err, "Drop")
+		return err
+	}
+
+	if err := f.kv.Del(root); err != nil {
+		logErr(f.logger, err, "Drop")
+		return err
+	}
+
+	return nil
+}
+
+// Embeddings calls fn with every stored embedding, ordered by ID.
+// It stops on the first error returned by fn.
+func (f *Flat) Embeddings(fn func(id string, embedding []float64) error) error {
+	err := f.kv.View(func(tx storage.ReadTx) error {
+		return f.embeddings(tx, fn)
+	})
+	if err != nil {
+		logErr(f.logger, err, "Embeddings")
+		return err
+	}
+
+	return nil
+}
+
+// embeddings is like Embeddings, reading within tx.
+func (f *Flat) embeddings(tx storage.ReadTx, fn func(id string, embedding []float64) error) error {
+	prefix := getEmbeddingPrefixKey(f.keyPrefix, f.indexName)
+
+	return tx.IterateWithPrefix(prefix, func(key string, val []byte) error {
+		embedding, err := decodeFloat64Slice(val)
+		if err != nil {
+			return err
+		}
+
+		return fn(unescapeKey(strings.TrimPrefix(key, prefix)), embedding)
+	})
+}
+
+// Get returns up to k of the stored items whose similarity to the query is at least threshold,
+// sorted by descending similarity. Every stored embedding is scored.
+func (f *Flat) Get(queryVec []float64, threshold float64, k uint32) ([]string, error) {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "Get")
+		return nil, err
+	}
+
+	query, err := f.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(f.logger, err, "Get")
+		return nil, err
+	}
+
+	return f.GetPrepared(queryVec, query, threshold, k)
+}
+
+// GetPrepared is like Get, scoring with a query already prepared by semantic.Semantic.NewQuery from queryVec.
+func (f *Flat) GetPrepared(queryVec []float64, query semantic.Query, threshold float64, k uint32) ([]string, error) {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "GetPrepared")
+		return nil, err
+	}
+
+	if f.columnar {
+		neighbors, err := f.searchBlock(query, threshold, k)
+		if err != nil {
+			logErr(f.logger, err, "GetPrepared")
+			return nil, err
+		}
+
+		ids := make([]string, len(neighbors))
+		for i, neighbor := range neighbors {
+			ids[i] = neighbor.ID
+		}
+
+		return ids, nil
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "GetPrepared")
+		return nil, err
+	}
+
+	ids, err := f.sem.SearchQuery(query, candidates, threshold, k)
+	if err != nil {
+		logErr(f.logger, err, "GetPrepared")
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// GetWithMeta is like Get, also returning the metadata of each neighbor, nil for those without any.
+// Neighbors and their metadata are read from the same snapshot, so they agree despite concurrent writes.
+func (f *Flat) GetWithMeta(queryVec []float64, threshold float64, k uint32) (ids []string, metas [][]byte, err error) {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "GetWithMeta")
+		return nil, nil, err
+	}
+
+	query, err := f.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(f.logger, err, "GetWithMeta")
+		return nil, nil, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.columnar {
+		// Holding the block keeps writes out until the metadata is read.
+		err = f.withBlock(func(block *semantic.Block) error {
+			neighbors, err := f.sem.SearchQueryBlock(query, block, threshold, k)
+			if err != nil {
+				return err
+			}
+
+			ids = make([]string, len(neighbors))
+			for i, neighbor := range neighbors {
+				ids[i] = neighbor.ID
+			}
+
+			metas, err = f.Meta(ids)
+			return err
+		})
+	} else {
+		err = f.kv.View(func(tx storage.ReadTx) error {
+			candidates := make(map[string][]float64)
+
+			err := f.embeddings(tx, func(id string, embedding []float64) error {
+				candidates[id] = embedding
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if ids, err = f.sem.SearchQuery(query, candidates, threshold, k); err != nil {
+				return err
+			}
+
+			metas, err = f.metas(tx, ids)
+			return err
+		})
+	}
+
+	if err != nil {
+		logErr(f.logger, err, "GetWithMeta")
+		return nil, nil, err
+	}
+
+	return ids, metas, nil
+}
+
+// GetFiltered is like Get, only scoring the items whose metadata, nil if there is none, is accepted by filter.
+func (f *Flat) GetFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool) ([]string, error) {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "GetFiltered")
+		return nil, err
+	}
+
+	query, err := f.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(f.logger, err, "GetFiltered")
+		return nil, err
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "GetFiltered")
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+
+	metas, err := f.Meta(ids)
+	if err != nil {
+		logErr(f.logger, err, "GetFiltered")
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if !filter(metas[i]) {
+			delete(candidates, id)
+		}
+	}
+
+	neighbors, err := f.sem.SearchQuery(query, candidates, threshold, k)
+	if err != nil {
+		logErr(f.logger, err, "GetFiltered")
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// GetWithScores is like Get, also returning the similarity of each neighbor.
+func (f *Flat) GetWithScores(queryVec []float64, threshold float64, k uint32) ([]semantic.Neighbor, error) {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	if f.columnar {
+		query, err := f.sem.NewQuery(queryVec)
+		if err != nil {
+			logErr(f.logger, err, "GetWithScores")
+			return nil, err
+		}
+
+		neighbors, err := f.searchBlock(query, threshold, k)
+		if err != nil {
+			logErr(f.logger, err, "GetWithScores")
+			return nil, err
+		}
+
+		return neighbors, nil
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	neighbors, err := f.sem.SearchScored(queryVec, candidates, threshold, k)
+	if err != nil {
+		logErr(f.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// GetStream calls fn with every stored item whose similarity to the query is at least threshold, in no
+// particular order. It stops on the first error returned by fn, or when ctx is done.
+func (f *Flat) GetStream(ctx context.Context, queryVec []float64, threshold float64, fn func(neighbor semantic.Neighbor) error) error {
+	if err := f.checkGetParams(queryVec, threshold); err != nil {
+		logErr(f.logger, err, "GetStream")
+		return err
+	}
+
+	query, err := f.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(f.logger, err, "GetStream")
+		return err
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "GetStream")
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return f.sem.SearchQueryFunc(query, candidates, threshold, func(neighbor semantic.Neighbor) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fn(neighbor)
+	})
+}
+
+// GetSimilarToID returns up to k neighbors of a stored item, the item itself excluded.
+func (f *Flat) GetSimilarToID(id string, threshold float64, k uint32) ([]string, error) {
+	if err := f.checkThreshold(threshold); err != nil {
+		logErr(f.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	embedding, ok := candidates[id]
+	if !ok {
+		err := &itemDoesNotExistError{id}
+		logErr(f.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+	delete(candidates, id)
+
+	ids, err := f.sem.Search(embedding, candidates, threshold, k)
+	if err != nil {
+		logErr(f.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Nearest returns the k stored items most similar to the query, without threshold, sorted by descending similarity.
+func (f *Flat) Nearest(queryVec []float64, k uint32) ([]string, error) {
+	if err := f.checkEmbedding(queryVec); err != nil {
+		logErr(f.logger, err, "Nearest")
+		return nil, err
+	}
+
+	candidates, err := f.candidates()
+	if err != nil {
+		logErr(f.logger, err, "Nearest")
+		return nil, err
+	}
+
+	ids, err := f.sem.Search(queryVec, candidates, f.metric.MatchAll(), k)
+	if err != nil {
+		logErr(f.logger, err, "Nearest")
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// SimilarityMatrix returns the cosine similarities between every pair of the given items, in the order of ids.
+// Every item must exist.
+func (f *Flat) SimilarityMatrix(ids []string) ([][]float64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = getEmbeddingKey(f.keyPrefix, f.indexName, id)
+	}
+
+	exists, err := f.kv.KeysExist(keys...)
+	if err != nil {
+		logErr(f.logger, err, "SimilarityMatrix")
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if !exists[keys[i]] {
+			err = &itemDoesNotExistError{id}
+			logErr(f.logger, err, "SimilarityMatrix")
+			return nil, err
+		}
+	}
+
+	embeddings := make([][]float64, len(ids))
+	err = f.kv.View(func(tx storage.ReadTx) error {
+		for i, key := range keys {
+			val, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+
+			if embeddings[i], err = decodeFloat64Slice(val); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(f.logger, err, "SimilarityMatrix")
+		return nil, err
+	}
+
+	return semantic.SimilarityMatrix(embeddings)
+}
+
+// Centroid returns the mean of the stored embeddings, or nil when the index is empty. It scans every embedding.
+func (f *Flat) Centroid() ([]float64, error) {
+	var (
+		sum   []float64
+		count int
+	)
+
+	err := f.Embeddings(func(_ string, embedding []float64) error {
+		if sum == nil {
+			sum = make([]float64, len(embedding))
+		}
+
+		for i, val := range embedding {
+			sum[i] += val
+		}
+		count++
+
+		return nil
+	})
+	if err != nil {
+		logErr(f.logger, err, "Centroid")
+		return nil, err
+	}
+
+	for i := range sum {
+		sum[i] /= float64(count)
+	}
+
+	return sum, nil
+}
+
+// Exists tells whether the item is in the index.
+func (f *Flat) Exists(id string) (bool, error) {
+	exists, err := f.kv.KeyExists(getEmbeddingKey(f.keyPrefix, f.indexName, id))
+	if err != nil {
+		logErr(f.logger, err, "Exists")
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Embedding returns the stored embedding of the item.
+func (f *Flat) Embedding(id string) ([]float64, error) {
+	val, err := f.kv.Get(getEmbeddingKey(f.keyPrefix, f.indexName, id))
+	if errors.Is(err, storage.ErrNotFound) {
+		err = &itemDoesNotExistError{id}
+	}
+
+	if err != nil {
+		logErr(f.logger, err, "Embedding")
+		return nil, err
+	}
+
+	embedding, err := decodeFloat64Slice(val)
+	if err != nil {
+		logErr(f.logger, err, "Embedding")
+		return nil, err
+	}
+
+	return embedding, nil
+}
+
+// ListIDs returns the IDs of every item, ordered by their escaped form.
+func (f *Flat) ListIDs() ([]string, error) {
+	prefix := getEmbeddingPrefixKey(f.keyPrefix, f.indexName)
+
+	keys, err := f.kv.GetKeysWithPrefix(prefix)
+	if err != nil {
+		logErr(f.logger, err, "ListIDs")
+		return nil, err
+	}
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = unescapeKey(strings.TrimPrefix(key, prefix))
+	}
+
+	return ids, nil
+}
+
+// Count returns the number of items, counting their keys.
+func (f *Flat) Count() (int, error) {
+	count, err := f.kv.CountWithPrefix(getEmbeddingPrefixKey(f.keyPrefix, f.indexName))
+	if err != nil {
+		logErr(f.logger, err, "Count")
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (f *Flat) Info() map[string]any {
+	return map[string]any{
+		"spaceDim": f.spaceDim,
+	}
+}
+
+// candidates loads every stored embedding.
+func (f *Flat) candidates() (map[string][]float64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	candidates := make(map[string][]float64)
+
+	err := f.Embeddings(func(id string, embedding []float64) error {
+		candidates[id] = embedding
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// searchBlock scores the query against the block, loading it first if needed.
+func (f *Flat) searchBlock(query semantic.Query, threshold float64, k uint32) (neighbors []semantic.Neighbor, err error) {
+	err = f.withBlock(func(block *semantic.Block) error {
+		neighbors, err = f.sem.SearchQueryBlock(query, block, threshold, k)
+		return err
+	})
+
+	return neighbors, err
+}
+
+// withBlock calls fn with the block, loading it first if needed. No write lands while fn runs.
+func (f *Flat) withBlock(fn func(block *semantic.Block) error) error {
+	for {
+		f.blockMu.RLock()
+		if f.block != nil {
+			break
+		}
+		f.blockMu.RUnlock()
+
+		if err := f.loadBlock(); err != nil {
+			return err
+		}
+	}
+	defer f.blockMu.RUnlock()
+
+	return fn(f.block)
+}
+
+// loadBlock reads every stored embedding into the block, unless it is already loaded.
+func (f *Flat) loadBlock() error {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+
+	if f.block != nil {
+		return nil
+	}
+
+	block := semantic.NewBlock(int(f.spaceDim))
+
+	err := f.Embeddings(func(id string, embedding []float64) error {
+		return block.Add(id, embedding)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.block = block
+
+	return nil
+}
+
+// PurgeBlock drops the in-memory block, for the next Get to reload it from storage. It must be called after
+// the storage is written to without the index, as by a restore.
+func (f *Flat) PurgeBlock() {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+
+	f.block = nil
+}
+
+// lockBlock locks the block for a write, when columnar.
+func (f *Flat) lockBlock() {
+	if f.columnar {
+		f.blockMu.Lock()
+	}
+}
+
+func (f *Flat) unlockBlock() {
+	if f.columnar {
+		f.blockMu.Unlock()
+	}
+}
+
+// addToBlock adds written items to the block, if loaded. The block must be locked.
+func (f *Flat) addToBlock(items ...Item) {
+	if f.block == nil {
+		return
+	}
+
+	for _, item := range items {
+		// The length was checked by prepareItem.
+		_ = f.block.Add(item.ID, item.Embedding)
+	}
+}
+
+func (f *Flat) prepareItem(item Item) (map[string][]byte, error) {
+	if len(item.ID) == 0 {
+		return nil, &invalidIDLenError{len(item.ID)}
+	}
+
+	if err := f.checkEmbedding(item.Embedding); err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{
+		getEmbeddingKey(f.keyPrefix, f.indexName, item.ID): encodeFloat64Slice(item.Embedding),
+	}
+
+	if item.Meta != nil {
+		data[getMetaKey(f.keyPrefix, f.indexName, item.ID)] = item.Meta
+	}
+
+	return data, nil
+}
+
+// Meta returns the metadata stored with each item, in the order of ids. It is nil for items stored without any,
+// or missing.
+func (f *Flat) Meta(ids []string) (metas [][]byte, err error) {
+	err = f.kv.View(func(tx storage.ReadTx) error {
+		metas, err = f.metas(tx, ids)
+		return err
+	})
+	if err != nil {
+		logErr(f.logger, err, "Meta")
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// metas is like Meta, reading within tx.
+func (f *Flat) metas(tx storage.ReadTx, ids []string) ([][]byte, error) {
+	metas := make([][]byte, len(ids))
+
+	for i, id := range ids {
+		meta, err := tx.Get(getMetaKey(f.keyPrefix, f.indexName, id))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		metas[i] = meta
+	}
+
+	return metas, nil
+}
+
+func (f *Flat) checkItemExists(id string) error {
+	exists, err := f.kv.KeyExists(getEmbeddingKey(f.keyPrefix, f.indexName, id))
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return &itemDoesNotExistError{id}
+	}
+
+	return nil
+}
+
+// checkNotDropped must be called holding mu.
+func (f *Flat) checkNotDropped() error {
+	if f.dropped {
+		return &indexDroppedError{f.indexName}
+	}
+
+	return nil
+}
+
+func (f *Flat) checkGetParams(queryVec []float64, threshold float64) error {
+	if err := f.checkEmbedding(queryVec); err != nil {
+		return err
+	}
+
+	return f.checkThreshold(threshold)
+}
+
+func (f *Flat) checkEmbedding(embedding []float64) error {
+	if lenEmbedding := uint32(len(embedding)); f.spaceDim != lenEmbedding {
+		return &embeddingLenError{f.spaceDim, lenEmbedding}
+	}
+
+	return nil
+}
+
+// checkThreshold accepts similarities between 0 and 1 for cosine, non-negative distances for Euclidean,
+// non-positive negated distances for L1, and any threshold for dot products, which are unbounded.
+func (f *Flat) checkThreshold(threshold float64) error {
+	switch f.metric {
+	case semantic.Euclidean:
+		if threshold < 0 {
+			return &invalidDistanceThresholdError{threshold}
+		}
+	case semantic.L1:
+		if threshold > 0 {
+			return &invalidL1ThresholdError{threshold}
+		}
+	case semantic.DotProduct:
+	default:
+		if threshold < 0 || threshold > 1 {
+			return &invalidThresholdError{threshold}
+		}
+	}
+
+	return nil
+}
+
+func encodeFloat64Slice(slice []float64) []byte {
+	data := make([]byte, 0, len(slice)*FLOAT64_SIZE)
+	for _, val := range slice {
+		data = binary.LittleEndian.AppendUint64(data, math.Float64bits(val))
+	}
+
+	return data
+}
+
+func decodeFloat64Slice(data []byte) ([]float64, error) {
+	if len(data)%FLOAT64_SIZE != 0 {
+		return nil, &corruptEncodingError{len(data), FLOAT64_SIZE}
+	}
+
+	result := make([]float64, len(data)/FLOAT64_SIZE)
+	for i := range result {
+		result[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*FLOAT64_SIZE:]))
+	}
+
+	return result, nil
+}
+
+// logErr logs err with logger, or with the default logger when it is nil.
+func logErr(logger *slog.Logger, err error, trace string) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.LogAttrs(
+		context.TODO(),
+		slog.LevelError,
+		err.Error(),
+		slog.String("trace", "vectoria:src:internal:flat:"+trace),
+	)
+}
@@ -0,0 +1,305 @@
+package flat
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/mastrasec/vectoria/internal/semantic"
+	"github.com/mastrasec/vectoria/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// Overwrites the logger to keep tests outputs clean.
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	slog.SetDefault(logger)
+
+	os.Exit(m.Run())
+}
+
+func newTestFlat(t *testing.T, spaceDim uint32) *Flat {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	t.Cleanup(func() { kv.CloseDB() })
+
+	f, err := New("fake-index-name", kv, spaceDim)
+	assert.NoError(t, err)
+
+	return f
+}
+
+func TestNew(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	f, err := New("a/b", kv, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, MIN_SPACE_DIM, f.SpaceDim())
+
+	_, err = New("too-small", kv, 1)
+	assert.IsType(t, &spaceDimTooSmallError{}, err)
+
+	_, err = New("stored", kv, 3)
+	assert.NoError(t, err)
+
+	// The stored space dimension wins.
+	reopened, err := New("stored", kv, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), reopened.SpaceDim())
+
+	names, err := StoredIndexNames(kv, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a/b", "stored"}, names)
+}
+
+func TestGet(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	err := f.AddBatch([]Item{
+		{ID: "east", Embedding: []float64{1, 0}},
+		{ID: "north-east", Embedding: []float64{1, 1}},
+		{ID: "north", Embedding: []float64{0, 1}},
+		{ID: "west", Embedding: []float64{-1, 0}},
+	})
+	assert.NoError(t, err)
+
+	ids, err := f.Get([]float64{1, 0.1}, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"east", "north-east", "north"}, ids)
+
+	ids, err = f.Get([]float64{1, 0.1}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"east"}, ids)
+
+	ids, err = f.Nearest([]float64{-1, 0}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"west", "north"}, ids)
+
+	neighbors, err := f.GetWithScores([]float64{0, 1}, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "north", neighbors[0].ID)
+	assert.InDelta(t, 1, neighbors[0].Score, 1e-9)
+
+	ids, err = f.GetSimilarToID("east", 0.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"north-east"}, ids)
+
+	var streamed []string
+	err = f.GetStream(context.Background(), []float64{1, 0}, 0.5, func(neighbor semantic.Neighbor) error {
+		streamed = append(streamed, neighbor.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"east", "north-east"}, streamed)
+
+	_, err = f.Get([]float64{1, 0, 0}, 0.5, 0)
+	assert.IsType(t, &embeddingLenError{}, err)
+
+	_, err = f.Get([]float64{1, 0}, 2, 0)
+	assert.IsType(t, &invalidThresholdError{}, err)
+}
+
+func TestWrites(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	assert.NoError(t, f.Add("a", []float64{1, 2}))
+
+	inserted, err := f.AddBatchIfAbsent([]Item{{ID: "a", Embedding: []float64{3, 4}}, {ID: "b", Embedding: []float64{5, 6}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inserted)
+
+	assert.NoError(t, f.Update("a", []float64{7, 8}))
+	assert.IsType(t, &itemDoesNotExistError{}, f.Update("missing", []float64{7, 8}))
+
+	embedding, err := f.Embedding("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{7, 8}, embedding)
+
+	_, err = f.Embedding("missing")
+	assert.IsType(t, &itemDoesNotExistError{}, err)
+
+	ids, err := f.ListIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	centroid, err := f.Centroid()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{6, 7}, centroid)
+
+	assert.NoError(t, f.Delete("a"))
+	assert.IsType(t, &itemDoesNotExistError{}, f.Delete("a"))
+
+	count, err := f.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.IsType(t, &invalidIDLenError{}, f.Add("", []float64{1, 2}))
+}
+
+func TestDrop(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	assert.NoError(t, f.Add("a", []float64{1, 2}))
+	assert.NoError(t, f.Drop())
+
+	// Writes racing the drop fail rather than storing keys a later index of the same name would inherit.
+	assert.IsType(t, &indexDroppedError{}, f.Add("b", []float64{1, 2}))
+	assert.IsType(t, &indexDroppedError{}, f.Update("a", []float64{1, 2}))
+	assert.IsType(t, &indexDroppedError{}, f.Delete("a"))
+
+	_, err := f.AddBatchIfAbsent([]Item{{ID: "b", Embedding: []float64{1, 2}}})
+	assert.IsType(t, &indexDroppedError{}, err)
+
+	reopened, err := New(f.indexName, f.kv, 2)
+	assert.NoError(t, err)
+
+	count, err := reopened.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestWithMetric(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	items := []Item{{ID: "near", Embedding: []float64{1, 1}}, {ID: "far", Embedding: []float64{5, 5}}}
+
+	euclidean, err := New("euclidean", kv, 2, WithMetric(semantic.Euclidean))
+	assert.NoError(t, err)
+	assert.Equal(t, semantic.Euclidean, euclidean.Metric())
+	assert.NoError(t, euclidean.AddBatch(items))
+
+	ids, err := euclidean.Get([]float64{1.2, 1.2}, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, ids)
+
+	_, err = euclidean.Get([]float64{1.2, 1.2}, -1, 0)
+	assert.IsType(t, &invalidDistanceThresholdError{}, err)
+
+	l1, err := New("l1", kv, 2, WithMetric(semantic.L1))
+	assert.NoError(t, err)
+	assert.NoError(t, l1.AddBatch(items))
+
+	ids, err = l1.Get([]float64{1.2, 1.2}, -1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, ids)
+
+	_, err = l1.Get([]float64{1.2, 1.2}, 1, 0)
+	assert.IsType(t, &invalidL1ThresholdError{}, err)
+
+	ids, err = l1.Nearest([]float64{5, 5}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"far"}, ids)
+}
+
+func TestColumnar(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	rows, err := New("rows", kv, 2)
+	assert.NoError(t, err)
+
+	columnar, err := New("columnar", kv, 2, WithColumnar(true))
+	assert.NoError(t, err)
+
+	query := []float64{1, 0.5}
+
+	assertSameResults := func() {
+		want, err := rows.GetWithScores(query, 0, 0)
+		assert.NoError(t, err)
+
+		got, err := columnar.GetWithScores(query, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		ids, err := columnar.Get(query, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, len(want), len(ids))
+	}
+
+	items := []Item{{ID: "a", Embedding: []float64{1, 0}}, {ID: "b", Embedding: []float64{0, 1}}, {ID: "c", Embedding: []float64{1, 1}}}
+	for _, f := range []*Flat{rows, columnar} {
+		assert.NoError(t, f.AddBatch(items))
+	}
+
+	// Loads the block.
+	assertSameResults()
+
+	for _, f := range []*Flat{rows, columnar} {
+		assert.NoError(t, f.Update("a", []float64{2, 1}))
+		assert.NoError(t, f.Delete("b"))
+
+		_, err := f.AddBatchIfAbsent([]Item{{ID: "c", Embedding: []float64{5, 5}}, {ID: "d", Embedding: []float64{1, -1}}})
+		assert.NoError(t, err)
+	}
+
+	assertSameResults()
+
+	// Written behind the index's back, as by a restore: only seen once the block is purged.
+	assert.NoError(t, kv.Add(map[string][]byte{getEmbeddingKey("", "columnar", "e"): encodeFloat64Slice([]float64{1, 0.5})}))
+	assert.NoError(t, rows.Add("e", []float64{1, 0.5}))
+
+	columnar.PurgeBlock()
+	assertSameResults()
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	assert.NoError(t, f.AddBatch([]Item{{ID: "a", Embedding: []float64{1, 0}}, {ID: "b", Embedding: []float64{0, 1}}}))
+
+	matrix, err := f.SimilarityMatrix([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.InDelta(t, 1, matrix[0][0], 1e-9)
+	assert.InDelta(t, 0, matrix[0][1], 1e-9)
+
+	_, err = f.SimilarityMatrix([]string{"a", "missing"})
+	assert.IsType(t, &itemDoesNotExistError{}, err)
+}
+
+func TestMeta(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	assert.NoError(t, f.AddBatch([]Item{{ID: "a", Embedding: []float64{1, 0}, Meta: []byte("x")}, {ID: "b", Embedding: []float64{0, 1}}}))
+
+	metas, err := f.Meta([]string{"a", "b", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("x"), nil, nil}, metas)
+
+	ids, metas, err := f.GetWithMeta([]float64{1, 0.1}, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	assert.Equal(t, [][]byte{[]byte("x"), nil}, metas)
+
+	assert.NoError(t, f.Delete("a"))
+
+	metas, err = f.Meta([]string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil}, metas)
+}
+
+func TestGetFiltered(t *testing.T) {
+	f := newTestFlat(t, 2)
+
+	err := f.AddBatch([]Item{
+		{ID: "en", Embedding: []float64{1, 2}, Meta: []byte("en")},
+		{ID: "fr", Embedding: []float64{1, 2}, Meta: []byte("fr")},
+		{ID: "none", Embedding: []float64{1, 2}},
+	})
+	assert.NoError(t, err)
+
+	ids, err := f.GetFiltered([]float64{1, 2}, 0.9, 0, func(meta []byte) bool { return string(meta) == "en" })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"en"}, ids)
+
+	ids, err = f.GetFiltered([]float64{1, 2}, 0.9, 0, func(meta []byte) bool { return meta == nil })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"none"}, ids)
+}
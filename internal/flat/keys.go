@@ -0,0 +1,50 @@
+package flat
+
+import "strings"
+
+// KEY_SEPARATOR joins the elements of a key, as in the lsh package.
+const KEY_SEPARATOR = "\x1f"
+
+// Index names and item IDs are escaped within keys as the lsh package does, so that a separator in them
+// can't be mistaken for one of the key's.
+var (
+	keyEscaper   = strings.NewReplacer("\x1e", "\x1ee", KEY_SEPARATOR, "\x1es")
+	keyUnescaper = strings.NewReplacer("\x1ee", "\x1e", "\x1es", KEY_SEPARATOR)
+)
+
+func key(elems ...string) string {
+	return strings.Join(elems, KEY_SEPARATOR)
+}
+
+func escapeKey(elem string) string {
+	return keyEscaper.Replace(elem)
+}
+
+func unescapeKey(elem string) string {
+	return keyUnescaper.Replace(elem)
+}
+
+// getIndexKey is the root of every key of an index. Flat indexes live apart from LSH ones, under "flat".
+func getIndexKey(keyPrefix, indexName string) string {
+	if keyPrefix == "" {
+		return key("flat", escapeKey(indexName))
+	}
+
+	return key(keyPrefix, "flat", escapeKey(indexName))
+}
+
+func getSpaceDimKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "space_dim")
+}
+
+func getEmbeddingKey(keyPrefix, indexName, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "embedding", escapeKey(id))
+}
+
+func getMetaKey(keyPrefix, indexName, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "meta", escapeKey(id))
+}
+
+func getEmbeddingPrefixKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "embedding", "")
+}
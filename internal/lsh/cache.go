@@ -0,0 +1,145 @@
+package lsh
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/mastrasec/vectoria/internal/storage"
+)
+
+// embeddingCache is a fixed-size LRU cache of decoded embeddings, by item ID. It is safe for concurrent use.
+// A nil cache is disabled: it misses every lookup and stores nothing. Cached embeddings are shared by every
+// reader, so they must not be modified.
+type embeddingCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // Of *cachedEmbedding, the most recently used first.
+	items map[string]*list.Element
+
+	// Incremented by every invalidation, so that an embedding read from a snapshot older than one isn't cached.
+	gen uint64
+}
+
+type cachedEmbedding struct {
+	id        string
+	embedding []float64
+}
+
+// newEmbeddingCache returns a cache holding up to size embeddings, or nil when size is zero.
+func newEmbeddingCache(size uint32) *embeddingCache {
+	if size == 0 {
+		return nil
+	}
+
+	return &embeddingCache{
+		size:  int(size),
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *embeddingCache) get(id string) ([]float64, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*cachedEmbedding).embedding, true
+}
+
+// generation returns the number of invalidations so far.
+func (c *embeddingCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// add caches the embedding of id, read from a snapshot taken at generation gen, evicting the least recently
+// used one when full. It does nothing if the cache was invalidated since gen, as the embedding may be stale.
+func (c *embeddingCache) add(id string, embedding []float64, gen uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if elem, ok := c.items[id]; ok {
+		elem.Value.(*cachedEmbedding).embedding = embedding
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedEmbedding).id)
+	}
+
+	c.items[id] = c.order.PushFront(&cachedEmbedding{id, embedding})
+}
+
+func (c *embeddingCache) remove(ids ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for _, id := range ids {
+		if elem, ok := c.items[id]; ok {
+			c.order.Remove(elem)
+			delete(c.items, id)
+		}
+	}
+}
+
+func (c *embeddingCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	clear(c.items)
+}
+
+// snapshotTx is a read transaction along with the generation of the embedding cache from before it began,
+// so that the embeddings read through it can be cached.
+type snapshotTx struct {
+	storage.ReadTx
+	cacheGen uint64
+}
+
+// view is like kv.View, giving fn a transaction whose embedding reads populate the cache.
+func (l *LSH) view(fn func(tx storage.ReadTx) error) error {
+	gen := l.embeddingCache.generation()
+
+	return l.kv.View(func(tx storage.ReadTx) error {
+		return fn(&snapshotTx{tx, gen})
+	})
+}
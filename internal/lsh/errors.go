@@ -1,6 +1,12 @@
 package lsh
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/mastrasec/vectoria/internal/errs"
+	"github.com/mastrasec/vectoria/internal/semantic"
+)
 
 type invalidIDLenError struct {
 	idLen int
@@ -37,6 +43,10 @@ func (e *embeddingLenError) Error() string {
 	return fmt.Sprintf("embedding length must match space dimension (expected: %v, got: %v)", e.expected, e.got)
 }
 
+func (e *embeddingLenError) Unwrap() error {
+	return &errs.DimensionMismatchError{Expected: int(e.expected), Got: int(e.got)}
+}
+
 type invalidThresholdError struct {
 	got float64
 }
@@ -44,3 +54,211 @@ type invalidThresholdError struct {
 func (e *invalidThresholdError) Error() string {
 	return fmt.Sprintf("expected threshold to be between 0 and 1, but got: %v", e.got)
 }
+
+func (e *invalidThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "between 0 and 1", Got: e.got}
+}
+
+type invalidDistanceThresholdError struct {
+	got float64
+}
+
+func (e *invalidDistanceThresholdError) Error() string {
+	return fmt.Sprintf("expected distance threshold to be non-negative, but got: %v", e.got)
+}
+
+func (e *invalidDistanceThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "non-negative", Got: e.got}
+}
+
+type invalidL1ThresholdError struct {
+	got float64
+}
+
+func (e *invalidL1ThresholdError) Error() string {
+	return fmt.Sprintf("expected L1 threshold to be non-positive, but got: %v", e.got)
+}
+
+func (e *invalidL1ThresholdError) Unwrap() error {
+	return &errs.InvalidThresholdError{Expected: "non-positive", Got: e.got}
+}
+
+type invalidPercentileError struct {
+	got float64
+}
+
+func (e *invalidPercentileError) Error() string {
+	return fmt.Sprintf("expected percentile to be between 0 and 100, but got: %v", e.got)
+}
+
+type hyperplaneChecksumError struct {
+	indexName string
+}
+
+func (e *hyperplaneChecksumError) Error() string {
+	return fmt.Sprintf("stored hyperplanes of index %s do not match their checksum, the index must be rebuilt", e.indexName)
+}
+
+type embeddingsNotStoredError struct {
+	indexName string
+}
+
+func (e *embeddingsNotStoredError) Error() string {
+	return fmt.Sprintf("index %s does not store embeddings, so candidates cannot be scored", e.indexName)
+}
+
+type normalizeMetricError struct {
+	indexName string
+	metric    semantic.Metric
+}
+
+func (e *normalizeMetricError) Error() string {
+	return fmt.Sprintf("index %s scores by metric %s, which depends on magnitude, so its embeddings cannot be normalized", e.indexName, e.metric)
+}
+
+type metricMismatchError struct {
+	indexName string
+	stored    semantic.Metric
+	got       semantic.Metric
+}
+
+func (e *metricMismatchError) Error() string {
+	return fmt.Sprintf("index %s was created with metric %s, but got: %s", e.indexName, e.stored, e.got)
+}
+
+type corruptEncodingError struct {
+	dataLen     int
+	expectedLen int
+}
+
+func (e *corruptEncodingError) Error() string {
+	return fmt.Sprintf("corrupt encoding: data length %d is not a multiple of %d", e.dataLen, e.expectedLen)
+}
+
+type corruptVarintError struct {
+	offset int
+}
+
+func (e *corruptVarintError) Error() string {
+	return fmt.Sprintf("corrupt encoding: invalid varint at offset %d", e.offset)
+}
+
+type unknownCodecError struct {
+	codec EmbeddingCodec
+}
+
+func (e *unknownCodecError) Error() string {
+	return fmt.Sprintf("unknown embedding codec %d", e.codec)
+}
+
+type emptyDriftWindowError struct {
+	since time.Time
+}
+
+func (e *emptyDriftWindowError) Error() string {
+	return fmt.Sprintf("drift needs embeddings added both before and after %v", e.since)
+}
+
+type invalidSampleSizeError struct {
+	got int
+}
+
+func (e *invalidSampleSizeError) Error() string {
+	return fmt.Sprintf("sample size cannot be negative, but got: %d", e.got)
+}
+
+type unknownSeedError struct {
+	indexName string
+}
+
+func (e *unknownSeedError) Error() string {
+	return fmt.Sprintf("seed of index %s is unknown: it was created before seeds were stored or had rounds pruned", e.indexName)
+}
+
+type invalidRoundError struct {
+	round     int
+	numRounds uint32
+}
+
+func (e *invalidRoundError) Error() string {
+	return fmt.Sprintf("round must be in [0, %d), but got: %d", e.numRounds, e.round)
+}
+
+type pruneAllRoundsError struct {
+	indexName string
+}
+
+func (e *pruneAllRoundsError) Error() string {
+	return fmt.Sprintf("cannot prune every round of index %s, at least one must remain", e.indexName)
+}
+
+type corruptEmbeddingError struct {
+	id  string
+	err error
+}
+
+func (e *corruptEmbeddingError) Error() string {
+	return fmt.Sprintf("embedding of %s is corrupt: %v", e.id, e.err)
+}
+
+func (e *corruptEmbeddingError) Unwrap() error {
+	return e.err
+}
+
+type itemDoesNotExistError struct {
+	id string
+}
+
+func (e *itemDoesNotExistError) Error() string {
+	return fmt.Sprintf("item %s does not exist", e.id)
+}
+
+func (e *itemDoesNotExistError) Unwrap() error {
+	return &errs.NotFoundError{Kind: errs.KindItem, Name: e.id}
+}
+
+type emptyQueriesError struct{}
+
+func (e *emptyQueriesError) Error() string {
+	return "at least one query is required"
+}
+
+type unknownMultiModeError struct {
+	mode MultiMode
+}
+
+func (e *unknownMultiModeError) Error() string {
+	return fmt.Sprintf("unknown multi-query mode: %d", e.mode)
+}
+
+type hyperParamTooSmallError struct {
+	name string
+	min  uint32
+	got  uint32
+}
+
+func (e *hyperParamTooSmallError) Error() string {
+	return fmt.Sprintf("%s must be at least %d, but got: %d", e.name, e.min, e.got)
+}
+
+type hyperParamTooLargeError struct {
+	name string
+	max  uint32
+	got  uint32
+}
+
+func (e *hyperParamTooLargeError) Error() string {
+	return fmt.Sprintf("%s must be at most %d, but got: %d", e.name, e.max, e.got)
+}
+
+type indexDroppedError struct {
+	indexName string
+}
+
+func (e *indexDroppedError) Error() string {
+	return fmt.Sprintf("index %s was dropped", e.indexName)
+}
+
+func (e *indexDroppedError) Unwrap() error {
+	return &errs.NotFoundError{Kind: errs.KindIndex, Name: e.indexName}
+}
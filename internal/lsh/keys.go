@@ -5,38 +5,145 @@ import (
 	"strings"
 )
 
+// KEY_SEPARATOR joins the elements of a key. It is non-printable (0x1F, unit separator), so that it hardly
+// ever appears in index names and item IDs, which may then hold any other byte, "/" included.
+const KEY_SEPARATOR = "\x1f"
+
+// Index names and item IDs are escaped within keys, so that a separator in them can't be mistaken for one of the
+// key's, which would mix up the keys of different items or indexes on prefix scans. The escape byte (0x1E, record
+// separator) is non-printable too, so names and IDs without either keep keys identical to their unescaped form.
+var (
+	keyEscaper   = strings.NewReplacer("\x1e", "\x1ee", KEY_SEPARATOR, "\x1es")
+	keyUnescaper = strings.NewReplacer("\x1ee", "\x1e", "\x1es", KEY_SEPARATOR)
+)
+
 func key(elems ...string) string {
-	return strings.Join(elems, "/")
+	return strings.Join(elems, KEY_SEPARATOR)
+}
+
+// escapeKey escapes a name or ID to be used as a single key element.
+func escapeKey(elem string) string {
+	return keyEscaper.Replace(elem)
+}
+
+// unescapeKey reverts escapeKey, for names and IDs parsed back from keys.
+func unescapeKey(elem string) string {
+	return keyUnescaper.Replace(elem)
+}
+
+// getIndexKey is the root of every key of an index. A non-empty keyPrefix namespaces
+// the index's keys, so they don't collide with the ones of a storage shared with other apps.
+func getIndexKey(keyPrefix, indexName string) string {
+	if keyPrefix == "" {
+		return key("index", escapeKey(indexName))
+	}
+
+	return key(keyPrefix, "index", escapeKey(indexName))
+}
+
+func getEmbeddingKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "embedding", escapeKey(id))
+}
+
+func getEmbeddingPrefixKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "embedding", "")
+}
+
+func getTimestampKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "timestamp", escapeKey(id))
+}
+
+func getTimestampPrefixKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "timestamp", "")
+}
+
+func getOriginalNormKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "original_norm", escapeKey(id))
+}
+
+func getNormKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "norm", escapeKey(id))
+}
+
+func getMetaKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "meta", escapeKey(id))
+}
+
+// getIDSketchKey holds the concatenated sketches of an item, for Get to rank candidates by Hamming distance.
+func getIDSketchKey(keyPrefix, indexName string, id string) string {
+	return key(getIndexKey(keyPrefix, indexName), "idsketch", escapeKey(id))
+}
+
+func getSketchKey(keyPrefix, indexName, sketch, id string) string {
+	return key(getSketchPrefixKey(keyPrefix, indexName, sketch), escapeKey(id))
+}
+
+// getBucketPrefixKey is the prefix of the keys of a single bucket. The trailing separator keeps a bucket's scan
+// from reaching the keys of a longer sketch that starts with the same bits.
+func getBucketPrefixKey(keyPrefix, indexName, sketch string) string {
+	return key(getSketchPrefixKey(keyPrefix, indexName, sketch), "")
+}
+
+func getSketchPrefixKey(keyPrefix, indexName, sketch string) string {
+	return key(getIndexKey(keyPrefix, indexName), "sketch", sketch)
+}
+
+func getNumRoundsKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "num_rounds")
+}
+
+func getNumHyperPlanesKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "num_hyperplanes")
+}
+
+func getSpaceDimKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "space_dim")
+}
+
+func getHyperPlanesKey(keyPrefix, indexName string, hashIdx int) string {
+	return key(getIndexKey(keyPrefix, indexName), "hash", strconv.Itoa(hashIdx), "hyperplanes")
+}
+
+func getHyperPlanesPrefixKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "hash", "")
+}
+
+func getHyperPlanesChecksumKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "hyperplanes_checksum")
+}
+
+func getStoreEmbeddingsKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "store_embeddings")
 }
 
-func getIndexKey(indexName string) string {
-	return key("index", indexName)
+func getPrecomputeNormsKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "precompute_norms")
 }
 
-func getEmbeddingKey(indexName string, id string) string {
-	return key(getIndexKey(indexName), "embedding", id)
+func getEmbeddingCodecKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "embedding_codec")
 }
 
-func getSketchKey(indexName, sketch, id string) string {
-	return key(getSketchPrefixKey(indexName, sketch), id)
+func getMetricKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "metric")
 }
 
-func getSketchPrefixKey(indexName, sketch string) string {
-	return key(getIndexKey(indexName), "sketch", sketch)
+func getSeedKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "seed")
 }
 
-func getNumRoundsKey(indexName string) string {
-	return key(getIndexKey(indexName), "num_rounds")
+func getNumAddsKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "stats", "num_adds")
 }
 
-func getNumHyperPlanesKey(indexName string) string {
-	return key(getIndexKey(indexName), "num_hyperplanes")
+func getNumGetsKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "stats", "num_gets")
 }
 
-func getSpaceDimKey(indexName string) string {
-	return key(getIndexKey(indexName), "space_dim")
+func getCountKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "stats", "count")
 }
 
-func getHyperPlanesKey(indexName string, hashIdx int) string {
-	return key(getIndexKey(indexName), "hash", strconv.Itoa(hashIdx), "hyperplanes")
+func getEmbeddingSumKey(keyPrefix, indexName string) string {
+	return key(getIndexKey(keyPrefix, indexName), "stats", "embedding_sum")
 }
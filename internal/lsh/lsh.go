@@ -3,9 +3,20 @@ package lsh
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"log/slog"
 	"maps"
+	"math"
+	"math/rand"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mastrasec/vectoria/internal/semantic"
 	"github.com/mastrasec/vectoria/internal/simhash"
@@ -19,27 +30,131 @@ const (
 
 	MIN_SPACE_DIM uint32 = 2
 
+	// Hyperplanes take NumRounds*NumHyperPlanes*SpaceDim floats, in memory and in storage, and every item
+	// NumRounds sketch keys of NumHyperPlanes bytes: past these, an index is pathological rather than fine-tuned.
+	MAX_NUM_ROUNDS uint32 = 256
+
+	MAX_NUM_HYPERPLANES uint32 = 256
+
+	// Bytes taken by an encoded float64.
+	FLOAT64_SIZE int = 8
+
+	// Bytes taken by an encoded float32.
+	FLOAT32_SIZE int = 4
+
+	// Number of embeddings rewritten per transaction by MigrateNormalize.
+	MIGRATE_BATCH_SIZE int = 1000
+
+	// Below this many multiplications per sketching, NumRounds*NumHyperPlanes*SpaceDim, rounds are sketched
+	// sequentially, as starting goroutines would cost more than it saves.
+	PARALLEL_SKETCH_MIN_WORK int = 1 << 16
+
 	// MAX_BUCKET_SIZE = 100
 )
 
 type LSH struct {
 	indexName string
+	keyPrefix string
 	hashes    []simhash.SimHash
 	kv        storage.Contract
 	sem       semantic.Contract
 
+	// How candidates are scored on Get, and the options sem is built with.
+	metric  semantic.Metric
+	semOpts []semantic.Option
+
+	// Whether WithMetric was given, so that a stored index scored by another metric is rejected instead of reopened.
+	metricGiven bool
+
+	// Logs errors. Nil uses slog's default logger.
+	logger *slog.Logger
+
+	// Whether New must not write to kv, when reopening an index from a read-only storage.
+	readOnly bool
+
 	numRounds      uint32
 	numHyperPlanes uint32
 	spaceDim       uint32
-}
 
-func New(indexName string, kv storage.Contract, numRounds, numHyperPlanes, spaceDim uint32) (l *LSH, err error) {
-	var sh *simhash.SimHash
+	roundOrder    RoundOrder
+	maxCandidates uint32
+
+	// When false, only sketches are stored and Get returns bucket members unranked.
+	storeEmbeddings bool
+
+	// How stored embeddings are encoded.
+	codec EmbeddingCodec
+
+	// When true, each embedding's norm is stored along with it, and read by Get instead of computed.
+	precomputeNorms bool
+
+	// Maximum Hamming distance probed when a round's bucket is empty. Zero disables the fallback.
+	fallbackRadius uint32
+
+	// Clock used to timestamp insertions.
+	now func() time.Time
 
+	// Seed the hyperplanes were generated from. Zero when unknown.
+	seed int64
+
+	// When true, candidates with a corrupt embedding are skipped on Get instead of failing it.
+	skipCorrupt bool
+
+	// Decoded embeddings recently read, invalidated by every write of their items. Nil when disabled.
+	embeddingCache *embeddingCache
+
+	// When true, New rejects hyperparameters below their minimum instead of clamping them.
+	strictHyperParams bool
+
+	// Notified of every Get and GetPrepared. Defaults to one that does nothing.
+	observer Observer
+
+	// When true, a new index created with a zero spaceDim takes the length of its first embedding.
+	// Until then, its spaceDim is zero and it has no hyperplanes.
+	inferSpaceDim bool
+
+	// Whether New stored a new index, rather than reopening one.
+	created bool
+
+	// Cumulative counts of added items and queries, including the ones loaded from storage.
+	// They are only persisted by FlushStats.
+	numAdds atomic.Uint64
+	numGets atomic.Uint64
+
+	// Number of items and element-wise sum of their stored embeddings (nil when embeddings aren't stored),
+	// persisted within every write that changes them. statsMu serializes those writes, so that each one
+	// updates them consistently with the items it writes.
+	statsMu      sync.Mutex
+	count        int
+	embeddingSum []float64
+
+	// Sketches of the buckets that may have items, nil until WarmBucketFilter is called. Buckets outside it
+	// are known to be empty, so Get doesn't read them. Writes mark their buckets before they are stored,
+	// and Delete unmarks the ones it empties, so it never misses a non-empty bucket.
+	bucketsMu sync.RWMutex
+	buckets   map[string]struct{}
+
+	// Guards the hyperplanes, which PruneRounds replaces, and serializes read-modify-write operations
+	// (Update, Delete, AddBatchIfAbsent, Repair, MigrateNormalize, PruneRounds, Reembed and Drop), which hold it exclusively.
+	// WarmBucketFilter holds it exclusively too, so that no write is missed while it scans.
+	// Other operations share it. Callbacks, such as GetStream's, never run while holding it.
+	mu sync.RWMutex
+
+	// Set by Drop, under mu, so that writes racing it fail instead of storing keys under a dropped index.
+	dropped bool
+}
+
+func New(indexName string, kv storage.Contract, numRounds, numHyperPlanes, spaceDim uint32, opts ...Option) (l *LSH, err error) {
 	l = &LSH{
-		indexName: indexName,
-		kv:        kv,
-		sem:       semantic.New(),
+		indexName:       indexName,
+		kv:              kv,
+		storeEmbeddings: true,
+		now:             time.Now,
+		observer:        noopObserver{},
+	}
+
+	for _, opt := range opts {
+		opt(l)
 	}
 
 	exists, err := l.indexExists()
@@ -52,17 +167,76 @@ func New(indexName string, kv storage.Contract, numRounds, numHyperPlanes, space
 			return nil, err
 		}
 
+		l.sem = semantic.NewWithMetric(l.metric, l.semOpts...)
+
 		return l, nil
 	}
 
+	l.sem = semantic.NewWithMetric(l.metric, l.semOpts...)
+
+	pending := l.inferSpaceDim && spaceDim == 0
+	if pending {
+		// Stands in for the dimension until the first embedding gives it.
+		spaceDim = MIN_SPACE_DIM
+	}
+
+	if err := validateMaxHyperParams(numRounds, numHyperPlanes); err != nil {
+		logErr(l.logger, err, "New")
+		return nil, err
+	}
+
+	if l.strictHyperParams {
+		if err := validateHyperParams(numRounds, numHyperPlanes, spaceDim); err != nil {
+			logErr(l.logger, err, "New")
+			return nil, err
+		}
+	}
+
+	if l.codec > Float32Codec {
+		err := &unknownCodecError{l.codec}
+		logErr(l.logger, err, "New")
+		return nil, err
+	}
+
 	l.setHyperParams(numRounds, numHyperPlanes, spaceDim)
 
+	for l.seed == 0 {
+		l.seed = rand.Int63()
+	}
+
+	if pending {
+		l.spaceDim = 0
+	} else if err := l.generateHashes(); err != nil {
+		logErr(l.logger, err, "New")
+		return nil, err
+	}
+
+	if err := l.storeConfig(); err != nil {
+		return nil, err
+	}
+
+	if l.storeEmbeddings && !pending {
+		l.embeddingSum = make([]float64, l.spaceDim)
+	}
+
+	if err := l.kv.Add(l.runningStatsData(0, l.embeddingSum)); err != nil {
+		return nil, err
+	}
+
+	l.created = true
+
+	return l, nil
+}
+
+func (l *LSH) generateHashes() error {
+	// A single source shared by all rounds, so the whole set of hyperplanes follows from the seed.
+	rng := rand.New(rand.NewSource(l.seed))
+
 	hashes := make([]simhash.SimHash, l.numRounds)
 	for i := uint32(0); i < l.numRounds; i++ {
-		sh, err = simhash.New(l.numHyperPlanes, l.spaceDim)
+		sh, err := simhash.NewWithRand(l.numHyperPlanes, l.spaceDim, rng)
 		if err != nil {
-			logErr(err, "New")
-			return nil, err
+			return err
 		}
 
 		hashes[i] = *sh
@@ -70,267 +244,3558 @@ func New(indexName string, kv storage.Contract, numRounds, numHyperPlanes, space
 
 	l.hashes = hashes
 
-	if err := l.storeConfig(); err != nil {
-		return nil, err
+	return nil
+}
+
+// inferSpaceDimFrom gives an index created with WithInferredSpaceDim the length of the first embeddings added
+// to it, and stores its hyperplanes. Embeddings of different lengths fail without setting it.
+func (l *LSH) inferSpaceDimFrom(embeddings ...[]float64) error {
+	l.mu.RLock()
+	inferred := l.spaceDim != 0
+	l.mu.RUnlock()
+
+	if inferred || len(embeddings) == 0 {
+		return nil
 	}
 
-	return l, nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Another write may have set it meanwhile.
+	if l.spaceDim != 0 {
+		return nil
+	}
+
+	spaceDim := uint32(len(embeddings[0]))
+	if spaceDim < MIN_SPACE_DIM {
+		return &hyperParamTooSmallError{"spaceDim", MIN_SPACE_DIM, spaceDim}
+	}
+
+	for _, embedding := range embeddings {
+		if uint32(len(embedding)) != spaceDim {
+			return &embeddingLenError{spaceDim, uint32(len(embedding))}
+		}
+	}
+
+	l.spaceDim = spaceDim
+
+	if err := l.generateHashes(); err != nil {
+		l.spaceDim = 0
+		return err
+	}
+
+	if l.storeEmbeddings {
+		l.embeddingSum = make([]float64, l.spaceDim)
+	}
+
+	data := l.runningStatsData(l.count, l.embeddingSum)
+	if err := l.storeConfig(data); err != nil {
+		l.spaceDim, l.hashes, l.embeddingSum = 0, nil, nil
+		return err
+	}
+
+	return nil
 }
 
 func (l *LSH) indexExists() (exists bool, err error) {
-	exists, err = l.kv.KeyExists(getIndexKey(l.indexName))
+	exists, err = l.kv.KeyExists(getIndexKey(l.keyPrefix, l.indexName))
 	if err != nil {
 		return false, err
 	}
 
-	return exists, nil
+	return exists, nil
+}
+
+// storeConfig writes the index's config, along with the extra data given, in a single transaction.
+func (l *LSH) storeConfig(extra ...map[string][]byte) (err error) {
+	data := map[string][]byte{
+		getIndexKey(l.keyPrefix, l.indexName):           []byte(""),
+		getNumRoundsKey(l.keyPrefix, l.indexName):       encodeUInt32(l.numRounds),
+		getNumHyperPlanesKey(l.keyPrefix, l.indexName):  encodeUInt32(l.numHyperPlanes),
+		getSpaceDimKey(l.keyPrefix, l.indexName):        encodeUInt32(l.spaceDim),
+		getStoreEmbeddingsKey(l.keyPrefix, l.indexName): encodeBool(l.storeEmbeddings),
+		getPrecomputeNormsKey(l.keyPrefix, l.indexName): encodeBool(l.precomputeNorms),
+		getSeedKey(l.keyPrefix, l.indexName):            encodeUInt64(uint64(l.seed)),
+		getEmbeddingCodecKey(l.keyPrefix, l.indexName):  {byte(l.codec)},
+		getMetricKey(l.keyPrefix, l.indexName):          {byte(l.metric)},
+	}
+
+	checksum := sha256.New()
+
+	for i, hash := range l.hashes {
+		hyperplanes, err := encodeFloat64Slice2D(hash.Hyperplanes)
+		if err != nil {
+			return err
+		}
+		data[getHyperPlanesKey(l.keyPrefix, l.indexName, i)] = hyperplanes
+		checksum.Write(hyperplanes)
+	}
+
+	data[getHyperPlanesChecksumKey(l.keyPrefix, l.indexName)] = checksum.Sum(nil)
+
+	for _, extraData := range extra {
+		maps.Copy(data, extraData)
+	}
+
+	if err := l.kv.Add(data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (l *LSH) getStoredConfig() error {
+	numRoundsKey := getNumRoundsKey(l.keyPrefix, l.indexName)
+	encodedNumRounds, err := l.kv.Get(numRoundsKey)
+	if err != nil {
+		return err
+	}
+
+	numHyperPlanesKey := getNumHyperPlanesKey(l.keyPrefix, l.indexName)
+	encodedNumHyperPlanes, err := l.kv.Get(numHyperPlanesKey)
+	if err != nil {
+		return err
+	}
+
+	spaceDimKey := getSpaceDimKey(l.keyPrefix, l.indexName)
+	encodedSpaceDim, err := l.kv.Get(spaceDimKey)
+	if err != nil {
+		return err
+	}
+
+	l.numHyperPlanes = binary.LittleEndian.Uint32(encodedNumHyperPlanes)
+	l.numRounds = binary.LittleEndian.Uint32(encodedNumRounds)
+	l.spaceDim = binary.LittleEndian.Uint32(encodedSpaceDim)
+
+	// Indexes created before this setting existed always stored embeddings.
+	storeEmbeddingsKey := getStoreEmbeddingsKey(l.keyPrefix, l.indexName)
+	exists, err := l.kv.KeyExists(storeEmbeddingsKey)
+	if err != nil {
+		return err
+	}
+
+	l.storeEmbeddings = true
+	if exists {
+		encodedStoreEmbeddings, err := l.kv.Get(storeEmbeddingsKey)
+		if err != nil {
+			return err
+		}
+
+		l.storeEmbeddings = decodeBool(encodedStoreEmbeddings)
+	}
+
+	// Indexes created before norms could be precomputed never did.
+	precomputeNormsKey := getPrecomputeNormsKey(l.keyPrefix, l.indexName)
+	exists, err = l.kv.KeyExists(precomputeNormsKey)
+	if err != nil {
+		return err
+	}
+
+	l.precomputeNorms = false
+	if exists {
+		encodedPrecomputeNorms, err := l.kv.Get(precomputeNormsKey)
+		if err != nil {
+			return err
+		}
+
+		l.precomputeNorms = decodeBool(encodedPrecomputeNorms)
+	}
+
+	// Indexes created before seeds were stored have an unknown seed.
+	seedKey := getSeedKey(l.keyPrefix, l.indexName)
+	exists, err = l.kv.KeyExists(seedKey)
+	if err != nil {
+		return err
+	}
+
+	l.seed = 0
+	if exists {
+		encodedSeed, err := l.kv.Get(seedKey)
+		if err != nil {
+			return err
+		}
+
+		l.seed = int64(binary.LittleEndian.Uint64(encodedSeed))
+	}
+
+	// Indexes created before codecs existed store raw embeddings.
+	codecKey := getEmbeddingCodecKey(l.keyPrefix, l.indexName)
+	exists, err = l.kv.KeyExists(codecKey)
+	if err != nil {
+		return err
+	}
+
+	l.codec = RawCodec
+	if exists {
+		encodedCodec, err := l.kv.Get(codecKey)
+		if err != nil {
+			return err
+		}
+
+		if len(encodedCodec) != 1 {
+			return &corruptEncodingError{len(encodedCodec), 1}
+		}
+
+		l.codec = EmbeddingCodec(encodedCodec[0])
+	}
+
+	// Indexes created before metrics were stored keep the given one.
+	metricKey := getMetricKey(l.keyPrefix, l.indexName)
+	exists, err = l.kv.KeyExists(metricKey)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		encodedMetric, err := l.kv.Get(metricKey)
+		if err != nil {
+			return err
+		}
+
+		if len(encodedMetric) != 1 {
+			return &corruptEncodingError{len(encodedMetric), 1}
+		}
+
+		stored := semantic.Metric(encodedMetric[0])
+		if l.metricGiven && l.metric != stored {
+			return &metricMismatchError{l.indexName, stored, l.metric}
+		}
+
+		l.metric = stored
+	}
+
+	if err := l.loadStats(); err != nil {
+		return err
+	}
+
+	if err := l.loadRunningStats(); err != nil {
+		return err
+	}
+
+	// The index waits for its first embedding to have a dimension and hyperplanes.
+	if l.spaceDim == 0 {
+		return nil
+	}
+
+	l.hashes = make([]simhash.SimHash, l.numRounds)
+	checksum := sha256.New()
+
+	for i := 0; i < int(l.numRounds); i++ {
+		encodedHyperPlanes, err := l.kv.Get(getHyperPlanesKey(l.keyPrefix, l.indexName, i))
+		if err != nil {
+			return err
+		}
+		checksum.Write(encodedHyperPlanes)
+
+		hyperPlanes, err := decodeFloat64Slice2D(encodedHyperPlanes, l.spaceDim)
+		if err != nil {
+			return err
+		}
+
+		l.hashes[i].Hyperplanes = hyperPlanes
+	}
+
+	if err := l.verifyHyperPlanesChecksum(checksum.Sum(nil)); err != nil {
+		logErr(l.logger, err, "getStoredConfig")
+		return err
+	}
+
+	return nil
+}
+
+// verifyHyperPlanesChecksum compares the checksum of the loaded hyperplanes with the stored one.
+// Indexes created before checksums were stored have nothing to compare against and are accepted.
+func (l *LSH) verifyHyperPlanesChecksum(got []byte) error {
+	checksumKey := getHyperPlanesChecksumKey(l.keyPrefix, l.indexName)
+
+	exists, err := l.kv.KeyExists(checksumKey)
+	if err != nil || !exists {
+		return err
+	}
+
+	want, err := l.kv.Get(checksumKey)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(want, got) {
+		return &hyperplaneChecksumError{l.indexName}
+	}
+
+	return nil
+}
+
+type Item struct {
+	ID        string
+	Embedding []float64
+
+	// Opaque payload stored along with the item by AddBatch and AddBatchIfAbsent, and returned by Meta.
+	// Nil stores none, leaving the metadata of a replaced item in place.
+	Meta []byte
+}
+
+func (l *LSH) Add(id string, embedding []float64) error {
+	if err := l.inferSpaceDimFrom(embedding); err != nil {
+		logErr(l.logger, err, "Add")
+		return err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "Add")
+		return err
+	}
+
+	data, err := l.prepareItem(id, embedding)
+	if err != nil {
+		logErr(l.logger, err, "Add")
+		return err
+	}
+
+	// The embedding is stored as given, so a norm kept by MigrateNormalize for a previous one no longer applies.
+	stale := []string{getOriginalNormKey(l.keyPrefix, l.indexName, id)}
+
+	if err = l.write(data, stale, []Item{{ID: id, Embedding: embedding}}, nil); err != nil {
+		logErr(l.logger, err, "Add")
+		return err
+	}
+
+	l.numAdds.Add(1)
+
+	return nil
+}
+
+// AddBatch writes all items in a single storage transaction.
+// Every item is validated up front, so an invalid one fails the whole batch and nothing is written.
+func (l *LSH) AddBatch(items []Item) error {
+	if err := l.inferSpaceDimFrom(itemEmbeddings(items)...); err != nil {
+		logErr(l.logger, err, "AddBatch")
+		return err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "AddBatch")
+		return err
+	}
+
+	var (
+		data  = make(map[string][]byte, len(items)*int(1+l.numRounds))
+		stale = make([]string, 0, len(items))
+	)
+
+	for _, item := range items {
+		itemData, err := l.prepareItem(item.ID, item.Embedding)
+		if err != nil {
+			logErr(l.logger, err, "AddBatch")
+			return err
+		}
+
+		l.prepareMeta(itemData, item)
+		maps.Copy(data, itemData)
+
+		// As in Add, a norm kept by MigrateNormalize no longer applies.
+		stale = append(stale, getOriginalNormKey(l.keyPrefix, l.indexName, item.ID))
+	}
+
+	if err := l.write(data, stale, items, nil); err != nil {
+		logErr(l.logger, err, "AddBatch")
+		return err
+	}
+
+	l.numAdds.Add(uint64(len(items)))
+
+	return nil
+}
+
+// Embeddings calls fn with every stored embedding, ordered by ID.
+// It stops on the first error returned by fn.
+func (l *LSH) Embeddings(fn func(id string, embedding []float64) error) error {
+	prefix := getEmbeddingPrefixKey(l.keyPrefix, l.indexName)
+
+	err := l.kv.IterateWithPrefix(prefix, func(key string, val []byte) error {
+		embedding, err := l.decodeEmbedding(val)
+		if err != nil {
+			return err
+		}
+
+		return fn(unescapeKey(strings.TrimPrefix(key, prefix)), embedding)
+	})
+	if err != nil {
+		logErr(l.logger, err, "Embeddings")
+		return err
+	}
+
+	return nil
+}
+
+// Update replaces the embedding of an existing item in a single transaction, moving it out of the buckets
+// it no longer hashes to, while the keys of the buckets it still hashes to are rewritten, not deleted.
+// Unlike Add, it leaves no stale bucket entries behind.
+func (l *LSH) Update(id string, embedding []float64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	data, err := l.prepareItem(id, embedding)
+	if err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	exists, err := l.kv.KeyExists(l.getPresenceKey(id))
+	if err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	if !exists {
+		err = &itemDoesNotExistError{id}
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	oldSketchKeys, err := l.getItemSketchKeys(id)
+	if err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	// The norm MigrateNormalize kept belongs to the old embedding.
+	stale := []string{getOriginalNormKey(l.keyPrefix, l.indexName, id)}
+	for _, key := range oldSketchKeys {
+		if _, ok := data[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+
+	if err := l.write(data, stale, []Item{{ID: id, Embedding: embedding}}, nil); err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	if err := l.unmarkEmptyBuckets(stale[1:]); err != nil {
+		logErr(l.logger, err, "Update")
+		return err
+	}
+
+	return nil
+}
+
+// Drop deletes every key of the index: its config, hyperplanes, items and stats.
+// Writes to the index fail afterwards, and FlushStats does nothing.
+// Keys are deleted in batches, the index's root key last, so that an interrupted Drop leaves an index that
+// New reopens and Drop can finish.
+func (l *LSH) Drop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Set first, so that a Drop interrupted by a storage error still stops writes.
+	l.dropped = true
+
+	root := getIndexKey(l.keyPrefix, l.indexName)
+
+	if err := l.kv.DelWithPrefix(key(root, "")); err != nil {
+		logErr(l.logger, err, "Drop")
+		return err
+	}
+
+	if err := l.kv.Del(root); err != nil {
+		logErr(l.logger, err, "Drop")
+		return err
+	}
+
+	l.embeddingCache.purge()
+
+	return nil
+}
+
+// PurgeEmbeddingCache empties the embedding cache, for when the index's storage was written to behind its back,
+// e.g. by loading a backup.
+func (l *LSH) PurgeEmbeddingCache() {
+	l.embeddingCache.purge()
+}
+
+// ReloadStats reads the counters, item count and embedding sum from storage again, for when the index's storage
+// was written to behind its back, e.g. by loading a backup. Otherwise, the next write would store stale ones.
+func (l *LSH) ReloadStats() error {
+	if err := l.loadStats(); err != nil {
+		logErr(l.logger, err, "ReloadStats")
+		return err
+	}
+
+	if err := l.loadRunningStats(); err != nil {
+		logErr(l.logger, err, "ReloadStats")
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes an item and every key written for it in a single transaction.
+// Concurrent Gets never see it half-deleted. It must not race with an Add of the same ID.
+func (l *LSH) Delete(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	exists, err := l.kv.KeyExists(l.getPresenceKey(id))
+	if err != nil {
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	if !exists {
+		err = &itemDoesNotExistError{id}
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	sketchKeys, err := l.getItemSketchKeys(id)
+	if err != nil {
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	keys := append(sketchKeys,
+		getEmbeddingKey(l.keyPrefix, l.indexName, id),
+		getTimestampKey(l.keyPrefix, l.indexName, id),
+		getOriginalNormKey(l.keyPrefix, l.indexName, id),
+		getNormKey(l.keyPrefix, l.indexName, id),
+		getMetaKey(l.keyPrefix, l.indexName, id),
+		getIDSketchKey(l.keyPrefix, l.indexName, id),
+	)
+
+	if err := l.write(nil, keys, nil, []string{id}); err != nil {
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	if err := l.unmarkEmptyBuckets(sketchKeys); err != nil {
+		logErr(l.logger, err, "Delete")
+		return err
+	}
+
+	return nil
+}
+
+// WarmBucketFilter loads the sketches of the non-empty buckets, so that Get skips reading the empty ones.
+// It pays off on sparse indexes, with many hyperplanes, where most probed buckets are empty.
+// It scans every sketch key, and the filter then takes memory proportional to the number of non-empty buckets.
+// Calling it again rebuilds the filter.
+func (l *LSH) WarmBucketFilter() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make(map[string]struct{})
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	err := l.kv.IterateKeysWithPrefix(prefix, func(key string) error {
+		sk, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), KEY_SEPARATOR)
+		buckets[sk] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "WarmBucketFilter")
+		return err
+	}
+
+	l.bucketsMu.Lock()
+	l.buckets = buckets
+	l.bucketsMu.Unlock()
+
+	return nil
+}
+
+// mayHaveBucket tells whether the bucket of sk may have items. It always does until the filter is warmed.
+func (l *LSH) mayHaveBucket(sk string) bool {
+	l.bucketsMu.RLock()
+	defer l.bucketsMu.RUnlock()
+
+	if l.buckets == nil {
+		return true
+	}
+
+	_, ok := l.buckets[sk]
+	return ok
+}
+
+// markBuckets adds to the filter, if warmed, the buckets of the sketch keys among data's keys.
+func (l *LSH) markBuckets(data map[string][]byte) {
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	if l.buckets == nil {
+		return
+	}
+
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	for key := range data {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			sk, _, _ := strings.Cut(rest, KEY_SEPARATOR)
+			l.buckets[sk] = struct{}{}
+		}
+	}
+}
+
+// unmarkEmptyBuckets removes from the filter, if warmed, the buckets of sketchKeys left empty.
+// The caller must hold l.mu exclusively, so that no write fills them meanwhile.
+func (l *LSH) unmarkEmptyBuckets(sketchKeys []string) error {
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	if l.buckets == nil {
+		return nil
+	}
+
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	for _, key := range sketchKeys {
+		sk, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), KEY_SEPARATOR)
+
+		size, err := l.kv.CountWithPrefix(getBucketPrefixKey(l.keyPrefix, l.indexName, sk))
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			delete(l.buckets, sk)
+		}
+	}
+
+	return nil
+}
+
+// getItemSketchKeys returns the bucket keys of an item. Without its embedding to sketch,
+// every bucket is scanned for it.
+func (l *LSH) getItemSketchKeys(id string) (keys []string, err error) {
+	if !l.storeEmbeddings {
+		prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+		err = l.kv.IterateWithPrefix(prefix, func(k string, _ []byte) error {
+			sk, found := strings.CutSuffix(strings.TrimPrefix(k, prefix), KEY_SEPARATOR+escapeKey(id))
+			if found && uint32(len(sk)) == l.numHyperPlanes {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+
+		return keys, err
+	}
+
+	embedding, err := l.getEmbedding(l.kv, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sks, err := l.getSketches(embedding)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(sks))
+	for _, sk := range sks {
+		if !seen[sk] {
+			seen[sk] = true
+			keys = append(keys, getSketchKey(l.keyPrefix, l.indexName, sk, id))
+		}
+	}
+
+	return keys, nil
+}
+
+// StreamEmbeddings is like Embeddings, but reads key ranges concurrently: it is faster on large indexes,
+// visits embeddings in no particular order, and stops when ctx is done. fn is never called concurrently.
+func (l *LSH) StreamEmbeddings(ctx context.Context, fn func(id string, embedding []float64) error) error {
+	prefix := getEmbeddingPrefixKey(l.keyPrefix, l.indexName)
+
+	err := l.kv.Stream(ctx, prefix, func(key string, val []byte) error {
+		embedding, err := l.decodeEmbedding(val)
+		if err != nil {
+			return err
+		}
+
+		return fn(unescapeKey(strings.TrimPrefix(key, prefix)), embedding)
+	})
+	if err != nil {
+		logErr(l.logger, err, "StreamEmbeddings")
+		return err
+	}
+
+	return nil
+}
+
+// FindDuplicateClusters groups near-identical items: within each bucket, items whose similarity is at least
+// threshold are linked, and linked items form a cluster, even when only transitively similar.
+// Only clusters of at least two items are returned, each sorted, ordered by their first ID.
+func (l *LSH) FindDuplicateClusters(threshold float64) (clusters [][]string, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "FindDuplicateClusters")
+		return nil, err
+	}
+
+	if err := l.checkThreshold(threshold); err != nil {
+		logErr(l.logger, err, "FindDuplicateClusters")
+		return nil, err
+	}
+
+	uf := make(unionFind)
+
+	var (
+		bucket   []string
+		bucketSK string
+	)
+
+	linkBucket := func() error {
+		defer func() { bucket = bucket[:0] }()
+
+		if len(bucket) < 2 {
+			return nil
+		}
+
+		return l.linkDuplicates(uf, bucket, threshold)
+	}
+
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	// Keys are sorted, so the members of a bucket are contiguous.
+	err = l.kv.IterateWithPrefix(prefix, func(key string, val []byte) error {
+		// Keys too short to hold a sketch and an ID are left to Repair.
+		rest := strings.TrimPrefix(key, prefix)
+		if uint32(len(rest)) <= l.numHyperPlanes {
+			return nil
+		}
+
+		sk := rest[:l.numHyperPlanes]
+
+		if sk != bucketSK {
+			if err := linkBucket(); err != nil {
+				return err
+			}
+			bucketSK = sk
+		}
+
+		bucket = append(bucket, string(val))
+
+		return nil
+	})
+	if err == nil {
+		err = linkBucket()
+	}
+	if err != nil {
+		logErr(l.logger, err, "FindDuplicateClusters")
+		return nil, err
+	}
+
+	return uf.sets(), nil
+}
+
+// linkDuplicates unions the items of a bucket that are similar enough. Stale members, whose embedding is gone,
+// are skipped.
+func (l *LSH) linkDuplicates(uf unionFind, ids []string, threshold float64) error {
+	embeddings := make(map[string][]float64, len(ids))
+	for _, id := range ids {
+		embedding, err := l.getEmbedding(l.kv, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		embeddings[id] = embedding
+	}
+
+	for id, embedding := range embeddings {
+		query, err := l.sem.NewQuery(embedding)
+		if err != nil {
+			return err
+		}
+
+		err = l.sem.SearchQueryFunc(query, embeddings, threshold, func(neighbor semantic.Neighbor) error {
+			if neighbor.ID != id {
+				uf.union(id, neighbor.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unionFind is a disjoint-set forest over IDs: each ID maps to its parent, roots map to themselves.
+type unionFind map[string]string
+
+func (uf unionFind) find(id string) string {
+	parent, ok := uf[id]
+	if !ok {
+		uf[id] = id
+		return id
+	}
+
+	if parent == id {
+		return id
+	}
+
+	root := uf.find(parent)
+	uf[id] = root
+
+	return root
+}
+
+func (uf unionFind) union(a, b string) {
+	rootA, rootB := uf.find(a), uf.find(b)
+	if rootA != rootB {
+		uf[rootB] = rootA
+	}
+}
+
+// sets returns the sets of at least two IDs, each sorted, ordered by their first ID.
+func (uf unionFind) sets() [][]string {
+	byRoot := make(map[string][]string)
+	for id := range uf {
+		root := uf.find(id)
+		byRoot[root] = append(byRoot[root], id)
+	}
+
+	sets := make([][]string, 0, len(byRoot))
+	for _, set := range byRoot {
+		if len(set) < 2 {
+			continue
+		}
+
+		sort.Strings(set)
+		sets = append(sets, set)
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i][0] < sets[j][0]
+	})
+
+	return sets
+}
+
+// SimilarityMatrix returns the cosine similarities between every pair of the given items, in the order of ids.
+// Every item must exist. Its cost is O(N²) in the number of ids.
+func (l *LSH) SimilarityMatrix(ids []string) ([][]float64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "SimilarityMatrix")
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = getEmbeddingKey(l.keyPrefix, l.indexName, id)
+	}
+
+	exists, err := l.kv.KeysExist(keys...)
+	if err != nil {
+		logErr(l.logger, err, "SimilarityMatrix")
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if !exists[keys[i]] {
+			err = &itemDoesNotExistError{id}
+			logErr(l.logger, err, "SimilarityMatrix")
+			return nil, err
+		}
+	}
+
+	embeddings := make([][]float64, len(ids))
+	err = l.kv.View(func(tx storage.ReadTx) error {
+		for i, id := range ids {
+			embedding, err := l.getEmbedding(tx, id)
+			if err != nil {
+				return err
+			}
+
+			embeddings[i] = embedding
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "SimilarityMatrix")
+		return nil, err
+	}
+
+	return semantic.SimilarityMatrix(embeddings)
+}
+
+// Sample returns up to n embeddings picked uniformly at random, using reservoir sampling so that
+// at most n embeddings are held in memory. The same seed yields the same sample for the same data.
+func (l *LSH) Sample(n int, seed int64) (map[string][]float64, error) {
+	if n < 0 {
+		err := &invalidSampleSizeError{n}
+		logErr(l.logger, err, "Sample")
+		return nil, err
+	}
+
+	// The reservoir grows as items are read, since n may be far more than the index holds.
+	var (
+		rng       = rand.New(rand.NewSource(seed))
+		reservoir []Item
+		seen      int64
+	)
+
+	err := l.Embeddings(func(id string, embedding []float64) error {
+		seen++
+
+		if len(reservoir) < n {
+			reservoir = append(reservoir, Item{ID: id, Embedding: embedding})
+			return nil
+		}
+
+		if i := rng.Int63n(seen); i < int64(n) {
+			reservoir[i] = Item{ID: id, Embedding: embedding}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "Sample")
+		return nil, err
+	}
+
+	sample := make(map[string][]float64, len(reservoir))
+	for _, item := range reservoir {
+		sample[item.ID] = item.Embedding
+	}
+
+	return sample, nil
+}
+
+// AddBatchIfAbsent is like AddBatch, but only writes items whose ID isn't in the index yet,
+// so re-sending a dataset doesn't re-sketch nor re-write unchanged items. When an ID repeats within
+// the batch, its first occurrence wins. It returns how many items were written.
+func (l *LSH) AddBatchIfAbsent(items []Item) (inserted int, err error) {
+	if err := l.inferSpaceDimFrom(itemEmbeddings(items)...); err != nil {
+		logErr(l.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = l.getPresenceKey(item.ID)
+	}
+
+	exists, err := l.kv.KeysExist(keys...)
+	if err != nil {
+		logErr(l.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	var (
+		data    = make(map[string][]byte)
+		written []Item
+	)
+
+	for i, item := range items {
+		if exists[keys[i]] {
+			continue
+		}
+		exists[keys[i]] = true
+
+		itemData, err := l.prepareItem(item.ID, item.Embedding)
+		if err != nil {
+			logErr(l.logger, err, "AddBatchIfAbsent")
+			return 0, err
+		}
+
+		l.prepareMeta(itemData, item)
+		maps.Copy(data, itemData)
+		written = append(written, item)
+		inserted++
+	}
+
+	if inserted == 0 {
+		return 0, nil
+	}
+
+	if err := l.write(data, nil, written, nil); err != nil {
+		logErr(l.logger, err, "AddBatchIfAbsent")
+		return 0, err
+	}
+
+	l.numAdds.Add(uint64(inserted))
+
+	return inserted, nil
+}
+
+// getPresenceKey returns the key written once per item, telling whether an ID is in the index.
+func (l *LSH) getPresenceKey(id string) string {
+	if l.storeEmbeddings {
+		return getEmbeddingKey(l.keyPrefix, l.indexName, id)
+	}
+
+	return getTimestampKey(l.keyPrefix, l.indexName, id)
+}
+
+func (l *LSH) prepareItem(id string, embedding []float64) (data map[string][]byte, err error) {
+	var embedData map[string][]byte
+
+	if l.storeEmbeddings {
+		embedData, err = l.prepareEmbedding(id, embedding)
+	} else {
+		err = l.checkEmbedding(embedding)
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "prepareItem")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(embedding)
+	if err != nil {
+		logErr(l.logger, err, "prepareItem")
+		return nil, err
+	}
+
+	sksData, err := l.prepareSketches(id, sks)
+	if err != nil {
+		logErr(l.logger, err, "prepareItem")
+		return nil, err
+	}
+
+	data = make(map[string][]byte, len(embedData)+len(sksData)+2)
+	maps.Copy(data, embedData)
+	maps.Copy(data, sksData)
+	data[getIDSketchKey(l.keyPrefix, l.indexName, id)] = []byte(strings.Join(sks, ""))
+	data[getTimestampKey(l.keyPrefix, l.indexName, id)] = encodeUInt64(uint64(l.now().UnixNano()))
+
+	return data, nil
+}
+
+// prepareMeta adds the item's metadata, if any, to data.
+func (l *LSH) prepareMeta(data map[string][]byte, item Item) {
+	if item.Meta != nil {
+		data[getMetaKey(l.keyPrefix, l.indexName, item.ID)] = item.Meta
+	}
+}
+
+// Meta returns the metadata stored with each item, in the order of ids. It is nil for items stored without any,
+// or missing.
+func (l *LSH) Meta(ids []string) (metas [][]byte, err error) {
+	metas = make([][]byte, len(ids))
+
+	err = l.kv.View(func(tx storage.ReadTx) error {
+		for i, id := range ids {
+			meta, err := tx.Get(getMetaKey(l.keyPrefix, l.indexName, id))
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			metas[i] = meta
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "Meta")
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// Drift compares the embeddings added before and after a point in time.
+type Drift struct {
+	NumBefore int
+	NumAfter  int
+
+	// Cosine similarity between the centroids of both groups. The lower, the larger the drift.
+	CentroidSimilarity float64
+}
+
+// Drift compares the centroid of the embeddings added before since with the centroid of the ones
+// added at or after it. Embeddings without an insertion timestamp are ignored.
+func (l *LSH) Drift(ctx context.Context, since time.Time) (Drift, error) {
+	var drift Drift
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "Drift")
+		return Drift{}, err
+	}
+
+	timestamps := make(map[string]time.Time)
+	prefix := getTimestampPrefixKey(l.keyPrefix, l.indexName)
+
+	err := l.kv.Stream(ctx, prefix, func(key string, val []byte) error {
+		timestamps[unescapeKey(strings.TrimPrefix(key, prefix))] = time.Unix(0, int64(binary.LittleEndian.Uint64(val)))
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "Drift")
+		return Drift{}, err
+	}
+
+	before := make([]float64, l.spaceDim)
+	after := make([]float64, l.spaceDim)
+
+	err = l.StreamEmbeddings(ctx, func(id string, embedding []float64) error {
+		timestamp, ok := timestamps[id]
+		if !ok {
+			return nil
+		}
+
+		centroid := after
+		if timestamp.Before(since) {
+			centroid = before
+			drift.NumBefore++
+		} else {
+			drift.NumAfter++
+		}
+
+		for i, val := range embedding {
+			centroid[i] += val
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "Drift")
+		return Drift{}, err
+	}
+
+	if drift.NumBefore == 0 || drift.NumAfter == 0 {
+		err = &emptyDriftWindowError{since}
+		logErr(l.logger, err, "Drift")
+		return Drift{}, err
+	}
+
+	// Averaging doesn't change the direction, so sums are as good as centroids for the cosine.
+	drift.CentroidSimilarity, err = semantic.CosineSimilarity(before, after)
+	if err != nil {
+		logErr(l.logger, err, "Drift")
+		return Drift{}, err
+	}
+
+	return drift, nil
+}
+
+func (l *LSH) Get(queryVec []float64, threshold float64, k uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+	start := time.Now()
+
+	l.mu.RLock()
+	neighbors, numCandidates, err := l.get(queryVec, threshold, k, gathering{})
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.observer.OnQuery(l.indexName, numCandidates, len(neighbors), time.Since(start))
+
+	return neighbors, nil
+}
+
+// GetFiltered is like Get, only considering the candidates whose metadata, nil if there is none, is accepted by
+// filter. Rejected candidates are skipped before being ranked, so they neither count toward k nor MaxCandidates.
+// Filtering happens after bucketing though: neighbors that didn't share a bucket with the query are never
+// considered, so a selective filter can leave fewer than k neighbors even though more would pass it.
+// Raising NumRounds or the fallback radius, to gather more candidates, helps.
+func (l *LSH) GetFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool) (neighbors []string, err error) {
+	l.numGets.Add(1)
+	start := time.Now()
+
+	l.mu.RLock()
+	neighbors, numCandidates, err := l.get(queryVec, threshold, k, gathering{filter: filter})
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.observer.OnQuery(l.indexName, numCandidates, len(neighbors), time.Since(start))
+
+	return neighbors, nil
+}
+
+// GetPreFiltered is like Get, but when the buckets hold more than preFilterTopN candidates, only the preFilterTopN
+// whose sketches are the closest to the query's, by Hamming distance over every round, are scored. It trades
+// recall for speed on large buckets, as sketches are read instead of embeddings. Zero preFilterTopN is the same
+// as Get. Candidates stored without a sketch, by versions that didn't store them, are always scored.
+// Indexes without stored embeddings don't score candidates, and ignore it.
+func (l *LSH) GetPreFiltered(queryVec []float64, threshold float64, k, preFilterTopN uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+	start := time.Now()
+
+	l.mu.RLock()
+	neighbors, numCandidates, err := l.get(queryVec, threshold, k, gathering{preFilterTopN: preFilterTopN})
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.observer.OnQuery(l.indexName, numCandidates, len(neighbors), time.Since(start))
+
+	return neighbors, nil
+}
+
+// get also returns the number of candidates read from the buckets. Candidates are gathered as tuned by g.
+func (l *LSH) get(queryVec []float64, threshold float64, k uint32, g gathering) (neighbors []string, numCandidates int, err error) {
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "Get")
+		return nil, 0, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "Get")
+		return nil, 0, err
+	}
+
+	if !l.storeEmbeddings {
+		return l.getUnranked(sks, k, g)
+	}
+
+	// The query's norm is computed once here, not per candidate set.
+	query, err := l.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "Get")
+		return nil, 0, err
+	}
+
+	return l.searchBuckets(sks, query, threshold, k, g)
+}
+
+// GetWithMeta is like Get, also returning the metadata of each neighbor, nil for those without any.
+// Neighbors and their metadata are read from the same snapshot, so they agree despite concurrent writes.
+func (l *LSH) GetWithMeta(queryVec []float64, threshold float64, k uint32) (neighbors []string, metas [][]byte, err error) {
+	l.numGets.Add(1)
+	start := time.Now()
+
+	g := gathering{metas: make(map[string][]byte)}
+
+	l.mu.RLock()
+	neighbors, numCandidates, err := l.get(queryVec, threshold, k, g)
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.observer.OnQuery(l.indexName, numCandidates, len(neighbors), time.Since(start))
+
+	metas = make([][]byte, len(neighbors))
+	for i, id := range neighbors {
+		metas[i] = g.metas[id]
+	}
+
+	return neighbors, metas, nil
+}
+
+// GetWithGroundTruth returns, side by side, the k nearest neighbors found through the buckets, as Get does (approx),
+// and the true k nearest neighbors among every stored item (exact), both without threshold, so that recall can be
+// measured as the share of exact found in approx. exact scores every stored embedding, which is as expensive as
+// a full scan: it is meant for offline evaluation, not for serving queries. The index must store embeddings.
+func (l *LSH) GetWithGroundTruth(queryVec []float64, k uint32) (approx, exact []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	if err := l.checkEmbedding(queryVec); err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	query, err := l.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	approx, _, err = l.searchBuckets(sks, query, l.metric.MatchAll(), k, gathering{})
+	if err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	candidates := make(map[string][]float64)
+
+	err = l.Embeddings(func(id string, embedding []float64) error {
+		candidates[id] = embedding
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	exact, err = l.sem.SearchQuery(query, candidates, l.metric.MatchAll(), k)
+	if err != nil {
+		logErr(l.logger, err, "GetWithGroundTruth")
+		return nil, nil, err
+	}
+
+	return approx, exact, nil
+}
+
+// GetPrepared is like Get, scoring with a query already prepared by semantic.Semantic.NewQuery from queryVec,
+// so that its setup can be shared by several indexes.
+func (l *LSH) GetPrepared(queryVec []float64, query semantic.Query, threshold float64, k uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+	start := time.Now()
+
+	l.mu.RLock()
+	neighbors, numCandidates, err := l.getPrepared(queryVec, query, threshold, k)
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.observer.OnQuery(l.indexName, numCandidates, len(neighbors), time.Since(start))
+
+	return neighbors, nil
+}
+
+func (l *LSH) getPrepared(queryVec []float64, query semantic.Query, threshold float64, k uint32) (neighbors []string, numCandidates int, err error) {
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "GetPrepared")
+		return nil, 0, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetPrepared")
+		return nil, 0, err
+	}
+
+	if !l.storeEmbeddings {
+		return l.getUnranked(sks, k, gathering{})
+	}
+
+	return l.searchBuckets(sks, query, threshold, k, gathering{})
+}
+
+// GetSimilarToID returns up to k neighbors of a stored item, using its own embedding as the query,
+// sorted by descending similarity. The item itself is left out.
+func (l *LSH) GetSimilarToID(id string, threshold float64, k uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	exists, err := l.kv.KeyExists(getEmbeddingKey(l.keyPrefix, l.indexName, id))
+	if err != nil {
+		logErr(l.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	if !exists {
+		err = &itemDoesNotExistError{id}
+		logErr(l.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	embedding, err := l.getEmbedding(l.kv, id)
+	if err != nil {
+		logErr(l.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	// One more, as the item itself is among its neighbors.
+	if k != 0 {
+		k++
+	}
+
+	neighbors, _, err = l.get(embedding, threshold, k, gathering{})
+	if err != nil {
+		logErr(l.logger, err, "GetSimilarToID")
+		return nil, err
+	}
+
+	neighbors = slices.DeleteFunc(neighbors, func(neighbor string) bool {
+		return neighbor == id
+	})
+
+	if k != 0 && uint32(len(neighbors)) >= k {
+		neighbors = neighbors[:k-1]
+	}
+
+	return neighbors, nil
+}
+
+// GetRounds is like Get, only probing the buckets of the given rounds, e.g. the ones a node owns
+// in a sharded deployment. Merging the results of disjoint rounds gives the results of Get over all of them,
+// unless MaxCandidates or k cut them short.
+func (l *LSH) GetRounds(queryVec []float64, rounds []int, threshold float64, k uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "GetRounds")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetRounds")
+		return nil, err
+	}
+
+	sks, err = l.selectRounds(sks, rounds)
+	if err != nil {
+		logErr(l.logger, err, "GetRounds")
+		return nil, err
+	}
+
+	if !l.storeEmbeddings {
+		neighbors, _, err = l.getUnranked(sks, k, gathering{})
+		return neighbors, err
+	}
+
+	query, err := l.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetRounds")
+		return nil, err
+	}
+
+	neighbors, _, err = l.searchBuckets(sks, query, threshold, k, gathering{})
+
+	return neighbors, err
+}
+
+// selectRounds returns the sketches of the given rounds, in that order.
+func (l *LSH) selectRounds(sks []string, rounds []int) ([]string, error) {
+	selected := make([]string, len(rounds))
+
+	for i, round := range rounds {
+		if round < 0 || round >= len(sks) {
+			return nil, &invalidRoundError{round, l.numRounds}
+		}
+
+		selected[i] = sks[round]
+	}
+
+	return selected, nil
+}
+
+// searchBuckets returns up to k members of the buckets whose similarity to query is at least threshold.
+// searchBuckets also returns the number of candidates it scored. Candidates are gathered as tuned by g.
+func (l *LSH) searchBuckets(sks []string, query semantic.Query, threshold float64, k uint32, g gathering) (neighbors []string, numCandidates int, err error) {
+	var norms map[string]float64
+	if l.usesNorms() {
+		norms = make(map[string]float64)
+	}
+
+	g.norms = norms
+
+	candidates, err := l.gatherEmbeddings(sks, g)
+	if err != nil {
+		logErr(l.logger, err, "searchBuckets")
+		return nil, 0, err
+	}
+
+	if norms != nil {
+		neighbors, err = l.sem.SearchQueryWithNorms(query, candidates, norms, threshold, k)
+	} else {
+		neighbors, err = l.sem.SearchQuery(query, candidates, threshold, k)
+	}
+	if err != nil {
+		logErr(l.logger, err, "searchBuckets")
+		return nil, 0, err
+	}
+
+	return neighbors, len(candidates), nil
+}
+
+// getUnranked returns up to k bucket members in discovery order, for indexes without stored embeddings,
+// along with the number of members found. Members are gathered as tuned by g.
+func (l *LSH) getUnranked(sks []string, k uint32, g gathering) (ids []string, numCandidates int, err error) {
+	err = l.kv.View(func(tx storage.ReadTx) error {
+		if ids, err = l.gatherCandidateIDs(tx, sks, g); err != nil {
+			return err
+		}
+
+		numCandidates = len(ids)
+		if k != 0 && k < uint32(len(ids)) {
+			ids = ids[:k]
+		}
+
+		if g.metas == nil {
+			return nil
+		}
+
+		for _, id := range ids {
+			if g.metas[id], err = l.getMeta(tx, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "getUnranked")
+		return nil, 0, err
+	}
+
+	if ids == nil {
+		ids = []string{}
+	}
+
+	return ids, numCandidates, nil
+}
+
+// GetTopK returns the k neighbors closest to the query among the candidates gathered from its buckets, sorted
+// from the closest, whatever their similarity: unlike Get with a threshold, it returns k neighbors whenever the
+// buckets hold that many. Up to k*overFetch candidates are gathered, in place of MaxCandidates, and all of them
+// are scored. Zero k or overFetch keeps MaxCandidates. The index must store embeddings.
+func (l *LSH) GetTopK(queryVec []float64, k, overFetch uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	if err := l.checkEmbedding(queryVec); err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	query, err := l.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	candidates, err := l.gatherEmbeddings(sks, gathering{maxCandidates: k * overFetch})
+	if err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	neighbors, err = l.sem.SearchQuery(query, candidates, l.metric.MatchAll(), k)
+	if err != nil {
+		logErr(l.logger, err, "GetTopK")
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// GetStream calls fn with every neighbor whose similarity is at least threshold, as soon as it is scored.
+// Neighbors are visited in discovery order, not by similarity. It stops when ctx is done or fn fails.
+func (l *LSH) GetStream(ctx context.Context, queryVec []float64, threshold float64, fn func(neighbor semantic.Neighbor) error) error {
+	l.numGets.Add(1)
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetStream")
+		return err
+	}
+
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "GetStream")
+		return err
+	}
+
+	query, err := l.sem.NewQuery(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetStream")
+		return err
+	}
+
+	candidates, err := l.getCandidates(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetStream")
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return l.sem.SearchQueryFunc(query, candidates, threshold, func(neighbor semantic.Neighbor) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fn(neighbor)
+	})
+}
+
+// ExplainedNeighbor is a neighbor along with the number of rounds in which it shared the query's bucket,
+// a proxy for how confident the match is.
+type ExplainedNeighbor struct {
+	semantic.Neighbor
+	RoundMatches int
+}
+
+// GetWithScores is like Get, also returning the similarity of each neighbor.
+func (l *LSH) GetWithScores(queryVec []float64, threshold float64, k uint32) (neighbors []semantic.Neighbor, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	candidates, err := l.getEmbeddingsFromBuckets(sks)
+	if err != nil {
+		logErr(l.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	neighbors, err = l.sem.SearchScored(queryVec, candidates, threshold, k)
+	if err != nil {
+		logErr(l.logger, err, "GetWithScores")
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// GetExplained is like Get, also returning the similarity and round matches of each neighbor.
+func (l *LSH) GetExplained(queryVec []float64, threshold float64, k uint32) (neighbors []ExplainedNeighbor, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetExplained")
+		return nil, err
+	}
+
+	if err := l.checkGetParams(queryVec, threshold); err != nil {
+		logErr(l.logger, err, "GetExplained")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetExplained")
+		return nil, err
+	}
+
+	roundMatches := make(map[string]int)
+
+	candidates, err := l.gatherEmbeddings(sks, gathering{roundMatches: roundMatches})
+	if err != nil {
+		logErr(l.logger, err, "GetExplained")
+		return nil, err
+	}
+
+	scored, err := l.sem.SearchScored(queryVec, candidates, threshold, k)
+	if err != nil {
+		logErr(l.logger, err, "GetExplained")
+		return nil, err
+	}
+
+	neighbors = make([]ExplainedNeighbor, len(scored))
+	for i, neighbor := range scored {
+		neighbors[i] = ExplainedNeighbor{Neighbor: neighbor, RoundMatches: roundMatches[neighbor.ID]}
+	}
+
+	return neighbors, nil
+}
+
+// getCandidates returns the embeddings of the query's buckets, holding the lock only while gathering them.
+func (l *LSH) getCandidates(queryVec []float64) (map[string][]float64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.getEmbeddingsFromBuckets(sks)
+}
+
+// GetPercentile returns the candidates scoring at or above the given percentile (0 to 100)
+// of the candidates' scores, sorted by descending similarity.
+func (l *LSH) GetPercentile(queryVec []float64, percentile float64) (neighbors []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	if err := l.checkEmbedding(queryVec); err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	if err := l.checkPercentile(percentile); err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	sks, err := l.getSketches(queryVec)
+	if err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	candidates, err := l.getEmbeddingsFromBuckets(sks)
+	if err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	scored, err := l.sem.SearchScored(queryVec, candidates, l.metric.MatchAll(), 0)
+	if err != nil {
+		logErr(l.logger, err, "GetPercentile")
+		return nil, err
+	}
+
+	scored = l.metric.AbovePercentile(scored, percentile)
+
+	neighbors = make([]string, len(scored))
+	for i, neighbor := range scored {
+		neighbors[i] = neighbor.ID
+	}
+
+	return neighbors, nil
+}
+
+// MultiMode defines how GetMulti combines several query vectors.
+type MultiMode uint8
+
+const (
+	// Union runs every query and merges their neighbors, keeping each item's best similarity.
+	Union MultiMode = iota
+
+	// Centroid runs a single query with the mean of the query vectors.
+	Centroid
+)
+
+// GetMulti returns up to k neighbors of several queries combined according to mode, sorted by descending similarity.
+// Every query must match the index's space dimension.
+func (l *LSH) GetMulti(queries [][]float64, mode MultiMode, threshold float64, k uint32) (neighbors []string, err error) {
+	l.numGets.Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(queries) == 0 {
+		err := &emptyQueriesError{}
+		logErr(l.logger, err, "GetMulti")
+		return nil, err
+	}
+
+	for _, queryVec := range queries {
+		if err := l.checkGetParams(queryVec, threshold); err != nil {
+			logErr(l.logger, err, "GetMulti")
+			return nil, err
+		}
+	}
+
+	switch mode {
+	case Union:
+		return l.getUnion(queries, threshold, k)
+	case Centroid:
+		neighbors, _, err = l.get(centroid(queries), threshold, k, gathering{})
+		return neighbors, err
+	default:
+		err := &unknownMultiModeError{mode: mode}
+		logErr(l.logger, err, "GetMulti")
+		return nil, err
+	}
+}
+
+// getUnion merges the neighbors of every query, scoring each item by its best similarity to any of them.
+func (l *LSH) getUnion(queries [][]float64, threshold float64, k uint32) (neighbors []string, err error) {
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "getUnion")
+		return nil, err
+	}
+
+	best := make(map[string]float64)
+
+	for _, queryVec := range queries {
+		sks, err := l.getSketches(queryVec)
+		if err != nil {
+			logErr(l.logger, err, "getUnion")
+			return nil, err
+		}
+
+		candidates, err := l.getEmbeddingsFromBuckets(sks)
+		if err != nil {
+			logErr(l.logger, err, "getUnion")
+			return nil, err
+		}
+
+		scored, err := l.sem.SearchScored(queryVec, candidates, threshold, 0)
+		if err != nil {
+			logErr(l.logger, err, "getUnion")
+			return nil, err
+		}
+
+		for _, neighbor := range scored {
+			if score, ok := best[neighbor.ID]; !ok || l.metric.Closer(neighbor.Score, score) {
+				best[neighbor.ID] = neighbor.Score
+			}
+		}
+	}
+
+	neighbors = make([]string, 0, len(best))
+	for id := range best {
+		neighbors = append(neighbors, id)
+	}
+
+	// Ties are broken by ID, so results don't depend on map iteration order.
+	sort.Slice(neighbors, func(i, j int) bool {
+		if best[neighbors[i]] != best[neighbors[j]] {
+			return l.metric.Closer(best[neighbors[i]], best[neighbors[j]])
+		}
+		return neighbors[i] < neighbors[j]
+	})
+
+	if k == 0 || k > uint32(len(neighbors)) {
+		return neighbors, nil
+	}
+
+	return neighbors[:k], nil
+}
+
+// centroid returns the element-wise mean of vecs, which must share the same length.
+func centroid(vecs [][]float64) []float64 {
+	res := make([]float64, len(vecs[0]))
+
+	for _, vec := range vecs {
+		for i, v := range vec {
+			res[i] += v
+		}
+	}
+
+	for i := range res {
+		res[i] /= float64(len(vecs))
+	}
+
+	return res
+}
+
+func (l *LSH) checkGetParams(queryVec []float64, threshold float64) error {
+	if err := l.checkEmbedding(queryVec); err != nil {
+		logErr(l.logger, err, "checkGetParams")
+		return err
+	}
+
+	if err := l.checkThreshold(threshold); err != nil {
+		logErr(l.logger, err, "checkGetParams")
+		return err
+	}
+
+	return nil
+}
+
+// Seed returns the seed the index's hyperplanes were generated from.
+// Creating an index with the same seed and hyperparameters reproduces its sketches.
+func (l *LSH) Seed() (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.seed == 0 {
+		err := &unknownSeedError{l.indexName}
+		logErr(l.logger, err, "Seed")
+		return 0, err
+	}
+
+	return l.seed, nil
+}
+
+// SpaceDim returns the length the index's embeddings must have, or zero while WithInferredSpaceDim waits for
+// the first one.
+func (l *LSH) SpaceDim() uint32 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.spaceDim
+}
+
+func itemEmbeddings(items []Item) [][]float64 {
+	embeddings := make([][]float64, len(items))
+	for i, item := range items {
+		embeddings[i] = item.Embedding
+	}
+
+	return embeddings
+}
+
+// Metric returns how the index scores candidates on Get.
+func (l *LSH) Metric() semantic.Metric {
+	return l.metric
+}
+
+// Created tells whether New stored a new index, rather than reopening one.
+func (l *LSH) Created() bool {
+	return l.created
+}
+
+func (l *LSH) Info() map[string]any {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return map[string]any{
+		"numRounds":      l.numRounds,
+		"numHyperPlanes": l.numHyperPlanes,
+		"spaceDim":       l.spaceDim,
+		"numAdds":        l.numAdds.Load(),
+		"numGets":        l.numGets.Load(),
+		"count":          l.Count(),
+	}
+}
+
+// FlushStats persists the counters reported by Info, so that they survive a restart.
+// Operations counted after the last flush are lost on a crash.
+func (l *LSH) FlushStats() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.dropped {
+		return nil
+	}
+
+	err := l.kv.Add(map[string][]byte{
+		getNumAddsKey(l.keyPrefix, l.indexName): encodeUInt64(l.numAdds.Load()),
+		getNumGetsKey(l.keyPrefix, l.indexName): encodeUInt64(l.numGets.Load()),
+	})
+	if err != nil {
+		logErr(l.logger, err, "FlushStats")
+		return err
+	}
+
+	return nil
+}
+
+// loadStats restores the counters last flushed. Indexes never flushed start from zero.
+func (l *LSH) loadStats() error {
+	counters := map[string]*atomic.Uint64{
+		getNumAddsKey(l.keyPrefix, l.indexName): &l.numAdds,
+		getNumGetsKey(l.keyPrefix, l.indexName): &l.numGets,
+	}
+
+	for key, counter := range counters {
+		exists, err := l.kv.KeyExists(key)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		encoded, err := l.kv.Get(key)
+		if err != nil {
+			return err
+		}
+
+		counter.Store(binary.LittleEndian.Uint64(encoded))
+	}
+
+	return nil
+}
+
+// Count returns the number of items of the index. It is maintained on every write, so it doesn't scan the index.
+func (l *LSH) Count() int {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	return l.count
+}
+
+// Centroid returns the mean of the stored embeddings, or nil when the index is empty. It is derived from a sum
+// maintained on every write, so it doesn't scan the index, but it may drift from the exact mean by rounding errors.
+func (l *LSH) Centroid() ([]float64, error) {
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "Centroid")
+		return nil, err
+	}
+
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	if l.count == 0 {
+		return nil, nil
+	}
+
+	mean := make([]float64, len(l.embeddingSum))
+	for i, val := range l.embeddingSum {
+		mean[i] = val / float64(l.count)
+	}
+
+	return mean, nil
+}
+
+// write sets data and deletes the keys in del within a single transaction, along with the running stats
+// updated for upserted, the items data writes (replacing any stored under the same ID), and deleted,
+// the IDs of the items del removes.
+func (l *LSH) write(data map[string][]byte, del []string, upserted []Item, deleted []string) error {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	// ID -> embedding written, or nil when deleted. The last write of an ID wins.
+	changes := make(map[string][]float64, len(upserted)+len(deleted))
+	for _, item := range upserted {
+		changes[item.ID] = item.Embedding
+	}
+	for _, id := range deleted {
+		changes[id] = nil
+	}
+
+	presenceKeys := make([]string, 0, len(changes))
+	for id := range changes {
+		presenceKeys = append(presenceKeys, l.getPresenceKey(id))
+	}
+
+	exists, err := l.kv.KeysExist(presenceKeys...)
+	if err != nil {
+		return err
+	}
+
+	count, sum := l.count, slices.Clone(l.embeddingSum)
+
+	err = l.kv.View(func(tx storage.ReadTx) error {
+		for id, embedding := range changes {
+			if exists[l.getPresenceKey(id)] {
+				count--
+
+				if sum != nil {
+					old, err := l.getEmbedding(tx, id)
+					if err != nil && !isCorrupt(err) {
+						return err
+					}
+
+					addScaled(sum, old, -1)
+				}
+			}
+
+			if embedding != nil {
+				count++
+				addScaled(sum, embedding, 1)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		data = make(map[string][]byte, 2)
+	}
+	maps.Copy(data, l.runningStatsData(count, sum))
+	l.markBuckets(data)
+
+	err = l.kv.Write(data, del)
+
+	// Invalidated whether the write succeeded or not, to be safe: it only costs a few cache misses.
+	for id := range changes {
+		l.embeddingCache.remove(id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	l.count, l.embeddingSum = count, sum
+
+	return nil
+}
+
+// addScaled adds scale*vec to sum in place. Vectors of another length, such as corrupt ones, are ignored.
+func addScaled(sum, vec []float64, scale float64) {
+	if len(vec) != len(sum) {
+		return
+	}
+
+	for i, val := range vec {
+		sum[i] += scale * val
+	}
+}
+
+func (l *LSH) runningStatsData(count int, sum []float64) map[string][]byte {
+	data := map[string][]byte{getCountKey(l.keyPrefix, l.indexName): encodeUInt64(uint64(count))}
+
+	if sum != nil {
+		// Encoding only fails on empty slices, which an index's dimension rules out.
+		data[getEmbeddingSumKey(l.keyPrefix, l.indexName)], _ = encodeFloat64Slice(sum)
+	}
+
+	return data
+}
+
+// loadRunningStats restores the item count and embedding sum. Indexes created before they were maintained
+// have them computed with a full scan, once.
+func (l *LSH) loadRunningStats() error {
+	countKey := getCountKey(l.keyPrefix, l.indexName)
+
+	exists, err := l.kv.KeyExists(countKey)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return l.rebuildRunningStats()
+	}
+
+	encodedCount, err := l.kv.Get(countKey)
+	if err != nil {
+		return err
+	}
+
+	var sum []float64
+	if l.storeEmbeddings && l.spaceDim != 0 {
+		encodedSum, err := l.kv.Get(getEmbeddingSumKey(l.keyPrefix, l.indexName))
+		if err != nil {
+			return err
+		}
+
+		if sum, err = decodeFloat64Slice(encodedSum); err != nil {
+			return err
+		}
+	}
+
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	l.count, l.embeddingSum = int(binary.LittleEndian.Uint64(encodedCount)), sum
+
+	return nil
+}
+
+// rebuildRunningStats computes the item count and embedding sum with a full scan, and stores them unless read-only.
+func (l *LSH) rebuildRunningStats() error {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	count, err := l.kv.CountWithPrefix(l.getPresenceKey(""))
+	if err != nil {
+		return err
+	}
+
+	var sum []float64
+	if l.storeEmbeddings {
+		sum = make([]float64, l.spaceDim)
+
+		err = l.Embeddings(func(_ string, embedding []float64) error {
+			addScaled(sum, embedding, 1)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !l.readOnly {
+		if err := l.kv.Add(l.runningStatsData(count, sum)); err != nil {
+			return err
+		}
+	}
+
+	l.count, l.embeddingSum = count, sum
+
+	return nil
+}
+
+// Exists tells whether the item is in the index.
+func (l *LSH) Exists(id string) (bool, error) {
+	exists, err := l.kv.KeyExists(l.getPresenceKey(id))
+	if err != nil {
+		logErr(l.logger, err, "Exists")
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Embedding returns the stored embedding of the item. It must not be modified, as it may be shared with the
+// embedding cache. It fails if the index doesn't store embeddings.
+func (l *LSH) Embedding(id string) ([]float64, error) {
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "Embedding")
+		return nil, err
+	}
+
+	var embedding []float64
+
+	err := l.view(func(tx storage.ReadTx) (err error) {
+		embedding, err = l.getEmbedding(tx, id)
+		return err
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		err = &itemDoesNotExistError{id}
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "Embedding")
+		return nil, err
+	}
+
+	return embedding, nil
+}
+
+// StoresEmbeddings tells whether the index stores embeddings, as set by WithStoreEmbeddings.
+func (l *LSH) StoresEmbeddings() bool {
+	return l.storeEmbeddings
+}
+
+// ListIDs returns the IDs of every item, ordered by their escaped form (see escapeKey).
+func (l *LSH) ListIDs() ([]string, error) {
+	prefix := l.getPresenceKey("")
+
+	keys, err := l.kv.GetKeysWithPrefix(prefix)
+	if err != nil {
+		logErr(l.logger, err, "ListIDs")
+		return nil, err
+	}
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = unescapeKey(strings.TrimPrefix(key, prefix))
+	}
+
+	return ids, nil
+}
+
+// StoredIndexNames returns the names of the indexes found in kv under keyPrefix, sorted, to be reopened with New.
+// It scans every key of those indexes, without reading values.
+func StoredIndexNames(kv storage.Contract, keyPrefix string) (names []string, err error) {
+	root := getIndexKey(keyPrefix, "")
+
+	// Every index has a key at its root, the only one of its keys without a separator after the name.
+	err = kv.IterateKeysWithPrefix(root, func(key string) error {
+		if name := strings.TrimPrefix(key, root); !strings.Contains(name, KEY_SEPARATOR) {
+			names = append(names, unescapeKey(name))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// CountItems counts the items of every given index, keyed by index name, in a single pass over their keys
+// without reading values. The indexes must share the same storage and key prefix.
+func CountItems(indexes ...*LSH) (counts map[string]int, err error) {
+	counts = make(map[string]int, len(indexes))
+	if len(indexes) == 0 {
+		return counts, nil
+	}
+
+	// escaped index name -> prefix of the keys written once per item
+	presencePrefixes := make(map[string]string, len(indexes))
+	for _, l := range indexes {
+		counts[l.indexName] = 0
+		presencePrefixes[escapeKey(l.indexName)] = l.getPresenceKey("")
+	}
+
+	root := getIndexKey(indexes[0].keyPrefix, "")
+
+	err = indexes[0].kv.IterateKeysWithPrefix(root, func(key string) error {
+		indexName, _, _ := strings.Cut(strings.TrimPrefix(key, root), KEY_SEPARATOR)
+
+		if prefix, ok := presencePrefixes[indexName]; ok && strings.HasPrefix(key, prefix) {
+			counts[unescapeKey(indexName)]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// Footprint is the storage used by an index, per key category.
+type Footprint struct {
+	Embeddings  storage.Usage
+	Sketches    storage.Usage
+	HyperPlanes storage.Usage
+}
+
+func (l *LSH) Footprint() (fp Footprint, err error) {
+	categories := map[string]*storage.Usage{
+		getEmbeddingPrefixKey(l.keyPrefix, l.indexName):   &fp.Embeddings,
+		getSketchPrefixKey(l.keyPrefix, l.indexName, ""):  &fp.Sketches,
+		getHyperPlanesPrefixKey(l.keyPrefix, l.indexName): &fp.HyperPlanes,
+	}
+
+	for prefix, usage := range categories {
+		*usage, err = l.kv.UsageWithPrefix(prefix)
+		if err != nil {
+			logErr(l.logger, err, "Footprint")
+			return Footprint{}, err
+		}
+	}
+
+	return fp, nil
+}
+
+// BucketStats describes how the items spread over buckets. Items piling up in a few buckets hurt recall
+// and query time, and call for more hyperplanes; many singleton buckets call for fewer.
+type BucketStats struct {
+	// Number of non-empty buckets.
+	NumBuckets int
+
+	// Sizes of the buckets, in items. Zero when there are none.
+	MinSize  int
+	MaxSize  int
+	MeanSize float64
+
+	// Number of buckets holding a single item.
+	Singletons int
+}
+
+// BucketStats scans every sketch key, grouping them by bucket.
+func (l *LSH) BucketStats() (stats BucketStats, err error) {
+	sizes := make(map[string]int)
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	err = l.kv.IterateKeysWithPrefix(prefix, func(key string) error {
+		sk, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), KEY_SEPARATOR)
+		sizes[sk]++
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "BucketStats")
+		return BucketStats{}, err
+	}
+
+	if len(sizes) == 0 {
+		return BucketStats{}, nil
+	}
+
+	stats = BucketStats{NumBuckets: len(sizes), MinSize: math.MaxInt}
+
+	var total int
+	for _, size := range sizes {
+		stats.MinSize = min(stats.MinSize, size)
+		stats.MaxSize = max(stats.MaxSize, size)
+		total += size
+
+		if size == 1 {
+			stats.Singletons++
+		}
+	}
+
+	stats.MeanSize = float64(total) / float64(len(sizes))
+
+	return stats, nil
+}
+
+// RepairReport counts the inconsistencies fixed by Repair.
+type RepairReport struct {
+	// Sketch keys removed because their item is gone or doesn't hash to their bucket.
+	OrphanedSketches int
+
+	// Sketch keys written back for items missing from some of their buckets.
+	MissingSketches int
+
+	// Items with at least one missing sketch key.
+	ResketchedItems int
+}
+
+// Repair restores the consistency between embeddings and bucket membership, which an interrupted write
+// can break: it removes sketch keys of missing items or of buckets their item doesn't hash to, and re-sketches
+// items missing from some of their buckets. Indexes without stored embeddings can't be checked and are left
+// as they are. It must not run concurrently with writes to the index.
+func (l *LSH) Repair() (report RepairReport, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "Repair")
+		return RepairReport{}, err
+	}
+
+	if !l.storeEmbeddings {
+		return RepairReport{}, nil
+	}
+
+	if err := l.repairMissingSketches(&report); err != nil {
+		logErr(l.logger, err, "Repair")
+		return RepairReport{}, err
+	}
+
+	if err := l.repairOrphanedSketches(&report); err != nil {
+		logErr(l.logger, err, "Repair")
+		return RepairReport{}, err
+	}
+
+	return report, nil
+}
+
+func (l *LSH) repairMissingSketches(report *RepairReport) error {
+	batch := make([]Item, 0, MIGRATE_BATCH_SIZE)
+
+	resketch := func() error {
+		defer func() { batch = batch[:0] }()
+
+		// item ID -> its expected sketch keys
+		expected := make(map[string][]string, len(batch))
+		var keys []string
+
+		for _, item := range batch {
+			sks, err := l.getSketches(item.Embedding)
+			if err != nil {
+				return err
+			}
+
+			for _, sk := range sks {
+				key := getSketchKey(l.keyPrefix, l.indexName, sk, item.ID)
+				expected[item.ID] = append(expected[item.ID], key)
+				keys = append(keys, key)
+			}
+		}
+
+		exists, err := l.kv.KeysExist(keys...)
+		if err != nil {
+			return err
+		}
+
+		data := make(map[string][]byte)
+
+		for _, item := range batch {
+			missing := 0
+
+			for _, key := range expected[item.ID] {
+				if !exists[key] {
+					if _, ok := data[key]; !ok {
+						missing++
+					}
+					data[key] = []byte(item.ID)
+				}
+			}
+
+			if missing != 0 {
+				report.MissingSketches += missing
+				report.ResketchedItems++
+			}
+		}
+
+		if len(data) == 0 {
+			return nil
+		}
+
+		l.markBuckets(data)
+
+		return l.kv.Add(data)
+	}
+
+	err := l.Embeddings(func(id string, embedding []float64) error {
+		batch = append(batch, Item{ID: id, Embedding: embedding})
+
+		if len(batch) < MIGRATE_BATCH_SIZE {
+			return nil
+		}
+
+		return resketch()
+	})
+	if err == nil && len(batch) != 0 {
+		err = resketch()
+	}
+
+	return err
+}
+
+func (l *LSH) repairOrphanedSketches(report *RepairReport) error {
+	prefix := getSketchPrefixKey(l.keyPrefix, l.indexName, "")
+
+	var (
+		orphans []string
+
+		// item ID -> the sketches it hashes to, or nil if it's gone. Reset every batch to bound memory.
+		sketches = make(map[string]map[string]bool)
+	)
+
+	err := l.kv.IterateKeysWithPrefix(prefix, func(key string) error {
+		rest := strings.TrimPrefix(key, prefix)
+		if uint32(len(rest)) <= l.numHyperPlanes {
+			orphans = append(orphans, key)
+			return nil
+		}
+
+		sk, id := rest[:l.numHyperPlanes], unescapeKey(rest[l.numHyperPlanes+1:])
+
+		itemSketches, ok := sketches[id]
+		if !ok {
+			if len(sketches) == MIGRATE_BATCH_SIZE {
+				clear(sketches)
+			}
+
+			exists, err := l.kv.KeyExists(getEmbeddingKey(l.keyPrefix, l.indexName, id))
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				embedding, err := l.getEmbedding(l.kv, id)
+				if err != nil {
+					return err
+				}
+
+				sks, err := l.getSketches(embedding)
+				if err != nil {
+					return err
+				}
+
+				itemSketches = make(map[string]bool, len(sks))
+				for _, sk := range sks {
+					itemSketches[sk] = true
+				}
+			}
+
+			sketches[id] = itemSketches
+		}
+
+		if !itemSketches[sk] {
+			orphans = append(orphans, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(orphans); start += MIGRATE_BATCH_SIZE {
+		if err := l.kv.Del(orphans[start:min(start+MIGRATE_BATCH_SIZE, len(orphans))]...); err != nil {
+			return err
+		}
+	}
+
+	report.OrphanedSketches = len(orphans)
+
+	return nil
+}
+
+// MigrateNormalize rewrites every stored embedding as a unit vector, keeping its original norm under its own key.
+// Cosine similarity and sketches don't depend on magnitude, so query results are unchanged. Other metrics do, so
+// it fails unless the index scores by semantic.Cosine.
+// It writes in batches and skips already migrated embeddings, so an interrupted migration resumes when rerun.
+// Zero vectors can't be normalized and are left as they are. Embeddings added afterwards are not normalized.
+func (l *LSH) MigrateNormalize() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "MigrateNormalize")
+		return err
+	}
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "MigrateNormalize")
+		return err
+	}
+
+	if l.metric != semantic.Cosine {
+		err := &normalizeMetricError{l.indexName, l.metric}
+		logErr(l.logger, err, "MigrateNormalize")
+		return err
+	}
+
+	batch := make([]Item, 0, MIGRATE_BATCH_SIZE)
+
+	err := l.Embeddings(func(id string, embedding []float64) error {
+		batch = append(batch, Item{ID: id, Embedding: embedding})
+
+		if len(batch) < MIGRATE_BATCH_SIZE {
+			return nil
+		}
+
+		if err := l.migrateNormalizeBatch(batch); err != nil {
+			return err
+		}
+
+		batch = batch[:0]
+
+		return nil
+	})
+	if err == nil && len(batch) != 0 {
+		err = l.migrateNormalizeBatch(batch)
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "MigrateNormalize")
+		return err
+	}
+
+	return nil
+}
+
+// Reembed replaces every stored embedding with the one fn returns for it, keeping IDs, and re-sketches the items.
+// New embeddings must match the index's space dimension. It writes in batches, so items of earlier batches stay
+// re-embedded when fn fails or ctx is done.
+func (l *LSH) Reembed(ctx context.Context, fn func(id string, embedding []float64) ([]float64, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "Reembed")
+		return err
+	}
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "Reembed")
+		return err
+	}
+
+	batch := make([]Item, 0, MIGRATE_BATCH_SIZE)
+
+	err := l.Embeddings(func(id string, embedding []float64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		newEmbedding, err := fn(id, embedding)
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, Item{ID: id, Embedding: newEmbedding})
+
+		if len(batch) < MIGRATE_BATCH_SIZE {
+			return nil
+		}
+
+		if err := l.reembedBatch(batch); err != nil {
+			return err
+		}
+
+		batch = batch[:0]
+
+		return nil
+	})
+	if err == nil && len(batch) != 0 {
+		err = l.reembedBatch(batch)
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "Reembed")
+		return err
+	}
+
+	return nil
+}
+
+// reembedBatch writes the items' new embeddings and sketches, and deletes the sketches they no longer hash to,
+// in a single transaction.
+func (l *LSH) reembedBatch(items []Item) error {
+	var (
+		data  = make(map[string][]byte, len(items)*int(2+l.numRounds))
+		stale []string
+	)
+
+	for _, item := range items {
+		itemData, err := l.prepareItem(item.ID, item.Embedding)
+		if err != nil {
+			return err
+		}
+
+		oldKeys, err := l.getItemSketchKeys(item.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range oldKeys {
+			if _, ok := itemData[key]; !ok {
+				stale = append(stale, key)
+			}
+		}
+
+		// The new embedding is stored as given, so a norm kept by MigrateNormalize no longer applies.
+		stale = append(stale, getOriginalNormKey(l.keyPrefix, l.indexName, item.ID))
+
+		maps.Copy(data, itemData)
+	}
+
+	return l.write(data, stale, items, nil)
+}
+
+func (l *LSH) migrateNormalizeBatch(items []Item) error {
+	normKeys := make([]string, len(items))
+	for i, item := range items {
+		normKeys[i] = getOriginalNormKey(l.keyPrefix, l.indexName, item.ID)
+	}
+
+	migrated, err := l.kv.KeysExist(normKeys...)
+	if err != nil {
+		return err
+	}
+
+	var (
+		data      = make(map[string][]byte, 2*len(items))
+		rewritten []Item
+	)
+
+	for i, item := range items {
+		if migrated[normKeys[i]] {
+			continue
+		}
+
+		var norm float64
+		for _, val := range item.Embedding {
+			norm += val * val
+		}
+		norm = math.Sqrt(norm)
+
+		if norm <= semantic.EPSILON {
+			continue
+		}
+
+		normalized := make([]float64, len(item.Embedding))
+		for j, val := range item.Embedding {
+			normalized[j] = val / norm
+		}
+
+		encoded, err := l.encodeEmbedding(normalized)
+		if err != nil {
+			return err
+		}
+
+		encodedNorm, err := encodeFloat64Slice([]float64{norm})
+		if err != nil {
+			return err
+		}
+
+		// Sketches are left untouched: the side of a hyperplane through the origin doesn't depend on magnitude.
+		data[getEmbeddingKey(l.keyPrefix, l.indexName, item.ID)] = encoded
+		data[normKeys[i]] = encodedNorm
+
+		if l.precomputeNorms {
+			normData, err := l.prepareNorm(item.ID, normalized, encoded)
+			if err != nil {
+				return err
+			}
+
+			maps.Copy(data, normData)
+		}
+		rewritten = append(rewritten, Item{ID: item.ID, Embedding: normalized})
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return l.write(data, nil, rewritten, nil)
+}
+
+// RoundContribution is how many candidates a round's buckets yielded over the sampled queries,
+// and how many of those no other round yielded.
+type RoundContribution struct {
+	Round      int
+	Candidates int
+	Unique     int
+}
+
+// OptimizeReport measures how much each round contributes to the candidates gathered on Get.
+// Dropping every round in Redundant loses Loss (a fraction) of the candidates found with all rounds.
+type OptimizeReport struct {
+	NumQueries    int
+	NumCandidates int
+	Rounds        []RoundContribution
+	Redundant     []int
+	Loss          float64
+}
+
+// Optimize samples up to numQueries stored embeddings as queries, measures each round's unique-candidate
+// contribution, and greedily picks the rounds that can be dropped together while losing at most maxLoss
+// (a fraction) of the candidates. One round is always kept. The fallback search is not taken into account.
+func (l *LSH) Optimize(numQueries int, maxLoss float64) (report OptimizeReport, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "Optimize")
+		return report, err
+	}
+
+	queries, err := l.Sample(numQueries, l.seed)
+	if err != nil {
+		logErr(l.logger, err, "Optimize")
+		return report, err
+	}
+
+	// Per query, the candidates each round found and how many rounds found each candidate.
+	found := make([][][]string, 0, len(queries))
+	counts := make([]map[string]int, 0, len(queries))
+
+	for _, queryVec := range queries {
+		sks, err := l.getSketches(queryVec)
+		if err != nil {
+			logErr(l.logger, err, "Optimize")
+			return report, err
+		}
+
+		queryFound := make([][]string, len(sks))
+		queryCounts := make(map[string]int)
+
+		for round, sk := range sks {
+			ids, err := l.getBucketIDs(l.kv, sk)
+			if err != nil {
+				logErr(l.logger, err, "Optimize")
+				return report, err
+			}
+
+			queryFound[round] = ids
+			for _, id := range ids {
+				queryCounts[id]++
+			}
+		}
+
+		found = append(found, queryFound)
+		counts = append(counts, queryCounts)
+		report.NumCandidates += len(queryCounts)
+	}
+
+	report.NumQueries = len(queries)
+	report.Rounds = make([]RoundContribution, len(l.hashes))
+
+	for round := range l.hashes {
+		report.Rounds[round].Round = round
+
+		for q := range found {
+			report.Rounds[round].Candidates += len(found[q][round])
+			report.Rounds[round].Unique += countLost(found[q][round], counts[q])
+		}
+	}
+
+	// Least unique first; on ties, later rounds are dropped first.
+	order := make([]int, len(l.hashes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := report.Rounds[order[i]], report.Rounds[order[j]]
+		if a.Unique != b.Unique {
+			return a.Unique < b.Unique
+		}
+		return a.Round > b.Round
+	})
+
+	var lost int
+	for _, round := range order {
+		if len(report.Redundant) == len(l.hashes)-1 {
+			break
+		}
+
+		roundLost := 0
+		for q := range found {
+			roundLost += countLost(found[q][round], counts[q])
+		}
+
+		if report.NumCandidates == 0 || float64(lost+roundLost) > maxLoss*float64(report.NumCandidates) {
+			continue
+		}
+
+		for q := range found {
+			for _, id := range found[q][round] {
+				counts[q][id]--
+			}
+		}
+
+		lost += roundLost
+		report.Redundant = append(report.Redundant, round)
+	}
+
+	sort.Ints(report.Redundant)
+
+	if report.NumCandidates != 0 {
+		report.Loss = float64(lost) / float64(report.NumCandidates)
+	}
+
+	return report, nil
+}
+
+// countLost counts the ids that no other round found, so they would be lost with the round.
+func countLost(ids []string, counts map[string]int) (lost int) {
+	for _, id := range ids {
+		if counts[id] == 1 {
+			lost++
+		}
+	}
+
+	return lost
+}
+
+// PruneRounds drops the given rounds: their hyperplanes and the sketch keys only they wrote are deleted,
+// and the remaining rounds are renumbered. The index's seed becomes unknown, as the hyperplanes no longer follow from it.
+// It must not run concurrently with other operations on the index.
+func (l *LSH) PruneRounds(ctx context.Context, rounds ...int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkNotDropped(); err != nil {
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	if err := l.checkEmbeddingsStored(); err != nil {
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	pruned := make(map[int]bool, len(rounds))
+	for _, round := range rounds {
+		if round < 0 || round >= len(l.hashes) {
+			err := &invalidRoundError{round, l.numRounds}
+			logErr(l.logger, err, "PruneRounds")
+			return err
+		}
+
+		pruned[round] = true
+	}
+
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	if len(pruned) == len(l.hashes) {
+		err := &pruneAllRoundsError{l.indexName}
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	// Buckets are shared by all rounds, so a pruned round's sketch key stays when a kept round wrote it too.
+	var (
+		staleKeys  []string
+		idSketches = make(map[string][]byte)
+	)
+
+	err := l.StreamEmbeddings(ctx, func(id string, embedding []float64) error {
+		sks, err := l.getSketches(embedding)
+		if err != nil {
+			return err
+		}
+
+		kept := make(map[string]bool, len(sks))
+		keptSks := make([]string, 0, len(sks)-len(pruned))
+		for round, sk := range sks {
+			if !pruned[round] {
+				kept[sk] = true
+				keptSks = append(keptSks, sk)
+			}
+		}
+
+		idSketches[getIDSketchKey(l.keyPrefix, l.indexName, id)] = []byte(strings.Join(keptSks, ""))
+
+		for round, sk := range sks {
+			if pruned[round] && !kept[sk] {
+				kept[sk] = true
+				staleKeys = append(staleKeys, getSketchKey(l.keyPrefix, l.indexName, sk, id))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	numRounds := len(l.hashes)
+
+	hashes := make([]simhash.SimHash, 0, numRounds-len(pruned))
+	for round, hash := range l.hashes {
+		if !pruned[round] {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	l.hashes = hashes
+	l.numRounds = uint32(len(hashes))
+	l.seed = 0
+
+	if err := l.storeConfig(); err != nil {
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	for round := len(hashes); round < numRounds; round++ {
+		staleKeys = append(staleKeys, getHyperPlanesKey(l.keyPrefix, l.indexName, round))
+	}
+
+	if err := l.kv.Write(idSketches, staleKeys); err != nil {
+		logErr(l.logger, err, "PruneRounds")
+		return err
+	}
+
+	return nil
+}
+
+// getEmbeddingsFromBuckets reads the buckets and the candidates' embeddings within a single snapshot,
+// so that an item written or deleted concurrently is either fully seen or not seen at all.
+// Bucket members whose embedding is missing, left behind by an interrupted write, are skipped.
+func (l *LSH) getEmbeddingsFromBuckets(sks []string) (data map[string][]float64, err error) {
+	return l.gatherEmbeddings(sks, gathering{})
+}
+
+// gathering tunes how candidates are gathered. The zero value gathers them as Get does.
+type gathering struct {
+	// Unless nil, counts the rounds in which each candidate was found in the query's own bucket.
+	// Fallback buckets don't count.
+	roundMatches map[string]int
+
+	// Unless nil, receives the candidates' stored norms.
+	norms map[string]float64
+
+	// Replaces MaxCandidates when non-zero.
+	maxCandidates uint32
+
+	// Unless nil, skips the candidates whose metadata it rejects, before they count toward maxCandidates.
+	filter func(meta []byte) bool
+
+	// When non-zero, only this many candidates, the closest to the query by sketch, have their embeddings read.
+	preFilterTopN uint32
+
+	// Unless nil, receives the metadata of the candidates, nil for those without any, read in the same
+	// transaction as their embeddings.
+	metas map[string][]byte
+}
+
+// gatherEmbeddings is like getEmbeddingsFromBuckets, as tuned by g.
+func (l *LSH) gatherEmbeddings(sks []string, g gathering) (data map[string][]float64, err error) {
+	err = l.view(func(tx storage.ReadTx) error {
+		ids, err := l.gatherCandidateIDs(tx, sks, g)
+		if err != nil {
+			return err
+		}
+
+		if g.preFilterTopN != 0 {
+			if ids, err = l.preFilter(tx, ids, strings.Join(sks, ""), g.preFilterTopN); err != nil {
+				return err
+			}
+		}
+
+		data = make(map[string][]float64, len(ids))
+
+		for _, id := range ids {
+			embed, err := l.getEmbedding(tx, id)
+			if errors.Is(err, storage.ErrNotFound) {
+				// A stale bucket member, whose embedding is gone.
+				continue
+			}
+
+			if err == nil {
+				err = l.checkEmbedding(embed)
+			}
+
+			if err != nil && isCorrupt(err) {
+				err = &corruptEmbeddingError{id, err}
+
+				if l.skipCorrupt {
+					logErr(l.logger, err, "getEmbeddingsFromBuckets")
+					continue
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if g.norms != nil {
+				if g.norms[id], err = l.getNorm(tx, id); err != nil {
+					return err
+				}
+			}
+
+			if g.metas != nil {
+				if g.metas[id], err = l.getMeta(tx, id); err != nil {
+					return err
+				}
+			}
+
+			data[id] = embed
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(l.logger, err, "getEmbeddingsFromBuckets")
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// preFilter keeps the topN candidates whose stored sketches are the closest to querySketch by Hamming distance,
+// ties in discovery order, along with the candidates without a stored sketch of the expected length.
+func (l *LSH) preFilter(tx storage.ReadTx, ids []string, querySketch string, topN uint32) ([]string, error) {
+	if uint32(len(ids)) <= topN {
+		return ids, nil
+	}
+
+	type ranked struct {
+		id   string
+		dist int
+	}
+
+	var (
+		kept  []string
+		ranks = make([]ranked, 0, len(ids))
+	)
+
+	for _, id := range ids {
+		sk, err := tx.Get(getIDSketchKey(l.keyPrefix, l.indexName, id))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+
+		if len(sk) != len(querySketch) {
+			kept = append(kept, id)
+			continue
+		}
+
+		ranks = append(ranks, ranked{id, hammingDistance(sk, querySketch)})
+	}
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		return ranks[i].dist < ranks[j].dist
+	})
+
+	for _, r := range ranks[:min(int(topN), len(ranks))] {
+		kept = append(kept, r.id)
+	}
+
+	return kept, nil
+}
+
+// hammingDistance counts the positions where the sketches, of the same length, differ.
+func hammingDistance(sk []byte, other string) (dist int) {
+	for i := range sk {
+		if sk[i] != other[i] {
+			dist++
+		}
+	}
+
+	return dist
+}
+
+// getCandidateIDs returns the unique IDs found in the buckets, in discovery order.
+func (l *LSH) getCandidateIDs(tx storage.ReadTx, sks []string) ([]string, error) {
+	return l.gatherCandidateIDs(tx, sks, gathering{})
+}
+
+// gatherCandidateIDs is like getCandidateIDs, as tuned by g.
+func (l *LSH) gatherCandidateIDs(tx storage.ReadTx, sks []string, g gathering) ([]string, error) {
+	var (
+		ids  []string
+		seen = make(map[string]bool)
+	)
+
+	maxCandidates := l.maxCandidates
+	if g.maxCandidates != 0 {
+		maxCandidates = g.maxCandidates
+	}
+
+	rounds, err := l.orderRounds(tx, sks)
+	if err != nil {
+		logErr(l.logger, err, "getCandidateIDs")
+		return nil, err
+	}
+
+	for _, round := range rounds {
+		if reachedMaxCandidates(len(ids), maxCandidates) {
+			break
+		}
+
+		bucketIDs, err := l.getBucketIDs(tx, sks[round])
+		if err != nil {
+			logErr(l.logger, err, "getCandidateIDs")
+			return nil, err
+		}
+
+		exact := true
+
+		if len(bucketIDs) == 0 && l.fallbackRadius != 0 {
+			exact = false
+
+			bucketIDs, err = l.getNearestBucketIDs(tx, sks[round])
+			if err != nil {
+				logErr(l.logger, err, "getCandidateIDs")
+				return nil, err
+			}
+		}
+
+		for _, id := range bucketIDs {
+			if !seen[id] {
+				if reachedMaxCandidates(len(ids), maxCandidates) {
+					continue
+				}
+
+				seen[id] = true
+
+				if g.filter != nil {
+					accepted, err := l.acceptsMeta(tx, id, g.filter)
+					if err != nil {
+						logErr(l.logger, err, "getCandidateIDs")
+						return nil, err
+					}
+
+					if !accepted {
+						continue
+					}
+				}
+
+				ids = append(ids, id)
+			}
+
+			if exact && g.roundMatches != nil {
+				g.roundMatches[id]++
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// acceptsMeta tells whether filter accepts the metadata stored with the item, nil if there is none.
+func (l *LSH) acceptsMeta(tx storage.ReadTx, id string, filter func(meta []byte) bool) (bool, error) {
+	meta, err := l.getMeta(tx, id)
+	if err != nil {
+		return false, err
+	}
+
+	return filter(meta), nil
+}
+
+// getMeta returns the metadata of an item, nil if it has none.
+func (l *LSH) getMeta(tx storage.ReadTx, id string) ([]byte, error) {
+	meta, err := tx.Get(getMetaKey(l.keyPrefix, l.indexName, id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	return meta, err
+}
+
+// getNearestBucketIDs returns the IDs of the non-empty buckets closest to sk, by Hamming distance,
+// up to the fallback radius. All buckets at the closest distance are merged.
+func (l *LSH) getNearestBucketIDs(tx storage.ReadTx, sk string) ([]string, error) {
+	maxRadius := min(int(l.fallbackRadius), len(sk))
+
+	for radius := 1; radius <= maxRadius; radius++ {
+		var ids []string
+
+		err := flipBits([]byte(sk), 0, radius, func(neighbor string) error {
+			bucketIDs, err := l.getBucketIDs(tx, neighbor)
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, bucketIDs...)
+			return nil
+		})
+		if err != nil {
+			logErr(l.logger, err, "getNearestBucketIDs")
+			return nil, err
+		}
+
+		if len(ids) != 0 {
+			return ids, nil
+		}
+	}
+
+	return nil, nil
 }
 
-func (l *LSH) storeConfig() (err error) {
-	var data = make(map[string][]byte, 4+len(l.hashes))
-
-	data = map[string][]byte{
-		getIndexKey(l.indexName):          []byte(""),
-		getNumRoundsKey(l.indexName):      encodeUInt32(l.numRounds),
-		getNumHyperPlanesKey(l.indexName): encodeUInt32(l.numHyperPlanes),
-		getSpaceDimKey(l.indexName):       encodeUInt32(l.spaceDim),
+// flipBits calls fn with every sketch obtained by flipping exactly radius bits of sk at positions from onwards.
+func flipBits(sk []byte, from, radius int, fn func(sk string) error) error {
+	if radius == 0 {
+		return fn(string(sk))
 	}
 
-	for i, hash := range l.hashes {
-		hyperplanes, err := encodeFloat64Slice2D(hash.Hyperplanes)
+	for i := from; i <= len(sk)-radius; i++ {
+		sk[i] = flipBit(sk[i])
+		err := flipBits(sk, i+1, radius-1, fn)
+		sk[i] = flipBit(sk[i])
+
 		if err != nil {
 			return err
 		}
-		data[getHyperPlanesKey(l.indexName, i)] = hyperplanes
-	}
-
-	if err := l.kv.Add(data); err != nil {
-		return err
 	}
 
 	return nil
 }
 
-func (l *LSH) getStoredConfig() error {
-	numRoundsKey := getNumRoundsKey(l.indexName)
-	encodedNumRounds, err := l.kv.Get(numRoundsKey)
-	if err != nil {
-		return err
+func flipBit(bit byte) byte {
+	if bit == simhash.POSITIVE_SIDE[0] {
+		return simhash.NEGATIVE_SIDE[0]
 	}
 
-	numHyperPlanesKey := getNumHyperPlanesKey(l.indexName)
-	encodedNumHyperPlanes, err := l.kv.Get(numHyperPlanesKey)
-	if err != nil {
-		return err
-	}
+	return simhash.POSITIVE_SIDE[0]
+}
 
-	spaceDimKey := getSpaceDimKey(l.indexName)
-	encodedSpaceDim, err := l.kv.Get(spaceDimKey)
-	if err != nil {
-		return err
+// orderRounds returns the rounds' indexes in the order their buckets should be read.
+func (l *LSH) orderRounds(tx storage.ReadTx, sks []string) ([]int, error) {
+	rounds := make([]int, len(sks))
+	for i := range rounds {
+		rounds[i] = i
 	}
 
-	l.numHyperPlanes = binary.LittleEndian.Uint32(encodedNumHyperPlanes)
-	l.numRounds = binary.LittleEndian.Uint32(encodedNumRounds)
-	l.spaceDim = binary.LittleEndian.Uint32(encodedSpaceDim)
-
-	l.hashes = make([]simhash.SimHash, l.numRounds)
+	if l.roundOrder != SelectiveFirst {
+		return rounds, nil
+	}
 
-	for i := 0; i < int(l.numRounds); i++ {
-		encodedHyperPlanes, err := l.kv.Get(getHyperPlanesKey(l.indexName, i))
-		if err != nil {
-			return err
+	sizes := make([]int, len(sks))
+	for i, sk := range sks {
+		if !l.mayHaveBucket(sk) {
+			continue
 		}
 
-		hyperPlanes, err := decodeFloat64Slice2D(encodedHyperPlanes, l.spaceDim)
+		size, err := tx.CountWithPrefix(getBucketPrefixKey(l.keyPrefix, l.indexName, sk))
 		if err != nil {
-			return err
+			logErr(l.logger, err, "orderRounds")
+			return nil, err
 		}
 
-		l.hashes[i].Hyperplanes = hyperPlanes
+		sizes[i] = size
 	}
 
-	return nil
+	sort.SliceStable(rounds, func(i, j int) bool {
+		return sizes[rounds[i]] < sizes[rounds[j]]
+	})
+
+	return rounds, nil
 }
 
-func (l *LSH) Add(id string, embedding []float64) error {
-	embedData, err := l.prepareEmbedding(id, embedding)
-	if err != nil {
-		logErr(err, "Add")
-		return err
-	}
+func reachedMaxCandidates(numCandidates int, maxCandidates uint32) bool {
+	return maxCandidates != 0 && uint32(numCandidates) >= maxCandidates
+}
 
-	sks, err := l.getSketches(embedding)
-	if err != nil {
-		logErr(err, "Add")
-		return err
+func (l *LSH) getBucketIDs(tx storage.ReadTx, sk string) ([]string, error) {
+	if !l.mayHaveBucket(sk) {
+		return nil, nil
 	}
 
-	sksData, err := l.prepareSketches(id, sks)
+	// IDs are converted as they are read, rather than after collecting every value.
+	var ids []string
+
+	err := tx.GetWithPrefixFunc(getBucketPrefixKey(l.keyPrefix, l.indexName, sk), func(encodedID []byte) error {
+		ids = append(ids, string(encodedID))
+		return nil
+	})
 	if err != nil {
-		logErr(err, "Add")
-		return err
+		logErr(l.logger, err, "getBucketIDs")
+		return nil, err
 	}
 
-	data := make(map[string][]byte, len(embedData)+len(sksData))
-	maps.Copy(data, embedData)
-	maps.Copy(data, sksData)
+	return ids, nil
+}
 
-	if err = l.kv.Add(data); err != nil {
-		logErr(err, "Add")
-		return err
-	}
+// isCorrupt tells whether err comes from a stored value that can't be decoded or has the wrong dimension.
+func isCorrupt(err error) bool {
+	var (
+		encodingErr *corruptEncodingError
+		varintErr   *corruptVarintError
+		lenErr      *embeddingLenError
+	)
 
-	return nil
+	return errors.As(err, &encodingErr) || errors.As(err, &varintErr) || errors.As(err, &lenErr)
 }
 
-func (l *LSH) Get(queryVec []float64, threshold float64, k uint32) (neighbors []string, err error) {
-	if err := l.checkGetParams(queryVec, threshold); err != nil {
-		logErr(err, "Get")
-		return nil, err
+// getEmbedding reads an embedding from the cache, or from tx. Only the ones read through a snapshotTx are cached,
+// as there is no telling how old other transactions are.
+func (l *LSH) getEmbedding(tx storage.ReadTx, id string) ([]float64, error) {
+	if embed, ok := l.embeddingCache.get(id); ok {
+		return embed, nil
 	}
 
-	sks, err := l.getSketches(queryVec)
-	if err != nil {
-		logErr(err, "Get")
+	encodedEmbed, err := tx.Get(getEmbeddingKey(l.keyPrefix, l.indexName, id))
+	if errors.Is(err, storage.ErrNotFound) {
 		return nil, err
 	}
 
-	candidates, err := l.getEmbeddingsFromBuckets(sks)
 	if err != nil {
-		logErr(err, "Get")
+		logErr(l.logger, err, "getEmbedding")
 		return nil, err
 	}
 
-	neighbors, err = l.sem.Search(queryVec, candidates, threshold, k)
+	embed, err := l.decodeEmbedding(encodedEmbed)
 	if err != nil {
-		logErr(err, "Get")
+		logErr(l.logger, err, "getEmbedding")
 		return nil, err
 	}
 
-	return neighbors, nil
+	if snapshot, ok := tx.(*snapshotTx); ok {
+		l.embeddingCache.add(id, embed, snapshot.cacheGen)
+	}
+
+	return embed, nil
 }
 
-func (l *LSH) checkGetParams(queryVec []float64, threshold float64) error {
-	if err := l.checkEmbedding(queryVec); err != nil {
-		logErr(err, "checkGetParams")
-		return err
+func (l *LSH) getNorm(tx storage.ReadTx, id string) (float64, error) {
+	encodedNorm, err := tx.Get(getNormKey(l.keyPrefix, l.indexName, id))
+	if err != nil {
+		return 0, err
 	}
 
-	if err := l.checkThreshold(threshold); err != nil {
-		logErr(err, "checkGetParams")
-		return err
+	norm, err := decodeFloat64Slice(encodedNorm)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
-}
-
-func (l *LSH) Info() map[string]any {
-	return map[string]any{
-		"numRounds":      l.numRounds,
-		"numHyperPlanes": l.numHyperPlanes,
-		"spaceDim":       l.spaceDim,
+	if len(norm) != 1 {
+		return 0, &corruptEncodingError{len(encodedNorm), 8}
 	}
+
+	return norm[0], nil
 }
 
-func (l *LSH) getEmbeddingsFromBuckets(sks []string) (map[string][]float64, error) {
-	var (
-		ids   []string
-		err   error
-		ok    bool
-		embed []float64
-	)
+func (l *LSH) prepareEmbedding(id string, embedding []float64) (data map[string][]byte, err error) {
+	if err = l.checkEmbedding(embedding); err != nil {
+		logErr(l.logger, err, "prepareEmbedding")
+		return nil, err
+	}
 
-	data := make(map[string][]float64)
+	encodedEmbed, err := l.encodeEmbedding(embedding)
+	if err != nil {
+		logErr(l.logger, err, "prepareEmbedding")
+		return nil, err
+	}
 
-	for _, sk := range sks {
-		ids, err = l.getBucketIDs(sk)
+	if l.precomputeNorms {
+		data, err = l.prepareNorm(id, embedding, encodedEmbed)
 		if err != nil {
-			logErr(err, "getEmbeddingsFromBuckets")
+			logErr(l.logger, err, "prepareEmbedding")
 			return nil, err
 		}
-
-		for _, id := range ids {
-			if _, ok = data[id]; !ok {
-				embed, err = l.getEmbedding(id)
-				if err != nil {
-					logErr(err, "getEmbeddingsFromBuckets")
-					return nil, err
-				}
-				data[id] = embed
-			}
-		}
+	} else {
+		data = make(map[string][]byte, 1)
 	}
 
+	data[getEmbeddingKey(l.keyPrefix, l.indexName, id)] = encodedEmbed
+
 	return data, nil
 }
 
-func (l *LSH) getBucketIDs(sk string) ([]string, error) {
-	encodedIDs, err := l.kv.GetWithPrefix(getSketchPrefixKey(l.indexName, sk))
-	if err != nil {
-		logErr(err, "getBucketIDs")
-		return nil, err
-	}
-
-	ids := make([]string, len(encodedIDs))
-
-	for i, encodedID := range encodedIDs {
-		ids[i] = string(encodedID)
+// prepareNorm returns the data storing the norm of an embedding, given with its encoding.
+func (l *LSH) prepareNorm(id string, embedding []float64, encodedEmbed []byte) (data map[string][]byte, err error) {
+	// The norm must be the one of the embedding read back, which Float32Codec rounds.
+	if l.codec == Float32Codec {
+		if embedding, err = l.decodeEmbedding(encodedEmbed); err != nil {
+			return nil, err
+		}
 	}
 
-	return ids, nil
-}
-
-func (l *LSH) getEmbedding(id string) ([]float64, error) {
-	encodedEmbed, err := l.kv.Get(getEmbeddingKey(l.indexName, id))
+	norm, err := semantic.EuclideanNorm(embedding)
 	if err != nil {
-		logErr(err, "getEmbedding")
 		return nil, err
 	}
 
-	embed, err := decodeFloat64Slice(encodedEmbed)
+	encodedNorm, err := encodeFloat64Slice([]float64{norm})
 	if err != nil {
-		logErr(err, "getEmbedding")
 		return nil, err
 	}
 
-	return embed, nil
+	return map[string][]byte{getNormKey(l.keyPrefix, l.indexName, id): encodedNorm}, nil
 }
 
-func (l *LSH) prepareEmbedding(id string, embedding []float64) (data map[string][]byte, err error) {
-	if err = l.checkEmbedding(embedding); err != nil {
-		logErr(err, "prepareEmbedding")
-		return nil, err
-	}
-
-	encodedEmbed, err := encodeFloat64Slice(embedding)
-	if err != nil {
-		logErr(err, "prepareEmbedding")
-		return nil, err
-	}
-
-	data = make(map[string][]byte, 1)
-	data[getEmbeddingKey(l.indexName, id)] = encodedEmbed
-
-	return data, nil
+// usesNorms tells whether Get reads the stored norms of candidates.
+func (l *LSH) usesNorms() bool {
+	return l.precomputeNorms && l.metric == semantic.Cosine
 }
 
 func (l *LSH) prepareSketches(id string, sks []string) (data map[string][]byte, err error) {
 	if len(id) == 0 {
 		err = &invalidIDLenError{len(id)}
-		logErr(err, "prepareSketches")
+		logErr(l.logger, err, "prepareSketches")
 		return nil, err
 	}
 
 	if err = l.checkSketches(sks); err != nil {
-		logErr(err, "prepareSketches")
+		logErr(l.logger, err, "prepareSketches")
 		return nil, err
 	}
 
 	data = make(map[string][]byte, len(sks))
 
 	for _, sk := range sks {
-		data[getSketchKey(l.indexName, sk, id)] = []byte(id)
+		data[getSketchKey(l.keyPrefix, l.indexName, sk, id)] = []byte(id)
 	}
 
 	return data, nil
@@ -341,17 +3806,65 @@ func (l *LSH) checkEmbedding(embedding []float64) error {
 
 	if l.spaceDim != lenEmbedding {
 		err := &embeddingLenError{l.spaceDim, lenEmbedding}
-		logErr(err, "checkEmbedding")
+		logErr(l.logger, err, "checkEmbedding")
 		return err
 	}
 
 	return nil
 }
 
+// checkThreshold accepts similarities between 0 and 1 for cosine, non-negative distances for Euclidean,
+// non-positive negated distances for L1, and any threshold for dot products, which are unbounded.
 func (l *LSH) checkThreshold(threshold float64) error {
-	if threshold < 0 || threshold > 1 {
-		err := &invalidThresholdError{threshold}
-		logErr(err, "checkThreshold")
+	var err error
+
+	switch l.metric {
+	case semantic.Euclidean:
+		if threshold < 0 {
+			err = &invalidDistanceThresholdError{threshold}
+		}
+	case semantic.L1:
+		if threshold > 0 {
+			err = &invalidL1ThresholdError{threshold}
+		}
+	case semantic.DotProduct:
+	default:
+		if threshold < 0 || threshold > 1 {
+			err = &invalidThresholdError{threshold}
+		}
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "checkThreshold")
+		return err
+	}
+
+	return nil
+}
+
+func (l *LSH) checkEmbeddingsStored() error {
+	if !l.storeEmbeddings {
+		err := &embeddingsNotStoredError{l.indexName}
+		logErr(l.logger, err, "checkEmbeddingsStored")
+		return err
+	}
+
+	return nil
+}
+
+// checkNotDropped must be called holding mu.
+func (l *LSH) checkNotDropped() error {
+	if l.dropped {
+		return &indexDroppedError{l.indexName}
+	}
+
+	return nil
+}
+
+func (l *LSH) checkPercentile(percentile float64) error {
+	if percentile < 0 || percentile > 100 {
+		err := &invalidPercentileError{percentile}
+		logErr(l.logger, err, "checkPercentile")
 		return err
 	}
 
@@ -367,7 +3880,7 @@ func (l *LSH) checkSketches(sks []string) error {
 
 	if l.numRounds != lenSks {
 		err = &invalidNumSketchesError{l.numRounds, lenSks}
-		logErr(err, "checkSketches")
+		logErr(l.logger, err, "checkSketches")
 		return err
 	}
 
@@ -375,7 +3888,7 @@ func (l *LSH) checkSketches(sks []string) error {
 		lenSk = uint32(len(sk))
 		if l.numHyperPlanes != lenSk {
 			err = &invalidSketchLenError{l.numHyperPlanes, lenSk}
-			logErr(err, "checkSketches")
+			logErr(l.logger, err, "checkSketches")
 			return err
 		}
 	}
@@ -390,13 +3903,31 @@ func encodeUInt32(val uint32) []byte {
 	return data
 }
 
+func encodeUInt64(val uint64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, val)
+
+	return data
+}
+
+func encodeBool(val bool) []byte {
+	if val {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+func decodeBool(data []byte) bool {
+	return len(data) == 1 && data[0] == 1
+}
+
 func encodeFloat64Slice(slice []float64) ([]byte, error) {
 	var err error
 	buf := new(bytes.Buffer)
 
 	for _, val := range slice {
 		if err = binary.Write(buf, binary.LittleEndian, val); err != nil {
-			logErr(err, "encodeFloat64Slice")
 			return nil, err
 		}
 	}
@@ -404,6 +3935,90 @@ func encodeFloat64Slice(slice []float64) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// encodeEmbedding encodes an embedding with the index's codec.
+func (l *LSH) encodeEmbedding(embedding []float64) ([]byte, error) {
+	switch l.codec {
+	case DeltaVarintCodec:
+		return encodeDeltaVarint(embedding), nil
+	case Float32Codec:
+		return encodeFloat32Slice(embedding), nil
+	}
+
+	return encodeFloat64Slice(embedding)
+}
+
+// decodeEmbedding decodes an embedding encoded with the index's codec.
+func (l *LSH) decodeEmbedding(data []byte) ([]float64, error) {
+	switch l.codec {
+	case DeltaVarintCodec:
+		return decodeDeltaVarint(data)
+	case Float32Codec:
+		return decodeFloat32Slice(data)
+	}
+
+	return decodeFloat64Slice(data)
+}
+
+// encodeFloat32Slice encodes every value as a float32, rounding it to float32 precision.
+func encodeFloat32Slice(slice []float64) []byte {
+	data := make([]byte, 0, len(slice)*FLOAT32_SIZE)
+	for _, val := range slice {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(val)))
+	}
+
+	return data
+}
+
+func decodeFloat32Slice(data []byte) ([]float64, error) {
+	if len(data)%FLOAT32_SIZE != 0 {
+		err := &corruptEncodingError{len(data), FLOAT32_SIZE}
+		return nil, err
+	}
+
+	result := make([]float64, len(data)/FLOAT32_SIZE)
+	for i := range result {
+		result[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[i*FLOAT32_SIZE:])))
+	}
+
+	return result, nil
+}
+
+// encodeDeltaVarint encodes every value as the zigzag varint of the difference between its bits and the previous value's.
+func encodeDeltaVarint(slice []float64) []byte {
+	var prev int64
+
+	data := make([]byte, 0, len(slice)*binary.MaxVarintLen64)
+
+	for _, val := range slice {
+		bits := int64(math.Float64bits(val))
+		data = binary.AppendVarint(data, bits-prev)
+		prev = bits
+	}
+
+	return data
+}
+
+func decodeDeltaVarint(data []byte) ([]float64, error) {
+	var (
+		result []float64
+		prev   int64
+	)
+
+	for offset := 0; offset < len(data); {
+		delta, n := binary.Varint(data[offset:])
+		if n <= 0 {
+			err := &corruptVarintError{offset}
+			return nil, err
+		}
+		offset += n
+
+		prev += delta
+		result = append(result, math.Float64frombits(uint64(prev)))
+	}
+
+	return result, nil
+}
+
 func encodeFloat64Slice2D(slice [][]float64) ([]byte, error) {
 	var err error
 	buf := new(bytes.Buffer)
@@ -411,7 +4026,6 @@ func encodeFloat64Slice2D(slice [][]float64) ([]byte, error) {
 	for _, row := range slice {
 		for _, val := range row {
 			if err = binary.Write(buf, binary.LittleEndian, val); err != nil {
-				logErr(err, "encodeFloat64Slice2D")
 				return nil, err
 			}
 		}
@@ -426,11 +4040,15 @@ func decodeFloat64Slice(data []byte) ([]float64, error) {
 		val    float64
 	)
 
+	if len(data)%FLOAT64_SIZE != 0 {
+		err := &corruptEncodingError{len(data), FLOAT64_SIZE}
+		return nil, err
+	}
+
 	buf := bytes.NewReader(data)
 
 	for buf.Len() > 0 {
 		if err := binary.Read(buf, binary.LittleEndian, &val); err != nil {
-			logErr(err, "decodeFloat64Slice")
 			return nil, err
 		}
 		result = append(result, val)
@@ -443,15 +4061,21 @@ func decodeFloat64Slice2D(data []byte, numCols uint32) ([][]float64, error) {
 	var (
 		result [][]float64
 		val    float64
+		rowLen = int(numCols) * FLOAT64_SIZE
 	)
 
+	// Without columns, only empty data is consistent (and rows would never consume it).
+	if (rowLen == 0 && len(data) != 0) || (rowLen != 0 && len(data)%rowLen != 0) {
+		err := &corruptEncodingError{len(data), rowLen}
+		return nil, err
+	}
+
 	buf := bytes.NewReader(data)
 
 	for buf.Len() > 0 {
 		var row []float64
 		for i := uint32(0); i < numCols; i++ {
 			if err := binary.Read(buf, binary.LittleEndian, &val); err != nil {
-				logErr(err, "decodeFloat64Slice2D")
 				return nil, err
 			}
 			row = append(row, val)
@@ -462,18 +4086,35 @@ func decodeFloat64Slice2D(data []byte, numCols uint32) ([][]float64, error) {
 	return result, nil
 }
 
+// getSketches returns the sketch of every round, in round order. Large configs sketch rounds in parallel,
+// given several CPUs.
 func (l *LSH) getSketches(embedding []float64) ([]string, error) {
 	var (
-		sk  string
-		err error
+		sketches []string
+		err      error
 	)
 
+	work := len(l.hashes) * int(l.numHyperPlanes) * len(embedding)
+	if len(l.hashes) > 1 && runtime.NumCPU() > 1 && work >= PARALLEL_SKETCH_MIN_WORK {
+		sketches, err = l.getSketchesParallel(embedding)
+	} else {
+		sketches, err = l.getSketchesSequential(embedding)
+	}
+
+	if err != nil {
+		logErr(l.logger, err, "getSketches")
+		return nil, err
+	}
+
+	return sketches, nil
+}
+
+func (l *LSH) getSketchesSequential(embedding []float64) ([]string, error) {
 	sketches := make([]string, len(l.hashes))
 
 	for i, hash := range l.hashes {
-		sk, err = hash.Sketch(embedding)
+		sk, err := hash.Sketch(embedding)
 		if err != nil {
-			logErr(err, "getSketches")
 			return nil, err
 		}
 
@@ -483,6 +4124,75 @@ func (l *LSH) getSketches(embedding []float64) ([]string, error) {
 	return sketches, nil
 }
 
+// getSketchesParallel is like getSketchesSequential, spreading rounds over up to one worker per CPU.
+// Worker w sketches rounds w, w+numWorkers, and so on, into their own slots, so that order is kept.
+func (l *LSH) getSketchesParallel(embedding []float64) ([]string, error) {
+	var (
+		wg         sync.WaitGroup
+		numWorkers = min(runtime.NumCPU(), len(l.hashes))
+		sketches   = make([]string, len(l.hashes))
+		errs       = make([]error, numWorkers)
+	)
+
+	wg.Add(numWorkers)
+
+	for w := 0; w < numWorkers; w++ {
+		go func(w int) {
+			defer wg.Done()
+
+			for i := w; i < len(l.hashes); i += numWorkers {
+				sk, err := l.hashes[i].Sketch(embedding)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+
+				sketches[i] = sk
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sketches, nil
+}
+
+// validateHyperParams reports the first hyperparameter below its minimum, which setHyperParams would clamp.
+func validateHyperParams(numRounds, numHyperplanes, spaceDim uint32) error {
+	if numRounds < MIN_NUM_ROUNDS {
+		return &hyperParamTooSmallError{"numRounds", MIN_NUM_ROUNDS, numRounds}
+	}
+
+	if numHyperplanes < MIN_NUM_HYPERPLANES {
+		return &hyperParamTooSmallError{"numHyperPlanes", MIN_NUM_HYPERPLANES, numHyperplanes}
+	}
+
+	if spaceDim < MIN_SPACE_DIM {
+		return &hyperParamTooSmallError{"spaceDim", MIN_SPACE_DIM, spaceDim}
+	}
+
+	return nil
+}
+
+// validateMaxHyperParams reports the first hyperparameter above its maximum. Unlike minimums, maximums are never clamped.
+func validateMaxHyperParams(numRounds, numHyperplanes uint32) error {
+	if numRounds > MAX_NUM_ROUNDS {
+		return &hyperParamTooLargeError{"numRounds", MAX_NUM_ROUNDS, numRounds}
+	}
+
+	if numHyperplanes > MAX_NUM_HYPERPLANES {
+		return &hyperParamTooLargeError{"numHyperPlanes", MAX_NUM_HYPERPLANES, numHyperplanes}
+	}
+
+	return nil
+}
+
 func (l *LSH) setHyperParams(numRounds, numHyperplanes, spaceDim uint32) {
 	if numRounds < MIN_NUM_ROUNDS {
 		numRounds = MIN_NUM_ROUNDS
@@ -501,8 +4211,13 @@ func (l *LSH) setHyperParams(numRounds, numHyperplanes, spaceDim uint32) {
 	l.spaceDim = spaceDim
 }
 
-func logErr(err error, trace string) {
-	slog.LogAttrs(
+// logErr logs err with logger, or with the default logger when it is nil.
+func logErr(logger *slog.Logger, err error, trace string) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.LogAttrs(
 		context.TODO(),
 		slog.LevelError,
 		err.Error(),
@@ -1,12 +1,23 @@
 package lsh
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"math/rand"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mastrasec/vectoria/internal/semantic"
 	"github.com/mastrasec/vectoria/internal/simhash"
 	"github.com/mastrasec/vectoria/internal/storage"
 
@@ -93,6 +104,7 @@ func TestNew(t *testing.T) {
 			func(t *testing.T) {
 				kv, err := storage.New("")
 				assert.NoError(t, err)
+				defer kv.CloseDB()
 
 				l, err := New("fake-index-name", kv, tc.numRounds, tc.numHyperPlanes, tc.spaceDim)
 				assert.NoError(t, err)
@@ -142,6 +154,36 @@ func TestNew_Persistence(t *testing.T) {
 	}
 }
 
+func TestNew_HyperPlanesChecksum(t *testing.T) {
+	var (
+		path      string = t.TempDir()
+		indexName string = "fake-index"
+	)
+
+	kv, err := storage.New(path)
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New(indexName, kv, 2, 3, 4)
+	assert.NoError(t, err)
+
+	// Untouched hyperplanes reload fine.
+	_, err = New(indexName, kv, 0, 0, 0)
+	assert.NoError(t, err)
+
+	tampered := l.hashes[1].Hyperplanes
+	tampered[0][0] += 1
+
+	encoded, err := encodeFloat64Slice2D(tampered)
+	assert.NoError(t, err)
+
+	err = kv.Add(map[string][]byte{getHyperPlanesKey("", indexName, 1): encoded})
+	assert.NoError(t, err)
+
+	_, err = New(indexName, kv, 0, 0, 0)
+	assert.IsType(t, &hyperplaneChecksumError{}, err)
+}
+
 func TestGetStoredConfig(t *testing.T) {
 	var (
 		indexName      string = "fake-index"
@@ -226,6 +268,225 @@ func TestAdd(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAddBatch(t *testing.T) {
+	l := setup(t, Opts{numRounds: 3, numHyperPlanes: 4, spaceDim: 2})
+
+	items := []Item{
+		{ID: "b", Embedding: []float64{1.5, -2}},
+		{ID: "a", Embedding: []float64{0.3, 4}},
+	}
+
+	err := l.AddBatch(items)
+	assert.NoError(t, err)
+
+	got := make(map[string][]float64)
+	var ids []string
+
+	err = l.Embeddings(func(id string, embedding []float64) error {
+		ids = append(ids, id)
+		got[id] = embedding
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	for _, item := range items {
+		assert.Equal(t, item.Embedding, got[item.ID])
+	}
+
+	// Nothing is written when a single item is invalid.
+	err = l.AddBatch([]Item{{ID: "c", Embedding: []float64{1, 2}}, {ID: "d", Embedding: []float64{1}}})
+	assert.IsType(t, &embeddingLenError{}, err)
+
+	exists, err := l.kv.KeyExists(getEmbeddingKey(l.keyPrefix, l.indexName, "c"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestAddBatchIfAbsent(t *testing.T) {
+	for _, storeEmbeddings := range []bool{true, false} {
+		t.Run(fmt.Sprintf("storeEmbeddings=%v", storeEmbeddings), func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 2, 2, 2, WithStoreEmbeddings(storeEmbeddings))
+			assert.NoError(t, err)
+
+			err = l.Add("a", []float64{1, 2})
+			assert.NoError(t, err)
+
+			items := []Item{
+				{ID: "a", Embedding: []float64{9, 9}},
+				{ID: "b", Embedding: []float64{3, 4}},
+				{ID: "b", Embedding: []float64{5, 6}},
+			}
+
+			inserted, err := l.AddBatchIfAbsent(items)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, inserted)
+
+			inserted, err = l.AddBatchIfAbsent(items)
+			assert.NoError(t, err)
+			assert.Zero(t, inserted)
+
+			if storeEmbeddings {
+				// Existing items and later duplicates are left untouched.
+				encoded, err := kv.Get(getEmbeddingKey("", "fake-index-name", "a"))
+				assert.NoError(t, err)
+				assert.Equal(t, mustEncode(t, []float64{1, 2}), encoded)
+
+				encoded, err = kv.Get(getEmbeddingKey("", "fake-index-name", "b"))
+				assert.NoError(t, err)
+				assert.Equal(t, mustEncode(t, []float64{3, 4}), encoded)
+			}
+		})
+	}
+}
+
+func TestAdd_WithoutEmbeddings(t *testing.T) {
+	var (
+		path      string = t.TempDir()
+		indexName string = "fake-index"
+	)
+
+	kv, err := storage.New(path)
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New(indexName, kv, 2, 3, 2, WithStoreEmbeddings(false))
+	assert.NoError(t, err)
+
+	embedding := []float64{1.31, 4.6}
+
+	err = l.Add("id", embedding)
+	assert.NoError(t, err)
+
+	count, err := kv.CountWithPrefix(getEmbeddingPrefixKey(l.keyPrefix, indexName))
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	sks, err := l.getSketches(embedding)
+	assert.NoError(t, err)
+
+	for _, sk := range sks {
+		ids, err := l.getBucketIDs(l.kv, sk)
+		assert.NoError(t, err)
+		assert.Contains(t, ids, "id")
+	}
+
+	// The setting is persisted, regardless of the options given on reload.
+	l2, err := New(indexName, kv, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.False(t, l2.storeEmbeddings)
+
+	got, err := l2.Get(embedding, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id"}, got)
+
+	_, err = l2.GetPercentile(embedding, 50)
+	assert.IsType(t, &embeddingsNotStoredError{}, err)
+}
+
+func TestDrift(t *testing.T) {
+	var (
+		start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock = start
+	)
+
+	l := setup(t, Opts{spaceDim: 2})
+	l.now = func() time.Time { return clock }
+
+	// Legacy items have no timestamp and are ignored.
+	err := l.kv.Add(map[string][]byte{getEmbeddingKey(l.keyPrefix, l.indexName, "legacy"): mustEncode(t, []float64{-1, -1})})
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{{ID: "a1", Embedding: []float64{1, 0}}, {ID: "a2", Embedding: []float64{1, 0.2}}})
+	assert.NoError(t, err)
+
+	clock = start.Add(time.Hour)
+
+	err = l.AddBatch([]Item{{ID: "b1", Embedding: []float64{0, 1}}, {ID: "b2", Embedding: []float64{0.2, 1}}, {ID: "b3", Embedding: []float64{0, 1}}})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		since   time.Time
+		want    Drift
+		wantSim float64
+		err     error
+	}{
+		{
+			name:    "between clusters",
+			since:   start.Add(time.Minute),
+			want:    Drift{NumBefore: 2, NumAfter: 3},
+			wantSim: 0.2,
+		},
+		{
+			name:  "nothing before",
+			since: start,
+			err:   &emptyDriftWindowError{},
+		},
+		{
+			name:  "nothing after",
+			since: start.Add(2 * time.Hour),
+			err:   &emptyDriftWindowError{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := l.Drift(context.Background(), tc.since)
+			assert.IsType(t, tc.err, err)
+
+			if tc.err == nil {
+				assert.Equal(t, tc.want.NumBefore, got.NumBefore)
+				assert.Equal(t, tc.want.NumAfter, got.NumAfter)
+				assert.InDelta(t, tc.wantSim, got.CentroidSimilarity, 0.05)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	l := setup(t, Opts{})
+
+	items := make([]Item, 50)
+	for i := range items {
+		items[i] = Item{ID: fmt.Sprintf("%02d", i), Embedding: []float64{float64(i), 1}}
+	}
+
+	err := l.AddBatch(items)
+	assert.NoError(t, err)
+
+	// Every item should eventually be picked, otherwise the reservoir is biased.
+	picked := make(map[string]bool)
+	for seed := int64(0); seed < 100; seed++ {
+		sample, err := l.Sample(5, seed)
+		assert.NoError(t, err)
+		assert.Len(t, sample, 5)
+
+		for id, embedding := range sample {
+			assert.Equal(t, items[int(embedding[0])].ID, id)
+			picked[id] = true
+		}
+	}
+
+	assert.Len(t, picked, len(items))
+
+	// A sample size far above the item count isn't preallocated.
+	sample, err := l.Sample(math.MaxInt, 0)
+	assert.NoError(t, err)
+	assert.Len(t, sample, len(items))
+}
+
+func mustEncode(t *testing.T, embedding []float64) []byte {
+	data, err := encodeFloat64Slice(embedding)
+	assert.NoError(t, err)
+
+	return data
+}
+
 func TestPrepareEmbedding(t *testing.T) {
 	tc := struct {
 		id        string
@@ -236,7 +497,7 @@ func TestPrepareEmbedding(t *testing.T) {
 	data, err := l.prepareEmbedding(tc.id, tc.embedding)
 	assert.NoError(t, err)
 
-	k := getEmbeddingKey(l.indexName, tc.id)
+	k := getEmbeddingKey(l.keyPrefix, l.indexName, tc.id)
 	gotEncoded, ok := data[k]
 	if !ok {
 		t.Errorf("expected key to exist: %v", k)
@@ -282,7 +543,7 @@ func TestPrepareSketches(t *testing.T) {
 				assert.NotNil(t, data)
 
 				for _, sk := range tc.sks {
-					k := getSketchKey(l.indexName, sk, tc.id)
+					k := getSketchKey(l.keyPrefix, l.indexName, sk, tc.id)
 					got, ok := data[k]
 					if !ok {
 						t.Errorf("expected key to exist: %v", k)
@@ -423,6 +684,104 @@ func TestEncodeFloat64Slice(t *testing.T) {
 	}
 }
 
+func TestEmbeddingCodec(t *testing.T) {
+	testCases := []struct {
+		name      string
+		embedding []float64
+	}{
+		{"empty", []float64{}},
+		{"zeros", []float64{0, 0, 0, 0}},
+		{"negatives", []float64{-1.5, -0.25, -1e-300, -math.MaxFloat64}},
+		{"mixed_signs", []float64{math.Copysign(0, -1), 1, -1, math.SmallestNonzeroFloat64, math.Inf(1), math.Inf(-1)}},
+		{"nan", []float64{math.NaN(), 2.5}},
+	}
+
+	for _, codec := range []EmbeddingCodec{RawCodec, DeltaVarintCodec} {
+		l := &LSH{codec: codec}
+
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("codec=%d/%s", codec, tc.name), func(t *testing.T) {
+				data, err := l.encodeEmbedding(tc.embedding)
+				assert.NoError(t, err)
+
+				got, err := l.decodeEmbedding(data)
+				assert.NoError(t, err)
+				assert.Len(t, got, len(tc.embedding))
+
+				// Bits, so that -0 and NaN are compared exactly.
+				for i := range tc.embedding {
+					assert.Equal(t, math.Float64bits(tc.embedding[i]), math.Float64bits(got[i]))
+				}
+			})
+		}
+	}
+
+	t.Run("zeros_shrink", func(t *testing.T) {
+		data := encodeDeltaVarint(make([]float64, 100))
+		assert.Len(t, data, 100)
+	})
+
+	t.Run("truncated_varint", func(t *testing.T) {
+		data := encodeDeltaVarint([]float64{1.5, -2.25})
+
+		_, err := decodeDeltaVarint(data[:len(data)-1])
+		assert.IsType(t, &corruptVarintError{}, err)
+		assert.True(t, isCorrupt(err))
+	})
+
+	t.Run("float32", func(t *testing.T) {
+		l := &LSH{codec: Float32Codec}
+
+		data, err := l.encodeEmbedding([]float64{0.5, -2, 1.1})
+		assert.NoError(t, err)
+		assert.Len(t, data, 3*FLOAT32_SIZE)
+
+		got, err := l.decodeEmbedding(data)
+		assert.NoError(t, err)
+		assert.Equal(t, []float64{0.5, -2, float64(float32(1.1))}, got)
+
+		_, err = l.decodeEmbedding(data[:len(data)-1])
+		assert.IsType(t, &corruptEncodingError{}, err)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		kv, err := storage.New("")
+		assert.NoError(t, err)
+		defer kv.CloseDB()
+
+		l, err := New("fake-index-name", kv, 2, 2, 3, WithEmbeddingCodec(DeltaVarintCodec))
+		assert.NoError(t, err)
+
+		assert.NoError(t, l.Add("a", []float64{0, -1, 2.5}))
+
+		// The stored codec wins over the option.
+		reopened, err := New("fake-index-name", kv, 2, 2, 3, WithEmbeddingCodec(RawCodec))
+		assert.NoError(t, err)
+		assert.Equal(t, DeltaVarintCodec, reopened.codec)
+
+		embeddings := map[string][]float64{}
+		err = reopened.Embeddings(func(id string, embedding []float64) error {
+			embeddings[id] = embedding
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]float64{"a": {0, -1, 2.5}}, embeddings)
+
+		res, err := reopened.Get([]float64{0, -1, 2.5}, 1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, res)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		kv, err := storage.New("")
+		assert.NoError(t, err)
+		defer kv.CloseDB()
+
+		_, err = New("fake-index-name", kv, 2, 2, 3, WithEmbeddingCodec(Float32Codec+1))
+		assert.IsType(t, &unknownCodecError{}, err)
+	})
+}
+
 func TestEncodeFloat64Slice2D(t *testing.T) {
 	testCases := []struct {
 		name    string
@@ -455,6 +814,88 @@ func TestEncodeFloat64Slice2D(t *testing.T) {
 	}
 }
 
+func TestDecodeFloat64Slice_Corrupt(t *testing.T) {
+	data, err := encodeFloat64Slice([]float64{1.5, -2.25})
+	assert.NoError(t, err)
+
+	_, err = decodeFloat64Slice(data[:len(data)-3])
+	assert.IsType(t, &corruptEncodingError{}, err)
+}
+
+func TestDecodeFloat64Slice2D_Corrupt(t *testing.T) {
+	data, err := encodeFloat64Slice2D([][]float64{{1.5, -2.25}, {3, 4}})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		numCols uint32
+	}{
+		{"truncated value", data[:len(data)-3], 2},
+		{"truncated row", data[:len(data)-8], 2},
+		{"wrong number of columns", data, 3},
+		{"no columns", data, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeFloat64Slice2D(tc.data, tc.numCols)
+			assert.IsType(t, &corruptEncodingError{}, err)
+		})
+	}
+}
+
+func FuzzDecodeFloat64Slice(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0xf8})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		got, err := decodeFloat64Slice(data)
+		if err != nil {
+			assert.IsType(t, &corruptEncodingError{}, err)
+			return
+		}
+
+		assert.Len(t, got, len(data)/FLOAT64_SIZE)
+
+		encoded, err := encodeFloat64Slice(got)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), len(encoded))
+
+		if len(data) != 0 {
+			assert.Equal(t, data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeFloat64Slice2D(f *testing.F) {
+	f.Add([]byte{}, uint32(0))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, uint32(1))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, uint32(0))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0, 0, 0, 0, 0, 0, 0xf8}, uint32(1))
+
+	f.Fuzz(func(t *testing.T, data []byte, numCols uint32) {
+		got, err := decodeFloat64Slice2D(data, numCols)
+		if err != nil {
+			assert.IsType(t, &corruptEncodingError{}, err)
+			return
+		}
+
+		for _, row := range got {
+			assert.Len(t, row, int(numCols))
+		}
+
+		encoded, err := encodeFloat64Slice2D(got)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), len(encoded))
+
+		if len(data) != 0 {
+			assert.Equal(t, data, encoded)
+		}
+	})
+}
+
 func TestGetNeighbors_HappyPath(t *testing.T) {
 	var (
 		spaceDim       uint32 = 3
@@ -609,6 +1050,9 @@ func TestGetNeighbors_HappyPath(t *testing.T) {
 						// False positives should not be returned since we remove them by measuring similarity directly.
 						assert.Contains(t, tc.wantIDs, id)
 					}
+
+					// Close now rather than on cleanup, so that the runs don't pile up open in-memory storages.
+					l.kv.CloseDB()
 				}
 
 				for id, count := range countMap {
@@ -688,192 +1132,2348 @@ func TestGetNeighbors_Errors(t *testing.T) {
 	}
 }
 
-func TestGetBucketIDs(t *testing.T) {
-	tc := struct {
-		id        string
-		embedding []float64
-	}{uuid.NewString(), []float64{1.31, 4.6}}
+func TestGetEmbeddingsFromBuckets_RoundOrder(t *testing.T) {
+	var (
+		numSparse     int    = 3
+		numDense      int    = 50
+		maxCandidates uint32 = 3
+		queryVec             = []float64{1, 1}
+	)
 
-	l := setup(t, Opts{numHyperPlanes: 10})
+	testCases := []struct {
+		name         string
+		order        RoundOrder
+		wantNumReads int
+	}{
+		{
+			name:         "natural order reads the dense bucket",
+			order:        NaturalOrder,
+			wantNumReads: numSparse + numDense,
+		},
+		{
+			name:         "selective first reads the sparse bucket",
+			order:        SelectiveFirst,
+			wantNumReads: numSparse,
+		},
+	}
 
-	err := l.Add(tc.id, tc.embedding)
-	assert.NoError(t, err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
 
-	sks, err := l.getSketches(tc.embedding)
-	assert.NoError(t, err)
+			ckv := &countingKV{Contract: kv}
 
-	for _, sk := range sks {
-		ids, err := l.getBucketIDs(sk)
-		assert.NoError(t, err)
-		assert.Contains(t, ids, tc.id)
-	}
-}
+			l, err := New("fake-index-name", ckv, 2, 2, 2, WithRoundOrder(tc.order), WithMaxCandidates(maxCandidates))
+			assert.NoError(t, err)
 
-func TestGetEmbedding(t *testing.T) {
-	tc := struct {
-		id        string
-		embedding []float64
-	}{uuid.NewString(), []float64{1.31, 4.6}}
+			// Skewed on purpose: round 0 puts every item in the same bucket,
+			// round 1 only groups the few items with positive y.
+			l.hashes = []simhash.SimHash{
+				{Hyperplanes: [][]float64{{1, 0}, {1, 0}}},
+				{Hyperplanes: [][]float64{{0, 1}, {0, -1}}},
+			}
 
-	l := setup(t, Opts{})
+			for i := 0; i < numSparse; i++ {
+				assert.NoError(t, l.Add(uuid.NewString(), []float64{1, float64(i + 1)}))
+			}
 
-	err := l.Add(tc.id, tc.embedding)
-	assert.NoError(t, err)
+			for i := 0; i < numDense; i++ {
+				assert.NoError(t, l.Add(uuid.NewString(), []float64{1, -float64(i + 1)}))
+			}
 
-	got, err := l.getEmbedding(tc.id)
-	assert.NoError(t, err)
-	assert.ElementsMatch(t, tc.embedding, got)
-}
+			sks, err := l.getSketches(queryVec)
+			assert.NoError(t, err)
 
-func TestGetEmbeddingsFromBuckets(t *testing.T) {
-	tc := struct {
-		id        string
-		embedding []float64
-	}{uuid.NewString(), []float64{1.31, 4.6}}
+			ckv.numReads = 0
 
-	l := setup(t, Opts{})
+			got, err := l.getEmbeddingsFromBuckets(sks)
+			assert.NoError(t, err)
+			assert.Len(t, got, int(maxCandidates))
+			assert.Equal(t, tc.wantNumReads, ckv.numReads)
+		})
+	}
+}
 
-	err := l.Add(tc.id, tc.embedding)
-	assert.NoError(t, err)
+func TestOrderRounds(t *testing.T) {
+	l := setup(t, Opts{numRounds: 3, numHyperPlanes: 2})
+	l.roundOrder = SelectiveFirst
+
+	data := map[string][]byte{
+		getSketchKey(l.keyPrefix, l.indexName, "00", "a"): []byte("a"),
+		getSketchKey(l.keyPrefix, l.indexName, "00", "b"): []byte("b"),
+		getSketchKey(l.keyPrefix, l.indexName, "11", "c"): []byte("c"),
+		getSketchKey(l.keyPrefix, l.indexName, "10", "d"): []byte("d"),
+		getSketchKey(l.keyPrefix, l.indexName, "10", "e"): []byte("e"),
+		getSketchKey(l.keyPrefix, l.indexName, "10", "f"): []byte("f"),
+	}
+	assert.NoError(t, l.kv.Add(data))
 
-	sks, err := l.getSketches(tc.embedding)
+	got, err := l.orderRounds(l.kv, []string{"10", "00", "11"})
 	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 1, 0}, got)
 
-	got, err := l.getEmbeddingsFromBuckets(sks)
-	assert.NoError(t, err)
+	l.roundOrder = NaturalOrder
 
-	assert.Contains(t, got, tc.id)
-	assert.ElementsMatch(t, got[tc.id], tc.embedding)
+	got, err = l.orderRounds(l.kv, []string{"10", "00", "11"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, got)
 }
 
-func TestStoreConfig_HyperParams(t *testing.T) {
-	l := setup(t, Opts{})
+func TestGet_FallbackRadius(t *testing.T) {
+	var (
+		spaceDim uint32 = 8
+		item            = []float64{1, 1, 1, 1, 1, 1, 1, 1}
+	)
 
-	configKeys := []string{
-		getIndexKey(l.indexName),
-		getNumRoundsKey(l.indexName),
-		getNumHyperPlanesKey(l.indexName),
-		getSpaceDimKey(l.indexName),
+	// Bit i is the sign of component i, so flipping a component's sign flips a single bit.
+	hyperplanes := make([][]float64, spaceDim)
+	for i := range hyperplanes {
+		hyperplanes[i] = make([]float64, spaceDim)
+		hyperplanes[i][i] = 1
 	}
 
-	err := l.storeConfig()
-	assert.NoError(t, err)
-
-	for _, k := range configKeys {
-		exists, err := l.kv.KeyExists(k)
-		assert.NoError(t, err)
-		assert.True(t, exists)
-	}
+	testCases := []struct {
+		name     string
+		radius   uint32
+		queryVec []float64
+		want     []string
+	}{
+		{
+			name:     "exact probe misses",
+			radius:   0,
+			queryVec: []float64{1, 1, 1, 1, 1, 1, 1, -1},
+			want:     []string{},
+		},
+		{
+			name:     "fallback finds bucket one bit away",
+			radius:   1,
+			queryVec: []float64{1, 1, 1, 1, 1, 1, 1, -1},
+			want:     []string{"item"},
+		},
+		{
+			name:     "fallback finds bucket two bits away",
+			radius:   3,
+			queryVec: []float64{-1, 1, 1, 1, 1, 1, 1, -1},
+			want:     []string{"item"},
+		},
+		{
+			name:     "bucket beyond radius",
+			radius:   1,
+			queryVec: []float64{-1, 1, 1, 1, 1, 1, 1, -1},
+			want:     []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 1, spaceDim, spaceDim, WithFallbackRadius(tc.radius))
+			assert.NoError(t, err)
+
+			l.hashes = []simhash.SimHash{{Hyperplanes: hyperplanes}}
+
+			err = l.Add("item", item)
+			assert.NoError(t, err)
+
+			got, err := l.Get(tc.queryVec, 0, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
 }
 
-func TestStoreConfig_HyperPlanes(t *testing.T) {
-	l := setup(t, Opts{})
+func TestFlipBits(t *testing.T) {
+	var got []string
 
-	err := l.storeConfig()
+	err := flipBits([]byte("000"), 0, 2, func(sk string) error {
+		got = append(got, sk)
+		return nil
+	})
 	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"110", "101", "011"}, got)
+}
 
-	for i, _ := range l.hashes {
-		k := getHyperPlanesKey(l.indexName, i)
+// countingKV counts the values read from buckets, and the reads (seeks) issued for them.
+type countingKV struct {
+	storage.Contract
+	numReads int
+	numSeeks int
+}
 
-		exists, err := l.kv.KeyExists(k)
-		assert.NoError(t, err)
-		assert.True(t, exists)
-	}
+func (c *countingKV) GetWithPrefix(prefix string) ([][]byte, error) {
+	values, err := c.Contract.GetWithPrefix(prefix)
+	c.numReads += len(values)
+	c.numSeeks++
+
+	return values, err
 }
 
-type Opts struct {
-	numRounds      uint32
-	numHyperPlanes uint32
-	spaceDim       uint32
+func (c *countingKV) GetWithPrefixFunc(prefix string, fn func(val []byte) error) error {
+	c.numSeeks++
+
+	return c.Contract.GetWithPrefixFunc(prefix, func(val []byte) error {
+		c.numReads++
+		return fn(val)
+	})
 }
 
-func setup(t *testing.T, opts Opts) *LSH {
-	var (
-		l   *LSH
-		err error
-	)
+func (c *countingKV) View(fn func(tx storage.ReadTx) error) error {
+	return c.Contract.View(func(tx storage.ReadTx) error {
+		return fn(&countingTx{ReadTx: tx, kv: c})
+	})
+}
 
-	assert.NotNil(t, opts)
+// countingTx counts the values read from buckets within a snapshot into its countingKV.
+type countingTx struct {
+	storage.ReadTx
+	kv *countingKV
+}
 
-	if opts.numRounds == 0 {
-		opts.numRounds = MIN_NUM_ROUNDS
+func (c *countingTx) GetWithPrefix(prefix string) ([][]byte, error) {
+	values, err := c.ReadTx.GetWithPrefix(prefix)
+	c.kv.numReads += len(values)
+	c.kv.numSeeks++
+
+	return values, err
+}
+
+func (c *countingTx) GetWithPrefixFunc(prefix string, fn func(val []byte) error) error {
+	c.kv.numSeeks++
+
+	return c.ReadTx.GetWithPrefixFunc(prefix, func(val []byte) error {
+		c.kv.numReads++
+		return fn(val)
+	})
+}
+
+func TestGetPercentile(t *testing.T) {
+	l := setup(t, Opts{})
+
+	// A null hyperplane puts every item in the same bucket, so all of them are candidates.
+	l.hashes = []simhash.SimHash{{Hyperplanes: [][]float64{{0, 0}}}}
+
+	// Unit vectors whose similarity to the query is 0.1, 0.2, ..., 1.0.
+	for i := 1; i <= 10; i++ {
+		c := float64(i) / 10
+		err := l.Add(fmt.Sprint(i), []float64{c, math.Sqrt(1 - c*c)})
+		assert.NoError(t, err)
 	}
 
-	// TODO: Add seed or accept tolerable deviations when NumHyperPlanes > 1.
-	if opts.numHyperPlanes == 0 {
-		opts.numHyperPlanes = MIN_NUM_HYPERPLANES
+	testCases := []struct {
+		percentile float64
+		want       []string
+		err        error
+	}{
+		{0, []string{"10", "9", "8", "7", "6", "5", "4", "3", "2", "1"}, nil},
+		{80, []string{"10", "9", "8"}, nil},
+		{100, []string{"10"}, nil},
+		{-1, nil, &invalidPercentileError{}},
+		{101, nil, &invalidPercentileError{}},
 	}
 
-	if opts.spaceDim == 0 {
-		opts.spaceDim = MIN_SPACE_DIM
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("percentile=%v", tc.percentile), func(t *testing.T) {
+			got, err := l.GetPercentile([]float64{1, 0}, tc.percentile)
+			assert.IsType(t, tc.err, err)
+			assert.Equal(t, tc.want, got)
+		})
 	}
+}
 
-	storage, err := storage.New("")
+func TestGetBucketIDs(t *testing.T) {
+	tc := struct {
+		id        string
+		embedding []float64
+	}{uuid.NewString(), []float64{1.31, 4.6}}
+
+	l := setup(t, Opts{numHyperPlanes: 10})
+
+	err := l.Add(tc.id, tc.embedding)
 	assert.NoError(t, err)
 
-	l, err = New("fake-index-name", storage, opts.numRounds, opts.numHyperPlanes, opts.spaceDim)
+	sks, err := l.getSketches(tc.embedding)
 	assert.NoError(t, err)
-	assert.NotNil(t, l)
 
-	return l
+	for _, sk := range sks {
+		ids, err := l.getBucketIDs(l.kv, sk)
+		assert.NoError(t, err)
+		assert.Contains(t, ids, tc.id)
+	}
 }
 
-func probByCandidate(
-	t *testing.T,
-	queryVec []float64,
-	candidates map[string][]float64,
-	numHyperPlanes,
-	numRounds uint32,
-) map[string]float64 {
-	probMap := make(map[string]float64, len(candidates))
+func TestGetEmbedding(t *testing.T) {
+	tc := struct {
+		id        string
+		embedding []float64
+	}{uuid.NewString(), []float64{1.31, 4.6}}
 
-	for id, vec := range candidates {
-		prob := probSimilar(t, queryVec, vec, numHyperPlanes, numRounds)
-		probMap[id] = prob
-	}
+	l := setup(t, Opts{})
 
-	return probMap
+	err := l.Add(tc.id, tc.embedding)
+	assert.NoError(t, err)
+
+	got, err := l.getEmbedding(l.kv, tc.id)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, tc.embedding, got)
 }
 
-func probSimilar(t *testing.T, vecA, vecB []float64, numHyperPlanes, numRounds uint32) float64 {
-	theta := angleBetween(t, vecA, vecB)
+func TestGetEmbeddingsFromBuckets(t *testing.T) {
+	tc := struct {
+		id        string
+		embedding []float64
+	}{uuid.NewString(), []float64{1.31, 4.6}}
 
-	// probability of both vectors being mapped to the same bucket in each projection / hyperplane
-	p := 1 - theta/math.Pi
+	l := setup(t, Opts{})
 
-	// probability of both vectors being considered similar to each other by the LSH algorithm
-	return 1 - math.Pow(1-math.Pow(p, float64(numHyperPlanes)), float64(numRounds))
+	err := l.Add(tc.id, tc.embedding)
+	assert.NoError(t, err)
+
+	sks, err := l.getSketches(tc.embedding)
+	assert.NoError(t, err)
+
+	got, err := l.getEmbeddingsFromBuckets(sks)
+	assert.NoError(t, err)
+
+	assert.Contains(t, got, tc.id)
+	assert.ElementsMatch(t, got[tc.id], tc.embedding)
 }
 
-func angleBetween(t *testing.T, vecA, vecB []float64) float64 {
-	if len(vecA) != len(vecB) {
-		t.Fatalf("to compute angle between, vectors must have same len")
+func TestGetEmbeddingsFromBuckets_Stale(t *testing.T) {
+	l := setup(t, Opts{})
+
+	assert.NoError(t, l.Add("a", []float64{1, 2}))
+	assert.NoError(t, l.Add("b", []float64{1, 2}))
+
+	// A bucket member outliving its embedding is skipped instead of failing the query.
+	assert.NoError(t, l.kv.Del(getEmbeddingKey(l.keyPrefix, l.indexName, "a")))
+
+	sks, err := l.getSketches([]float64{1, 2})
+	assert.NoError(t, err)
+
+	got, err := l.getEmbeddingsFromBuckets(sks)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]float64{"b": {1, 2}}, got)
+
+	neighbors, err := l.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, neighbors)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, "index\x1ffake-index\x1fembedding\x1fid", getEmbeddingKey("", "fake-index", "id"))
+	assert.Equal(t, "app\x1findex\x1ffake-index\x1fembedding\x1fid", getEmbeddingKey("app", "fake-index", "id"))
+	assert.Equal(t, "app\x1findex\x1ffake-index\x1fsketch\x1f101", getSketchPrefixKey("app", "fake-index", "101"))
+
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index", kv, 1, 1, 2, WithKeyPrefix("app"))
+	assert.NoError(t, err)
+
+	exists, err := kv.KeyExists(getIndexKey("app", "fake-index"))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = kv.KeyExists(getIndexKey("", "fake-index"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	err = l.Add("id", []float64{1, 2})
+	assert.NoError(t, err)
+
+	exists, err = kv.KeyExists(getEmbeddingKey("app", "fake-index", "id"))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSeed(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	original, err := New("original", kv, 3, 8, 4)
+	assert.NoError(t, err)
+
+	seed, err := original.Seed()
+	assert.NoError(t, err)
+	assert.NotZero(t, seed)
+
+	// Reopening loads the stored seed.
+	reopened, err := New("original", kv, 3, 8, 4)
+	assert.NoError(t, err)
+
+	got, err := reopened.Seed()
+	assert.NoError(t, err)
+	assert.Equal(t, seed, got)
+
+	recreated, err := New("recreated", kv, 3, 8, 4, WithSeed(seed))
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		embedding := make([]float64, 4)
+		for j := range embedding {
+			embedding[j] = rand.NormFloat64()
+		}
+
+		for round := range original.hashes {
+			want, err := original.hashes[round].Sketch(embedding)
+			assert.NoError(t, err)
+
+			got, err := recreated.hashes[round].Sketch(embedding)
+			assert.NoError(t, err)
+
+			assert.Equal(t, want, got)
+		}
 	}
 
-	normA := vecNorm(vecA)
-	normB := vecNorm(vecB)
+	// Indexes created before seeds were stored report an unknown seed.
+	err = kv.Del(getSeedKey("", "original"))
+	assert.NoError(t, err)
 
-	if normA*normB == 0 {
-		t.Fatalf("norm cannot be zero")
+	legacy, err := New("original", kv, 3, 8, 4)
+	assert.NoError(t, err)
+
+	_, err = legacy.Seed()
+	assert.IsType(t, &unknownSeedError{}, err)
+}
+
+func TestOptimize(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 3, 2, 2)
+	assert.NoError(t, err)
+
+	// Round 2 repeats round 0, so it never finds a candidate round 0 doesn't.
+	l.hashes = []simhash.SimHash{
+		{Hyperplanes: [][]float64{{1, 0}, {0, 1}}},
+		{Hyperplanes: [][]float64{{1, 1}, {1, -1}}},
+		{Hyperplanes: [][]float64{{1, 0}, {0, 1}}},
 	}
+	err = l.storeConfig()
+	assert.NoError(t, err)
 
-	return math.Acos(dotProduct(vecA, vecB) / (normA * normB))
+	rng := rand.New(rand.NewSource(1))
+	items := make([]Item, 50)
+	for i := range items {
+		items[i] = Item{ID: fmt.Sprint(i), Embedding: []float64{rng.NormFloat64(), rng.NormFloat64()}}
+	}
+
+	err = l.AddBatch(items)
+	assert.NoError(t, err)
+
+	report, err := l.Optimize(len(items), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), report.NumQueries)
+	assert.Len(t, report.Rounds, 3)
+	assert.Zero(t, report.Rounds[2].Unique)
+	assert.Equal(t, report.Rounds[0].Candidates, report.Rounds[2].Candidates)
+	assert.Equal(t, []int{2}, report.Redundant)
+	assert.Zero(t, report.Loss)
+
+	// Tolerating any loss still keeps one round.
+	report, err = l.Optimize(len(items), 1)
+	assert.NoError(t, err)
+	assert.Len(t, report.Redundant, 2)
+
+	err = l.PruneRounds(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), l.numRounds)
+
+	exists, err := kv.KeyExists(getHyperPlanesKey("", "fake-index-name", 2))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = l.Seed()
+	assert.IsType(t, &unknownSeedError{}, err)
+
+	err = l.PruneRounds(context.Background(), 1)
+	assert.NoError(t, err)
+
+	// Only the sketches of the remaining round are left.
+	want := make([]string, len(items))
+	for i, item := range items {
+		sk, err := l.hashes[0].Sketch(item.Embedding)
+		assert.NoError(t, err)
+		want[i] = getSketchKey("", "fake-index-name", sk, item.ID)
+	}
+
+	var got []string
+	err = kv.IterateWithPrefix(getSketchPrefixKey("", "fake-index-name", ""), func(key string, _ []byte) error {
+		got = append(got, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+
+	// The pruned config is reloaded, checksum included.
+	reopened, err := New("fake-index-name", kv, 3, 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), reopened.numRounds)
+
+	res, err := reopened.Get(items[0].Embedding, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Contains(t, res, items[0].ID)
+
+	err = reopened.PruneRounds(context.Background(), 0)
+	assert.IsType(t, &pruneAllRoundsError{}, err)
+
+	err = reopened.PruneRounds(context.Background(), 1)
+	assert.IsType(t, &invalidRoundError{}, err)
 }
 
-func dotProduct(vecA, vecB []float64) float64 {
-	dotProd := 0.0
-	for i := 0; i < len(vecA); i++ {
-		dotProd += vecA[i] * vecB[i]
+func TestGet_SkipCorrupt(t *testing.T) {
+	for _, skipCorrupt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipCorrupt=%v", skipCorrupt), func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 1, 1, 2, WithSkipCorrupt(skipCorrupt))
+			assert.NoError(t, err)
+
+			// A zero hyperplane puts every item in the same bucket.
+			l.hashes = []simhash.SimHash{{Hyperplanes: [][]float64{{0, 0}}}}
+
+			err = l.AddBatch([]Item{
+				{ID: "a", Embedding: []float64{1, 2}},
+				{ID: "truncated", Embedding: []float64{1, 2}},
+				{ID: "wrong-dim", Embedding: []float64{1, 2}},
+			})
+			assert.NoError(t, err)
+
+			err = kv.Add(map[string][]byte{
+				getEmbeddingKey("", "fake-index-name", "truncated"): {1, 2, 3},
+				getEmbeddingKey("", "fake-index-name", "wrong-dim"): mustEncode(t, []float64{1, 2, 3}),
+			})
+			assert.NoError(t, err)
+
+			got, err := l.Get([]float64{1, 2}, 0.9, 0)
+
+			if !skipCorrupt {
+				assert.IsType(t, &corruptEmbeddingError{}, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a"}, got)
+		})
 	}
+}
 
-	return dotProd
+func TestMigrateNormalize_Metric(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	for _, metric := range []semantic.Metric{semantic.DotProduct, semantic.Euclidean, semantic.L1} {
+		l, err := New(fmt.Sprint(metric), kv, 1, 1, 2, WithMetric(metric))
+		assert.NoError(t, err)
+		assert.NoError(t, l.Add("a", []float64{3, 4}))
+
+		assert.IsType(t, &normalizeMetricError{}, l.MigrateNormalize())
+
+		embedding, err := l.Embedding("a")
+		assert.NoError(t, err)
+		assert.Equal(t, []float64{3, 4}, embedding)
+	}
 }
 
-func vecNorm(vec []float64) float64 {
-	norm := 0.0
-	for _, component := range vec {
-		norm += component * component
+func TestMigrateNormalize(t *testing.T) {
+	l := setup(t, Opts{numRounds: 3, numHyperPlanes: 3, spaceDim: 3})
+
+	rng := rand.New(rand.NewSource(1))
+	items := make([]Item, 40)
+	for i := range items {
+		items[i] = Item{ID: fmt.Sprint(i), Embedding: []float64{rng.NormFloat64() * 10, rng.NormFloat64(), rng.NormFloat64() * 3}}
 	}
+	items = append(items, Item{ID: "zero", Embedding: []float64{0, 0, 0}})
 
-	return math.Sqrt(norm)
+	err := l.AddBatch(items)
+	assert.NoError(t, err)
+
+	queryVec := []float64{1, 2, 3}
+	want, err := l.Get(queryVec, 0, 0)
+	assert.NoError(t, err)
+
+	// Running it twice must not lose the original norms.
+	for i := 0; i < 2; i++ {
+		err = l.MigrateNormalize()
+		assert.NoError(t, err)
+	}
+
+	for _, item := range items {
+		embedding, err := l.getEmbedding(l.kv, item.ID)
+		assert.NoError(t, err)
+
+		if item.ID == "zero" {
+			assert.Equal(t, item.Embedding, embedding)
+			continue
+		}
+
+		var norm float64
+		for _, val := range item.Embedding {
+			norm += val * val
+		}
+
+		encodedNorm, err := l.kv.Get(getOriginalNormKey("", l.indexName, item.ID))
+		assert.NoError(t, err)
+		assert.Equal(t, mustEncode(t, []float64{math.Sqrt(norm)}), encodedNorm)
+
+		var unitNorm float64
+		for _, val := range embedding {
+			unitNorm += val * val
+		}
+		assert.InDelta(t, 1, unitNorm, 1e-9)
+	}
+
+	got, err := l.Get(queryVec, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Migrated items written again are stored raw, so the next migration must normalize them too.
+	assert.NoError(t, l.Add(items[0].ID, items[0].Embedding))
+	assert.NoError(t, l.AddBatch(items[1:2]))
+	assert.NoError(t, l.MigrateNormalize())
+
+	for _, item := range items[:2] {
+		embedding, err := l.getEmbedding(l.kv, item.ID)
+		assert.NoError(t, err)
+
+		var unitNorm float64
+		for _, val := range embedding {
+			unitNorm += val * val
+		}
+		assert.InDelta(t, 1, unitNorm, 1e-9, item.ID)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, storeEmbeddings := range []bool{true, false} {
+		t.Run(fmt.Sprintf("storeEmbeddings=%v", storeEmbeddings), func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 3, 2, 2, WithStoreEmbeddings(storeEmbeddings))
+			assert.NoError(t, err)
+
+			err = l.AddBatch([]Item{
+				{ID: "a", Embedding: []float64{1, 2}},
+				{ID: "b", Embedding: []float64{1, 2}},
+			})
+			assert.NoError(t, err)
+
+			err = l.Delete("a")
+			assert.NoError(t, err)
+
+			var keys []string
+			err = kv.IterateWithPrefix(getIndexKey("", "fake-index-name"), func(key string, _ []byte) error {
+				if strings.HasSuffix(key, KEY_SEPARATOR+"a") {
+					keys = append(keys, key)
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+
+			got, err := l.Get([]float64{1, 2}, 0.9, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b"}, got)
+
+			err = l.Delete("a")
+			assert.IsType(t, &itemDoesNotExistError{}, err)
+		})
+	}
+}
+
+func TestGet_ConcurrentDelete(t *testing.T) {
+	l := setup(t, Opts{})
+
+	// A zero hyperplane puts every item in the same bucket, so every Get reads the items being deleted.
+	l.hashes = []simhash.SimHash{{Hyperplanes: [][]float64{{0, 0}}}}
+
+	items := make([]Item, 200)
+	for i := range items {
+		items[i] = Item{ID: fmt.Sprint(i), Embedding: []float64{1, float64(i)}}
+	}
+
+	err := l.AddBatch(items)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for _, item := range items {
+			assert.NoError(t, l.Delete(item.ID))
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				_, err := l.Get([]float64{1, 1}, 0, 0)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestStoreConfig_HyperParams(t *testing.T) {
+	l := setup(t, Opts{})
+
+	configKeys := []string{
+		getIndexKey(l.keyPrefix, l.indexName),
+		getNumRoundsKey(l.keyPrefix, l.indexName),
+		getNumHyperPlanesKey(l.keyPrefix, l.indexName),
+		getSpaceDimKey(l.keyPrefix, l.indexName),
+		getHyperPlanesChecksumKey(l.keyPrefix, l.indexName),
+		getStoreEmbeddingsKey(l.keyPrefix, l.indexName),
+		getSeedKey(l.keyPrefix, l.indexName),
+	}
+
+	err := l.storeConfig()
+	assert.NoError(t, err)
+
+	for _, k := range configKeys {
+		exists, err := l.kv.KeyExists(k)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+}
+
+func TestStoreConfig_HyperPlanes(t *testing.T) {
+	l := setup(t, Opts{})
+
+	err := l.storeConfig()
+	assert.NoError(t, err)
+
+	for i, _ := range l.hashes {
+		k := getHyperPlanesKey(l.keyPrefix, l.indexName, i)
+
+		exists, err := l.kv.KeyExists(k)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+}
+
+type Opts struct {
+	numRounds      uint32
+	numHyperPlanes uint32
+	spaceDim       uint32
+}
+
+func setup(t *testing.T, opts Opts) *LSH {
+	var (
+		l   *LSH
+		err error
+	)
+
+	assert.NotNil(t, opts)
+
+	if opts.numRounds == 0 {
+		opts.numRounds = MIN_NUM_ROUNDS
+	}
+
+	// TODO: Add seed or accept tolerable deviations when NumHyperPlanes > 1.
+	if opts.numHyperPlanes == 0 {
+		opts.numHyperPlanes = MIN_NUM_HYPERPLANES
+	}
+
+	if opts.spaceDim == 0 {
+		opts.spaceDim = MIN_SPACE_DIM
+	}
+
+	storage, err := storage.New("")
+	assert.NoError(t, err)
+	t.Cleanup(func() { storage.CloseDB() })
+
+	l, err = New("fake-index-name", storage, opts.numRounds, opts.numHyperPlanes, opts.spaceDim)
+	assert.NoError(t, err)
+	assert.NotNil(t, l)
+
+	return l
+}
+
+func probByCandidate(
+	t *testing.T,
+	queryVec []float64,
+	candidates map[string][]float64,
+	numHyperPlanes,
+	numRounds uint32,
+) map[string]float64 {
+	probMap := make(map[string]float64, len(candidates))
+
+	for id, vec := range candidates {
+		prob := probSimilar(t, queryVec, vec, numHyperPlanes, numRounds)
+		probMap[id] = prob
+	}
+
+	return probMap
+}
+
+func probSimilar(t *testing.T, vecA, vecB []float64, numHyperPlanes, numRounds uint32) float64 {
+	theta := angleBetween(t, vecA, vecB)
+
+	// probability of both vectors being mapped to the same bucket in each projection / hyperplane
+	p := 1 - theta/math.Pi
+
+	// probability of both vectors being considered similar to each other by the LSH algorithm
+	return 1 - math.Pow(1-math.Pow(p, float64(numHyperPlanes)), float64(numRounds))
+}
+
+func angleBetween(t *testing.T, vecA, vecB []float64) float64 {
+	if len(vecA) != len(vecB) {
+		t.Fatalf("to compute angle between, vectors must have same len")
+	}
+
+	normA := vecNorm(vecA)
+	normB := vecNorm(vecB)
+
+	if normA*normB == 0 {
+		t.Fatalf("norm cannot be zero")
+	}
+
+	return math.Acos(dotProduct(vecA, vecB) / (normA * normB))
+}
+
+func dotProduct(vecA, vecB []float64) float64 {
+	dotProd := 0.0
+	for i := 0; i < len(vecA); i++ {
+		dotProd += vecA[i] * vecB[i]
+	}
+
+	return dotProd
+}
+
+func vecNorm(vec []float64) float64 {
+	norm := 0.0
+	for _, component := range vec {
+		norm += component * component
+	}
+
+	return math.Sqrt(norm)
+}
+
+func TestGetMulti(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 3, 2, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	// Two clusters around the x and y axes, plus an item halfway between them.
+	var items []Item
+	for i := 0; i < 5; i++ {
+		items = append(items,
+			Item{ID: fmt.Sprintf("a%d", i), Embedding: []float64{10, 0.1 * float64(i), 0}},
+			Item{ID: fmt.Sprintf("b%d", i), Embedding: []float64{0, 10, 0.1 * float64(i)}},
+		)
+	}
+	items = append(items, Item{ID: "mid", Embedding: []float64{1, 1, 0.05}})
+
+	err = l.AddBatch(items)
+	assert.NoError(t, err)
+
+	queries := [][]float64{{1, 0, 0}, {0, 1, 0}}
+
+	got, err := l.GetMulti(queries, Union, 0.9, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a0", "a1", "a2", "a3", "a4", "b0", "b1", "b2", "b3", "b4"}, got)
+	assert.Equal(t, []string{"a0", "b0"}, got[:2])
+
+	got, err = l.GetMulti(queries, Union, 0.9, 3)
+	assert.NoError(t, err)
+	assert.Len(t, got, 3)
+
+	got, err = l.GetMulti(queries, Centroid, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mid"}, got)
+
+	_, err = l.GetMulti(nil, Union, 0.9, 0)
+	assert.IsType(t, &emptyQueriesError{}, err)
+
+	_, err = l.GetMulti([][]float64{{1, 0, 0}, {1, 0}}, Centroid, 0.9, 0)
+	assert.IsType(t, &embeddingLenError{}, err)
+
+	_, err = l.GetMulti(queries, MultiMode(42), 0.9, 0)
+	assert.IsType(t, &unknownMultiModeError{}, err)
+
+	unstored, err := New("fake-unstored-index-name", kv, 3, 2, 3, WithStoreEmbeddings(false))
+	assert.NoError(t, err)
+
+	_, err = unstored.GetMulti(queries, Union, 0.9, 0)
+	assert.IsType(t, &embeddingsNotStoredError{}, err)
+}
+
+func TestFindDuplicateClusters(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 3, 2, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "a1", Embedding: []float64{1, 0, 0}},
+		{ID: "a2", Embedding: []float64{2, 0.001, 0}},
+		{ID: "b1", Embedding: []float64{0, 1, 0}},
+		{ID: "b2", Embedding: []float64{0, 1, 0.03}},
+		// Only similar enough to b2, but joins b1's cluster through it.
+		{ID: "b3", Embedding: []float64{0, 1, 0.06}},
+		{ID: "c", Embedding: []float64{0, 0, 1}},
+	})
+	assert.NoError(t, err)
+
+	clusters, err := l.FindDuplicateClusters(0.999)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"b1", "b2", "b3"}}, clusters)
+
+	// A stale member of a1's buckets, whose embedding is gone, and a key too short to hold a sketch are skipped.
+	aSketches, err := l.getSketches([]float64{1, 0, 0})
+	assert.NoError(t, err)
+
+	err = kv.Add(map[string][]byte{
+		getSketchKey("", "fake-index-name", aSketches[0], "ghost"): []byte("ghost"),
+		getSketchPrefixKey("", "fake-index-name", "0"):             []byte("short"),
+	})
+	assert.NoError(t, err)
+
+	clusters, err = l.FindDuplicateClusters(0.999)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"b1", "b2", "b3"}}, clusters)
+
+	_, err = l.FindDuplicateClusters(2)
+	assert.Error(t, err)
+
+	unstored, err := New("fake-unstored-index-name", kv, 3, 2, 3, WithStoreEmbeddings(false))
+	assert.NoError(t, err)
+
+	_, err = unstored.FindDuplicateClusters(0.999)
+	assert.IsType(t, &embeddingsNotStoredError{}, err)
+}
+
+func TestRepair(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 2, 4, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "a", Embedding: []float64{1, 2, 3}},
+		{ID: "b", Embedding: []float64{-3, 2, 1}},
+	})
+	assert.NoError(t, err)
+
+	aKeys, err := l.getItemSketchKeys("a")
+	assert.NoError(t, err)
+
+	bSketches, err := l.getSketches([]float64{-3, 2, 1})
+	assert.NoError(t, err)
+
+	var staleSK string
+	for _, sk := range []string{"0000", "1111", "0101"} {
+		if !slices.Contains(bSketches, sk) {
+			staleSK = sk
+			break
+		}
+	}
+
+	// An interrupted Add of a, a Delete of ghost that only removed its embedding, and a b in a wrong bucket.
+	err = kv.Del(aKeys[0])
+	assert.NoError(t, err)
+	err = kv.Add(map[string][]byte{
+		getSketchKey("", "fake-index-name", bSketches[0], "ghost"): []byte("ghost"),
+		getSketchKey("", "fake-index-name", staleSK, "b"):          []byte("b"),
+	})
+	assert.NoError(t, err)
+
+	report, err := l.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, RepairReport{OrphanedSketches: 2, MissingSketches: 1, ResketchedItems: 1}, report)
+
+	exists, err := kv.KeyExists(aKeys[0])
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	got, err := l.Get([]float64{-3, 2, 1}, 0, 0)
+	assert.NoError(t, err)
+	assert.NotContains(t, got, "ghost")
+
+	report, err = l.Repair()
+	assert.NoError(t, err)
+	assert.Zero(t, report)
+}
+
+// Size of the dataset indexed by BenchmarkGet, e.g. go test -bench Get -args -bench-items=100000
+var benchNumItems = flag.Int("bench-items", 1000, "number of items indexed by BenchmarkGet")
+
+const BENCH_SEED int64 = 42
+
+var benchCases = []struct {
+	numRounds      uint32
+	numHyperPlanes uint32
+	spaceDim       uint32
+}{
+	{numRounds: 4, numHyperPlanes: 8, spaceDim: 64},
+	{numRounds: 16, numHyperPlanes: 8, spaceDim: 64},
+	{numRounds: 16, numHyperPlanes: 16, spaceDim: 64},
+	{numRounds: 16, numHyperPlanes: 16, spaceDim: 768},
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(fmt.Sprintf("rounds=%d/hyperplanes=%d/dim=%d", bc.numRounds, bc.numHyperPlanes, bc.spaceDim), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(BENCH_SEED))
+
+			kv, err := storage.New("")
+			assert.NoError(b, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, bc.numRounds, bc.numHyperPlanes, bc.spaceDim, WithSeed(BENCH_SEED))
+			assert.NoError(b, err)
+
+			items := seededItems(rng, *benchNumItems, int(bc.spaceDim))
+			for start := 0; start < len(items); start += MIGRATE_BATCH_SIZE {
+				err = l.AddBatch(items[start:min(start+MIGRATE_BATCH_SIZE, len(items))])
+				assert.NoError(b, err)
+			}
+
+			queries := seededItems(rng, 100, int(bc.spaceDim))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Get(queries[i%len(queries)].Embedding, 0.5, 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(fmt.Sprintf("rounds=%d/hyperplanes=%d/dim=%d", bc.numRounds, bc.numHyperPlanes, bc.spaceDim), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(BENCH_SEED))
+
+			kv, err := storage.New("")
+			assert.NoError(b, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, bc.numRounds, bc.numHyperPlanes, bc.spaceDim, WithSeed(BENCH_SEED))
+			assert.NoError(b, err)
+
+			items := seededItems(rng, 1000, int(bc.spaceDim))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := l.Add(strconv.Itoa(i), items[i%len(items)].Embedding); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEmbeddingCodec measures the size (bytes/embedding) and decoding time of each codec
+// on dense embeddings and on sparse ones, where 90% of the values are zero.
+func BenchmarkEmbeddingCodec(b *testing.B) {
+	rng := rand.New(rand.NewSource(BENCH_SEED))
+
+	dense := seededItems(rng, 1000, 768)
+	sparse := seededItems(rng, 1000, 768)
+	for _, item := range sparse {
+		for j := range item.Embedding {
+			if rng.Float64() < 0.9 {
+				item.Embedding[j] = 0
+			}
+		}
+	}
+
+	for _, codec := range []EmbeddingCodec{RawCodec, DeltaVarintCodec} {
+		for name, items := range map[string][]Item{"dense": dense, "sparse": sparse} {
+			b.Run(fmt.Sprintf("codec=%d/%s", codec, name), func(b *testing.B) {
+				l := &LSH{codec: codec}
+
+				encoded := make([][]byte, len(items))
+				size := 0
+				for i, item := range items {
+					data, err := l.encodeEmbedding(item.Embedding)
+					assert.NoError(b, err)
+
+					encoded[i] = data
+					size += len(data)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := l.decodeEmbedding(encoded[i%len(encoded)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ReportMetric(float64(size)/float64(len(items)), "bytes/embedding")
+			})
+		}
+	}
+}
+
+// seededItems returns n items of normally distributed embeddings, the same for the same rng state.
+func seededItems(rng *rand.Rand, n, dim int) []Item {
+	items := make([]Item, n)
+	for i := range items {
+		embedding := make([]float64, dim)
+		for j := range embedding {
+			embedding[j] = rng.NormFloat64()
+		}
+
+		items[i] = Item{ID: strconv.Itoa(i), Embedding: embedding}
+	}
+
+	return items
+}
+
+func TestGetExplained(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 40, 8, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "near-duplicate", Embedding: []float64{1, 0.01, 0}},
+		// 45 degrees away from the query.
+		{ID: "weak", Embedding: []float64{1, 1, 0}},
+	})
+	assert.NoError(t, err)
+
+	neighbors, err := l.GetExplained([]float64{1, 0, 0}, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, neighbors, 2)
+
+	assert.Equal(t, "near-duplicate", neighbors[0].ID)
+	assert.Equal(t, "weak", neighbors[1].ID)
+	assert.Greater(t, neighbors[0].RoundMatches, 35)
+	assert.Greater(t, neighbors[0].RoundMatches, neighbors[1].RoundMatches)
+	assert.GreaterOrEqual(t, neighbors[1].RoundMatches, 1)
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 2, 2, 2)
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "a", Embedding: []float64{1, 0}},
+		{ID: "b", Embedding: []float64{0, 1}},
+	})
+	assert.NoError(t, err)
+
+	matrix, err := l.SimilarityMatrix([]string{"b", "a"})
+	assert.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{1, 0}, matrix[0], 1e-9)
+	assert.InDeltaSlice(t, []float64{0, 1}, matrix[1], 1e-9)
+
+	_, err = l.SimilarityMatrix([]string{"a", "missing"})
+	assert.IsType(t, &itemDoesNotExistError{}, err)
+}
+
+func TestGetRounds(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 6, 3, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	rng := rand.New(rand.NewSource(BENCH_SEED))
+	err = l.AddBatch(seededItems(rng, 200, 3))
+	assert.NoError(t, err)
+
+	query := []float64{1, 2, 3}
+
+	want, err := l.Get(query, 0, 0)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, want)
+
+	first, err := l.GetRounds(query, []int{0, 1, 2}, 0, 0)
+	assert.NoError(t, err)
+
+	second, err := l.GetRounds(query, []int{3, 4, 5}, 0, 0)
+	assert.NoError(t, err)
+
+	union := map[string]bool{}
+	for _, id := range append(first, second...) {
+		union[id] = true
+	}
+
+	assert.Len(t, union, len(want))
+	for _, id := range want {
+		assert.True(t, union[id], id)
+	}
+
+	_, err = l.GetRounds(query, []int{6}, 0, 0)
+	assert.IsType(t, &invalidRoundError{}, err)
+}
+
+func TestReembed(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 4, 3, 2, WithSeed(42))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "a", Embedding: []float64{1, 0}},
+		{ID: "b", Embedding: []float64{0, 1}},
+	})
+	assert.NoError(t, err)
+
+	// Swapping coordinates moves every item to the other's buckets.
+	err = l.Reembed(context.Background(), func(id string, embedding []float64) ([]float64, error) {
+		return []float64{embedding[1], embedding[0]}, nil
+	})
+	assert.NoError(t, err)
+
+	neighbors, err := l.Get([]float64{1, 0}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, neighbors)
+
+	report, err := l.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, RepairReport{}, report)
+
+	err = l.Reembed(context.Background(), func(id string, embedding []float64) ([]float64, error) {
+		return []float64{1, 2, 3}, nil
+	})
+	assert.IsType(t, &embeddingLenError{}, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = l.Reembed(ctx, func(id string, embedding []float64) ([]float64, error) {
+		return embedding, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestStrictHyperParams(t *testing.T) {
+	testCases := []struct {
+		name                                string
+		numRounds, numHyperPlanes, spaceDim uint32
+		wantField                           string
+	}{
+		{"numRounds", 0, 2, 3, "numRounds"},
+		{"numHyperPlanes", 2, 0, 3, "numHyperPlanes"},
+		{"spaceDim", 2, 2, 1, "spaceDim"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			// Lenient by default: out-of-range values are clamped.
+			l, err := New("lenient", kv, tc.numRounds, tc.numHyperPlanes, tc.spaceDim)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, l.numRounds, MIN_NUM_ROUNDS)
+			assert.GreaterOrEqual(t, l.numHyperPlanes, MIN_NUM_HYPERPLANES)
+
+			_, err = New("strict", kv, tc.numRounds, tc.numHyperPlanes, tc.spaceDim, WithStrictHyperParams(true))
+			var tooSmall *hyperParamTooSmallError
+			assert.ErrorAs(t, err, &tooSmall)
+			assert.Equal(t, tc.wantField, tooSmall.name)
+
+			exists, err := kv.KeyExists(getIndexKey("", "strict"))
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	_, err = New("strict", kv, MIN_NUM_ROUNDS, MIN_NUM_HYPERPLANES, MIN_SPACE_DIM, WithStrictHyperParams(true))
+	assert.NoError(t, err)
+}
+
+func TestMaxHyperParams(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	var tooLarge *hyperParamTooLargeError
+
+	// Even lenient indexes reject values above the maximums.
+	_, err = New("rounds", kv, MAX_NUM_ROUNDS+1, 2, 2)
+	assert.ErrorAs(t, err, &tooLarge)
+	assert.Equal(t, "numRounds", tooLarge.name)
+
+	_, err = New("hyperplanes", kv, 2, 100000, 2)
+	assert.ErrorAs(t, err, &tooLarge)
+	assert.Equal(t, "numHyperPlanes", tooLarge.name)
+
+	exists, err := kv.KeyExists(getIndexKey("", "hyperplanes"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = New("max", kv, MAX_NUM_ROUNDS, MAX_NUM_HYPERPLANES, 2)
+	assert.NoError(t, err)
+}
+
+func TestFlushStats(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 2, 2, 2)
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.Add("a", []float64{1, 2}))
+	assert.NoError(t, l.AddBatch([]Item{{ID: "b", Embedding: []float64{2, 1}}, {ID: "c", Embedding: []float64{1, 1}}}))
+	_, err = l.Get([]float64{1, 2}, 0, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(3), l.Info()["numAdds"])
+	assert.Equal(t, uint64(1), l.Info()["numGets"])
+
+	// Counters are only persisted on flush.
+	reopened, err := New("fake-index-name", kv, 2, 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), reopened.Info()["numAdds"])
+
+	assert.NoError(t, l.FlushStats())
+
+	reopened, err = New("fake-index-name", kv, 2, 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), reopened.Info()["numAdds"])
+	assert.Equal(t, uint64(1), reopened.Info()["numGets"])
+}
+
+func TestEscapeKey(t *testing.T) {
+	for _, elem := range []string{"", "plain", "a/b", "\x1f", "a\x1fb", "\x1e\x1f", "\x1es", "x\x1ee\x1f"} {
+		escaped := escapeKey(elem)
+		assert.NotContains(t, escaped, KEY_SEPARATOR)
+		assert.Equal(t, elem, unescapeKey(escaped))
+	}
+
+	// Names and IDs without 0x1E or 0x1F are left as they are, slashes included.
+	assert.Equal(t, "index\x1fplain\x1fembedding\x1fid", getEmbeddingKey("", "plain", "id"))
+	assert.Equal(t, "index\x1fa/b\x1fembedding\x1fx/y", getEmbeddingKey("", "a/b", "x/y"))
+}
+
+func TestSlashesInNamesAndIDs(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	// Slashes are plain bytes in keys, while without escaping, the keys of "a\x1fembedding" would fall within
+	// the embedding prefix of "a".
+	a, err := New("a", kv, 2, 2, 2)
+	assert.NoError(t, err)
+
+	nested, err := New("a/embedding", kv, 2, 2, 2)
+	assert.NoError(t, err)
+
+	separated, err := New("a"+KEY_SEPARATOR+"embedding", kv, 2, 2, 2)
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.AddBatch([]Item{{ID: "x/y", Embedding: []float64{1, 2}}, {ID: "z", Embedding: []float64{2, 1}}}))
+	assert.NoError(t, nested.Add("w/", []float64{1, 1}))
+	assert.NoError(t, separated.Add("v"+KEY_SEPARATOR, []float64{2, 2}))
+
+	got := map[string][]float64{}
+	err = a.Embeddings(func(id string, embedding []float64) error {
+		got[id] = embedding
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]float64{"x/y": {1, 2}, "z": {2, 1}}, got)
+
+	neighbors, err := a.Get([]float64{1, 2}, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x/y"}, neighbors)
+
+	counts, err := CountItems(a, nested, separated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 2, "a/embedding": 1, "a\x1fembedding": 1}, counts)
+
+	names, err := StoredIndexNames(kv, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "a/embedding", "a\x1fembedding"}, names)
+
+	report, err := a.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, RepairReport{}, report)
+
+	assert.NoError(t, a.Delete("x/y"))
+
+	neighbors, err = a.Get([]float64{1, 2}, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, neighbors)
+
+	reopened, err := New("a/embedding", kv, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), reopened.numRounds)
+}
+
+func TestGetSimilarToID(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 4, 2, 3, WithSeed(42))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "x", Embedding: []float64{1, 2, 3}},
+		{ID: "near-duplicate", Embedding: []float64{1, 2, 3.01}},
+		{ID: "close", Embedding: []float64{1, 2.5, 3}},
+	})
+	assert.NoError(t, err)
+
+	neighbors, err := l.GetSimilarToID("x", 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near-duplicate", "close"}, neighbors)
+
+	neighbors, err = l.GetSimilarToID("x", 0.9, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near-duplicate"}, neighbors)
+
+	_, err = l.GetSimilarToID("missing", 0.9, 1)
+	assert.IsType(t, &itemDoesNotExistError{}, err)
+}
+
+func TestRunningStats(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 2, 2, 3)
+	assert.NoError(t, err)
+
+	rng := rand.New(rand.NewSource(BENCH_SEED))
+	items := seededItems(rng, 100, 3)
+
+	for _, item := range items {
+		assert.NoError(t, l.Add(item.ID, item.Embedding))
+	}
+
+	// Re-adding an item replaces it.
+	assert.NoError(t, l.Add(items[0].ID, []float64{1, 1, 1}))
+	items[0].Embedding = []float64{1, 1, 1}
+
+	for _, i := range rng.Perm(len(items))[:40] {
+		assert.NoError(t, l.Delete(items[i].ID))
+	}
+
+	_, err = l.AddBatchIfAbsent(seededItems(rng, 10, 3))
+	assert.NoError(t, err)
+
+	var (
+		count int
+		want  = make([]float64, 3)
+	)
+	err = l.Embeddings(func(id string, embedding []float64) error {
+		count++
+		addScaled(want, embedding, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, count, l.Count())
+	assert.Equal(t, count, l.Info()["count"])
+
+	centroid, err := l.Centroid()
+	assert.NoError(t, err)
+	for i := range want {
+		assert.InDelta(t, want[i]/float64(count), centroid[i], 1e-9)
+	}
+
+	// Reloaded from storage, not recomputed.
+	reopened, err := New("fake-index-name", kv, 2, 2, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, count, reopened.Count())
+
+	// Indexes created before the stats existed get them by a full scan.
+	assert.NoError(t, kv.Del(getCountKey("", "fake-index-name"), getEmbeddingSumKey("", "fake-index-name")))
+
+	reopened, err = New("fake-index-name", kv, 2, 2, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, count, reopened.Count())
+
+	reopenedCentroid, err := reopened.Centroid()
+	assert.NoError(t, err)
+	assert.InDeltaSlice(t, centroid, reopenedCentroid, 1e-9)
+}
+
+func TestBucketFilter(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	counting := &countingKV{Contract: kv}
+
+	l, err := New("fake-index-name", counting, 1, 8, 2)
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.Add("a", []float64{1, 0}))
+
+	sks, err := l.getSketches([]float64{1, 0})
+	assert.NoError(t, err)
+	occupied := sks[0]
+
+	// Flipping every bit of a sketch gives the sketch of the opposite vector, in another bucket.
+	empty := []byte(occupied)
+	for i := range empty {
+		empty[i] = flipBit(empty[i])
+	}
+
+	// Until warmed, every bucket is read.
+	_, err = l.getBucketIDs(counting, string(empty))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, counting.numSeeks)
+
+	assert.NoError(t, l.WarmBucketFilter())
+
+	counting.numSeeks = 0
+	ids, err := l.getBucketIDs(counting, string(empty))
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, 0, counting.numSeeks)
+
+	ids, err = l.getBucketIDs(counting, occupied)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+	assert.Equal(t, 1, counting.numSeeks)
+
+	// Adds after warming mark their buckets.
+	assert.NoError(t, l.Add("b", []float64{-1, 0}))
+
+	res, err := l.Get([]float64{-1, 0}, 0.9, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, res)
+
+	// Deletes unmark the buckets they empty, and only those.
+	assert.NoError(t, l.Add("c", []float64{2, 0}))
+	assert.NoError(t, l.Delete("b"))
+	assert.NoError(t, l.Delete("a"))
+
+	assert.False(t, l.mayHaveBucket(string(empty)))
+	assert.True(t, l.mayHaveBucket(occupied))
+
+	res, err = l.Get([]float64{1, 0}, 0.9, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, res)
+}
+
+func TestGetWithGroundTruth(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("fake-index-name", kv, 4, 4, 8, WithSeed(BENCH_SEED))
+	assert.NoError(t, err)
+
+	rng := rand.New(rand.NewSource(BENCH_SEED))
+	items := seededItems(rng, 200, 8)
+	assert.NoError(t, l.AddBatch(items))
+
+	query := seededItems(rng, 1, 8)[0].Embedding
+
+	approx, exact, err := l.GetWithGroundTruth(query, 10)
+	assert.NoError(t, err)
+
+	// The true top-k, by brute force.
+	want := make([]string, len(items))
+	sims := make(map[string]float64, len(items))
+	for i, item := range items {
+		want[i] = item.ID
+		sims[item.ID], err = semantic.CosineSimilarity(query, item.Embedding)
+		assert.NoError(t, err)
+	}
+	sort.Slice(want, func(i, j int) bool { return sims[want[i]] > sims[want[j]] })
+	assert.Equal(t, want[:10], exact)
+
+	// approx is ranked by the same scores, among the bucket members only: each of its neighbors is at most
+	// as similar as the one of the same rank in exact.
+	assert.LessOrEqual(t, len(approx), 10)
+	for i, id := range approx {
+		assert.LessOrEqual(t, sims[id], sims[exact[i]]+semantic.EPSILON)
+	}
+
+	found := 0
+	for _, id := range approx {
+		if slices.Contains(exact, id) {
+			found++
+		}
+	}
+	assert.Positive(t, found)
+
+	// Get finds the same approximate neighbors, up to its threshold.
+	got, err := l.Get(query, 0, 10)
+	assert.NoError(t, err)
+	for _, id := range got {
+		assert.Contains(t, approx, id)
+	}
+
+	_, _, err = l.GetWithGroundTruth([]float64{1}, 10)
+	assert.IsType(t, &embeddingLenError{}, err)
+}
+
+func TestUpdate(t *testing.T) {
+	for _, storeEmbeddings := range []bool{true, false} {
+		t.Run(fmt.Sprintf("store_embeddings=%v", storeEmbeddings), func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 8, 2, 2, WithSeed(BENCH_SEED), WithStoreEmbeddings(storeEmbeddings))
+			assert.NoError(t, err)
+
+			// The item's sketch keys, read from storage.
+			itemSketchKeys := func(id string) []string {
+				var keys []string
+				prefix := getSketchPrefixKey("", "fake-index-name", "")
+
+				err := kv.IterateKeysWithPrefix(prefix, func(key string) error {
+					if strings.HasSuffix(key, KEY_SEPARATOR+id) {
+						keys = append(keys, key)
+					}
+					return nil
+				})
+				assert.NoError(t, err)
+
+				return keys
+			}
+
+			wantSketchKeys := func(id string, embedding []float64) []string {
+				sks, err := l.getSketches(embedding)
+				assert.NoError(t, err)
+
+				data, err := l.prepareSketches(id, sks)
+				assert.NoError(t, err)
+
+				keys := make([]string, 0, len(data))
+				for key := range data {
+					keys = append(keys, key)
+				}
+
+				return keys
+			}
+
+			assert.NoError(t, l.Add("a", []float64{1, 0}))
+			assert.NoError(t, l.Add("b", []float64{0, 1}))
+
+			testCases := []struct {
+				name      string
+				embedding []float64
+			}{
+				// Same buckets: every key must survive.
+				{"scaled", []float64{2, 0}},
+				// Disjoint buckets: every key moves.
+				{"opposite", []float64{-2, 0}},
+				// Some buckets in common, most likely.
+				{"rotated", []float64{-1, 1}},
+			}
+
+			for _, tc := range testCases {
+				assert.NoError(t, l.Update("a", tc.embedding), tc.name)
+				assert.ElementsMatch(t, wantSketchKeys("a", tc.embedding), itemSketchKeys("a"), tc.name)
+			}
+
+			assert.Equal(t, 2, l.Count())
+
+			// The other item is untouched.
+			assert.ElementsMatch(t, wantSketchKeys("b", []float64{0, 1}), itemSketchKeys("b"))
+
+			report, err := l.Repair()
+			assert.NoError(t, err)
+			assert.Equal(t, RepairReport{}, report)
+
+			err = l.Update("missing", []float64{1, 0})
+			assert.IsType(t, &itemDoesNotExistError{}, err)
+
+			err = l.Update("a", []float64{1})
+			assert.IsType(t, &embeddingLenError{}, err)
+		})
+	}
+
+	t.Run("embedding", func(t *testing.T) {
+		kv, err := storage.New("")
+		assert.NoError(t, err)
+		defer kv.CloseDB()
+
+		l, err := New("fake-index-name", kv, 2, 2, 2)
+		assert.NoError(t, err)
+
+		assert.NoError(t, l.Add("a", []float64{1, 0}))
+		assert.NoError(t, l.Update("a", []float64{0, 3}))
+
+		res, err := l.Get([]float64{0, 1}, 0.99, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, res)
+
+		centroid, err := l.Centroid()
+		assert.NoError(t, err)
+		assert.InDeltaSlice(t, []float64{0, 3}, centroid, 1e-9)
+	})
+}
+
+func TestListIDs(t *testing.T) {
+	for _, storeEmbeddings := range []bool{true, false} {
+		t.Run(fmt.Sprintf("store_embeddings=%v", storeEmbeddings), func(t *testing.T) {
+			kv, err := storage.New("")
+			assert.NoError(t, err)
+			defer kv.CloseDB()
+
+			l, err := New("fake-index-name", kv, 2, 2, 2, WithStoreEmbeddings(storeEmbeddings))
+			assert.NoError(t, err)
+
+			ids, err := l.ListIDs()
+			assert.NoError(t, err)
+			assert.Empty(t, ids)
+
+			for _, id := range []string{"b", "a/1", "c"} {
+				assert.NoError(t, l.Add(id, []float64{1, 2}))
+			}
+			assert.NoError(t, l.Delete("c"))
+
+			// An index whose name extends this one's isn't listed.
+			other, err := New("fake-index-name-2", kv, 2, 2, 2)
+			assert.NoError(t, err)
+			assert.NoError(t, other.Add("d", []float64{1, 2}))
+
+			ids, err = l.ListIDs()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a/1", "b"}, ids)
+		})
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+	l := setup(t, Opts{})
+
+	assert.True(t, l.StoresEmbeddings())
+	assert.NoError(t, l.Add("a", []float64{1, 2}))
+
+	embedding, err := l.Embedding("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 2}, embedding)
+
+	_, err = l.Embedding("missing")
+	assert.IsType(t, &itemDoesNotExistError{}, err)
+
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	skipping, err := New("fake-index-name", kv, 2, 2, 2, WithStoreEmbeddings(false))
+	assert.NoError(t, err)
+	assert.False(t, skipping.StoresEmbeddings())
+
+	_, err = skipping.Embedding("a")
+	assert.IsType(t, &embeddingsNotStoredError{}, err)
+}
+
+func TestGetWithScores(t *testing.T) {
+	l := setup(t, Opts{})
+
+	// A null hyperplane puts every item in the same bucket, so all of them are candidates.
+	l.hashes = []simhash.SimHash{{Hyperplanes: [][]float64{{0, 0}}}}
+
+	assert.NoError(t, l.Add("same", []float64{2, 0}))
+	assert.NoError(t, l.Add("diagonal", []float64{1, 1}))
+	assert.NoError(t, l.Add("orthogonal", []float64{0, 1}))
+
+	neighbors, err := l.GetWithScores([]float64{1, 0}, 0.5, 0)
+	assert.NoError(t, err)
+	assert.Len(t, neighbors, 2)
+
+	assert.Equal(t, "same", neighbors[0].ID)
+	assert.InDelta(t, 1, neighbors[0].Score, 1e-9)
+	assert.Equal(t, "diagonal", neighbors[1].ID)
+	assert.InDelta(t, math.Sqrt2/2, neighbors[1].Score, 1e-9)
+
+	ids, err := l.Get([]float64{1, 0}, 0.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"same", "diagonal"}, ids)
+}
+
+func TestWithMetric_Stored(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	_, err = New("euclidean", kv, 1, 1, 2, WithMetric(semantic.Euclidean))
+	assert.NoError(t, err)
+
+	_, err = New("euclidean", kv, 0, 0, 0, WithMetric(semantic.Cosine))
+	assert.IsType(t, &metricMismatchError{}, err)
+
+	for _, opts := range [][]Option{nil, {WithMetric(semantic.Euclidean)}} {
+		reopened, err := New("euclidean", kv, 0, 0, 0, opts...)
+		assert.NoError(t, err)
+		assert.Equal(t, semantic.Euclidean, reopened.Metric())
+	}
+}
+
+func TestWithMetric(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("euclidean", kv, 1, 1, 2, WithMetric(semantic.Euclidean))
+	assert.NoError(t, err)
+
+	// Same direction, so that both items share the query's bucket.
+	assert.NoError(t, l.AddBatch([]Item{{ID: "near", Embedding: []float64{1, 1}}, {ID: "far", Embedding: []float64{5, 5}}}))
+
+	ids, err := l.Get([]float64{1.2, 1.2}, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, ids)
+
+	_, err = l.Get([]float64{1.2, 1.2}, -1, 0)
+	assert.IsType(t, &invalidDistanceThresholdError{}, err)
+
+	ids, err = l.GetPercentile([]float64{1.2, 1.2}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, ids)
+
+	dot, err := New("dot", kv, 1, 1, 2, WithMetric(semantic.DotProduct))
+	assert.NoError(t, err)
+
+	// Dot products accept thresholds above 1.
+	_, err = dot.Get([]float64{1, 1}, 10, 0)
+	assert.NoError(t, err)
+
+	l1, err := New("l1", kv, 1, 1, 2, WithMetric(semantic.L1))
+	assert.NoError(t, err)
+	assert.NoError(t, l1.AddBatch([]Item{{ID: "near", Embedding: []float64{1, 1}}, {ID: "far", Embedding: []float64{5, 5}}}))
+
+	// L1 thresholds are negated distances.
+	ids, err = l1.Get([]float64{1.2, 1.2}, -1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, ids)
+
+	_, err = l1.Get([]float64{1.2, 1.2}, 1, 0)
+	assert.IsType(t, &invalidL1ThresholdError{}, err)
+}
+
+func TestDrop(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 2, 2, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Add("x", []float64{1, 2}))
+
+	// An index whose name extends the dropped one's is left alone.
+	other, err := New("ab", kv, 2, 2, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, other.Add("y", []float64{1, 2}))
+
+	assert.NoError(t, l.Drop())
+
+	keys, err := kv.GetKeysWithPrefix(getIndexKey("", "a"))
+	assert.NoError(t, err)
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, getIndexKey("", "ab")), key)
+	}
+
+	names, err := StoredIndexNames(kv, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ab"}, names)
+
+	assert.Equal(t, 1, other.Count())
+
+	// Writes racing the drop fail rather than storing keys a later index of the same name would inherit.
+	assert.IsType(t, &indexDroppedError{}, l.Add("z", []float64{1, 2}))
+	assert.IsType(t, &indexDroppedError{}, l.AddBatch([]Item{{ID: "z", Embedding: []float64{1, 2}}}))
+	assert.IsType(t, &indexDroppedError{}, l.Update("x", []float64{1, 2}))
+	assert.IsType(t, &indexDroppedError{}, l.Delete("x"))
+	assert.NoError(t, l.FlushStats())
+
+	keys, err = kv.GetKeysWithPrefix(getIndexKey("", "a") + KEY_SEPARATOR)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestWithInferredSpaceDim(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 2, 2, 0, WithInferredSpaceDim(true))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), l.SpaceDim())
+
+	// Mixed lengths don't set it.
+	err = l.AddBatch([]Item{{ID: "x", Embedding: []float64{1, 2, 3}}, {ID: "y", Embedding: []float64{1, 2}}})
+	assert.IsType(t, &embeddingLenError{}, err)
+	assert.Equal(t, uint32(0), l.SpaceDim())
+
+	// Still pending after a reopen.
+	l, err = New("a", kv, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), l.SpaceDim())
+
+	assert.NoError(t, l.Add("x", []float64{1, 2, 3}))
+	assert.Equal(t, uint32(3), l.SpaceDim())
+	assert.IsType(t, &embeddingLenError{}, l.Add("y", []float64{1, 2}))
+
+	reopened, err := New("a", kv, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), reopened.SpaceDim())
+	assert.Equal(t, 1, reopened.Count())
+
+	ids, err := reopened.Get([]float64{1, 2, 3}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, ids)
+}
+
+type queryRecorder struct {
+	indexName                  string
+	numCandidates, numReturned int
+	calls                      int
+}
+
+func (r *queryRecorder) OnQuery(indexName string, numCandidates, numReturned int, dur time.Duration) {
+	r.indexName, r.numCandidates, r.numReturned = indexName, numCandidates, numReturned
+	r.calls++
+}
+
+func TestWithObserver(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	recorder := &queryRecorder{}
+
+	l, err := New("a", kv, 1, 1, 2, WithObserver(recorder))
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.AddBatch([]Item{
+		{ID: "x", Embedding: []float64{1, 2}},
+		{ID: "y", Embedding: []float64{1, 2.1}},
+		{ID: "z", Embedding: []float64{1, -2}},
+	}))
+
+	neighbors, err := l.Get([]float64{1, 2}, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, recorder.calls)
+	assert.Equal(t, "a", recorder.indexName)
+	assert.Equal(t, len(neighbors), recorder.numReturned)
+	assert.GreaterOrEqual(t, recorder.numCandidates, recorder.numReturned)
+
+	// Failed queries aren't reported.
+	_, err = l.Get([]float64{1}, 0.99, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 1, recorder.calls)
+}
+
+func TestWithPrecomputeNorms(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 2, 2, 2, WithPrecomputeNorms(true), WithEmbeddingCodec(Float32Codec))
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.AddBatch([]Item{{ID: "x", Embedding: []float64{3, 4}}, {ID: "y", Embedding: []float64{6, 8}}}))
+
+	norm, err := l.getNorm(kv, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, norm)
+
+	ids, err := l.Get([]float64{3, 4}, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, ids)
+
+	// Normalizing rewrites the norms along with the embeddings.
+	assert.NoError(t, l.MigrateNormalize())
+
+	norm, err = l.getNorm(kv, "y")
+	assert.NoError(t, err)
+	assert.InDelta(t, 1, norm, 1e-6)
+
+	assert.NoError(t, l.Delete("x"))
+
+	exists, err := kv.KeyExists(getNormKey("", "a", "x"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	reopened, err := New("a", kv, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, reopened.precomputeNorms)
+}
+
+func TestBucketStats(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 1, 1, 2)
+	assert.NoError(t, err)
+
+	stats, err := l.BucketStats()
+	assert.NoError(t, err)
+	assert.Equal(t, BucketStats{}, stats)
+
+	// Opposite vectors fall on opposite sides of the single hyperplane.
+	assert.NoError(t, l.AddBatch([]Item{
+		{ID: "x", Embedding: []float64{1, 2}},
+		{ID: "y", Embedding: []float64{2, 4}},
+		{ID: "z", Embedding: []float64{-1, -2}},
+	}))
+
+	stats, err = l.BucketStats()
+	assert.NoError(t, err)
+	assert.Equal(t, BucketStats{NumBuckets: 2, MinSize: 1, MaxSize: 2, MeanSize: 1.5, Singletons: 1}, stats)
+}
+
+func TestBucketPrefix(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 1, 3, 2)
+	assert.NoError(t, err)
+
+	// A sketch that the bucket's sketch is a prefix of, with an ID that extends the bucket member's.
+	err = kv.Add(map[string][]byte{
+		getSketchKey("", "a", "101", "a"):   []byte("a"),
+		getSketchKey("", "a", "1011", "ab"): []byte("ab"),
+	})
+	assert.NoError(t, err)
+
+	ids, err := l.getBucketIDs(kv, "101")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+
+	size, err := kv.CountWithPrefix(getBucketPrefixKey("", "a", "101"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
+
+func TestGetTopK(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	// Scaled copies of a vector share every bucket, and Euclidean distances tell them apart.
+	l, err := New("a", kv, 2, 2, 2, WithMetric(semantic.Euclidean))
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.AddBatch([]Item{
+		{ID: "x", Embedding: []float64{1, 2}},
+		{ID: "y", Embedding: []float64{2, 4}},
+		{ID: "z", Embedding: []float64{3, 6}},
+	}))
+
+	ids, err := l.Get([]float64{1, 2}, 0.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, ids)
+
+	ids, err = l.GetTopK([]float64{1, 2}, 2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, ids)
+
+	// A single candidate is gathered.
+	ids, err = l.GetTopK([]float64{1, 2}, 1, 1)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+
+	unranked, err := New("unranked", kv, 2, 2, 2, WithStoreEmbeddings(false))
+	assert.NoError(t, err)
+
+	_, err = unranked.GetTopK([]float64{1, 2}, 1, 1)
+	assert.IsType(t, &embeddingsNotStoredError{}, err)
+}
+
+func TestMeta(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 1, 3, 2)
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{{ID: "a", Embedding: []float64{1, 0}, Meta: []byte("x")}, {ID: "b", Embedding: []float64{0, 1}}})
+	assert.NoError(t, err)
+
+	metas, err := l.Meta([]string{"a", "b", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("x"), nil, nil}, metas)
+
+	// Nil metadata leaves the stored one in place.
+	assert.NoError(t, l.AddBatch([]Item{{ID: "a", Embedding: []float64{1, 1}}}))
+
+	metas, err = l.Meta([]string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("x")}, metas)
+
+	ids, metas, err := l.GetWithMeta([]float64{1, 1}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+	assert.Equal(t, [][]byte{[]byte("x")}, metas)
+
+	assert.NoError(t, l.Delete("a"))
+
+	exists, err := kv.KeyExists(getMetaKey("", "a", "a"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestGetFiltered(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 1, 3, 2, WithMaxCandidates(1))
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "en", Embedding: []float64{1, 2}, Meta: []byte("en")},
+		{ID: "fr", Embedding: []float64{1, 2}, Meta: []byte("fr")},
+		{ID: "none", Embedding: []float64{1, 2}},
+	})
+	assert.NoError(t, err)
+
+	isEN := func(meta []byte) bool { return string(meta) == "en" }
+
+	// Rejected candidates don't count toward MaxCandidates.
+	neighbors, err := l.GetFiltered([]float64{1, 2}, 0.9, 0, isEN)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"en"}, neighbors)
+
+	neighbors, err = l.GetFiltered([]float64{1, 2}, 0.9, 0, func(meta []byte) bool { return meta == nil })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"none"}, neighbors)
+}
+
+func TestGetPreFiltered(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 2, 3, 2)
+	assert.NoError(t, err)
+
+	err = l.AddBatch([]Item{
+		{ID: "near", Embedding: []float64{1, 2}},
+		{ID: "far", Embedding: []float64{1, 2}},
+		{ID: "legacy", Embedding: []float64{1, 2}},
+	})
+	assert.NoError(t, err)
+
+	sks, err := l.getSketches([]float64{1, 2})
+	assert.NoError(t, err)
+
+	// Fake the sketches' distances: every bit of far's differs from the query's, and legacy predates them.
+	flipped := []byte(strings.Join(sks, ""))
+	for i := range flipped {
+		flipped[i] = flipBit(flipped[i])
+	}
+	assert.NoError(t, kv.Add(map[string][]byte{getIDSketchKey("", "a", "far"): flipped}))
+	assert.NoError(t, kv.Del(getIDSketchKey("", "a", "legacy")))
+
+	neighbors, err := l.GetPreFiltered([]float64{1, 2}, 0.9, 0, 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"near", "legacy"}, neighbors)
+
+	neighbors, err = l.GetPreFiltered([]float64{1, 2}, 0.9, 0, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"near", "far", "legacy"}, neighbors)
+
+	// Pruning a round drops its bits from the stored sketches.
+	assert.NoError(t, l.PruneRounds(context.Background(), 0))
+
+	sk, err := kv.Get(getIDSketchKey("", "a", "near"))
+	assert.NoError(t, err)
+	assert.Equal(t, sks[1], string(sk))
+
+	assert.NoError(t, l.Delete("near"))
+
+	exists, err := kv.KeyExists(getIDSketchKey("", "a", "near"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestGetSketchesParallel(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 50, 20, 384, WithSeed(1))
+	assert.NoError(t, err)
+
+	embedding := seededItems(rand.New(rand.NewSource(1)), 1, 384)[0].Embedding
+
+	want, err := l.getSketchesSequential(embedding)
+	assert.NoError(t, err)
+
+	got, err := l.getSketchesParallel(embedding)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = l.getSketchesParallel(embedding[:2])
+	assert.Error(t, err)
+}
+
+// BenchmarkGetSketches compares sequential and parallel sketching, to tune PARALLEL_SKETCH_MIN_WORK.
+func BenchmarkGetSketches(b *testing.B) {
+	sketchCases := []struct {
+		numRounds      uint32
+		numHyperPlanes uint32
+		spaceDim       uint32
+	}{
+		{numRounds: 4, numHyperPlanes: 8, spaceDim: 64},
+		{numRounds: 50, numHyperPlanes: 20, spaceDim: 384},
+	}
+
+	for _, sc := range sketchCases {
+		kv, err := storage.New("")
+		assert.NoError(b, err)
+
+		l, err := New("fake-index-name", kv, sc.numRounds, sc.numHyperPlanes, sc.spaceDim, WithSeed(BENCH_SEED))
+		assert.NoError(b, err)
+
+		embedding := seededItems(rand.New(rand.NewSource(BENCH_SEED)), 1, int(sc.spaceDim))[0].Embedding
+
+		for name, getSketches := range map[string]func([]float64) ([]string, error){
+			"sequential": l.getSketchesSequential,
+			"parallel":   l.getSketchesParallel,
+		} {
+			b.Run(fmt.Sprintf("rounds=%d/hyperplanes=%d/dim=%d/%s", sc.numRounds, sc.numHyperPlanes, sc.spaceDim, name), func(b *testing.B) {
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := getSketches(embedding); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+
+		kv.CloseDB()
+	}
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	c := newEmbeddingCache(2)
+
+	c.add("a", []float64{1}, 0)
+	c.add("b", []float64{2}, 0)
+
+	// Reading "a" makes "b" the least recently used, evicted by "c".
+	_, ok := c.get("a")
+	assert.True(t, ok)
+
+	c.add("c", []float64{3}, 0)
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+
+	embed, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []float64{1}, embed)
+
+	// Embeddings read before an invalidation aren't cached.
+	gen := c.generation()
+	c.remove("a")
+	c.add("b", []float64{2}, gen)
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+
+	c.purge()
+
+	_, ok = c.get("c")
+	assert.False(t, ok)
+
+	// A nil cache is disabled.
+	var disabled *embeddingCache
+	disabled.add("a", []float64{1}, 0)
+	_, ok = disabled.get("a")
+	assert.False(t, ok)
+	assert.Nil(t, newEmbeddingCache(0))
+}
+
+func TestGet_EmbeddingCache(t *testing.T) {
+	kv, err := storage.New("")
+	assert.NoError(t, err)
+	defer kv.CloseDB()
+
+	l, err := New("a", kv, 1, 1, 2, WithEmbeddingCacheSize(10))
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.AddBatch([]Item{{ID: "x", Embedding: []float64{1, 2}}, {ID: "y", Embedding: []float64{2, 4}}}))
+
+	neighbors, err := l.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"x", "y"}, neighbors)
+
+	embed, ok := l.embeddingCache.get("x")
+	assert.True(t, ok)
+	assert.Equal(t, []float64{1, 2}, embed)
+
+	// Writes evict their items, so that Get never scores a stale vector.
+	assert.NoError(t, l.Update("x", []float64{2, -1}))
+
+	_, ok = l.embeddingCache.get("x")
+	assert.False(t, ok)
+
+	neighbors, err = l.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"y"}, neighbors)
+
+	assert.NoError(t, l.Delete("y"))
+
+	_, ok = l.embeddingCache.get("y")
+	assert.False(t, ok)
+
+	neighbors, err = l.Get([]float64{2, -1}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, neighbors)
+
+	_, ok = l.embeddingCache.get("x")
+	assert.True(t, ok)
+
+	l.PurgeEmbeddingCache()
+
+	_, ok = l.embeddingCache.get("x")
+	assert.False(t, ok)
 }
@@ -0,0 +1,189 @@
+package lsh
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/mastrasec/vectoria/internal/semantic"
+)
+
+// RoundOrder defines the order in which the rounds' buckets are read when gathering candidates.
+type RoundOrder uint8
+
+const (
+	// NaturalOrder reads buckets following the rounds' order.
+	NaturalOrder RoundOrder = iota
+
+	// SelectiveFirst reads the smallest buckets first, estimating their sizes by key count.
+	// Paired with a candidate cap, it maximizes the unique candidates gathered per read.
+	SelectiveFirst
+)
+
+// EmbeddingCodec defines how embeddings are encoded in storage.
+type EmbeddingCodec uint8
+
+const (
+	// RawCodec stores every value as its 8 bytes.
+	RawCodec EmbeddingCodec = iota
+
+	// DeltaVarintCodec stores the difference between the bits of consecutive values, zigzag and varint encoded.
+	// It's lossless. Zeros and repeated values take a single byte, so sparse embeddings shrink a lot,
+	// but dense ones grow by about 10%. See BenchmarkEmbeddingCodec.
+	DeltaVarintCodec
+
+	// Float32Codec stores every value as a float32, in 4 bytes, halving the size of raw embeddings.
+	// It's lossy: values are rounded to float32 precision when stored.
+	Float32Codec
+)
+
+// Observer is notified of queries, so that they can be measured without this package depending on a metrics library.
+// Its methods are called concurrently, and slow ones slow down queries.
+type Observer interface {
+	// OnQuery is called when Get or GetPrepared succeeds, with the number of candidates gathered from the buckets,
+	// the number of neighbors returned and the query's duration.
+	OnQuery(indexName string, numCandidates, numReturned int, dur time.Duration)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) OnQuery(string, int, int, time.Duration) {}
+
+type Option func(*LSH)
+
+func WithRoundOrder(order RoundOrder) Option {
+	return func(l *LSH) {
+		l.roundOrder = order
+	}
+}
+
+// WithMaxCandidates caps the number of candidates gathered from buckets on Get.
+// Zero means no cap.
+func WithMaxCandidates(maxCandidates uint32) Option {
+	return func(l *LSH) {
+		l.maxCandidates = maxCandidates
+	}
+}
+
+// WithKeyPrefix namespaces every storage key of the index under keyPrefix.
+func WithKeyPrefix(keyPrefix string) Option {
+	return func(l *LSH) {
+		l.keyPrefix = keyPrefix
+	}
+}
+
+// WithStoreEmbeddings sets whether embeddings are persisted. When they aren't, only sketches (bucket membership)
+// are stored and Get returns bucket members unranked. It only applies when the index is created.
+func WithStoreEmbeddings(storeEmbeddings bool) Option {
+	return func(l *LSH) {
+		l.storeEmbeddings = storeEmbeddings
+	}
+}
+
+// WithPrecomputeNorms makes Add store each embedding's Euclidean norm next to it, so that cosine scoring
+// on Get reads it instead of computing it for every candidate. It costs 8 bytes per item, and only pays off
+// for the cosine metric. It only applies when the index is created.
+func WithPrecomputeNorms(precompute bool) Option {
+	return func(l *LSH) {
+		l.precomputeNorms = precompute
+	}
+}
+
+// WithFallbackRadius makes Get probe the Hamming-nearest non-empty buckets, up to radius bit flips away,
+// when a round's exact bucket is empty. Zero disables the fallback.
+func WithFallbackRadius(radius uint32) Option {
+	return func(l *LSH) {
+		l.fallbackRadius = radius
+	}
+}
+
+// WithSimilarityEpsilon sets the tolerance applied when comparing similarities to the threshold on Get.
+func WithSimilarityEpsilon(epsilon float64) Option {
+	return func(l *LSH) {
+		l.semOpts = append(l.semOpts, semantic.WithEpsilon(epsilon))
+	}
+}
+
+// WithMetric sets how candidates are scored on Get. Defaults to semantic.Cosine. Buckets group vectors by angle
+// whatever the metric, so with semantic.Euclidean, vectors close in distance but far in angle may be missed.
+// For semantic.Euclidean, thresholds are maximum distances and results are sorted by ascending distance.
+// For semantic.L1, scores are negated distances, so thresholds are non-positive.
+// The metric is stored with the index: reopening it with another one fails, and without WithMetric uses it.
+func WithMetric(metric semantic.Metric) Option {
+	return func(l *LSH) {
+		l.metric = metric
+		l.metricGiven = true
+	}
+}
+
+// WithSeed seeds the hyperplanes' generation, so that the same seed and hyperparameters yield the same sketches.
+// Zero picks a random seed. It only applies when the index is created.
+func WithSeed(seed int64) Option {
+	return func(l *LSH) {
+		l.seed = seed
+	}
+}
+
+// WithEmbeddingCacheSize keeps up to size decoded embeddings in memory, the most recently read ones, so that hot
+// candidates aren't read and decoded again on every Get. Zero, the default, disables the cache.
+func WithEmbeddingCacheSize(size uint32) Option {
+	return func(l *LSH) {
+		l.embeddingCache = newEmbeddingCache(size)
+	}
+}
+
+// WithSkipCorrupt makes Get skip, and log, candidates whose stored embedding can't be decoded
+// or doesn't match the index's dimension, instead of failing the whole query.
+func WithSkipCorrupt(skipCorrupt bool) Option {
+	return func(l *LSH) {
+		l.skipCorrupt = skipCorrupt
+	}
+}
+
+// WithStrictHyperParams makes New fail with a hyperParamTooSmallError on hyperparameters below their minimum,
+// instead of silently raising them to it. It only applies when the index is created.
+func WithStrictHyperParams(strict bool) Option {
+	return func(l *LSH) {
+		l.strictHyperParams = strict
+	}
+}
+
+// WithEmbeddingCodec sets how embeddings are encoded in storage. It only applies when the index is created.
+func WithEmbeddingCodec(codec EmbeddingCodec) Option {
+	return func(l *LSH) {
+		l.codec = codec
+	}
+}
+
+// WithInferredSpaceDim makes a new index created with a zero spaceDim take the length of the first embedding
+// added to it, instead of MIN_SPACE_DIM. Its hyperplanes are generated then. It only applies when the index is created.
+func WithInferredSpaceDim(infer bool) Option {
+	return func(l *LSH) {
+		l.inferSpaceDim = infer
+	}
+}
+
+// WithReadOnly makes New reopen a stored index without writing to kv, e.g. a read-only storage: the running stats
+// of indexes stored before they were maintained are computed on every New instead of once.
+func WithReadOnly(readOnly bool) Option {
+	return func(l *LSH) {
+		l.readOnly = readOnly
+	}
+}
+
+// WithLogger sets the logger errors are logged with, including the scoring ones. Nil keeps the default,
+// slog's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(l *LSH) {
+		l.logger = logger
+		l.semOpts = append(l.semOpts, semantic.WithLogger(logger))
+	}
+}
+
+// WithObserver sets the Observer notified of queries. Nil keeps the default, which does nothing.
+func WithObserver(observer Observer) Option {
+	return func(l *LSH) {
+		if observer != nil {
+			l.observer = observer
+		}
+	}
+}
@@ -1,9 +1,22 @@
 package semantic
 
-type vectorsNotSameLenError struct{}
+import (
+	"fmt"
+
+	"github.com/mastrasec/vectoria/internal/errs"
+)
+
+type vectorsNotSameLenError struct {
+	lenA int
+	lenB int
+}
 
 func (e *vectorsNotSameLenError) Error() string {
-	return "vectors must have the same length"
+	return fmt.Sprintf("vectors must have the same length (got: %d and %d)", e.lenA, e.lenB)
+}
+
+func (e *vectorsNotSameLenError) Unwrap() error {
+	return &errs.DimensionMismatchError{Expected: e.lenA, Got: e.lenB}
 }
 
 type emptyVectorError struct{}
@@ -11,3 +24,7 @@ type emptyVectorError struct{}
 func (e *emptyVectorError) Error() string {
 	return "vector cannot be empty"
 }
+
+func (e *emptyVectorError) Unwrap() error {
+	return &errs.EmptyVectorError{}
+}
@@ -2,65 +2,687 @@ package semantic
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"math"
+	"runtime"
 	"slices"
 	"sort"
+	"sync"
 )
 
 const EPSILON = 1e-10
 
-type Semantic struct{}
+// DEFAULT_SIM_EPSILON is the default tolerance when comparing a similarity to the threshold,
+// so that identical vectors still meet a threshold of 1 despite floating-point rounding.
+const DEFAULT_SIM_EPSILON = 1e-9
+
+// From this many candidates, searches score them in parallel, given several CPUs. Below it, starting goroutines
+// would cost more than it saves.
+const PARALLEL_SEARCH_MIN_CANDIDATES = 2048
+
+// Metric selects how candidates are scored against the query.
+type Metric uint8
+
+const (
+	// Cosine scores by the cosine of the angle between vectors.
+	Cosine Metric = iota
+
+	// Pearson scores by the cosine between mean-centered vectors (Pearson correlation).
+	// Constant vectors have zero variance and are handled like zero-norm vectors.
+	Pearson
+
+	// L1 scores by the negated Manhattan distance, so that higher is still more similar and identical vectors score 0.
+	// Thresholds are therefore non-positive: -2 keeps candidates within an L1 distance of 2.
+	L1
+
+	// DotProduct scores by the dot product, which equals Cosine on normalized vectors but skips computing norms.
+	// Scores are unbounded on unnormalized vectors.
+	DotProduct
+
+	// Euclidean scores by the Euclidean (L2) distance. Unlike the other metrics, lower is more similar:
+	// the threshold is a maximum distance and neighbors are sorted by ascending score.
+	Euclidean
+)
+
+// String returns the metric's name, or its number when it is unknown.
+func (m Metric) String() string {
+	switch m {
+	case Cosine:
+		return "cosine"
+	case Pearson:
+		return "pearson"
+	case L1:
+		return "l1"
+	case DotProduct:
+		return "dot_product"
+	case Euclidean:
+		return "euclidean"
+	default:
+		return fmt.Sprintf("Metric(%d)", uint8(m))
+	}
+}
+
+// IsDistance reports whether the metric's scores are distances, for which lower is more similar.
+func (m Metric) IsDistance() bool {
+	return m == Euclidean
+}
+
+// Closer reports whether score a is more similar than score b under the metric.
+func (m Metric) Closer(a, b float64) bool {
+	if m.IsDistance() {
+		return a < b
+	}
+
+	return a > b
+}
+
+// MatchAll returns the threshold that every score meets under the metric.
+func (m Metric) MatchAll() float64 {
+	if m.IsDistance() {
+		return math.Inf(1)
+	}
+
+	return math.Inf(-1)
+}
+
+type Semantic struct {
+	metric Metric
+
+	// Similarities within epsilon below the threshold are treated as meeting it.
+	epsilon float64
+
+	// Logs errors. Nil uses slog's default logger.
+	logger *slog.Logger
+}
+
+type Option func(*Semantic)
+
+// WithEpsilon sets the tolerance applied when comparing a similarity to the threshold.
+// Zero makes the comparison exact.
+func WithEpsilon(epsilon float64) Option {
+	return func(s *Semantic) {
+		s.epsilon = epsilon
+	}
+}
+
+// WithLogger sets the logger errors are logged with. Nil keeps the default, slog's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Semantic) {
+		s.logger = logger
+	}
+}
 
 type Contract interface {
 	Search(queryVec []float64, candidates map[string][]float64, threshold float64, k uint32) (res []string, err error)
+	SearchScored(queryVec []float64, candidates map[string][]float64, threshold float64, k uint32) (res []Neighbor, err error)
+	SearchFunc(queryVec []float64, candidates map[string][]float64, threshold float64, fn func(neighbor Neighbor) error) (err error)
+	NewQuery(queryVec []float64) (query Query, err error)
+	SearchQuery(query Query, candidates map[string][]float64, threshold float64, k uint32) (res []string, err error)
+	SearchQueryWithNorms(query Query, candidates map[string][]float64, norms map[string]float64, threshold float64, k uint32) (res []string, err error)
+	SearchQueryFunc(query Query, candidates map[string][]float64, threshold float64, fn func(neighbor Neighbor) error) (err error)
+	SearchQueryBlock(query Query, block *Block, threshold float64, k uint32) (res []Neighbor, err error)
+}
+
+func New(opts ...Option) *Semantic {
+	return NewWithMetric(Cosine, opts...)
 }
 
-func New() *Semantic {
-	return &Semantic{}
+func NewWithMetric(metric Metric, opts ...Option) *Semantic {
+	s := &Semantic{
+		metric:  metric,
+		epsilon: DEFAULT_SIM_EPSILON,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type Neighbor struct {
+	ID    string
+	Score float64
+}
+
+// Query is a query vector prepared for scoring: preprocessed for the metric, with its norm computed once.
+// Reuse it to search several candidate sets without recomputing either.
+type Query struct {
+	vec  []float64
+	norm float64
+
+	// Orders candidates of equal similarity by their similarity to it. When nil, ties are ordered by ID.
+	tieBreaker *Query
+}
+
+func (s *Semantic) NewQuery(queryVec []float64) (Query, error) {
+	queryVec = s.prepare(queryVec)
+
+	norm, err := euclideanNorm(queryVec)
+	if err != nil {
+		logErr(s.logger, err, "NewQuery")
+		return Query{}, err
+	}
+
+	return Query{vec: queryVec, norm: norm}, nil
+}
+
+// NewQueryWithTieBreaker is like NewQuery, ranking candidates whose similarity to queryVec is equal
+// by their similarity to tieBreakerVec, which must have the same length. It never changes which candidates match.
+func (s *Semantic) NewQueryWithTieBreaker(queryVec, tieBreakerVec []float64) (Query, error) {
+	if len(tieBreakerVec) != len(queryVec) {
+		err := &vectorsNotSameLenError{len(queryVec), len(tieBreakerVec)}
+		logErr(s.logger, err, "NewQueryWithTieBreaker")
+		return Query{}, err
+	}
+
+	query, err := s.NewQuery(queryVec)
+	if err != nil {
+		return Query{}, err
+	}
+
+	tieBreaker, err := s.NewQuery(tieBreakerVec)
+	if err != nil {
+		logErr(s.logger, err, "NewQueryWithTieBreaker")
+		return Query{}, err
+	}
+
+	query.tieBreaker = &tieBreaker
+
+	return query, nil
 }
 
 func (s *Semantic) Search(queryVec []float64, candidates map[string][]float64, threshold float64, k uint32) (ids []string, err error) {
-	numCandidates := len(candidates)
-	ids = make([]string, 0, numCandidates)
-	simMap := make(map[string]float64, numCandidates)
+	query, err := s.NewQuery(queryVec)
+	if err != nil {
+		logErr(s.logger, err, "Search")
+		return nil, err
+	}
+
+	return s.SearchQuery(query, candidates, threshold, k)
+}
 
-	queryVecNorm, err := euclideanNorm(queryVec)
+// SearchQuery is like Search, for a prepared query.
+func (s *Semantic) SearchQuery(query Query, candidates map[string][]float64, threshold float64, k uint32) (ids []string, err error) {
+	neighbors, err := s.searchQueryScored(query, candidates, threshold, k)
 	if err != nil {
-		logErr(err, "SimSearch")
+		logErr(s.logger, err, "SearchQuery")
 		return nil, err
 	}
 
-	for id, candidate := range candidates {
-		candidateNorm, err := euclideanNorm(candidate)
+	ids = make([]string, len(neighbors))
+	for i, neighbor := range neighbors {
+		ids[i] = neighbor.ID
+	}
+
+	return ids, nil
+}
+
+// SearchQueryWithNorms is like SearchQuery, taking the candidates' Euclidean norms from norms instead of
+// computing them, for candidates whose norm is known ahead. Only Cosine uses them: other metrics ignore norms.
+func (s *Semantic) SearchQueryWithNorms(query Query, candidates map[string][]float64, norms map[string]float64, threshold float64, k uint32) (ids []string, err error) {
+	neighbors, err := s.scoreAll(query, candidates, norms, threshold)
+	if err != nil {
+		logErr(s.logger, err, "SearchQueryWithNorms")
+		return nil, err
+	}
+
+	neighbors, err = s.rank(query, neighbors, func(id string) []float64 { return candidates[id] }, k)
+	if err != nil {
+		logErr(s.logger, err, "SearchQueryWithNorms")
+		return nil, err
+	}
+
+	ids = make([]string, len(neighbors))
+	for i, neighbor := range neighbors {
+		ids[i] = neighbor.ID
+	}
+
+	return ids, nil
+}
+
+// SearchScored is like Search, but also returns the similarity of each neighbor, sorted descending.
+func (s *Semantic) SearchScored(queryVec []float64, candidates map[string][]float64, threshold float64, k uint32) (neighbors []Neighbor, err error) {
+	query, err := s.NewQuery(queryVec)
+	if err != nil {
+		logErr(s.logger, err, "SearchScored")
+		return nil, err
+	}
+
+	return s.searchQueryScored(query, candidates, threshold, k)
+}
+
+func (s *Semantic) searchQueryScored(query Query, candidates map[string][]float64, threshold float64, k uint32) (neighbors []Neighbor, err error) {
+	neighbors, err = s.scoreAll(query, candidates, nil, threshold)
+	if err != nil {
+		logErr(s.logger, err, "searchQueryScored")
+		return nil, err
+	}
+
+	return s.rank(query, neighbors, func(id string) []float64 { return candidates[id] }, k)
+}
+
+// scoreAll returns the candidates meeting threshold with their scores, in no particular order, taking their norms
+// from norms when there. Large candidate sets are scored in parallel.
+func (s *Semantic) scoreAll(query Query, candidates map[string][]float64, norms map[string]float64, threshold float64) ([]Neighbor, error) {
+	if len(candidates) >= PARALLEL_SEARCH_MIN_CANDIDATES && runtime.NumCPU() > 1 {
+		return s.scoreAllParallel(query, candidates, norms, threshold)
+	}
+
+	neighbors := make([]Neighbor, 0, len(candidates))
+
+	err := s.searchQueryFunc(query, candidates, norms, threshold, func(neighbor Neighbor) error {
+		neighbors = append(neighbors, neighbor)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// scoreAllParallel is like scoreAll, splitting the candidates in one chunk per CPU, each scored by its own worker
+// into its own slice. Slices are merged in chunk order, which rank's tie-breaking by ID makes irrelevant anyway.
+func (s *Semantic) scoreAllParallel(query Query, candidates map[string][]float64, norms map[string]float64, threshold float64) ([]Neighbor, error) {
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+
+	var (
+		wg         sync.WaitGroup
+		numWorkers = min(runtime.NumCPU(), len(ids))
+		chunkSize  = (len(ids) + numWorkers - 1) / numWorkers
+		results    = make([][]Neighbor, numWorkers)
+		errs       = make([]error, numWorkers)
+	)
+
+	wg.Add(numWorkers)
+
+	for w := 0; w < numWorkers; w++ {
+		go func(w int) {
+			defer wg.Done()
+
+			chunk := ids[min(w*chunkSize, len(ids)):min((w+1)*chunkSize, len(ids))]
+			local := make([]Neighbor, 0, len(chunk))
+
+			for _, id := range chunk {
+				norm, ok := norms[id]
+				if !ok {
+					norm = -1
+				}
+
+				sim, err := s.scoreWithNorm(query, candidates[id], norm)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+
+				if s.meets(sim, threshold) {
+					local = append(local, Neighbor{ID: id, Score: sim})
+				}
+			}
+
+			results[w] = local
+		}(w)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			logErr(s.logger, err, "scoreAllParallel")
+			return nil, err
+		}
+	}
+
+	neighbors := make([]Neighbor, 0, len(ids))
+	for _, local := range results {
+		neighbors = append(neighbors, local...)
+	}
+
+	return neighbors, nil
+}
+
+// rank sorts neighbors from the most to the least similar and keeps the best k of them, or all when k is 0.
+// Equal scores are ordered by the query's tie-breaker, if any, scored against the vectors vecOf returns, then by ID.
+func (s *Semantic) rank(query Query, neighbors []Neighbor, vecOf func(id string) []float64, k uint32) ([]Neighbor, error) {
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Score != neighbors[j].Score {
+			return s.metric.Closer(neighbors[i].Score, neighbors[j].Score)
+		}
+
+		return neighbors[i].ID < neighbors[j].ID
+	})
+
+	if query.tieBreaker != nil {
+		if err := s.breakTies(*query.tieBreaker, neighbors, vecOf); err != nil {
+			logErr(s.logger, err, "rank")
+			return nil, err
+		}
+	}
+
+	neighbors = slices.Clip(neighbors)
+
+	if k == 0 || k > uint32(len(neighbors)) {
+		return neighbors, nil
+	}
+
+	return neighbors[:k], nil
+}
+
+// breakTies reorders each run of equally scored neighbors by similarity to tieBreaker, most similar first,
+// keeping their current order among equals. Only tied neighbors are scored against it.
+func (s *Semantic) breakTies(tieBreaker Query, neighbors []Neighbor, vecOf func(id string) []float64) error {
+	for start := 0; start < len(neighbors); {
+		end := start + 1
+		for end < len(neighbors) && neighbors[end].Score == neighbors[start].Score {
+			end++
+		}
+
+		if end-start > 1 {
+			run := neighbors[start:end]
+
+			scores := make(map[string]float64, len(run))
+			for _, neighbor := range run {
+				score, err := s.score(tieBreaker, vecOf(neighbor.ID))
+				if err != nil {
+					return err
+				}
+
+				scores[neighbor.ID] = score
+			}
+
+			sort.SliceStable(run, func(i, j int) bool {
+				return s.metric.Closer(scores[run[i].ID], scores[run[j].ID])
+			})
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// Block holds embeddings of the same length in a single contiguous row-major slice, next to their IDs,
+// so that scoring them streams linearly through memory instead of following one slice per candidate.
+// It isn't safe for concurrent use.
+type Block struct {
+	dim  int
+	ids  []string
+	data []float64
+
+	// Row of each ID.
+	rows map[string]int
+}
+
+func NewBlock(dim int) *Block {
+	return &Block{dim: dim, rows: make(map[string]int)}
+}
+
+// Add appends an embedding to the block, or overwrites the row of an ID already in it.
+// It must have the block's length.
+func (b *Block) Add(id string, vec []float64) error {
+	if len(vec) != b.dim {
+		err := &vectorsNotSameLenError{b.dim, len(vec)}
+		return err
+	}
+
+	if i, ok := b.rows[id]; ok {
+		copy(b.row(i), vec)
+		return nil
+	}
+
+	b.rows[id] = len(b.ids)
+	b.ids = append(b.ids, id)
+	b.data = append(b.data, vec...)
+
+	return nil
+}
+
+// Delete removes the embedding of id, if in the block, moving the last row in its place.
+func (b *Block) Delete(id string) {
+	i, ok := b.rows[id]
+	if !ok {
+		return
+	}
+
+	last := len(b.ids) - 1
+	if i != last {
+		copy(b.row(i), b.row(last))
+		b.ids[i] = b.ids[last]
+		b.rows[b.ids[i]] = i
+	}
+
+	b.ids = b.ids[:last]
+	b.data = b.data[:last*b.dim]
+	delete(b.rows, id)
+}
+
+func (b *Block) row(i int) []float64 {
+	return b.data[i*b.dim : (i+1)*b.dim]
+}
+
+func (b *Block) Len() int {
+	return len(b.ids)
+}
+
+// SearchQueryBlock is like SearchQuery over the embeddings of a block, returning neighbors sorted from the most similar.
+func (s *Semantic) SearchQueryBlock(query Query, block *Block, threshold float64, k uint32) (neighbors []Neighbor, err error) {
+	neighbors = make([]Neighbor, 0, block.Len())
+
+	for i, id := range block.ids {
+		sim, err := s.score(query, block.row(i))
 		if err != nil {
-			logErr(err, "SimSearch")
+			logErr(s.logger, err, "SearchQueryBlock")
 			return nil, err
 		}
 
-		sim, err := cosineSim(queryVec, candidate, queryVecNorm, candidateNorm)
+		if s.meets(sim, threshold) {
+			neighbors = append(neighbors, Neighbor{ID: id, Score: sim})
+		}
+	}
+
+	return s.rank(query, neighbors, func(id string) []float64 {
+		return block.row(block.rows[id])
+	}, k)
+}
+
+// SearchFunc calls fn with every candidate whose similarity is at least threshold (minus epsilon), or whose distance is
+// at most threshold (plus epsilon) for Euclidean, as soon as it is scored.
+// Candidates are visited in no particular order. It stops on the first error returned by fn.
+func (s *Semantic) SearchFunc(queryVec []float64, candidates map[string][]float64, threshold float64, fn func(neighbor Neighbor) error) error {
+	query, err := s.NewQuery(queryVec)
+	if err != nil {
+		logErr(s.logger, err, "SearchFunc")
+		return err
+	}
+
+	return s.SearchQueryFunc(query, candidates, threshold, fn)
+}
+
+// SearchQueryFunc is like SearchFunc, for a prepared query.
+func (s *Semantic) SearchQueryFunc(query Query, candidates map[string][]float64, threshold float64, fn func(neighbor Neighbor) error) error {
+	return s.searchQueryFunc(query, candidates, nil, threshold, fn)
+}
+
+// searchQueryFunc is like SearchQueryFunc, taking the candidates' norms from norms when there.
+func (s *Semantic) searchQueryFunc(query Query, candidates map[string][]float64, norms map[string]float64, threshold float64, fn func(neighbor Neighbor) error) error {
+	for id, candidate := range candidates {
+		norm, ok := norms[id]
+		if !ok {
+			norm = -1
+		}
+
+		sim, err := s.scoreWithNorm(query, candidate, norm)
+		if err != nil {
+			logErr(s.logger, err, "SearchQueryFunc")
+			return err
+		}
+
+		if s.meets(sim, threshold) {
+			if err := fn(Neighbor{ID: id, Score: sim}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AbovePercentile keeps the neighbors scoring at or above the given percentile (0 to 100) of all scores,
+// using the nearest-rank method. Percentile 0 keeps everything, 100 keeps only the best score (and its ties).
+// Neighbors must be sorted by descending score, as returned by SearchScored.
+func AbovePercentile(neighbors []Neighbor, percentile float64) []Neighbor {
+	return Cosine.AbovePercentile(neighbors, percentile)
+}
+
+// AbovePercentile is like the package-level AbovePercentile, for neighbors sorted from the most similar under the metric,
+// so that distances are kept at or below their percentile.
+func (m Metric) AbovePercentile(neighbors []Neighbor, percentile float64) []Neighbor {
+	n := len(neighbors)
+	if n == 0 {
+		return neighbors
+	}
+
+	// 1-based rank of the cutoff in ascending order.
+	rank := int(math.Ceil(percentile * float64(n) / 100))
+	rank = max(1, min(rank, n))
+
+	cutoff := neighbors[n-rank].Score
+
+	end := 0
+	for end < n && !m.Closer(cutoff, neighbors[end].Score) {
+		end++
+	}
+
+	return neighbors[:end]
+}
+
+// CosineSimilarity returns the cosine of the angle between two vectors, or -1 if either has zero norm.
+func CosineSimilarity(vecA, vecB []float64) (float64, error) {
+	normA, err := euclideanNorm(vecA)
+	if err != nil {
+		return 0, err
+	}
+
+	normB, err := euclideanNorm(vecB)
+	if err != nil {
+		return 0, err
+	}
+
+	return cosineSim(vecA, vecB, normA, normB)
+}
+
+// SimilarityMatrix returns the symmetric matrix of cosine similarities between every pair of vectors,
+// computing each norm once. It takes O(N²) time and memory for N vectors.
+func SimilarityMatrix(vecs [][]float64) ([][]float64, error) {
+	norms := make([]float64, len(vecs))
+	for i, vec := range vecs {
+		norm, err := euclideanNorm(vec)
 		if err != nil {
-			logErr(err, "SimSearch")
 			return nil, err
 		}
 
-		if sim >= threshold {
-			simMap[id] = sim
-			ids = append(ids, id)
+		norms[i] = norm
+	}
+
+	matrix := make([][]float64, len(vecs))
+	for i := range matrix {
+		matrix[i] = make([]float64, len(vecs))
+	}
+
+	for i := range vecs {
+		for j := i; j < len(vecs); j++ {
+			sim, err := cosineSim(vecs[i], vecs[j], norms[i], norms[j])
+			if err != nil {
+				return nil, err
+			}
+
+			matrix[i][j], matrix[j][i] = sim, sim
+		}
+	}
+
+	return matrix, nil
+}
+
+// score returns the metric's similarity between the query and a candidate.
+// Higher is more similar, except for distances (see Metric.IsDistance).
+func (s *Semantic) score(query Query, candidate []float64) (float64, error) {
+	return s.scoreWithNorm(query, candidate, -1)
+}
+
+// scoreWithNorm is like score, with the candidate's Euclidean norm given. Negative norms are computed instead.
+func (s *Semantic) scoreWithNorm(query Query, candidate []float64, candidateNorm float64) (float64, error) {
+	switch s.metric {
+	case L1:
+		dist, err := l1Distance(query.vec, candidate)
+		if err != nil {
+			return 0, err
 		}
+
+		return -dist, nil
+	case DotProduct:
+		return dotProduct(query.vec, candidate)
+	case Euclidean:
+		return euclideanDistance(query.vec, candidate)
 	}
 
-	sort.Slice(ids, func(i, j int) bool {
-		return simMap[ids[i]] > simMap[ids[j]]
-	})
+	candidate = s.prepare(candidate)
+
+	// Identical vectors are exactly similar, where computing it would round to slightly less than 1.
+	if query.norm > EPSILON && slices.Equal(query.vec, candidate) {
+		return 1, nil
+	}
+
+	// Pearson's norm is the one of the centered candidate, which the given one isn't.
+	if candidateNorm < 0 || s.metric != Cosine {
+		var err error
+		if candidateNorm, err = euclideanNorm(candidate); err != nil {
+			return 0, err
+		}
+	}
+
+	return cosineSim(query.vec, candidate, query.norm, candidateNorm)
+}
 
-	ids = slices.Clip(ids)
+// meets reports whether a score meets the threshold, within epsilon.
+func (s *Semantic) meets(score, threshold float64) bool {
+	if s.metric.IsDistance() {
+		return score <= threshold+s.epsilon
+	}
+
+	return score >= threshold-s.epsilon
+}
 
-	if k == 0 || k > uint32(len(ids)) {
-		return ids, nil
+// prepare applies the metric-specific preprocessing to a vector. It never modifies the input.
+func (s *Semantic) prepare(vec []float64) []float64 {
+	if s.metric == Pearson {
+		return center(vec)
 	}
 
-	return ids[:k], nil
+	return vec
+}
+
+func center(vec []float64) []float64 {
+	if len(vec) == 0 {
+		return vec
+	}
+
+	var mean float64
+	for _, val := range vec {
+		mean += val
+	}
+	mean /= float64(len(vec))
+
+	centered := make([]float64, len(vec))
+	for i, val := range vec {
+		centered[i] = val - mean
+	}
+
+	return centered
 }
 
 func cosineSim(vecA, vecB []float64, normA, normB float64) (sim float64, err error) {
@@ -78,28 +700,57 @@ func cosineSim(vecA, vecB []float64, normA, normB float64) (sim float64, err err
 	return sim, nil
 }
 
+// EuclideanNorm returns the length of a vector, as cosine similarity uses it.
+func EuclideanNorm(vec []float64) (float64, error) {
+	return euclideanNorm(vec)
+}
+
 func euclideanNorm(vec []float64) (float64, error) {
 	var err error
 
 	if len(vec) == 0 {
 		err = new(emptyVectorError)
-		logErr(err, "dotProduct")
 		return 0, err
 	}
 
 	squaredEuclideanNorm, err := dotProduct(vec, vec)
 	if err != nil {
-		logErr(err, "EuclideanNorm")
 		return 0, err
 	}
 
 	return math.Sqrt(squaredEuclideanNorm), nil
 }
 
+func l1Distance(vecA, vecB []float64) (dist float64, err error) {
+	if len(vecA) != len(vecB) {
+		err = &vectorsNotSameLenError{len(vecA), len(vecB)}
+		return 0, err
+	}
+
+	for i := range vecA {
+		dist += math.Abs(vecA[i] - vecB[i])
+	}
+
+	return dist, nil
+}
+
+func euclideanDistance(vecA, vecB []float64) (dist float64, err error) {
+	if len(vecA) != len(vecB) {
+		err = &vectorsNotSameLenError{len(vecA), len(vecB)}
+		return 0, err
+	}
+
+	for i := range vecA {
+		diff := vecA[i] - vecB[i]
+		dist += diff * diff
+	}
+
+	return math.Sqrt(dist), nil
+}
+
 func dotProduct(vecA, vecB []float64) (res float64, err error) {
 	if len(vecA) != len(vecB) {
-		err = new(vectorsNotSameLenError)
-		logErr(err, "dotProduct")
+		err = &vectorsNotSameLenError{len(vecA), len(vecB)}
 		return 0, err
 	}
 
@@ -110,8 +761,13 @@ func dotProduct(vecA, vecB []float64) (res float64, err error) {
 	return res, nil
 }
 
-func logErr(err error, trace string) {
-	slog.LogAttrs(
+// logErr logs err with logger, or with the default logger when it is nil.
+func logErr(logger *slog.Logger, err error, trace string) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.LogAttrs(
 		context.TODO(),
 		slog.LevelError,
 		err.Error(),
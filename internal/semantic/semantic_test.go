@@ -1,13 +1,17 @@
 package semantic
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"math/rand"
 	"os"
+	"slices"
 	"testing"
 
+	"github.com/mastrasec/vectoria/internal/errs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -182,6 +186,341 @@ func TestSearch(t *testing.T) {
 	}
 }
 
+func TestSearchScored(t *testing.T) {
+	queryVec := []float64{1.0, 2.0, 3.0}
+	candidates := map[string][]float64{
+		"a": {1.0, 2.0, 3.0}, // sim ~ 0.9999
+		"b": {4.0, 5.0, 6.0}, // sim ~ 0.9746
+		"c": {7.0, 8.0, 9.0}, // sim ~ 0.9594
+	}
+
+	s := New()
+
+	got, err := s.SearchScored(queryVec, candidates, 0.96, 0)
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	assert.Equal(t, "a", got[0].ID)
+	assert.InDelta(t, 1.0, got[0].Score, 1e-9)
+
+	assert.Equal(t, "b", got[1].ID)
+	assert.InDelta(t, 0.9746, got[1].Score, 1e-4)
+}
+
+func TestSearchFunc(t *testing.T) {
+	queryVec := []float64{1.0, 2.0, 3.0}
+	candidates := map[string][]float64{
+		"a": {1.0, 2.0, 3.0}, // sim ~ 0.9999
+		"b": {4.0, 5.0, 6.0}, // sim ~ 0.9746
+		"c": {7.0, 8.0, 9.0}, // sim ~ 0.9594
+	}
+
+	s := New()
+
+	var ids []string
+	err := s.SearchFunc(queryVec, candidates, 0.96, func(neighbor Neighbor) error {
+		ids = append(ids, neighbor.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, ids)
+
+	stop := errors.New("stop")
+	numCalls := 0
+
+	err = s.SearchFunc(queryVec, candidates, 0, func(neighbor Neighbor) error {
+		numCalls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, numCalls)
+}
+
+func TestSearch_Epsilon(t *testing.T) {
+	// The cosine of these parallel vectors rounds to 0.9999999999999998.
+	queryVec := []float64{1.1, 2.3, 3.7}
+	candidates := map[string][]float64{
+		"a": {2.2, 4.6, 7.4},
+	}
+
+	got, err := New().Search(queryVec, candidates, 1.0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got)
+
+	got, err = New(WithEpsilon(0)).Search(queryVec, candidates, 1.0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestSearchQuery(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randVec := func() []float64 {
+		vec := make([]float64, 8)
+		for i := range vec {
+			vec[i] = rng.NormFloat64()
+		}
+		return vec
+	}
+
+	for _, metric := range []Metric{Cosine, Pearson} {
+		s := NewWithMetric(metric)
+
+		queryVec := randVec()
+
+		candidates := make(map[string][]float64, 50)
+		for i := 0; i < 50; i++ {
+			candidates[fmt.Sprint(i)] = randVec()
+		}
+
+		want, err := s.Search(queryVec, candidates, 0, 0)
+		assert.NoError(t, err)
+
+		query, err := s.NewQuery(queryVec)
+		assert.NoError(t, err)
+
+		got, err := s.SearchQuery(query, candidates, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := New().NewQuery([]float64{})
+	assert.IsType(t, &emptyVectorError{}, err)
+}
+
+func BenchmarkSearch_RepeatedQuery(b *testing.B) {
+	s := New()
+
+	queryVec := make([]float64, 1024)
+	candidate := make([]float64, 1024)
+	for i := range queryVec {
+		queryVec[i] = float64(i)
+		candidate[i] = float64(len(candidate) - i)
+	}
+	candidates := map[string][]float64{"a": candidate}
+
+	b.Run("vector", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = s.Search(queryVec, candidates, 0, 0)
+		}
+	})
+
+	b.Run("query", func(b *testing.B) {
+		query, _ := s.NewQuery(queryVec)
+		for i := 0; i < b.N; i++ {
+			_, _ = s.SearchQuery(query, candidates, 0, 0)
+		}
+	})
+}
+
+func TestAbovePercentile(t *testing.T) {
+	neighbors := make([]Neighbor, 10)
+	for i := range neighbors {
+		neighbors[i] = Neighbor{ID: fmt.Sprint(10 - i), Score: float64(10-i) / 10} // 1.0, 0.9, ..., 0.1
+	}
+
+	testCases := []struct {
+		percentile float64
+		want       []string
+	}{
+		{0, []string{"10", "9", "8", "7", "6", "5", "4", "3", "2", "1"}},
+		{50, []string{"10", "9", "8", "7", "6", "5"}},
+		{85, []string{"10", "9"}},
+		{90, []string{"10", "9"}},
+		{100, []string{"10"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("percentile=%v", tc.percentile), func(t *testing.T) {
+			got := AbovePercentile(neighbors, tc.percentile)
+
+			ids := make([]string, len(got))
+			for i, neighbor := range got {
+				ids[i] = neighbor.ID
+			}
+
+			assert.Equal(t, tc.want, ids)
+		})
+	}
+
+	t.Run("ties at the cutoff are kept", func(t *testing.T) {
+		got := AbovePercentile([]Neighbor{{"a", 1}, {"b", 1}, {"c", 0.5}}, 100)
+		assert.Len(t, got, 2)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, AbovePercentile([]Neighbor{}, 50))
+	})
+}
+
+func TestSearch_Pearson(t *testing.T) {
+	testCases := []struct {
+		name       string
+		metric     Metric
+		queryVec   []float64
+		candidates map[string][]float64
+		threshold  float64
+		want       []string
+	}{
+		{
+			name:     "cosine penalizes shifted vector",
+			metric:   Cosine,
+			queryVec: []float64{1.0, 2.0, 3.0},
+			candidates: map[string][]float64{
+				"shifted":  {11.0, 12.0, 13.0}, // sim ~ 0.9493
+				"reversed": {3.0, 2.0, 1.0},    // sim ~ 0.7143
+			},
+			threshold: 0.99,
+			want:      []string{},
+		},
+		{
+			name:     "pearson ignores constant shift",
+			metric:   Pearson,
+			queryVec: []float64{1.0, 2.0, 3.0},
+			candidates: map[string][]float64{
+				"shifted":  {11.0, 12.0, 13.0}, // corr ~ 1
+				"reversed": {3.0, 2.0, 1.0},    // corr ~ -1
+			},
+			threshold: 0.99,
+			want:      []string{"shifted"},
+		},
+		{
+			name:     "cosine accepts constant vector",
+			metric:   Cosine,
+			queryVec: []float64{1.0, 2.0, 3.0},
+			candidates: map[string][]float64{
+				"constant": {5.0, 5.0, 5.0}, // sim ~ 0.9258
+			},
+			threshold: 0.9,
+			want:      []string{"constant"},
+		},
+		{
+			name:     "pearson rejects constant vector",
+			metric:   Pearson,
+			queryVec: []float64{1.0, 2.0, 3.0},
+			candidates: map[string][]float64{
+				"constant": {5.0, 5.0, 5.0}, // zero variance
+			},
+			threshold: 0,
+			want:      []string{},
+		},
+		{
+			name:     "pearson with constant query",
+			metric:   Pearson,
+			queryVec: []float64{2.0, 2.0, 2.0},
+			candidates: map[string][]float64{
+				"shifted": {11.0, 12.0, 13.0},
+			},
+			threshold: 0,
+			want:      []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewWithMetric(tc.metric)
+
+			got, err := s.Search(tc.queryVec, tc.candidates, tc.threshold, 0)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tc.want, got)
+		})
+	}
+}
+
+func TestSearch_L1(t *testing.T) {
+	queryVec := []float64{1.0, 1.0}
+	candidates := map[string][]float64{
+		"scaled": {4.0, 4.0}, // cosine 1, L1 6
+		"near":   {1.5, 0.5}, // cosine ~0.8944, L1 1
+		"far":    {0.0, 3.0}, // cosine ~0.7071, L1 3
+	}
+
+	cosine, err := New().SearchScored(queryVec, candidates, -1, 0)
+	assert.NoError(t, err)
+
+	l1, err := NewWithMetric(L1).SearchScored(queryVec, candidates, -10, 0)
+	assert.NoError(t, err)
+
+	ids := func(neighbors []Neighbor) []string {
+		res := make([]string, len(neighbors))
+		for i, neighbor := range neighbors {
+			res[i] = neighbor.ID
+		}
+		return res
+	}
+
+	assert.Equal(t, []string{"scaled", "near", "far"}, ids(cosine))
+	assert.Equal(t, []string{"near", "far", "scaled"}, ids(l1))
+	assert.InDelta(t, -1.0, l1[0].Score, 1e-9)
+
+	// Identical vectors score 0, and the threshold bounds the distance.
+	got, err := NewWithMetric(L1).Search(queryVec, map[string][]float64{"same": {1.0, 1.0}, "far": {0.0, 3.0}}, -2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"same"}, got)
+
+	_, err = NewWithMetric(L1).Search(queryVec, map[string][]float64{"short": {1.0}}, -10, 0)
+	assert.IsType(t, &vectorsNotSameLenError{}, err)
+}
+
+func TestSearch_DotProduct(t *testing.T) {
+	queryVec := []float64{1.0, 1.0}
+	candidates := map[string][]float64{
+		"scaled": {4.0, 4.0}, // dot 8
+		"near":   {1.5, 0.5}, // dot 2
+		"far":    {0.0, 3.0}, // dot 3
+	}
+
+	neighbors, err := NewWithMetric(DotProduct).SearchScored(queryVec, candidates, 2.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Neighbor{{ID: "scaled", Score: 8}, {ID: "far", Score: 3}}, neighbors)
+}
+
+func TestSearch_Euclidean(t *testing.T) {
+	queryVec := []float64{1.0, 1.0}
+	candidates := map[string][]float64{
+		"same":   {1.0, 1.0}, // distance 0
+		"near":   {1.0, 2.0}, // distance 1
+		"scaled": {4.0, 5.0}, // distance 5
+	}
+
+	euclidean := NewWithMetric(Euclidean)
+
+	// Sorted by ascending distance.
+	neighbors, err := euclidean.SearchScored(queryVec, candidates, Euclidean.MatchAll(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Neighbor{{ID: "same", Score: 0}, {ID: "near", Score: 1}, {ID: "scaled", Score: 5}}, neighbors)
+
+	// The threshold is a maximum distance.
+	got, err := euclidean.Search(queryVec, candidates, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"same", "near"}, got)
+
+	assert.Equal(t, neighbors[:2], Euclidean.AbovePercentile(neighbors, 50))
+
+	_, err = euclidean.Search(queryVec, map[string][]float64{"short": {1.0}}, 10, 0)
+	assert.IsType(t, &vectorsNotSameLenError{}, err)
+}
+
+func TestCenter(t *testing.T) {
+	testCases := []struct {
+		vec  []float64
+		want []float64
+	}{
+		{[]float64{1.0, 2.0, 3.0}, []float64{-1.0, 0.0, 1.0}},
+		{[]float64{5.0, 5.0}, []float64{0.0, 0.0}},
+		{[]float64{}, []float64{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("vec: %v", tc.vec), func(t *testing.T) {
+			vec := slices.Clone(tc.vec)
+
+			got := center(vec)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.vec, vec) // input must be left untouched
+		})
+	}
+}
+
 func TestCosineSim(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -248,6 +587,19 @@ func TestCosineSim(t *testing.T) {
 	}
 }
 
+func TestCosineSimilarity(t *testing.T) {
+	got, err := CosineSimilarity([]float64{1, 0}, []float64{1, 1})
+	assert.NoError(t, err)
+	assert.InDelta(t, math.Sqrt2/2, got, 1e-9)
+
+	got, err = CosineSimilarity([]float64{0, 0}, []float64{1, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, -1.0, got)
+
+	_, err = CosineSimilarity([]float64{}, []float64{1, 1})
+	assert.IsType(t, &emptyVectorError{}, err)
+}
+
 func TestEuclideanNorm(t *testing.T) {
 	testCases := []struct {
 		vec  []float64
@@ -289,7 +641,7 @@ func TestDotProduct(t *testing.T) {
 			vecA:   []float64{1, 2},
 			vecB:   []float64{3, 4, 5},
 			result: 0,
-			err:    new(vectorsNotSameLenError),
+			err:    &vectorsNotSameLenError{2, 3},
 		},
 	}
 
@@ -302,3 +654,274 @@ func TestDotProduct(t *testing.T) {
 		})
 	}
 }
+
+func TestSimilarityMatrix(t *testing.T) {
+	matrix, err := SimilarityMatrix([][]float64{{1, 0}, {1, 1}, {0, 2}})
+	assert.NoError(t, err)
+	assert.Len(t, matrix, 3)
+
+	for i := range matrix {
+		assert.InDelta(t, 1, matrix[i][i], 1e-9)
+		for j := range matrix {
+			assert.Equal(t, matrix[i][j], matrix[j][i])
+		}
+	}
+
+	assert.InDelta(t, 0, matrix[0][2], 1e-9)
+	assert.InDelta(t, math.Sqrt2/2, matrix[0][1], 1e-9)
+
+	_, err = SimilarityMatrix([][]float64{{1, 0}, {}})
+	assert.IsType(t, &emptyVectorError{}, err)
+}
+
+func TestSearchQueryBlock(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	s := New()
+
+	block := NewBlock(8)
+	candidates := make(map[string][]float64, 100)
+	for i := 0; i < 100; i++ {
+		vec := make([]float64, 8)
+		for j := range vec {
+			vec[j] = rng.NormFloat64()
+		}
+
+		id := fmt.Sprint(i)
+		candidates[id] = vec
+		assert.NoError(t, block.Add(id, vec))
+	}
+	assert.Equal(t, 100, block.Len())
+
+	queryVec := candidates["0"]
+	query, err := s.NewQuery(queryVec)
+	assert.NoError(t, err)
+
+	want, err := s.SearchScored(queryVec, candidates, 0.1, 10)
+	assert.NoError(t, err)
+
+	got, err := s.SearchQueryBlock(query, block, 0.1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	err = block.Add("too-short", []float64{1, 2})
+	assert.IsType(t, &vectorsNotSameLenError{}, err)
+
+	// Overwriting and deleting rows keeps the block in sync with the candidates.
+	for i := 0; i < 100; i += 3 {
+		id := fmt.Sprint(i)
+		delete(candidates, id)
+		block.Delete(id)
+	}
+
+	candidates["1"] = candidates["2"]
+	assert.NoError(t, block.Add("1", candidates["2"]))
+	block.Delete("missing")
+	assert.Equal(t, len(candidates), block.Len())
+
+	want, err = s.SearchScored(queryVec, candidates, 0, 0)
+	assert.NoError(t, err)
+
+	got, err = s.SearchQueryBlock(query, block, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func BenchmarkSearch_Layout(b *testing.B) {
+	const (
+		numCandidates = 10000
+		dim           = 384
+	)
+
+	rng := rand.New(rand.NewSource(42))
+	s := New()
+
+	block := NewBlock(dim)
+	candidates := make(map[string][]float64, numCandidates)
+	for i := 0; i < numCandidates; i++ {
+		vec := make([]float64, dim)
+		for j := range vec {
+			vec[j] = rng.NormFloat64()
+		}
+
+		candidates[fmt.Sprint(i)] = vec
+		_ = block.Add(fmt.Sprint(i), vec)
+	}
+
+	query, _ := s.NewQuery(candidates["0"])
+
+	b.Run("row-per-key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = s.SearchQuery(query, candidates, 0.5, 10)
+		}
+	})
+
+	b.Run("columnar", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = s.SearchQueryBlock(query, block, 0.5, 10)
+		}
+	})
+}
+
+func TestSearchQuery_TieBreaker(t *testing.T) {
+	s := New()
+
+	// "a" and "b" are mirrored around the query, so their primary similarities are exactly equal.
+	candidates := map[string][]float64{
+		"a": {1, 1},
+		"b": {1, -1},
+		"c": {1, 0},
+	}
+
+	query, err := s.NewQuery([]float64{1, 0})
+	assert.NoError(t, err)
+
+	got, err := s.SearchQuery(query, candidates, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "a", "b"}, got)
+
+	query, err = s.NewQueryWithTieBreaker([]float64{1, 0}, []float64{0, -1})
+	assert.NoError(t, err)
+
+	got, err = s.SearchQuery(query, candidates, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "b", "a"}, got)
+
+	block := NewBlock(2)
+	for _, id := range []string{"a", "b", "c"} {
+		assert.NoError(t, block.Add(id, candidates[id]))
+	}
+
+	neighbors, err := s.SearchQueryBlock(query, block, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", neighbors[1].ID)
+
+	_, err = s.NewQueryWithTieBreaker([]float64{1, 0}, []float64{1})
+	assert.IsType(t, &vectorsNotSameLenError{}, err)
+}
+
+func TestSearchScored_IdenticalScoresOne(t *testing.T) {
+	// Computed, their cosine rounds to 0.9999999999999998 and 1.0000000000000002.
+	for _, vec := range [][]float64{{0.1, 0.7, 0.3}, {0.7, 0.1}} {
+		neighbors, err := New().SearchScored(vec, map[string][]float64{"a": slices.Clone(vec)}, 1, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []Neighbor{{ID: "a", Score: 1}}, neighbors)
+	}
+}
+
+func TestErrorsUnwrapToPublicKinds(t *testing.T) {
+	_, err := New().NewQuery([]float64{})
+
+	var emptyErr *errs.EmptyVectorError
+	assert.ErrorAs(t, err, &emptyErr)
+	assert.ErrorIs(t, err, errs.ErrEmptyVector)
+
+	_, err = New().NewQueryWithTieBreaker([]float64{1, 2}, []float64{1, 2, 3})
+
+	var dimErr *errs.DimensionMismatchError
+	assert.ErrorAs(t, err, &dimErr)
+	assert.Equal(t, &errs.DimensionMismatchError{Expected: 2, Got: 3}, dimErr)
+	assert.ErrorIs(t, err, errs.ErrDimensionMismatch)
+	assert.NotErrorIs(t, err, errs.ErrEmptyVector)
+}
+
+func TestSearchQueryWithNorms(t *testing.T) {
+	s := New()
+
+	query, err := s.NewQuery([]float64{1.0, 0.0})
+	assert.NoError(t, err)
+
+	candidates := map[string][]float64{
+		"given":    {3.0, 4.0}, // cosine 0.6
+		"computed": {4.0, 3.0}, // cosine 0.8
+	}
+
+	ids, err := s.SearchQueryWithNorms(query, candidates, map[string]float64{"given": 5}, 0.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"computed", "given"}, ids)
+
+	// The given norm is used as is: doubling it halves the similarity.
+	ids, err = s.SearchQueryWithNorms(query, candidates, map[string]float64{"given": 10}, 0.5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"computed"}, ids)
+}
+
+func TestScoreAllParallel(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+
+	candidates := make(map[string][]float64, PARALLEL_SEARCH_MIN_CANDIDATES)
+	norms := make(map[string]float64)
+	for i := 0; i < PARALLEL_SEARCH_MIN_CANDIDATES; i++ {
+		// Few distinct vectors, so that many scores tie.
+		vec := []float64{float64(rng.Intn(5)) - 2, float64(rng.Intn(5)) - 2, 1}
+		candidates[fmt.Sprint(i)] = vec
+
+		if i%2 == 0 {
+			norm, err := EuclideanNorm(vec)
+			assert.NoError(t, err)
+			norms[fmt.Sprint(i)] = norm
+		}
+	}
+
+	s := New()
+
+	query, err := s.NewQuery([]float64{1, 2, 3})
+	assert.NoError(t, err)
+
+	want, err := s.scoreAll(query, candidates, norms, 0.2)
+	assert.NoError(t, err)
+
+	got, err := s.scoreAllParallel(query, candidates, norms, 0.2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+
+	wantRanked, err := s.rank(query, want, nil, 10)
+	assert.NoError(t, err)
+
+	gotRanked, err := s.rank(query, got, nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, wantRanked, gotRanked)
+
+	candidates["short"] = []float64{1, 2}
+	_, err = s.scoreAllParallel(query, candidates, nil, 0.2)
+	assert.IsType(t, &vectorsNotSameLenError{}, err)
+}
+
+// BenchmarkSearch_Parallel compares sequential and parallel scoring, to tune PARALLEL_SEARCH_MIN_CANDIDATES.
+func BenchmarkSearch_Parallel(b *testing.B) {
+	const dim = 384
+
+	rng := rand.New(rand.NewSource(42))
+	s := New()
+
+	for _, numCandidates := range []int{256, 10000} {
+		candidates := make(map[string][]float64, numCandidates)
+		for i := 0; i < numCandidates; i++ {
+			vec := make([]float64, dim)
+			for j := range vec {
+				vec[j] = rng.NormFloat64()
+			}
+
+			candidates[fmt.Sprint(i)] = vec
+		}
+
+		query, _ := s.NewQuery(candidates["0"])
+
+		b.Run(fmt.Sprintf("candidates=%d/sequential", numCandidates), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = s.searchQueryFunc(query, candidates, nil, 0.5, func(Neighbor) error { return nil })
+			}
+		})
+
+		b.Run(fmt.Sprintf("candidates=%d/parallel", numCandidates), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = s.scoreAllParallel(query, candidates, nil, 0.5)
+			}
+		})
+	}
+}
+
+func TestMetricString(t *testing.T) {
+	assert.Equal(t, "cosine", Cosine.String())
+	assert.Equal(t, "euclidean", Euclidean.String())
+	assert.Equal(t, "Metric(9)", Metric(9).String())
+}
@@ -1,8 +1,6 @@
 package simhash
 
 import (
-	"context"
-	"log/slog"
 	"math/rand"
 	"strings"
 )
@@ -21,9 +19,18 @@ type SimHash struct {
 }
 
 func New(numHyperPlanes, spaceDim uint32) (*SimHash, error) {
-	hyperplanes, err := generateHyperplanes(numHyperPlanes, spaceDim)
+	return NewWithRand(numHyperPlanes, spaceDim, rand.New(rand.NewSource(rand.Int63())))
+}
+
+// NewWithSeed draws the hyperplanes from a source seeded with seed, so that the same seed yields the same hyperplanes.
+func NewWithSeed(numHyperPlanes, spaceDim uint32, seed int64) (*SimHash, error) {
+	return NewWithRand(numHyperPlanes, spaceDim, rand.New(rand.NewSource(seed)))
+}
+
+// NewWithRand draws the hyperplanes from rng, so that the same seeded source yields the same hyperplanes.
+func NewWithRand(numHyperPlanes, spaceDim uint32, rng *rand.Rand) (*SimHash, error) {
+	hyperplanes, err := generateHyperplanes(numHyperPlanes, spaceDim, rng)
 	if err != nil {
-		logErr(err, "New")
 		return nil, err
 	}
 
@@ -32,16 +39,14 @@ func New(numHyperPlanes, spaceDim uint32) (*SimHash, error) {
 	}, nil
 }
 
-func generateHyperplanes(numHyperPlanes, spaceDim uint32) (hyperPlanes [][]float64, err error) {
+func generateHyperplanes(numHyperPlanes, spaceDim uint32, rng *rand.Rand) (hyperPlanes [][]float64, err error) {
 	if numHyperPlanes == 0 {
 		err = new(numHyperPlanesError)
-		logErr(err, "generateHyperplanes")
 		return nil, err
 	}
 
 	if spaceDim == 0 {
 		err = new(spaceDimError)
-		logErr(err, "generateHyperplanes")
 		return nil, err
 	}
 
@@ -50,20 +55,23 @@ func generateHyperplanes(numHyperPlanes, spaceDim uint32) (hyperPlanes [][]float
 	for i := uint32(0); i < numHyperPlanes; i++ {
 		hyperPlanes[i] = make([]float64, spaceDim)
 		for j := uint32(0); j < spaceDim; j++ {
-			hyperPlanes[i][j] = rand.NormFloat64()
+			hyperPlanes[i][j] = rng.NormFloat64()
 		}
 	}
 
 	return hyperPlanes, nil
 }
 
+// Sketch returns one bit per hyperplane, where bit i is the side of hyperplane i the embedding falls on.
+//
+// The bit order is part of the stable API: stored sketch keys depend on it,
+// so any reordering silently invalidates every persisted bucket.
 func (sh *SimHash) Sketch(embedding []float64) (string, error) {
 	sk := make([]string, len(sh.Hyperplanes))
 
 	for i, projectionVector := range sh.Hyperplanes {
 		res, err := hash(projectionVector, embedding)
 		if err != nil {
-			logErr(err, "Sketch")
 			return "", err
 		}
 
@@ -76,7 +84,6 @@ func (sh *SimHash) Sketch(embedding []float64) (string, error) {
 func hash(projectionVector, embedding []float64) (string, error) {
 	res, err := dotProduct(projectionVector, embedding)
 	if err != nil {
-		logErr(err, "hash")
 		return "", err
 	}
 
@@ -90,7 +97,6 @@ func hash(projectionVector, embedding []float64) (string, error) {
 func dotProduct(vecA, vecB []float64) (res float64, err error) {
 	if len(vecA) != len(vecB) {
 		err = new(vectorsNotSameLenError)
-		logErr(err, "dotProduct")
 		return 0, err
 	}
 
@@ -100,12 +106,3 @@ func dotProduct(vecA, vecB []float64) (res float64, err error) {
 
 	return res, nil
 }
-
-func logErr(err error, trace string) {
-	slog.LogAttrs(
-		context.TODO(),
-		slog.LevelError,
-		err.Error(),
-		slog.String("trace", "vectoria:src:internal:simhash:"+trace),
-	)
-}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand"
 	"os"
 	"testing"
 
@@ -70,6 +71,48 @@ func TestSketch(t *testing.T) {
 	}
 }
 
+// Pins bit i of the sketch to hyperplane i. Stored sketch keys depend on this order,
+// so if this test breaks, every persisted index breaks with it.
+func TestSketch_BitOrder(t *testing.T) {
+	// Each row is the standard basis vector for its index (or its opposite),
+	// so bit i depends only on the sign of embedding[i].
+	hyperplanes := [][]float64{
+		{1, 0, 0, 0, 0, 0},
+		{0, 1, 0, 0, 0, 0},
+		{0, 0, 1, 0, 0, 0},
+		{0, 0, 0, -1, 0, 0},
+		{0, 0, 0, 0, -1, 0},
+		{0, 0, 0, 0, 0, 1},
+	}
+
+	testCases := []struct {
+		embedding []float64
+		sk        string
+	}{
+		{[]float64{1, 1, 1, 1, 1, 1}, "111001"},
+		{[]float64{-1, -1, -1, -1, -1, -1}, "000110"},
+		{[]float64{1, -1, 1, -1, 1, -1}, "101100"},
+		{[]float64{-2, 3, -5, 7, -11, 13}, "010011"},
+		{[]float64{0, 0, 0, 0, 0, 0}, "111111"}, // ties land on the positive side
+	}
+
+	sh := &SimHash{Hyperplanes: hyperplanes}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("embedding=%v", tc.embedding), func(t *testing.T) {
+			sk, err := sh.Sketch(tc.embedding)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.sk, sk)
+
+			for i, projectionVector := range hyperplanes {
+				bit, err := hash(projectionVector, tc.embedding)
+				assert.NoError(t, err)
+				assert.Equal(t, bit, string(sk[i]), "bit %d must come from hyperplane %d", i, i)
+			}
+		})
+	}
+}
+
 func TestGenerateHyperplanes(t *testing.T) {
 	testCases := []struct {
 		numHyperPlanes uint32
@@ -86,7 +129,7 @@ func TestGenerateHyperplanes(t *testing.T) {
 		t.Run(
 			fmt.Sprintf("numHyperPlanes=%d_spaceDim=%d_err=%v", tc.numHyperPlanes, tc.spaceDim, tc.err),
 			func(t *testing.T) {
-				hyperplanes, err := generateHyperplanes(tc.numHyperPlanes, tc.spaceDim)
+				hyperplanes, err := generateHyperplanes(tc.numHyperPlanes, tc.spaceDim, rand.New(rand.NewSource(1)))
 
 				assert.Equal(t, tc.err, err)
 
@@ -99,6 +142,30 @@ func TestGenerateHyperplanes(t *testing.T) {
 	}
 }
 
+func TestNewWithRand(t *testing.T) {
+	a, err := NewWithRand(4, 3, rand.New(rand.NewSource(42)))
+	assert.NoError(t, err)
+
+	b, err := NewWithRand(4, 3, rand.New(rand.NewSource(42)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, a.Hyperplanes, b.Hyperplanes)
+}
+
+func TestNewWithSeed(t *testing.T) {
+	a, err := NewWithSeed(4, 3, 42)
+	assert.NoError(t, err)
+
+	b, err := NewWithRand(4, 3, rand.New(rand.NewSource(42)))
+	assert.NoError(t, err)
+
+	c, err := NewWithSeed(4, 3, 43)
+	assert.NoError(t, err)
+
+	assert.Equal(t, a.Hyperplanes, b.Hyperplanes)
+	assert.NotEqual(t, a.Hyperplanes, c.Hyperplanes)
+}
+
 func TestDotProduct(t *testing.T) {
 	testCases := []struct {
 		name   string
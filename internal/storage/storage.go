@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"strings"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/ristretto/z"
 )
 
 type Contract interface {
@@ -12,52 +18,224 @@ type Contract interface {
 	Add(data map[string][]byte) (err error)
 	Get(key string) (val []byte, err error)
 	GetWithPrefix(prefix string) (values [][]byte, err error)
+	GetWithPrefixFunc(prefix string, fn func(val []byte) error) (err error)
+	GetKeysWithPrefix(prefix string) (keys []string, err error)
+	CountWithPrefix(prefix string) (count int, err error)
+	IterateWithPrefix(prefix string, fn func(key string, val []byte) error) (err error)
+	IterateKeysWithPrefix(prefix string, fn func(key string) error) (err error)
+	Stream(ctx context.Context, prefix string, fn func(key string, val []byte) error) (err error)
+	UsageWithPrefix(prefix string) (usage Usage, err error)
+	View(fn func(tx ReadTx) error) (err error)
 	Del(keys ...string) (err error)
+	DelWithPrefix(prefix string) (err error)
+	Write(set map[string][]byte, del []string) (err error)
 	KeyExists(key string) (exists bool, err error)
+	KeysExist(keys ...string) (exists map[string]bool, err error)
+	Backup(w io.Writer, since uint64) (version uint64, err error)
+	Load(r io.Reader) (err error)
+	RunGC(discardRatio float64) (err error)
+	Sync() (err error)
 }
 
+// Maximum number of pending writes while loading a backup.
+const LOAD_MAX_PENDING_WRITES int = 256
+
 type Storage struct {
-	db *badger.DB
+	db     *badger.DB
+	logger *slog.Logger
+}
+
+// Usage is the number of keys under a prefix and the bytes taken by those keys and their values.
+type Usage struct {
+	Count      int
+	KeyBytes   int64
+	ValueBytes int64
+}
+
+// Option configures a storage opened by New.
+type Option func(*options)
+
+type options struct {
+	readOnly   bool
+	syncWrites bool
+	logger     *slog.Logger
+}
+
+// WithReadOnly opens the storage without write access, so that it can be served from a read-only filesystem.
+// Writes then fail. It requires an on-disk storage.
+func WithReadOnly(readOnly bool) Option {
+	return func(o *options) {
+		o.readOnly = readOnly
+	}
+}
+
+// WithSyncWrites makes every write return only once it is synced to disk, instead of when Badger flushes it.
+// It makes writes durable on a crash, at the cost of write throughput. It has no effect on an in-memory storage.
+func WithSyncWrites(syncWrites bool) Option {
+	return func(o *options) {
+		o.syncWrites = syncWrites
+	}
 }
 
-func New(path string) (*Storage, error) {
+// WithLogger sets the logger errors are logged with. Nil keeps the default, slog's default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// New opens the storage at path, or an in-memory one when path is empty.
+//
+// An on-disk storage has single-writer semantics: while it is open, the directory is locked
+// and any other attempt to open it, from this or another process, fails with storageLockedError.
+func New(path string, opts ...Option) (*Storage, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	var inMemory bool
 	if len(path) == 0 {
 		inMemory = true
 	}
 
-	opts := badger.DefaultOptions(path).WithInMemory(inMemory).WithLogger(nil)
+	if inMemory && o.readOnly {
+		err := &readOnlyInMemoryError{}
+		logErr(o.logger, err, "New")
+		return nil, err
+	}
+
+	badgerOpts := badger.DefaultOptions(path).WithInMemory(inMemory).WithReadOnly(o.readOnly).
+		WithSyncWrites(o.syncWrites && !inMemory).WithLogger(nil)
+
+	db, err := badger.Open(badgerOpts)
+	if isLockError(err) {
+		err = &storageLockedError{path}
+		logErr(o.logger, err, "New")
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
 	if err != nil {
-		logErr(err, "New")
+		logErr(o.logger, err, "New")
 		return nil, err
 	}
 
 	return &Storage{
-		db: db,
+		db:     db,
+		logger: o.logger,
 	}, nil
 }
 
 func (s *Storage) CloseDB() (err error) {
 	if s == nil {
 		err = new(nilStorageReceiverError)
-		logErr(err, "CloseDB")
+		logErr(nil, err, "CloseDB")
 		return err
 	}
 
 	if err := s.db.Close(); err != nil {
-		logErr(err, "CloseDB")
+		logErr(s.logger, err, "CloseDB")
+		return err
+	}
+
+	return nil
+}
+
+// Backup writes a consistent snapshot of the storage to w, restorable with Load. Zero since writes every key;
+// otherwise only the keys written after that version, for incremental backups. It returns the version of the
+// last key written, to pass as since to the next incremental backup.
+func (s *Storage) Backup(w io.Writer, since uint64) (version uint64, err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "Backup")
+		return 0, err
+	}
+
+	version, err = s.db.Backup(w, since)
+	if err != nil {
+		logErr(s.logger, err, "Backup")
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Load writes every key of a backup made by Backup into the storage, overwriting existing ones.
+func (s *Storage) Load(r io.Reader) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "Load")
+		return err
+	}
+
+	if err := s.db.Load(r, LOAD_MAX_PENDING_WRITES); err != nil {
+		logErr(s.logger, err, "Load")
+		return err
+	}
+
+	return nil
+}
+
+// Sync flushes the writes done so far to disk, so that they survive a crash. It is a no-op for an in-memory
+// storage, which has nothing to flush, and for a read-only one.
+func (s *Storage) Sync() (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "Sync")
+		return err
+	}
+
+	if s.db.Opts().InMemory || s.db.Opts().ReadOnly {
+		return nil
+	}
+
+	if err := s.db.Sync(); err != nil {
+		logErr(s.logger, err, "Sync")
 		return err
 	}
 
 	return nil
 }
 
+// RunGC reclaims the value log space taken by deleted and overwritten values, rewriting every value log file
+// of which at least discardRatio, between 0 and 1 excluded, can be discarded. It is a no-op for an in-memory
+// storage, which has no value log, and for a read-only one.
+func (s *Storage) RunGC(discardRatio float64) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "RunGC")
+		return err
+	}
+
+	if discardRatio <= 0 || discardRatio >= 1 {
+		err = &invalidDiscardRatioError{discardRatio}
+		logErr(s.logger, err, "RunGC")
+		return err
+	}
+
+	// Neither has anything to reclaim.
+	if s.db.Opts().InMemory || s.db.Opts().ReadOnly {
+		return nil
+	}
+
+	// Each run rewrites at most one file, so it runs until there is nothing left to rewrite.
+	for {
+		err = s.db.RunValueLogGC(discardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		}
+
+		if err != nil {
+			logErr(s.logger, err, "RunGC")
+			return err
+		}
+	}
+}
+
 func (s *Storage) Add(data map[string][]byte) (err error) {
 	if s == nil {
 		err = new(nilStorageReceiverError)
-		logErr(err, "Add")
+		logErr(nil, err, "Add")
 		return err
 	}
 
@@ -70,7 +248,7 @@ func (s *Storage) Add(data map[string][]byte) (err error) {
 		return nil
 	})
 	if err != nil {
-		logErr(err, "Add")
+		logErr(s.logger, err, "Add")
 		return err
 	}
 
@@ -80,80 +258,359 @@ func (s *Storage) Add(data map[string][]byte) (err error) {
 func (s *Storage) Get(key string) (val []byte, err error) {
 	if s == nil {
 		err = &nilStorageReceiverError{}
-		logErr(err, "Get")
+		logErr(nil, err, "Get")
+		return nil, err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		val, err = (&readTx{txn}).Get(key)
+		return err
+	})
+	if err != nil {
+		logErr(s.logger, err, "Get")
+		return nil, err
+	}
+
+	return val, nil
+}
+
+func (s *Storage) GetWithPrefix(prefix string) (values [][]byte, err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "GetWithPrefix")
 		return nil, err
 	}
 
 	err = s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+		values, err = (&readTx{txn}).GetWithPrefix(prefix)
+		return err
+	})
+
+	if err != nil {
+		logErr(s.logger, err, "getValuesWithPrefix")
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// GetWithPrefixFunc is like GetWithPrefix, calling fn with each value instead of collecting them, so that
+// memory stays bounded whatever the number of values. val is only valid until fn returns: it must be copied
+// to be retained. It stops on the first error returned by fn.
+func (s *Storage) GetWithPrefixFunc(prefix string, fn func(val []byte) error) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "GetWithPrefixFunc")
+		return err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		return (&readTx{txn}).GetWithPrefixFunc(prefix, fn)
+	})
+	if err != nil {
+		logErr(s.logger, err, "GetWithPrefixFunc")
+		return err
+	}
+
+	return nil
+}
+
+// ReadTx is a point-in-time, read-only view of the storage.
+// Reads within the same ReadTx never observe writes committed after it started.
+type ReadTx interface {
+	Get(key string) (val []byte, err error)
+	GetWithPrefix(prefix string) (values [][]byte, err error)
+	GetWithPrefixFunc(prefix string, fn func(val []byte) error) (err error)
+	IterateWithPrefix(prefix string, fn func(key string, val []byte) error) (err error)
+	CountWithPrefix(prefix string) (count int, err error)
+}
+
+// View runs fn within a single read transaction, so multiple reads are consistent with each other.
+// The ReadTx must not be used after fn returns.
+func (s *Storage) View(fn func(tx ReadTx) error) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "View")
+		return err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		return fn(&readTx{txn})
+	})
+	if err != nil {
+		logErr(s.logger, err, "View")
+		return err
+	}
+
+	return nil
+}
+
+type readTx struct {
+	txn *badger.Txn
+}
+
+func (tx *readTx) Get(key string) (val []byte, err error) {
+	item, err := tx.txn.Get([]byte(key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, &NotFoundError{key}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (tx *readTx) GetWithPrefix(prefix string) (values [][]byte, err error) {
+	err = tx.GetWithPrefixFunc(prefix, func(val []byte) error {
+		values = append(values, bytes.Clone(val))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// IterateWithPrefix calls fn with the key and a copy of the value of every key starting with prefix, in key order.
+// It stops on the first error returned by fn.
+func (tx *readTx) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) (err error) {
+	encodedPrefix := []byte(prefix)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 128
+
+	it := tx.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(encodedPrefix); it.ValidForPrefix(encodedPrefix); it.Next() {
+		item := it.Item()
+
+		val, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
 
-		val, err = item.ValueCopy(nil)
+		if err := fn(string(item.KeyCopy(nil)), val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *readTx) GetWithPrefixFunc(prefix string, fn func(val []byte) error) (err error) {
+	encodedPrefix := []byte(prefix)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 128
+
+	it := tx.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(encodedPrefix); it.ValidForPrefix(encodedPrefix); it.Next() {
+		if err := it.Item().Value(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stream calls fn with every key-value pair with the given prefix, reading key ranges concurrently with
+// Badger's Stream framework. It is much faster than IterateWithPrefix on large datasets, but keys are
+// visited in no particular order. fn is never called concurrently. It stops when ctx is done, or on the
+// first error returned by fn.
+func (s *Storage) Stream(ctx context.Context, prefix string, fn func(key string, val []byte) error) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "Stream")
+		return err
+	}
+
+	stream := s.db.NewStream()
+	stream.Prefix = []byte(prefix)
+	stream.LogPrefix = "vectoria.Storage.Stream"
+
+	// Orchestrate may report the cancellation of its workers instead of the error that caused it.
+	var fnErr error
+
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
 		if err != nil {
 			return err
 		}
 
+		for _, kv := range list.Kv {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if fnErr = fn(string(kv.Key), kv.Value); fnErr != nil {
+				return fnErr
+			}
+		}
+
 		return nil
+	}
+
+	err = stream.Orchestrate(ctx)
+	if fnErr != nil {
+		err = fnErr
+	}
+
+	if err != nil {
+		logErr(s.logger, err, "Stream")
+		return err
+	}
+
+	return nil
+}
+
+func (tx *readTx) CountWithPrefix(prefix string) (count int, err error) {
+	encodedPrefix := []byte(prefix)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := tx.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(encodedPrefix); it.ValidForPrefix(encodedPrefix); it.Next() {
+		count++
+	}
+
+	return count, nil
+}
+
+// CountWithPrefix counts the keys with the given prefix without reading their values.
+func (s *Storage) CountWithPrefix(prefix string) (count int, err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "CountWithPrefix")
+		return 0, err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		count, err = (&readTx{txn}).CountWithPrefix(prefix)
+		return err
 	})
 	if err != nil {
-		logErr(err, "Get")
-		return nil, err
+		logErr(s.logger, err, "CountWithPrefix")
+		return 0, err
 	}
 
-	return val, nil
+	return count, nil
 }
 
-func (s *Storage) GetWithPrefix(prefix string) (values [][]byte, err error) {
-	var (
-		val           []byte
-		item          *badger.Item
-		encodedPrefix = []byte(prefix)
-	)
+// IterateWithPrefix calls fn with every key and value under prefix, in key order.
+// It stops on the first error returned by fn.
+func (s *Storage) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "IterateWithPrefix")
+		return err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		return (&readTx{txn}).IterateWithPrefix(prefix, fn)
+	})
+	if err != nil {
+		logErr(s.logger, err, "IterateWithPrefix")
+		return err
+	}
+
+	return nil
+}
+
+// IterateKeysWithPrefix calls fn with every key under prefix, in key order, without reading values.
+// It stops on the first error returned by fn.
+func (s *Storage) IterateKeysWithPrefix(prefix string, fn func(key string) error) (err error) {
+	encodedPrefix := []byte(prefix)
 
 	if s == nil {
 		err = new(nilStorageReceiverError)
-		logErr(err, "GetWithPrefix")
-		return nil, err
+		logErr(nil, err, "IterateKeysWithPrefix")
+		return err
 	}
 
 	err = s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 128
+		opts.PrefetchValues = false
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		for it.Seek(encodedPrefix); it.ValidForPrefix(encodedPrefix); it.Next() {
-			item = it.Item()
-			val, err = item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-
-			if err != nil {
+			if err := fn(string(it.Item().KeyCopy(nil))); err != nil {
 				return err
 			}
-
-			values = append(values, val)
 		}
 
 		return nil
 	})
+	if err != nil {
+		logErr(s.logger, err, "IterateKeysWithPrefix")
+		return err
+	}
 
+	return nil
+}
+
+// GetKeysWithPrefix returns every key under prefix, in key order, without reading values.
+func (s *Storage) GetKeysWithPrefix(prefix string) (keys []string, err error) {
+	err = s.IterateKeysWithPrefix(prefix, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
-		logErr(err, "getValuesWithPrefix")
 		return nil, err
 	}
 
-	return values, nil
+	return keys, nil
+}
+
+// UsageWithPrefix sums the key and value sizes under prefix without reading the values.
+func (s *Storage) UsageWithPrefix(prefix string) (usage Usage, err error) {
+	encodedPrefix := []byte(prefix)
+
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "UsageWithPrefix")
+		return Usage{}, err
+	}
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(encodedPrefix); it.ValidForPrefix(encodedPrefix); it.Next() {
+			item := it.Item()
+
+			usage.Count++
+			usage.KeyBytes += int64(item.KeySize())
+			usage.ValueBytes += item.ValueSize()
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(s.logger, err, "UsageWithPrefix")
+		return Usage{}, err
+	}
+
+	return usage, nil
 }
 
 func (s *Storage) Del(keys ...string) (err error) {
 	if s == nil {
 		err = new(nilStorageReceiverError)
-		logErr(err, "Del")
+		logErr(nil, err, "Del")
 		return err
 	}
 
@@ -166,24 +623,151 @@ func (s *Storage) Del(keys ...string) (err error) {
 		return nil
 	})
 	if err != nil {
-		logErr(err, "Del")
+		logErr(s.logger, err, "Del")
 		return err
 	}
 
 	return nil
 }
 
+// DelWithPrefix deletes every key under prefix, in batches, so that it isn't bound by the size of a transaction.
+// It isn't atomic: if it fails, some of the keys may already be deleted.
+func (s *Storage) DelWithPrefix(prefix string) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "DelWithPrefix")
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err = s.IterateKeysWithPrefix(prefix, func(key string) error {
+		return wb.Delete([]byte(key))
+	})
+	if err == nil {
+		err = wb.Flush()
+	}
+	if err != nil {
+		logErr(s.logger, err, "DelWithPrefix")
+		return err
+	}
+
+	return nil
+}
+
+// Write sets and deletes keys within a single transaction, so either all of it is applied or none of it.
+// A key both set and deleted ends up deleted.
+func (s *Storage) Write(set map[string][]byte, del []string) (err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "Write")
+		return err
+	}
+
+	err = s.db.Update(func(txn *badger.Txn) (err error) {
+		for key, val := range set {
+			if err = txn.Set([]byte(key), val); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range del {
+			if err = txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(s.logger, err, "Write")
+		return err
+	}
+
+	return nil
+}
+
+// KeysExist checks every key within a single read transaction. The result maps each given key to whether it exists.
+func (s *Storage) KeysExist(keys ...string) (exists map[string]bool, err error) {
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "KeysExist")
+		return nil, err
+	}
+
+	exists = make(map[string]bool, len(keys))
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			_, err := txn.Get([]byte(key))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				exists[key] = false
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			exists[key] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		logErr(s.logger, err, "KeysExist")
+		return nil, err
+	}
+
+	return exists, nil
+}
+
+// KeyExists reports whether key is stored, without reading its value. A missing key isn't logged as an error.
 func (s *Storage) KeyExists(key string) (exists bool, err error) {
-	_, err = s.Get(key)
-	if err == badger.ErrKeyNotFound {
-		return false, nil
+	if s == nil {
+		err = new(nilStorageReceiverError)
+		logErr(nil, err, "KeyExists")
+		return false, err
 	}
 
+	err = s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		exists = true
+
+		return nil
+	})
 	if err != nil {
+		logErr(s.logger, err, "KeyExists")
 		return false, err
 	}
 
-	return true, nil
+	return exists, nil
+}
+
+// ErrNotFound matches, with errors.Is, the NotFoundError returned when reading a missing key.
+var ErrNotFound = errors.New("key not found")
+
+// NotFoundError is returned by Get when the key isn't stored, so that callers can tell a missing key,
+// often a regular answer, from a failure of the storage.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("key not found: %s", e.Key)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
 }
 
 // To avoid panic when doing a bad init in high level packages.
@@ -194,8 +778,40 @@ func (e *nilStorageReceiverError) Error() string {
 	return "storage receiver cannot be nil"
 }
 
-func logErr(err error, trace string) {
-	slog.LogAttrs(
+// Badger flattens the directory lock error into a plain string, so there is nothing else to match on.
+func isLockError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Cannot acquire directory lock")
+}
+
+type readOnlyInMemoryError struct{}
+
+func (e *readOnlyInMemoryError) Error() string {
+	return "an in-memory storage can't be read-only"
+}
+
+type invalidDiscardRatioError struct {
+	discardRatio float64
+}
+
+func (e *invalidDiscardRatioError) Error() string {
+	return fmt.Sprintf("discard ratio must be between 0 and 1, both excluded, but got: %v", e.discardRatio)
+}
+
+type storageLockedError struct {
+	path string
+}
+
+func (e *storageLockedError) Error() string {
+	return fmt.Sprintf("storage at %s is locked by another instance", e.path)
+}
+
+// logErr logs err with logger, or with the default logger when it is nil.
+func logErr(logger *slog.Logger, err error, trace string) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.LogAttrs(
 		context.TODO(),
 		slog.LevelError,
 		err.Error(),
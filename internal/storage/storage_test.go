@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"testing"
 
 	"github.com/brianvoe/gofakeit"
+	"github.com/dgraph-io/badger/v3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,10 +29,80 @@ func TestNew(t *testing.T) {
 	path := t.TempDir()
 	stg, err := New(path)
 	assert.NoError(t, err)
+	defer stg.CloseDB()
 	assert.NotNil(t, stg)
 	assert.DirExists(t, path)
 }
 
+func TestNew_Locked(t *testing.T) {
+	path := t.TempDir()
+
+	stg, err := New(path)
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	_, err = New(path)
+	assert.IsType(t, &storageLockedError{}, err)
+	assert.ErrorContains(t, err, path)
+
+	// Lock is released once the first instance is closed.
+	assert.NoError(t, stg.CloseDB())
+
+	stg2, err := New(path)
+	assert.NoError(t, err)
+	assert.NoError(t, stg2.CloseDB())
+}
+
+func TestNew_ReadOnly(t *testing.T) {
+	path := t.TempDir()
+
+	stg, err := New(path)
+	assert.NoError(t, err)
+	assert.NoError(t, stg.Add(map[string][]byte{"a": []byte("1")}))
+	assert.NoError(t, stg.CloseDB())
+
+	stg, err = New(path, WithReadOnly(true))
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	val, err := stg.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+
+	assert.ErrorIs(t, stg.Add(map[string][]byte{"b": []byte("2")}), badger.ErrReadOnlyTxn)
+
+	_, err = New("", WithReadOnly(true))
+	assert.IsType(t, &readOnlyInMemoryError{}, err)
+}
+
+func TestNew_Logger(t *testing.T) {
+	var buf bytes.Buffer
+
+	stg, err := New("", WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	assert.Error(t, stg.RunGC(0))
+	assert.Contains(t, buf.String(), "vectoria:src:internal:storage:RunGC")
+}
+
+func TestGet_NotFound(t *testing.T) {
+	stg := setup(t)
+
+	_, err := stg.Get("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	var notFound *NotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, "missing", notFound.Key)
+
+	err = stg.View(func(tx ReadTx) error {
+		_, err := tx.Get("missing")
+		return err
+	})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
 func TestCloseDB(t *testing.T) {
 	stg := setup(t)
 
@@ -36,6 +111,39 @@ func TestCloseDB(t *testing.T) {
 	assert.True(t, stg.db.IsClosed())
 }
 
+func TestKeysExist(t *testing.T) {
+	stg, err := New("")
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	err = stg.Add(map[string][]byte{"a": []byte("1"), "b": []byte("")})
+	assert.NoError(t, err)
+
+	exists, err := stg.KeysExist("a", "b", "c", "a-suffix")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": false, "a-suffix": false}, exists)
+}
+
+func TestWrite(t *testing.T) {
+	stg, err := New("")
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	err = stg.Add(map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	assert.NoError(t, err)
+
+	err = stg.Write(map[string][]byte{"a": []byte("3"), "c": []byte("4")}, []string{"b"})
+	assert.NoError(t, err)
+
+	val, err := stg.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), val)
+
+	exists, err := stg.KeysExist("b", "c")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"b": false, "c": true}, exists)
+}
+
 func TestKeyExists(t *testing.T) {
 	key := gofakeit.Name()
 
@@ -71,6 +179,7 @@ func TestKeyExists(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			stg, err := New("")
 			assert.NoError(t, err)
+			defer stg.CloseDB()
 			assert.NotNil(t, stg)
 
 			err = stg.Add(tc.data)
@@ -88,10 +197,370 @@ func TestKeyExists(t *testing.T) {
 	}
 }
 
+func TestCountWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/a":   []byte("1"),
+		"prefix/b":   []byte("2"),
+		"prefix/c":   []byte("3"),
+		"other/a":    []byte("4"),
+		"prefixed/a": []byte("5"),
+	})
+	assert.NoError(t, err)
+
+	count, err := stg.CountWithPrefix("prefix/")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = stg.CountWithPrefix("missing/")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestStream(t *testing.T) {
+	stg := setup(t)
+
+	data := make(map[string][]byte, 5000)
+	for i := 0; i < 5000; i++ {
+		data[fmt.Sprintf("prefix/%d", i)] = []byte(fmt.Sprint(i))
+	}
+	data["other/0"] = []byte("0")
+
+	err := stg.Add(data)
+	assert.NoError(t, err)
+
+	seen := make(map[string]int, 5000)
+
+	err = stg.Stream(context.Background(), "prefix/", func(key string, val []byte) error {
+		assert.Equal(t, data[key], val)
+		seen[key]++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, seen, 5000)
+
+	for key, count := range seen {
+		assert.Equal(t, 1, count, key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = stg.Stream(ctx, "prefix/", func(key string, val []byte) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	stop := errors.New("stop")
+
+	err = stg.Stream(context.Background(), "prefix/", func(key string, val []byte) error {
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+}
+
+func TestIterateWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/b": []byte("2"),
+		"prefix/a": []byte("1"),
+		"other/c":  []byte("3"),
+	})
+	assert.NoError(t, err)
+
+	var keys, values []string
+
+	err = stg.IterateWithPrefix("prefix/", func(key string, val []byte) error {
+		keys = append(keys, key)
+		values = append(values, string(val))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a", "prefix/b"}, keys)
+	assert.Equal(t, []string{"1", "2"}, values)
+
+	stop := errors.New("stop")
+	numCalls := 0
+
+	err = stg.IterateWithPrefix("prefix/", func(key string, val []byte) error {
+		numCalls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, numCalls)
+}
+
+func TestGetWithPrefixFunc(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/b": []byte("2"),
+		"prefix/a": []byte("1"),
+		"other/c":  []byte("3"),
+	})
+	assert.NoError(t, err)
+
+	var values []string
+
+	err = stg.GetWithPrefixFunc("prefix/", func(val []byte) error {
+		values = append(values, string(val))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, values)
+
+	stop := errors.New("stop")
+	numCalls := 0
+
+	err = stg.View(func(tx ReadTx) error {
+		return tx.GetWithPrefixFunc("prefix/", func(val []byte) error {
+			numCalls++
+			return stop
+		})
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, numCalls)
+}
+
+func TestIterateKeysWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/b": []byte("2"),
+		"prefix/a": []byte("1"),
+		"other/c":  []byte("3"),
+	})
+	assert.NoError(t, err)
+
+	var keys []string
+
+	err = stg.IterateKeysWithPrefix("prefix/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a", "prefix/b"}, keys)
+
+	stop := errors.New("stop")
+
+	err = stg.IterateKeysWithPrefix("prefix/", func(key string) error {
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+}
+
+func TestGetKeysWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/b": []byte("2"),
+		"prefix/a": []byte("1"),
+		"other/c":  []byte("3"),
+	})
+	assert.NoError(t, err)
+
+	keys, err := stg.GetKeysWithPrefix("prefix/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a", "prefix/b"}, keys)
+
+	keys, err = stg.GetKeysWithPrefix("missing/")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	var nilStg *Storage
+	_, err = nilStg.GetKeysWithPrefix("prefix/")
+	assert.IsType(t, &nilStorageReceiverError{}, err)
+}
+
+func TestDelWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/b": []byte("2"),
+		"prefix/a": []byte("1"),
+		"prefixed": []byte("3"),
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, stg.DelWithPrefix("prefix/"))
+
+	keys, err := stg.GetKeysWithPrefix("prefix")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefixed"}, keys)
+
+	assert.NoError(t, stg.DelWithPrefix("missing/"))
+}
+
+func TestUsageWithPrefix(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{
+		"prefix/a":  []byte("1"),
+		"prefix/bb": []byte("22"),
+		"other/c":   []byte("333"),
+	})
+	assert.NoError(t, err)
+
+	usage, err := stg.UsageWithPrefix("prefix/")
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Count: 2, KeyBytes: 17, ValueBytes: 3}, usage)
+
+	usage, err = stg.UsageWithPrefix("missing/")
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{}, usage)
+}
+
+func TestView(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{"pair/a": {0}, "pair/b": {0}})
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := byte(1); i < 200; i++ {
+			// Both keys are always written together.
+			err := stg.Add(map[string][]byte{"pair/a": {i}, "pair/b": {i}})
+			assert.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		err := stg.View(func(tx ReadTx) error {
+			a, err := tx.Get("pair/a")
+			if err != nil {
+				return err
+			}
+
+			pair, err := tx.GetWithPrefix("pair/")
+			if err != nil {
+				return err
+			}
+
+			b, err := tx.Get("pair/b")
+			if err != nil {
+				return err
+			}
+
+			assert.Equal(t, a, b)
+			assert.Equal(t, [][]byte{a, b}, pair)
+
+			var keys []string
+			err = tx.IterateWithPrefix("pair/", func(key string, val []byte) error {
+				keys = append(keys, key)
+				assert.Equal(t, a, val)
+				return nil
+			})
+			assert.Equal(t, []string{"pair/a", "pair/b"}, keys)
+
+			return err
+		})
+		assert.NoError(t, err)
+	}
+
+	<-done
+}
+
+func TestBackupLoad(t *testing.T) {
+	src, err := New("")
+	assert.NoError(t, err)
+	defer src.CloseDB()
+
+	err = src.Add(map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	version, err := src.Backup(&buf, 0)
+	assert.NoError(t, err)
+
+	dst := setup(t)
+
+	err = dst.Load(&buf)
+	assert.NoError(t, err)
+
+	val, err := dst.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), val)
+
+	count, err := dst.CountWithPrefix("")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// An incremental backup only holds the keys written since the previous one.
+	err = src.Add(map[string][]byte{"c": []byte("3")})
+	assert.NoError(t, err)
+
+	buf.Reset()
+
+	_, err = src.Backup(&buf, version)
+	assert.NoError(t, err)
+
+	incremental := setup(t)
+
+	err = incremental.Load(&buf)
+	assert.NoError(t, err)
+
+	keys, err := incremental.GetKeysWithPrefix("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, keys)
+}
+
+func TestRunGC(t *testing.T) {
+	stg := setup(t)
+
+	err := stg.Add(map[string][]byte{"a": make([]byte, 1<<20)})
+	assert.NoError(t, err)
+
+	assert.NoError(t, stg.Del("a"))
+	assert.NoError(t, stg.RunGC(0.5))
+	assert.IsType(t, &invalidDiscardRatioError{}, stg.RunGC(1))
+
+	inMemory, err := New("")
+	assert.NoError(t, err)
+	defer inMemory.CloseDB()
+
+	assert.NoError(t, inMemory.RunGC(0.5))
+}
+
+func TestSync(t *testing.T) {
+	path := t.TempDir()
+
+	stg, err := New(path, WithSyncWrites(true))
+	assert.NoError(t, err)
+	assert.True(t, stg.db.Opts().SyncWrites)
+
+	assert.NoError(t, stg.Add(map[string][]byte{"a": []byte("1")}))
+	assert.NoError(t, stg.Sync())
+	assert.NoError(t, stg.CloseDB())
+
+	inMemory, err := New("", WithSyncWrites(true))
+	assert.NoError(t, err)
+	defer inMemory.CloseDB()
+
+	assert.False(t, inMemory.db.Opts().SyncWrites)
+	assert.NoError(t, inMemory.Sync())
+
+	readOnly, err := New(path, WithReadOnly(true))
+	assert.NoError(t, err)
+	defer readOnly.CloseDB()
+
+	assert.NoError(t, readOnly.Sync())
+
+	val, err := readOnly.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+}
+
 func setup(t *testing.T) *Storage {
 	stg, err := New(t.TempDir())
 	assert.NoError(t, err)
 	assert.NotNil(t, stg)
+	t.Cleanup(func() { stg.CloseDB() })
 
 	return stg
 }
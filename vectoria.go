@@ -1,12 +1,36 @@
 // Package vectoria provides an embedded vector database for simple use cases.
+//
+// A DB is safe for concurrent use by multiple goroutines. Every write to an index is a single transaction,
+// so concurrent reads see an item either fully added or not at all. Adds and Gets run concurrently, while
+// operations that read then modify an index (Update, Delete, AddBatchIfAbsent, Repair, MigrateNormalize, PruneRounds
+// and Reembed) are serialized per index. Creating and dropping indexes is serialized too, and writes racing the
+// drop of their index fail. Close must not run concurrently with other operations.
 package vectoria
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/mastrasec/vectoria/internal/errs"
+	"github.com/mastrasec/vectoria/internal/flat"
 	"github.com/mastrasec/vectoria/internal/lsh"
+	"github.com/mastrasec/vectoria/internal/semantic"
 	"github.com/mastrasec/vectoria/internal/storage"
 	"golang.org/x/exp/maps"
 )
@@ -15,9 +39,60 @@ type DB struct {
 	log bool
 	stg storage.Contract
 
+	// Prepended to every storage key, namespacing the DB's data.
+	keyPrefix string
+
+	// k used by GetDefaultK.
+	defaultK uint32
+
+	// Generates IDs, such as names for indexes created without one.
+	newID func() string
+
+	// Largest vector accepted, checked before any work is done on it.
+	maxSpaceDim uint32
+
+	// Neighbors returned per index at most, whatever k is. Zero means no cap.
+	maxResults uint32
+
+	// Whether writes require index names. See DBConfig.StrictIndexNames.
+	strictIndexNames bool
+
+	// Passed on to LSH indexes. Nil leaves their default, which does nothing.
+	observer Observer
+
+	// Logs errors, here and in the storage and indexes. Never nil.
+	logger *slog.Logger
+
+	// File the in-memory storage is checkpointed to. Empty when checkpoints are disabled.
+	checkpointPath string
+
+	// Closed to stop the checkpoints goroutine, which closes checkpointsDone on return.
+	stopCheckpoints chan struct{}
+	checkpointsDone chan struct{}
+
+	// Closed to stop the stats goroutine, which closes statsDone on return.
+	stopStats chan struct{}
+	statsDone chan struct{}
+
+	// Closed to stop the GC goroutine, which closes gcDone on return.
+	stopGC chan struct{}
+	gcDone chan struct{}
+
 	// index ID -> index pointer
 	indexRef safeMap
 
+	// Set by DBConfig.ReadOnly.
+	readOnly bool
+
+	// Manifest of a read-only DB created before manifests existed, built by migrateManifest, which can't store it.
+	unstoredManifest []IndexManifestEntry
+
+	// Serializes index creation, so that two indexes can't be created under the same name.
+	schemaMu sync.Mutex
+
+	// Serializes Close, so that concurrent calls don't stop the goroutines twice.
+	closeMu sync.Mutex
+
 	// Keeps track of option functions called in Open to avoid duplication
 	called map[string]bool
 }
@@ -26,8 +101,11 @@ type Options func(*DB) error
 
 func newDB(stg storage.Contract) *DB {
 	db := &DB{
-		stg:    stg,
-		called: make(map[string]bool),
+		stg:         stg,
+		newID:       uuid.NewString,
+		maxSpaceDim: DEFAULT_MAX_SPACE_DIM,
+		logger:      slog.Default(),
+		called:      make(map[string]bool),
 	}
 
 	db.indexRef.make()
@@ -76,187 +154,3955 @@ func (sm *safeMap) keyExists(key string) bool {
 	return exists
 }
 
+// snapshot copies the items, so they can be ranged over without holding the lock.
+func (sm *safeMap) snapshot() map[string]index {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return maps.Clone(sm.items)
+}
+
+func (sm *safeMap) keys() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return maps.Keys(sm.items)
+}
+
 func (sm *safeMap) len() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
 	return len(sm.items)
 }
 
 // =================================== API ===================================
 
+// Number of items written per batch by ImportJSONL.
+const IMPORT_BATCH_SIZE int = 1000
+
+// Largest space dimension (vector length) accepted by default.
+const DEFAULT_MAX_SPACE_DIM uint32 = 1 << 16
+
+// Time between checkpoints, by default.
+const DEFAULT_CHECKPOINT_INTERVAL time.Duration = time.Minute
+
+// Discard ratio of the periodic value log GC, by default.
+const DEFAULT_GC_DISCARD_RATIO float64 = 0.5
+
+// Time the circuit breaker stays open, by default, before probing the storage again.
+const DEFAULT_BREAKER_COOLDOWN time.Duration = 30 * time.Second
+
 type DBConfig struct {
 	Path string
 	log  bool
 
+	// Prepended to every storage key, so the DB's data doesn't collide with other data in the same storage.
+	// Defaults to no prefix. It must be the same every time the DB is opened.
+	KeyPrefix string
+
+	// Number of neighbors returned per index by GetDefaultK. Zero means all of them.
+	DefaultK uint32
+
+	// Generates IDs, such as names for indexes created without one. Defaults to random UUIDs.
+	// Plug in ULIDs, for instance, to get IDs that sort by creation time.
+	IDGenerator func() string
+
+	// Largest space dimension (vector length) accepted, both for indexes and for the vectors given to Add and Get.
+	// It protects against oversized inputs. Zero uses DEFAULT_MAX_SPACE_DIM.
+	MaxSpaceDim uint32
+
+	// Hard cap on the neighbors returned per index by Get, GetCapped, GetPrepared, GetMulti and GetPercentile,
+	// whatever k is, protecting callers from huge result sets. Zero means no cap. GetCapped reports whether it
+	// truncated the results.
+	MaxResults uint32
+
+	// Stops hitting a failing storage. Disabled by default.
+	CircuitBreaker CircuitBreakerConfig
+
+	// Opens the DB at Path without write access, to serve queries from a pre-built DB, possibly on a read-only
+	// filesystem. Every method that writes, from Add to DropIndex, Restore and the index migrations, then fails
+	// with a readOnlyError, and counters aren't saved. Ping only reads.
+	// Indexes must already be stored: only stored ones can be listed in LSH and Flat. It requires a Path.
+	ReadOnly bool
+
+	// Syncs every write to disk before it returns, so that no acknowledged write is lost on a crash, at the cost
+	// of write throughput: each one waits for an fsync. Without it, calling Sync after a batch of writes makes
+	// them durable for a single fsync. Ignored in memory.
+	SyncWrites bool
+
+	// When true, Add, AddBatch and Delete require index names instead of targeting every index
+	// when given none, so a forgotten index name fails instead of silently writing to all indexes.
+	// AddAll still adds to every index.
+	StrictIndexNames bool
+
+	// When true, New repairs every index, as Repair does, logging what it fixed.
+	// It recovers from writes interrupted by a crash, at the cost of a full scan of every index.
+	AutoRepair bool
+
+	// Periodically saves an in-memory DB to disk. Disabled by default.
+	Checkpoint CheckpointConfig
+
+	// Time between saves of the per-index counters reported by Overview (items added, queries run), so they survive
+	// restarts without a write per operation. Zero only saves them on Close. Saved counters lag behind the actual
+	// operations until the next save, and the ones counted since the last save are lost on a crash.
+	StatsInterval time.Duration
+
+	// Periodically reclaims the disk space of deleted and overwritten vectors. Disabled by default.
+	GC GCConfig
+
+	// Indexes to open, created unless they are already stored. Stored indexes not listed here are reopened too,
+	// with their stored hyperparameters and default query settings.
 	LSH []LSHConfig
+
+	// Logs the errors and background failures of the DB, its storage and its indexes, instead of slog's default
+	// logger, so that they can be routed to the application's logger, or silenced. Nil uses slog's default logger.
+	Logger *slog.Logger
+
+	// Notified of the queries run on LSH indexes by Get and GetPrepared, to feed metrics such as the candidates scanned
+	// per query. Disabled by default.
+	Observer Observer
+
+	// Exact indexes to open, created unless they are already stored. Like LSH ones, stored flat indexes not
+	// listed here are reopened too. Index names are shared by both kinds of indexes.
+	Flat []FlatConfig
+}
+
+// CircuitBreakerConfig makes the DB fail fast while its storage is unhealthy (full disk, corruption...).
+// After Threshold consecutive storage errors, every storage operation fails with a storageUnavailableError
+// for Cooldown. Then a single operation is let through as a probe: its success closes the breaker,
+// its failure opens it for another Cooldown.
+type CircuitBreakerConfig struct {
+	// Consecutive storage errors that open the breaker. Zero disables it.
+	Threshold uint32
+
+	// Time the breaker stays open before probing. Zero uses DEFAULT_BREAKER_COOLDOWN.
+	Cooldown time.Duration
+}
+
+// CheckpointConfig runs the DB in memory while keeping it durable up to the last checkpoint:
+// a background goroutine writes a backup of the storage to Path every Interval, and Close writes a last one.
+// On New, the DB is restored from Path if it exists. DBConfig.Path must be empty.
+type CheckpointConfig struct {
+	// File the backups are written to. Empty disables checkpoints.
+	Path string
+
+	// Time between checkpoints. Zero uses DEFAULT_CHECKPOINT_INTERVAL.
+	Interval time.Duration
+}
+
+// GCConfig runs RunGC in a background goroutine every Interval, until Close. Like RunGC, it does nothing
+// for an in-memory DB.
+type GCConfig struct {
+	// Time between GC runs. Zero disables them.
+	Interval time.Duration
+
+	// Passed on to RunGC. Zero uses DEFAULT_GC_DISCARD_RATIO.
+	DiscardRatio float64
 }
 
 func (conf LSHConfig) indexName() string {
 	return conf.IndexName
 }
 
+func (conf FlatConfig) indexName() string {
+	return conf.IndexName
+}
+
 func New(config DBConfig) (db *DB, err error) {
-	stg, err := storage.New(config.Path)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var stg storage.Contract
+	stg, err = storage.New(config.Path, storage.WithReadOnly(config.ReadOnly),
+		storage.WithSyncWrites(config.SyncWrites), storage.WithLogger(config.Logger))
 	if err != nil {
 		return nil, err
 	}
 
+	if config.Checkpoint.Path != "" {
+		if err := restoreCheckpoint(stg, config.Checkpoint.Path); err != nil {
+			stg.CloseDB()
+			return nil, err
+		}
+	}
+
+	if config.CircuitBreaker.Threshold != 0 {
+		stg = newBreaker(stg, config.CircuitBreaker)
+	}
+
+	stg = &closable{Contract: stg}
+
 	db = newDB(stg)
+	db.keyPrefix = config.KeyPrefix
+	db.defaultK = config.DefaultK
+	db.maxResults = config.MaxResults
+	db.strictIndexNames = config.StrictIndexNames
+	db.readOnly = config.ReadOnly
+	db.observer = config.Observer
+
+	if config.Logger != nil {
+		db.logger = config.Logger
+	}
+
+	if config.IDGenerator != nil {
+		db.newID = config.IDGenerator
+	}
+
+	if config.MaxSpaceDim != 0 {
+		db.maxSpaceDim = config.MaxSpaceDim
+	}
+
+	if err := db.migrateKeySeparator(); err != nil {
+		stg.CloseDB()
+		return nil, err
+	}
+
+	if err := db.migrateManifest(); err != nil {
+		stg.CloseDB()
+		return nil, err
+	}
+
+	if err := db.addIndexes(config.LSH, config.Flat); err != nil {
+		stg.CloseDB()
+		return nil, err
+	}
 
-	if err := db.addLSH(config.LSH...); err != nil {
+	if err := db.loadStoredIndexes(); err != nil {
+		stg.CloseDB()
 		return nil, err
 	}
 
+	if config.AutoRepair {
+		if err := db.repairAll(); err != nil {
+			stg.CloseDB()
+			return nil, err
+		}
+	}
+
+	if config.Checkpoint.Path != "" {
+		interval := config.Checkpoint.Interval
+		if interval == 0 {
+			interval = DEFAULT_CHECKPOINT_INTERVAL
+		}
+
+		db.startCheckpoints(config.Checkpoint.Path, interval)
+	}
+
+	if config.StatsInterval != 0 && !config.ReadOnly {
+		db.startStatsFlushes(config.StatsInterval)
+	}
+
+	if config.GC.Interval != 0 {
+		discardRatio := config.GC.DiscardRatio
+		if discardRatio == 0 {
+			discardRatio = DEFAULT_GC_DISCARD_RATIO
+		}
+
+		db.startGC(config.GC.Interval, discardRatio)
+	}
+
 	return db, nil
 }
 
-func (db *DB) addLSH(configs ...LSHConfig) error {
-	for i, config := range configs {
-		if exists := db.indexExists(config.IndexName); exists {
-			db.addLSHRollback(configs[:i+1]...)
-			return &indexAlreadyExistsError{config.IndexName}
-		}
+// loadStoredIndexes reopens the indexes of the manifest that config.LSH and config.Flat didn't list, so that a DB
+// opened on an existing Path gets back the indexes of previous runs. Their hyperparameters and metric are stored,
+// but their other query settings (such as MaxCandidates or FallbackRadius) aren't: list them in config.LSH to set those.
+func (db *DB) loadStoredIndexes() error {
+	entries, err := db.Manifest()
+	if err != nil {
+		return err
+	}
 
-		if config.IndexName == "" {
-			config.IndexName = uuid.NewString()
+	for _, entry := range entries {
+		if db.indexExists(entry.Name) {
+			continue
 		}
 
-		locality, err := lsh.New(config.IndexName, db.stg, config.NumRounds, config.NumHyperPlanes, config.SpaceDim)
+		idx, err := db.openStoredIndex(entry.Name, entry.Type, &entry.Metric)
 		if err != nil {
 			return err
 		}
 
-		db.indexRef.add(config.IndexName, &lshIndex{locality: locality})
+		db.indexRef.add(entry.Name, idx)
 	}
 
 	return nil
 }
 
-func (db *DB) addLSHRollback(configs ...LSHConfig) {
-	for _, config := range configs {
-		db.indexRef.del(config.IndexName)
+// openStoredIndex opens an index of the given type from its stored config. A nil metric, for indexes found
+// without a manifest, leaves LSH indexes with their stored one, and flat indexes with MetricCosine.
+func (db *DB) openStoredIndex(name, indexType string, metric *Metric) (index, error) {
+	if indexType == IndexTypeFlat {
+		opts := []flat.Option{flat.WithKeyPrefix(db.keyPrefix), flat.WithLogger(db.logger)}
+		if metric != nil {
+			opts = append(opts, flat.WithMetric(*metric))
+		}
+
+		// Zero space dimension, as the stored one is loaded.
+		exact, err := flat.New(name, db.stg, 0, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &flatIndex{exact: exact}, nil
+	}
+
+	opts := []lsh.Option{
+		lsh.WithKeyPrefix(db.keyPrefix),
+		lsh.WithObserver(db.observer),
+		lsh.WithLogger(db.logger),
+		lsh.WithReadOnly(db.readOnly),
+	}
+	if metric != nil {
+		opts = append(opts, lsh.WithMetric(*metric))
+	}
+
+	// Zero hyperparameters, as the stored ones are loaded.
+	locality, err := lsh.New(name, db.stg, 0, 0, 0, opts...)
+	if err != nil {
+		return nil, err
 	}
+
+	return &lshIndex{locality: locality}, nil
 }
 
-func (db *DB) Indexes() []string {
-	return maps.Keys(db.indexRef.items)
+// Types of index recorded in the manifest.
+const (
+	IndexTypeLSH  = "lsh"
+	IndexTypeFlat = "flat"
+)
+
+// IndexManifestEntry describes a stored index, as recorded in the manifest when it was created.
+type IndexManifestEntry struct {
+	Name string `json:"name"`
+
+	// IndexTypeLSH or IndexTypeFlat.
+	Type string `json:"type"`
+
+	// Zero for indexes created before the manifest existed.
+	CreatedAt time.Time `json:"created_at"`
+
+	SpaceDim uint32 `json:"space_dim"`
+
+	// MetricCosine for indexes created before the manifest recorded it.
+	Metric Metric `json:"metric"`
 }
 
-func (db *DB) NumIndexes() uint32 {
-	return uint32(len(db.Indexes()))
+// Manifest returns the entry of every stored index, sorted by name. The manifest is a single key, written
+// whenever indexes are created or dropped, that New reads to reopen the indexes of previous runs.
+func (db *DB) Manifest() ([]IndexManifestEntry, error) {
+	entries, _, err := db.readManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes created with a zero SpaceDim are recorded before their first vector sets it.
+	for i, entry := range entries {
+		if idx, ok := db.indexRef.get(entry.Name); ok && entry.SpaceDim == 0 {
+			entries[i].SpaceDim = idx.spaceDim()
+		}
+	}
+
+	return entries, nil
 }
 
-// TODO: rollback on err
-func (db *DB) Add(itemID string, itemVec []float64, indexNames ...string) error {
-	if db.NumIndexes() == 0 {
-		return &dbHasNoIndexError{}
+func (db *DB) manifestKey() string {
+	if db.keyPrefix == "" {
+		return "manifest"
 	}
 
-	if len(indexNames) == 0 {
-		indexNames = db.Indexes()
+	return db.keyPrefix + lsh.KEY_SEPARATOR + "manifest"
+}
+
+// readManifest returns the stored manifest, or found false when there is none yet.
+func (db *DB) readManifest() (entries []IndexManifestEntry, found bool, err error) {
+	found, err = db.stg.KeyExists(db.manifestKey())
+	if err != nil {
+		return nil, false, err
 	}
 
-	for _, indexName := range indexNames {
-		idx, ok := db.indexRef.get(indexName)
-		if !ok {
-			return &indexDoesNotExistError{name: indexName}
+	if !found {
+		if db.unstoredManifest != nil {
+			return slices.Clone(db.unstoredManifest), true, nil
 		}
 
-		if err := idx.add(itemID, itemVec); err != nil {
-			return err
-		}
+		return nil, false, nil
 	}
 
-	return nil
+	data, err := db.stg.Get(db.manifestKey())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, false, err
+	}
+
+	return entries, true, nil
 }
 
-func (db *DB) Get(queryVec []float64, threshold float64, k uint32, indexNames ...string) (res map[string][]string, err error) {
-	if len(indexNames) == 0 {
-		indexNames = db.Indexes()
+func (db *DB) writeManifest(entries []IndexManifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
 	}
 
-	res = make(map[string][]string, len(indexNames))
+	return db.stg.Add(map[string][]byte{db.manifestKey(): data})
+}
 
-	for _, indexName := range indexNames {
-		idx, ok := db.indexRef.get(indexName)
-		if !ok {
-			return nil, &indexDoesNotExistError{name: indexName}
+// recordIndexes adds the given indexes to the manifest, unless they are already in it.
+func (db *DB) recordIndexes(indexNames ...string) error {
+	entries, _, err := db.readManifest()
+	if err != nil {
+		return err
+	}
+
+	recorded := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		recorded[entry.Name] = true
+	}
+
+	var added bool
+
+	for _, name := range indexNames {
+		idx, ok := db.indexRef.get(name)
+		if !ok || recorded[name] {
+			continue
 		}
 
-		ids, err := idx.get(queryVec, threshold, k)
-		if err != nil {
-			return nil, err
+		entry := IndexManifestEntry{Name: name, CreatedAt: time.Now().UTC(), SpaceDim: idx.spaceDim()}
+
+		switch idx := idx.(type) {
+		case *lshIndex:
+			entry.Type = IndexTypeLSH
+			entry.Metric = idx.locality.Metric()
+		case *flatIndex:
+			entry.Type = IndexTypeFlat
+			entry.Metric = idx.exact.Metric()
 		}
 
-		res[indexName] = ids
+		entries = append(entries, entry)
+		added = true
 	}
 
-	return res, nil
-}
+	// Reopening recorded indexes leaves the manifest as is, which a read-only DB relies on.
+	if !added {
+		return nil
+	}
 
-func (db *DB) clean(itemID string, indexNames ...string) {
-	// TODO: delete all
+	return db.writeManifest(entries)
 }
 
-func (db *DB) indexExists(indexName string) bool {
-	return db.indexRef.keyExists(indexName)
-}
+// migrateManifest writes the manifest of a DB created before it existed, finding its indexes with a scan of their keys.
+// A read-only DB keeps it in memory instead.
+func (db *DB) migrateManifest() error {
+	_, found, err := db.readManifest()
+	if err != nil || found {
+		return err
+	}
 
-// =================================== INDEXES ===================================
+	entries := []IndexManifestEntry{}
 
-type index interface {
-	add(itemID string, itemVec []float64) error
-	get(queryVec []float64, threshold float64, k uint32) (ids []string, err error)
-	info() map[string]any
-}
+	for indexType, storedIndexNames := range map[string]func(storage.Contract, string) ([]string, error){
+		IndexTypeLSH:  lsh.StoredIndexNames,
+		IndexTypeFlat: flat.StoredIndexNames,
+	} {
+		names, err := storedIndexNames(db.stg, db.keyPrefix)
+		if err != nil {
+			return err
+		}
 
-type LSHConfig struct {
-	IndexName string `json:"index_name"`
+		for _, name := range names {
+			idx, err := db.openStoredIndex(name, indexType, nil)
+			if err != nil {
+				return err
+			}
 
-	// Number of rounds. More rounds improve quality, but also adds computation overhead.
-	// It must be at least 1.
-	// If invalid value is given, default value is used.
-	NumRounds uint32 `json:"num_rounds"`
+			entries = append(entries, IndexManifestEntry{Name: name, Type: indexType, SpaceDim: idx.spaceDim(), Metric: idx.metric()})
+		}
+	}
 
-	// Number of hyperplanes to split the space on. It must be at least 1.
-	// If invalid value is given, default value is used.
-	NumHyperPlanes uint32 `json:"num_hyper_planes"`
+	if db.readOnly {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
 
-	// Dimension of the space (vector length). It must be at least 2.
-	// If invalid value is given, default value is used.
-	SpaceDim uint32 `json:"space_dim"`
-}
+		db.unstoredManifest = entries
 
-type lshIndex struct {
-	locality *lsh.LSH
-}
+		return nil
+	}
 
-func (l *lshIndex) add(itemID string, itemVec []float64) error {
-	return l.locality.Add(itemID, itemVec)
+	return db.writeManifest(entries)
 }
 
-func (l *lshIndex) get(queryVec []float64, threshold float64, k uint32) (ids []string, err error) {
-	return l.locality.Get(queryVec, threshold, k)
-}
+// Keys written before KEY_SEPARATOR joined their elements with "/" as is. keyEscaper escapes names and IDs
+// as the lsh package now does.
+var keyEscaper = strings.NewReplacer("\x1e", "\x1ee", lsh.KEY_SEPARATOR, "\x1es")
 
-func (l *lshIndex) info() map[string]any {
-	return l.locality.Info()
-}
+// MIGRATE_BATCH_SIZE is how many keys migrateKeySeparator rewrites at a time.
+const MIGRATE_BATCH_SIZE int = 1000
 
-// =================================== ERRORS ===================================
+// migrateKeySeparator rewrites the keys of the LSH indexes stored before KEY_SEPARATOR, whose elements were
+// joined with "/", so that they are found again. Every batch is written before its legacy keys are deleted,
+// so an interrupted migration resumes on the next New.
+func (db *DB) migrateKeySeparator() error {
+	legacyPrefix, newPrefix := "index/", "index"+lsh.KEY_SEPARATOR
+	if db.keyPrefix != "" {
+		legacyPrefix, newPrefix = db.keyPrefix+"/"+legacyPrefix, db.keyPrefix+lsh.KEY_SEPARATOR+newPrefix
+	}
 
-type indexAlreadyExistsError struct {
-	name string
-}
+	var legacyKeys []string
+	err := db.stg.IterateKeysWithPrefix(legacyPrefix, func(key string) error {
+		legacyKeys = append(legacyKeys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-func (e *indexAlreadyExistsError) Error() string {
-	return fmt.Sprintf("index %s already exists.", e.name)
-}
+	if len(legacyKeys) > 0 && db.readOnly {
+		return &legacyKeysReadOnlyError{}
+	}
 
-type indexDoesNotExistError struct {
-	name string
+	// Names and IDs may hold "/" too, so a key's index name is told apart by the index's own num_rounds key.
+	exists := make(map[string]bool, len(legacyKeys))
+	for _, legacyKey := range legacyKeys {
+		exists[legacyKey] = true
+	}
+
+	var names []string
+	for _, legacyKey := range legacyKeys {
+		if exists[legacyKey+"/num_rounds"] {
+			names = append(names, strings.TrimPrefix(legacyKey, legacyPrefix))
+		}
+	}
+
+	for start := 0; start < len(legacyKeys); start += MIGRATE_BATCH_SIZE {
+		batch := legacyKeys[start:min(start+MIGRATE_BATCH_SIZE, len(legacyKeys))]
+		data := make(map[string][]byte, len(batch))
+
+		for _, legacyKey := range batch {
+			val, err := db.stg.Get(legacyKey)
+			if err != nil {
+				return err
+			}
+
+			data[newPrefix+migrateLegacyKey(strings.TrimPrefix(legacyKey, legacyPrefix), names)] = val
+		}
+
+		if err := db.stg.Add(data); err != nil {
+			return err
+		}
+
+		if err := db.stg.Del(batch...); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (e *indexDoesNotExistError) Error() string {
-	return fmt.Sprintf("index %s does not exist.", e.name)
+// migrateLegacyKey rewrites a legacy key, without its "index/" prefix, with KEY_SEPARATOR. Only the index name
+// and the structural elements that follow it are split on "/", so that an ID holding "/" stays a single element.
+func migrateLegacyKey(tail string, names []string) string {
+	name := ""
+	for _, n := range names {
+		if len(n) > len(name) && (tail == n || strings.HasPrefix(tail, n+"/")) {
+			name = n
+		}
+	}
+
+	if name == "" {
+		name, _, _ = strings.Cut(tail, "/")
+	}
+
+	elems := []string{keyEscaper.Replace(name)}
+
+	rest, found := strings.CutPrefix(tail, name+"/")
+	if !found {
+		return elems[0]
+	}
+
+	kind, rest, found := strings.Cut(rest, "/")
+	elems = append(elems, kind)
+
+	if found {
+		switch kind {
+		case "sketch":
+			sk, id, found := strings.Cut(rest, "/")
+			elems = append(elems, sk)
+			if found {
+				elems = append(elems, keyEscaper.Replace(id))
+			}
+		case "hash", "stats":
+			elems = append(elems, strings.Split(rest, "/")...)
+		default:
+			elems = append(elems, keyEscaper.Replace(rest))
+		}
+	}
+
+	return strings.Join(elems, lsh.KEY_SEPARATOR)
+}
+
+// repairAll repairs every index, logging the ones that needed it.
+func (db *DB) repairAll() error {
+	for name, idx := range db.indexRef.snapshot() {
+		report, err := idx.repair()
+		if err != nil {
+			return err
+		}
+
+		if report != (RepairReport{}) {
+			db.logger.Warn("repaired index", "index", name,
+				"orphaned_sketches", report.OrphanedSketches,
+				"missing_sketches", report.MissingSketches,
+				"resketched_items", report.ResketchedItems)
+		}
+	}
+
+	return nil
+}
+
+// Close saves the counters reported by Overview, stops the checkpoints, if any, after writing a last one,
+// and closes the storage, releasing its directory. Afterwards, operations that read or write the storage fail
+// with a "database closed" error. Closing it again is a no-op.
+func (db *DB) Close() error {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+
+	if db.closed() {
+		return nil
+	}
+
+	if db.stopGC != nil {
+		close(db.stopGC)
+		<-db.gcDone
+		db.stopGC = nil
+	}
+
+	if db.stopStats != nil {
+		close(db.stopStats)
+		<-db.statsDone
+		db.stopStats = nil
+	}
+
+	if !db.readOnly {
+		if err := db.flushStats(); err != nil {
+			db.stg.CloseDB()
+			return err
+		}
+	}
+
+	if db.stopCheckpoints != nil {
+		close(db.stopCheckpoints)
+		<-db.checkpointsDone
+		db.stopCheckpoints = nil
+
+		if err := db.checkpoint(); err != nil {
+			db.stg.CloseDB()
+			return err
+		}
+	}
+
+	return db.stg.CloseDB()
+}
+
+// Ping checks that the storage works with a write, read and delete of a health key, or only a read of it
+// if the DB is read-only. Every call writes its own key, so concurrent calls don't fail each other.
+// It fails on a closed DB.
+func (db *DB) Ping() error {
+	if db.readOnly {
+		_, err := db.stg.KeyExists(db.healthKey())
+		return err
+	}
+
+	token := uuid.NewString()
+	key, value := db.healthKey()+lsh.KEY_SEPARATOR+token, []byte(token)
+
+	if err := db.stg.Add(map[string][]byte{key: value}); err != nil {
+		return err
+	}
+
+	got, err := db.stg.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got, value) {
+		return &healthCheckError{}
+	}
+
+	return db.stg.Del(key)
+}
+
+// Backup writes a consistent snapshot of the whole storage to w, to be restored with Restore. Zero since writes
+// everything; otherwise only what was written after that version. It returns the version to pass as since
+// to the next, incremental, backup.
+func (db *DB) Backup(w io.Writer, since uint64) (version uint64, err error) {
+	return db.stg.Backup(w, since)
+}
+
+// Restore loads a backup made by Backup, overwriting the stored keys it holds, then opens the indexes it
+// brought along and reloads the stats of the ones already open. It is meant for a fresh DB.
+// Incremental backups are restored in order, after the full one.
+func (db *DB) Restore(r io.Reader) error {
+	if db.readOnly {
+		return &readOnlyError{}
+	}
+
+	if err := db.stg.Load(r); err != nil {
+		return err
+	}
+
+	db.schemaMu.Lock()
+	defer db.schemaMu.Unlock()
+
+	// Their cached vectors and stats may have been overwritten.
+	for _, idx := range db.indexRef.snapshot() {
+		if err := idx.reload(); err != nil {
+			return err
+		}
+	}
+
+	return db.loadStoredIndexes()
+}
+
+func (db *DB) healthKey() string {
+	if db.keyPrefix == "" {
+		return "health"
+	}
+
+	return db.keyPrefix + lsh.KEY_SEPARATOR + "health"
+}
+
+// closed tells whether Close was called. DBs not created by New, whose storage isn't closable, never are.
+func (db *DB) closed() bool {
+	c, ok := db.stg.(*closable)
+	return ok && c.closed.Load()
+}
+
+func (db *DB) startCheckpoints(path string, interval time.Duration) {
+	db.checkpointPath = path
+	db.stopCheckpoints = make(chan struct{})
+	db.checkpointsDone = make(chan struct{})
+
+	go func() {
+		defer close(db.checkpointsDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.checkpoint(); err != nil {
+					db.logger.Error("unable to write checkpoint", "path", path, "error", err)
+				}
+			case <-db.stopCheckpoints:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startStatsFlushes(interval time.Duration) {
+	db.stopStats = make(chan struct{})
+	db.statsDone = make(chan struct{})
+
+	go func() {
+		defer close(db.statsDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.flushStats(); err != nil {
+					db.logger.Error("unable to save stats", "error", err)
+				}
+			case <-db.stopStats:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startGC(interval time.Duration, discardRatio float64) {
+	db.stopGC = make(chan struct{})
+	db.gcDone = make(chan struct{})
+
+	go func() {
+		defer close(db.gcDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.RunGC(discardRatio); err != nil {
+					db.logger.Error("unable to run value log GC", "error", err)
+				}
+			case <-db.stopGC:
+				return
+			}
+		}
+	}()
+}
+
+// RunGC reclaims the disk space taken by deleted and overwritten vectors, which Badger only frees by rewriting
+// its value log files. A file is rewritten when at least discardRatio of it, between 0 and 1 excluded, can be
+// discarded: 0.5 is a good default. It is a no-op for an in-memory or read-only DB. See DBConfig.GC to run it periodically.
+func (db *DB) RunGC(discardRatio float64) error {
+	return db.stg.RunGC(discardRatio)
+}
+
+// Sync flushes the writes done so far to disk, so that they survive a crash, e.g. before acknowledging them to
+// another system. Writes are otherwise flushed by Badger in the background, and the latest ones can be lost on
+// a crash. See DBConfig.SyncWrites to sync every write instead. It is a no-op for an in-memory or read-only DB.
+func (db *DB) Sync() error {
+	return db.stg.Sync()
+}
+
+// flushStats saves the counters of every index.
+func (db *DB) flushStats() error {
+	for _, idx := range db.indexRef.snapshot() {
+		if err := idx.flushStats(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkpoint writes a backup of the storage next to the checkpoint file, then renames it over,
+// so a crash mid-write never leaves a truncated checkpoint behind.
+func (db *DB) checkpoint() error {
+	tmpPath := db.checkpointPath + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.stg.Backup(f, 0); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, db.checkpointPath)
+}
+
+// restoreCheckpoint loads the checkpoint at path into stg. A missing checkpoint restores nothing.
+func restoreCheckpoint(stg storage.Contract, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return stg.Load(f)
+}
+
+// validate checks the whole config, reporting all of its problems at once in a ConfigValidationError.
+func (config DBConfig) validate() error {
+	maxSpaceDim := config.MaxSpaceDim
+	if maxSpaceDim == 0 {
+		maxSpaceDim = DEFAULT_MAX_SPACE_DIM
+	}
+
+	var errs []error
+
+	if config.Checkpoint.Path != "" && config.Path != "" {
+		errs = append(errs, &checkpointOnDiskError{config.Path})
+	}
+
+	if config.ReadOnly && config.Path == "" {
+		errs = append(errs, &readOnlyInMemoryError{})
+	}
+
+	if ratio := config.GC.DiscardRatio; ratio < 0 || ratio >= 1 {
+		errs = append(errs, &invalidDiscardRatioError{ratio})
+	}
+
+	if err := validateIndexes(config.LSH, config.Flat, maxSpaceDim, func(string) bool { return false }); err != nil {
+		errs = append(errs, err.(*ConfigValidationError).Errs...)
+	}
+
+	if len(errs) != 0 {
+		return &ConfigValidationError{errs}
+	}
+
+	return nil
+}
+
+func (db *DB) addLSH(configs ...LSHConfig) error {
+	return db.addIndexes(configs, nil)
+}
+
+// addIndexes creates or opens every index of the configs, or none of them if any fails.
+func (db *DB) addIndexes(lshConfigs []LSHConfig, flatConfigs []FlatConfig) error {
+	db.schemaMu.Lock()
+	defer db.schemaMu.Unlock()
+
+	if err := validateIndexes(lshConfigs, flatConfigs, db.maxSpaceDim, db.indexExists); err != nil {
+		return err
+	}
+
+	added := make([]string, 0, len(lshConfigs)+len(flatConfigs))
+
+	// The indexes stored by this call, rather than reopened, whose data a rollback drops.
+	var created []index
+
+	for _, config := range lshConfigs {
+		if config.IndexName == "" {
+			config.IndexName = db.newID()
+		}
+
+		opts := []lsh.Option{
+			lsh.WithRoundOrder(config.RoundOrder),
+			lsh.WithMaxCandidates(config.MaxCandidates),
+			lsh.WithKeyPrefix(db.keyPrefix),
+			lsh.WithStoreEmbeddings(config.StoreEmbeddings == nil || *config.StoreEmbeddings),
+			lsh.WithPrecomputeNorms(config.PrecomputeNorms),
+			lsh.WithFallbackRadius(config.FallbackRadius),
+			lsh.WithSeed(config.Seed),
+			lsh.WithSkipCorrupt(config.SkipCorrupt),
+			lsh.WithEmbeddingCacheSize(config.EmbeddingCacheSize),
+			lsh.WithEmbeddingCodec(config.EmbeddingCodec),
+			lsh.WithInferredSpaceDim(true),
+			lsh.WithObserver(db.observer),
+			lsh.WithLogger(db.logger),
+			lsh.WithReadOnly(db.readOnly),
+		}
+
+		if config.SimilarityEpsilon != 0 {
+			opts = append(opts, lsh.WithSimilarityEpsilon(max(config.SimilarityEpsilon, 0)))
+		}
+
+		// Unset, a stored index keeps its metric, as it keeps its other hyperparameters.
+		if config.Metric != nil {
+			opts = append(opts, lsh.WithMetric(*config.Metric))
+		}
+
+		locality, err := lsh.New(
+			config.IndexName,
+			db.stg,
+			config.NumRounds,
+			config.NumHyperPlanes,
+			config.SpaceDim,
+			opts...,
+		)
+		if err != nil {
+			db.addIndexesRollback(added, created)
+			return err
+		}
+
+		idx := &lshIndex{locality: locality}
+		if locality.Created() {
+			created = append(created, idx)
+		}
+
+		if config.BucketFilter {
+			if err := locality.WarmBucketFilter(); err != nil {
+				db.addIndexesRollback(added, created)
+				return err
+			}
+		}
+
+		db.indexRef.add(config.IndexName, idx)
+		added = append(added, config.IndexName)
+	}
+
+	for _, config := range flatConfigs {
+		if config.IndexName == "" {
+			config.IndexName = db.newID()
+		}
+
+		exact, err := flat.New(config.IndexName, db.stg, config.SpaceDim,
+			flat.WithKeyPrefix(db.keyPrefix), flat.WithMetric(config.Metric), flat.WithColumnar(config.Columnar),
+			flat.WithLogger(db.logger))
+		if err != nil {
+			db.addIndexesRollback(added, created)
+			return err
+		}
+
+		idx := &flatIndex{exact: exact}
+		if exact.Created() {
+			created = append(created, idx)
+		}
+
+		db.indexRef.add(config.IndexName, idx)
+		added = append(added, config.IndexName)
+	}
+
+	if err := db.recordIndexes(added...); err != nil {
+		db.addIndexesRollback(added, created)
+		return err
+	}
+
+	return nil
+}
+
+// validateIndexes checks every config up front and reports all of their problems at once in a ConfigValidationError.
+func validateIndexes(lshConfigs []LSHConfig, flatConfigs []FlatConfig, maxSpaceDim uint32, indexExists func(indexName string) bool) error {
+	var (
+		errs  []error
+		names = make(map[string]bool, len(lshConfigs)+len(flatConfigs))
+	)
+
+	for i, config := range lshConfigs {
+		if config.IndexName != "" {
+			if names[config.IndexName] || indexExists(config.IndexName) {
+				errs = append(errs, &indexAlreadyExistsError{config.IndexName})
+			}
+			names[config.IndexName] = true
+		}
+
+		if config.SpaceDim != 0 && config.SpaceDim < lsh.MIN_SPACE_DIM {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "SpaceDim",
+				fmt.Sprintf("must be at least %d, but got: %d", lsh.MIN_SPACE_DIM, config.SpaceDim)})
+		}
+
+		if config.SpaceDim > maxSpaceDim {
+			errs = append(errs, &spaceDimTooLargeError{int(config.SpaceDim), maxSpaceDim})
+		}
+
+		if config.NumRounds > lsh.MAX_NUM_ROUNDS {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "NumRounds",
+				fmt.Sprintf("must be at most %d, but got: %d", lsh.MAX_NUM_ROUNDS, config.NumRounds)})
+		}
+
+		if config.NumHyperPlanes > lsh.MAX_NUM_HYPERPLANES {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "NumHyperPlanes",
+				fmt.Sprintf("must be at most %d, but got: %d", lsh.MAX_NUM_HYPERPLANES, config.NumHyperPlanes)})
+		}
+
+		if numHyperPlanes := max(config.NumHyperPlanes, lsh.MIN_NUM_HYPERPLANES); config.FallbackRadius > numHyperPlanes {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "FallbackRadius",
+				fmt.Sprintf("cannot exceed the number of hyperplanes (%d), but got: %d", numHyperPlanes, config.FallbackRadius)})
+		}
+
+		if config.RoundOrder != NaturalOrder && config.RoundOrder != SelectiveFirst {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "RoundOrder",
+				fmt.Sprintf("unknown value: %d", config.RoundOrder)})
+		}
+
+		if config.EmbeddingCodec > Float32Codec {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "EmbeddingCodec",
+				fmt.Sprintf("unknown value: %d", config.EmbeddingCodec)})
+		}
+
+		if config.Metric != nil && !isKnownMetric(*config.Metric) {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "Metric",
+				fmt.Sprintf("unknown value: %d", *config.Metric)})
+		}
+
+		if math.IsNaN(config.SimilarityEpsilon) || math.IsInf(config.SimilarityEpsilon, 0) {
+			errs = append(errs, &invalidLSHConfigError{i, config.IndexName, "SimilarityEpsilon",
+				fmt.Sprintf("must be finite, but got: %v", config.SimilarityEpsilon)})
+		}
+	}
+
+	for i, config := range flatConfigs {
+		if config.IndexName != "" {
+			if names[config.IndexName] || indexExists(config.IndexName) {
+				errs = append(errs, &indexAlreadyExistsError{config.IndexName})
+			}
+			names[config.IndexName] = true
+		}
+
+		if config.SpaceDim != 0 && config.SpaceDim < flat.MIN_SPACE_DIM {
+			errs = append(errs, &invalidFlatConfigError{i, config.IndexName, "SpaceDim",
+				fmt.Sprintf("must be at least %d, but got: %d", flat.MIN_SPACE_DIM, config.SpaceDim)})
+		}
+
+		if config.SpaceDim > maxSpaceDim {
+			errs = append(errs, &spaceDimTooLargeError{int(config.SpaceDim), maxSpaceDim})
+		}
+
+		if !isKnownMetric(config.Metric) {
+			errs = append(errs, &invalidFlatConfigError{i, config.IndexName, "Metric",
+				fmt.Sprintf("unknown value: %d", config.Metric)})
+		}
+	}
+
+	if len(errs) != 0 {
+		return &ConfigValidationError{errs}
+	}
+
+	return nil
+}
+
+func isKnownMetric(metric Metric) bool {
+	return metric == MetricCosine || metric == MetricPearson || metric == MetricDotProduct || metric == MetricEuclidean ||
+		metric == MetricL1
+}
+
+// addIndexesRollback removes the indexes of a failed addIndexes, and drops the data of the ones it created, so that
+// their configs aren't reopened in place of the ones given when their names are reused. Reopened indexes are kept.
+func (db *DB) addIndexesRollback(added []string, created []index) {
+	for _, indexName := range added {
+		db.indexRef.del(indexName)
+	}
+
+	for _, idx := range created {
+		if err := idx.drop(); err != nil {
+			db.logger.Warn("unable to drop an index created by a failed index creation", "error", err)
+		}
+	}
+}
+
+// DropIndex deletes an index and all of its data, reclaiming its space. A later New or index creation can reuse
+// its name. Writes to the index that run concurrently with it either finish before it or fail with ErrNotFound,
+// so they leave nothing behind. If it fails partway, the index is reopened by the next New, and DropIndex can be
+// called again to finish.
+func (db *DB) DropIndex(indexName string) error {
+	if db.readOnly {
+		return &readOnlyError{}
+	}
+
+	db.schemaMu.Lock()
+	defer db.schemaMu.Unlock()
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	db.indexRef.del(indexName)
+
+	// The data goes first, so that an interrupted drop leaves the index in the manifest, to be dropped again.
+	if err := idx.drop(); err != nil {
+		return err
+	}
+
+	entries, _, err := db.readManifest()
+	if err != nil {
+		return err
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry IndexManifestEntry) bool {
+		return entry.Name == indexName
+	})
+
+	return db.writeManifest(entries)
+}
+
+func (db *DB) Indexes() []string {
+	return db.indexRef.keys()
+}
+
+func (db *DB) NumIndexes() uint32 {
+	return uint32(len(db.Indexes()))
+}
+
+// Add adds the item to the given indexes, or to all of them if none is given, unless
+// DBConfig.StrictIndexNames is set. Then AddAll must be used to target every index.
+// If an index fails to add the item, the indexes it was already added to are rolled back: it is deleted from
+// those it wasn't in, and its previous vector is restored in the others. Its metadata is left untouched.
+func (db *DB) Add(itemID string, itemVec []float64, indexNames ...string) error {
+	if db.NumIndexes() == 0 {
+		return &dbHasNoIndexError{}
+	}
+
+	if err := db.checkSpaceDim(itemVec); err != nil {
+		return err
+	}
+
+	indexNames, err := db.writeTargets(indexNames)
+	if err != nil {
+		return err
+	}
+
+	idxs := make([]index, len(indexNames))
+	for i, indexName := range indexNames {
+		idx, ok := db.indexRef.get(indexName)
+		if !ok {
+			return &indexDoesNotExistError{name: indexName}
+		}
+
+		// Zero while the index waits for its first vector to set it.
+		if spaceDim := idx.spaceDim(); spaceDim != 0 && uint32(len(itemVec)) != spaceDim {
+			return &itemLenError{indexName, itemID, spaceDim, len(itemVec)}
+		}
+
+		idxs[i] = idx
+	}
+
+	// Taken before anything is written, so that a failed read leaves every index as it was.
+	snapshots := make([]itemSnapshot, len(idxs))
+	for i, idx := range idxs {
+		if snapshots[i], err = snapshotItem(idx, itemID); err != nil {
+			return err
+		}
+	}
+
+	for i, idx := range idxs {
+		if err := idx.add(itemID, itemVec); err != nil {
+			db.rollbackAdd(itemID, indexNames[:i], idxs[:i], snapshots[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// itemSnapshot is the state of an item in an index before an Add, to roll it back to.
+type itemSnapshot struct {
+	existed bool
+
+	// The previous vector of an existing item. Nil if the index doesn't store embeddings.
+	vec []float64
+}
+
+func snapshotItem(idx index, itemID string) (itemSnapshot, error) {
+	exists, err := idx.exists(itemID)
+	if err != nil || !exists {
+		return itemSnapshot{}, err
+	}
+
+	vec, err := idx.embedding(itemID)
+	if err != nil {
+		return itemSnapshot{}, err
+	}
+
+	return itemSnapshot{existed: true, vec: vec}, nil
+}
+
+// rollbackAdd returns the item to its snapshotted state in the indexes it was added to before an Add failed.
+// An existing item whose previous vector wasn't stored keeps the new one.
+func (db *DB) rollbackAdd(itemID string, indexNames []string, idxs []index, snapshots []itemSnapshot) {
+	for i, idx := range idxs {
+		var err error
+
+		switch snapshot := snapshots[i]; {
+		case !snapshot.existed:
+			err = idx.delete(itemID)
+		case snapshot.vec != nil:
+			err = idx.update(itemID, snapshot.vec)
+		default:
+			db.logger.Warn("unable to restore the previous vector of the item", "index", indexNames[i], "id", itemID)
+		}
+
+		if err != nil {
+			db.logger.Error("unable to roll back add", "index", indexNames[i], "id", itemID, "error", err)
+		}
+	}
+}
+
+// Update replaces the vector of an existing item in the given indexes, or in all of them if none is given,
+// unless DBConfig.StrictIndexNames is set. Unlike Add, it leaves no stale bucket entries behind.
+// Each index is updated in a single transaction. It fails if the item isn't in one of them.
+func (db *DB) Update(itemID string, itemVec []float64, indexNames ...string) error {
+	if db.NumIndexes() == 0 {
+		return &dbHasNoIndexError{}
+	}
+
+	if err := db.checkSpaceDim(itemVec); err != nil {
+		return err
+	}
+
+	indexNames, err := db.writeTargets(indexNames)
+	if err != nil {
+		return err
+	}
+
+	for _, indexName := range indexNames {
+		idx, ok := db.indexRef.get(indexName)
+		if !ok {
+			return &indexDoesNotExistError{name: indexName}
+		}
+
+		if err := idx.update(itemID, itemVec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddF32 is like Add, for float32 vectors. Pair it with Float32Codec indexes, which store them without
+// doubling their size. Sketches and similarities are computed in float64.
+func (db *DB) AddF32(itemID string, itemVec []float32, indexNames ...string) error {
+	return db.Add(itemID, float32To64(itemVec), indexNames...)
+}
+
+func float32To64(vec []float32) []float64 {
+	res := make([]float64, len(vec))
+	for i, val := range vec {
+		res[i] = float64(val)
+	}
+
+	return res
+}
+
+type Item struct {
+	ID  string    `json:"id"`
+	Vec []float64 `json:"vec"`
+
+	// Optional payload stored along with the vector, returned by GetWithMeta. Nil stores none.
+	Meta []byte `json:"meta,omitempty"`
+}
+
+// AddWithMeta is like Add, also storing meta along with the vector, to be returned by GetWithMeta.
+// A nil meta stores none, leaving the metadata of a replaced item in place.
+func (db *DB) AddWithMeta(itemID string, itemVec []float64, meta []byte, indexNames ...string) error {
+	return db.AddBatch([]Item{{ID: itemID, Vec: itemVec, Meta: meta}}, indexNames...)
+}
+
+// AddAll adds the item to every index, whatever DBConfig.StrictIndexNames is.
+func (db *DB) AddAll(itemID string, itemVec []float64) error {
+	if db.NumIndexes() == 0 {
+		return &dbHasNoIndexError{}
+	}
+
+	return db.Add(itemID, itemVec, db.Indexes()...)
+}
+
+// writeTargets resolves the indexes a write goes to: all of them when none is given, unless in strict mode,
+// where a forgotten or mistyped index name shouldn't silently write everywhere.
+func (db *DB) writeTargets(indexNames []string) ([]string, error) {
+	if db.readOnly {
+		return nil, &readOnlyError{}
+	}
+
+	if len(indexNames) != 0 {
+		return indexNames, nil
+	}
+
+	if db.strictIndexNames {
+		return nil, &indexNamesRequiredError{}
+	}
+
+	return db.Indexes(), nil
+}
+
+// readTargets looks up the indexes a read goes to: all of them when none is given. These are taken from a single
+// snapshot, so that an index dropped while the read runs is left out, rather than failing it.
+func (db *DB) readTargets(indexNames []string) ([]string, []index, error) {
+	if len(indexNames) == 0 {
+		indexes := db.indexRef.snapshot()
+
+		indexNames = make([]string, 0, len(indexes))
+		idxs := make([]index, 0, len(indexes))
+
+		for indexName, idx := range indexes {
+			indexNames = append(indexNames, indexName)
+			idxs = append(idxs, idx)
+		}
+
+		return indexNames, idxs, nil
+	}
+
+	idxs := make([]index, len(indexNames))
+	for i, indexName := range indexNames {
+		idx, ok := db.indexRef.get(indexName)
+		if !ok {
+			return nil, nil, &indexDoesNotExistError{name: indexName}
+		}
+
+		idxs[i] = idx
+	}
+
+	return indexNames, idxs, nil
+}
+
+// AddBatch adds all items to each index in a single write per index, amortizing the cost of a write transaction.
+// Every vector's length is checked against every index up front, so a wrong one fails the whole batch before
+// anything is written. Like Add, no index names means all of them, unless DBConfig.StrictIndexNames is set.
+func (db *DB) AddBatch(items []Item, indexNames ...string) error {
+	if db.NumIndexes() == 0 {
+		return &dbHasNoIndexError{}
+	}
+
+	for _, item := range items {
+		if err := db.checkSpaceDim(item.Vec); err != nil {
+			return err
+		}
+	}
+
+	indexNames, err := db.writeTargets(indexNames)
+	if err != nil {
+		return err
+	}
+
+	idxs := make([]index, len(indexNames))
+	for i, indexName := range indexNames {
+		idx, ok := db.indexRef.get(indexName)
+		if !ok {
+			return &indexDoesNotExistError{name: indexName}
+		}
+
+		// An index waiting for its first vector takes the length of the batch's first one.
+		spaceDim := idx.spaceDim()
+		if spaceDim == 0 && len(items) != 0 {
+			spaceDim = uint32(len(items[0].Vec))
+		}
+
+		for _, item := range items {
+			if uint32(len(item.Vec)) != spaceDim {
+				return &itemLenError{indexName, item.ID, spaceDim, len(item.Vec)}
+			}
+		}
+
+		idxs[i] = idx
+	}
+
+	for _, idx := range idxs {
+		if err := idx.addBatch(items); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the item from the given indexes, or from all of them if none is given,
+// unless DBConfig.StrictIndexNames is set.
+// Concurrent Gets see the item either fully or not at all.
+func (db *DB) Delete(itemID string, indexNames ...string) error {
+	if db.NumIndexes() == 0 {
+		return &dbHasNoIndexError{}
+	}
+
+	indexNames, err := db.writeTargets(indexNames)
+	if err != nil {
+		return err
+	}
+
+	for _, indexName := range indexNames {
+		idx, ok := db.indexRef.get(indexName)
+		if !ok {
+			return &indexDoesNotExistError{name: indexName}
+		}
+
+		if err := idx.delete(itemID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddBatchIfAbsent writes, in a single transaction, only the items whose ID isn't in the index yet.
+// Re-sending a dataset this way skips the unchanged items. It returns how many items were written.
+func (db *DB) AddBatchIfAbsent(items []Item, indexName string) (inserted int, err error) {
+	if db.readOnly {
+		return 0, &readOnlyError{}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return 0, &indexDoesNotExistError{name: indexName}
+	}
+
+	for _, item := range items {
+		if err := db.checkSpaceDim(item.Vec); err != nil {
+			return 0, err
+		}
+	}
+
+	return idx.addBatchIfAbsent(items)
+}
+
+// ExportJSONL writes every item of the index to w as JSON lines of the form {"id":...,"vec":[...]}, ordered by ID.
+func (db *DB) ExportJSONL(indexName string, w io.Writer) error {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	enc := json.NewEncoder(w)
+
+	return idx.embeddings(func(id string, vec []float64) error {
+		return enc.Encode(Item{ID: id, Vec: vec})
+	})
+}
+
+// ExportJSONLUnordered is like ExportJSONL, but reads the index with concurrent range scans: it is much faster
+// on large on-disk indexes, at the cost of writing items in no particular order. It stops when ctx is done.
+func (db *DB) ExportJSONLUnordered(ctx context.Context, indexName string, w io.Writer) error {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	enc := json.NewEncoder(w)
+
+	return idx.streamEmbeddings(ctx, func(id string, vec []float64) error {
+		return enc.Encode(Item{ID: id, Vec: vec})
+	})
+}
+
+// ImportJSONL reads JSON lines of the form {"id":...,"vec":[...]} from r and adds them to the index
+// in batches of IMPORT_BATCH_SIZE. Blank lines are skipped.
+// A malformed line aborts the import, but batches written before it are kept.
+func (db *DB) ImportJSONL(indexName string, r io.Reader) error {
+	if !db.indexExists(indexName) {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	reader := bufio.NewReader(r)
+	batch := make([]Item, 0, IMPORT_BATCH_SIZE)
+
+	for lineNum := 1; ; lineNum++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if len(bytes.TrimSpace(line)) != 0 {
+			var item Item
+			if err := json.Unmarshal(line, &item); err != nil {
+				return &malformedLineError{line: lineNum, reason: err.Error()}
+			}
+
+			if item.ID == "" {
+				return &malformedLineError{line: lineNum, reason: "missing id"}
+			}
+
+			batch = append(batch, item)
+		}
+
+		if len(batch) == IMPORT_BATCH_SIZE || (readErr == io.EOF && len(batch) != 0) {
+			if err := db.AddBatch(batch, indexName); err != nil {
+				return err
+			}
+
+			batch = batch[:0]
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (db *DB) Get(queryVec []float64, threshold float64, k uint32, indexNames ...string) (res map[string][]string, err error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make(map[string][]string, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		ids, _, err := db.getCapped(idx, queryVec, threshold, k)
+		if err != nil {
+			return nil, err
+		}
+
+		res[indexName] = ids
+	}
+
+	return res, nil
+}
+
+// GetWithScores is like Get, also returning the similarity of each neighbor, sorted by descending similarity.
+// Every index must store vectors. Like Get, k is capped by DBConfig.MaxResults.
+func (db *DB) GetWithScores(queryVec []float64, threshold float64, k uint32, indexNames ...string) (map[string][]Neighbor, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]Neighbor, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		neighbors, err := idx.getWithScores(queryVec, threshold, db.cappedK(k))
+		if err != nil {
+			return nil, err
+		}
+
+		res[indexName] = neighbors
+	}
+
+	return res, nil
+}
+
+// GetMerged queries every given index, or all of them if none is given, and merges their neighbors into a single
+// ranking, as when a corpus is sharded across indexes. An item found in several indexes is kept once, with its best
+// score. Neighbors are sorted from the most similar, ties by ID, and truncated to k, which is capped by
+// DBConfig.MaxResults. Every index must store vectors and use the same metric, for scores to be comparable.
+func (db *DB) GetMerged(queryVec []float64, threshold float64, k uint32, indexNames ...string) ([]Neighbor, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, idx := range idxs {
+		if idx.metric() != idxs[0].metric() {
+			return nil, &mixedMetricsError{indexNames[0], indexNames[i]}
+		}
+	}
+
+	if len(idxs) == 0 {
+		return []Neighbor{}, nil
+	}
+
+	metric := idxs[0].metric()
+	k = db.cappedK(k)
+
+	// Every neighbor of the merged top k is in the top k of the index where it scores best.
+	best := make(map[string]float64)
+	for _, idx := range idxs {
+		neighbors, err := idx.getWithScores(queryVec, threshold, k)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, neighbor := range neighbors {
+			if score, ok := best[neighbor.ID]; !ok || metric.Closer(neighbor.Score, score) {
+				best[neighbor.ID] = neighbor.Score
+			}
+		}
+	}
+
+	merged := make([]Neighbor, 0, len(best))
+	for id, score := range best {
+		merged = append(merged, Neighbor{ID: id, Score: score})
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Score != merged[j].Score {
+			return metric.Closer(merged[i].Score, merged[j].Score)
+		}
+
+		return merged[i].ID < merged[j].ID
+	})
+
+	if k != 0 && uint32(len(merged)) > k {
+		merged = merged[:k]
+	}
+
+	return merged, nil
+}
+
+// GetCapped is like Get on a single index, also reporting whether DBConfig.MaxResults truncated the results.
+func (db *DB) GetCapped(queryVec []float64, threshold float64, k uint32, indexName string) (ids []string, truncated bool, err error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, false, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, false, &indexDoesNotExistError{name: indexName}
+	}
+
+	return db.getCapped(idx, queryVec, threshold, k)
+}
+
+// QueryOptions tunes GetWithOptions.
+type QueryOptions struct {
+	// Minimum similarity of the neighbors, or maximum distance with MetricEuclidean. Ignored when OverFetch is set.
+	Threshold float64
+
+	// Number of neighbors wanted per index. Zero means all of them. Like Get's k, it's capped by DBConfig.MaxResults.
+	K uint32
+
+	// When non-zero, every index returns its K closest neighbors whatever their similarity, so that K is met
+	// whenever an LSH index's buckets hold that many candidates. Up to K*OverFetch candidates are gathered from
+	// the buckets, in place of MaxCandidates, and all of them are scored. Flat indexes score every item anyway.
+	OverFetch uint32
+
+	// When non-zero, an LSH index gathering more candidates than this only scores the PreFilterTopN whose sketches
+	// are the closest to the query's, by Hamming distance, which is much cheaper than reading and scoring every
+	// embedding of large buckets, at some cost in recall. Ignored when OverFetch is set, and by flat indexes.
+	PreFilterTopN uint32
+}
+
+// GetWithOptions is like Get, tuned by opts. Without OverFetch nor PreFilterTopN, it's the same as Get.
+func (db *DB) GetWithOptions(queryVec []float64, opts QueryOptions, indexNames ...string) (res map[string][]string, err error) {
+	if opts.OverFetch == 0 && opts.PreFilterTopN == 0 {
+		return db.Get(queryVec, opts.Threshold, opts.K, indexNames...)
+	}
+
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make(map[string][]string, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		var ids []string
+		if opts.OverFetch != 0 {
+			ids, err = idx.getTopK(queryVec, db.cappedK(opts.K), opts.OverFetch)
+		} else {
+			ids, err = idx.getPreFiltered(queryVec, opts.Threshold, db.cappedK(opts.K), opts.PreFilterTopN)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res[indexName] = nonNilIDs(ids)
+	}
+
+	return res, nil
+}
+
+// GetFrom is like Get on a single index, returning its neighbors directly instead of in a map.
+func (db *DB) GetFrom(indexName string, queryVec []float64, threshold float64, k uint32) ([]string, error) {
+	ids, _, err := db.GetCapped(queryVec, threshold, k, indexName)
+
+	return ids, err
+}
+
+// GetFiltered is like Get, only considering the items whose metadata, nil if there is none, is accepted by filter,
+// e.g. to restrict neighbors to a language. Rejected items don't count toward k. Like Get, k is capped by
+// DBConfig.MaxResults. For LSH indexes, filtering happens after bucketing, so a selective filter can find fewer
+// neighbors than exist: more rounds or a fallback radius gather more candidates to filter from.
+func (db *DB) GetFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool, indexNames ...string) (map[string][]string, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]string, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		ids, err := idx.getFiltered(queryVec, threshold, db.cappedK(k), filter)
+		if err != nil {
+			return nil, err
+		}
+
+		res[indexName] = nonNilIDs(ids)
+	}
+
+	return res, nil
+}
+
+// ItemMeta is a neighbor returned by GetWithMeta, along with its metadata.
+type ItemMeta struct {
+	ID   string `json:"id"`
+	Meta []byte `json:"meta"`
+}
+
+// GetWithMeta is like Get, also returning the metadata stored with each neighbor, nil if there is none.
+// Each index's neighbors and their metadata are read from the same snapshot, so that a concurrent write can't
+// pair a neighbor with metadata it doesn't have.
+func (db *DB) GetWithMeta(queryVec []float64, threshold float64, k uint32, indexNames ...string) (map[string][]ItemMeta, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	withMeta := make(map[string][]ItemMeta, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		var metas [][]byte
+
+		ids, _, err := db.capped(k, func(k uint32) (ids []string, err error) {
+			ids, metas, err = idx.getWithMeta(queryVec, threshold, k)
+			return ids, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		items := make([]ItemMeta, len(ids))
+		for i, id := range ids {
+			items[i] = ItemMeta{ID: id, Meta: metas[i]}
+		}
+
+		withMeta[indexName] = items
+	}
+
+	return withMeta, nil
+}
+
+// getCapped queries one more neighbor than the cap allows, to tell whether there were more to return.
+func (db *DB) getCapped(idx index, queryVec []float64, threshold float64, k uint32) (ids []string, truncated bool, err error) {
+	return db.capped(k, func(k uint32) ([]string, error) {
+		return idx.get(queryVec, threshold, k)
+	})
+}
+
+// nonNilIDs returns ids, or an empty slice when it is nil, so that neighbors serialize as [] instead of null.
+// Every Get variant returns its IDs through it.
+func nonNilIDs(ids []string) []string {
+	if ids == nil {
+		return []string{}
+	}
+
+	return ids
+}
+
+// cappedK returns k, or DBConfig.MaxResults when k exceeds it, for results that can't report truncation.
+func (db *DB) cappedK(k uint32) uint32 {
+	if db.maxResults != 0 && (k == 0 || k > db.maxResults) {
+		return db.maxResults
+	}
+
+	return k
+}
+
+// capped calls get with k, or with one more neighbor than DBConfig.MaxResults allows when k exceeds it,
+// to tell whether there were more to return. Without neighbors, ids is empty rather than nil.
+func (db *DB) capped(k uint32, get func(k uint32) ([]string, error)) (ids []string, truncated bool, err error) {
+	if db.maxResults == 0 || (k != 0 && k <= db.maxResults) {
+		ids, err = get(k)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return nonNilIDs(ids), false, nil
+	}
+
+	ids, err = get(db.maxResults + 1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if uint32(len(ids)) > db.maxResults {
+		return ids[:db.maxResults], true, nil
+	}
+
+	return nonNilIDs(ids), false, nil
+}
+
+// PreparedQuery is a query vector whose scoring setup (preprocessing and norm) is done once by Prepare,
+// to be reused across indexes and calls.
+type PreparedQuery struct {
+	vec   []float64
+	query semantic.Query
+}
+
+// Prepare sets up queryVec for scoring, once for every index GetPrepared is called with.
+func (db *DB) Prepare(queryVec []float64) (PreparedQuery, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return PreparedQuery{}, err
+	}
+
+	// Copied, so later changes to queryVec don't leak into the prepared query.
+	vec := slices.Clone(queryVec)
+
+	query, err := semantic.New().NewQuery(vec)
+	if err != nil {
+		return PreparedQuery{}, err
+	}
+
+	return PreparedQuery{vec: vec, query: query}, nil
+}
+
+// PrepareWithTieBreaker is like Prepare, also ranking neighbors of equal similarity to queryVec by their similarity
+// to tieBreakerVec, which must have the same length. Without a tie-breaker, equal neighbors are ordered by ID.
+func (db *DB) PrepareWithTieBreaker(queryVec, tieBreakerVec []float64) (PreparedQuery, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return PreparedQuery{}, err
+	}
+
+	vec := slices.Clone(queryVec)
+
+	query, err := semantic.New().NewQueryWithTieBreaker(vec, slices.Clone(tieBreakerVec))
+	if err != nil {
+		return PreparedQuery{}, err
+	}
+
+	return PreparedQuery{vec: vec, query: query}, nil
+}
+
+// GetPrepared is like Get, with a query set up by Prepare instead of once per index.
+func (db *DB) GetPrepared(pq PreparedQuery, threshold float64, k uint32, indexNames ...string) (res map[string][]string, err error) {
+	indexNames, idxs, err := db.readTargets(indexNames)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make(map[string][]string, len(indexNames))
+
+	for i, indexName := range indexNames {
+		idx := idxs[i]
+
+		ids, _, err := db.capped(k, func(k uint32) ([]string, error) {
+			return idx.getPrepared(pq, threshold, k)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		res[indexName] = ids
+	}
+
+	return res, nil
+}
+
+// GetDefaultK is like Get, using the DBConfig.DefaultK for every index.
+// Call Get to override it with a per-call k.
+func (db *DB) GetDefaultK(queryVec []float64, threshold float64, indexNames ...string) (res map[string][]string, err error) {
+	return db.Get(queryVec, threshold, db.defaultK, indexNames...)
+}
+
+type Neighbor struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+
+	// Number of rounds in which the neighbor shared the query's bucket, a proxy for confidence.
+	// Only set by GetExplained.
+	RoundMatches int `json:"round_matches,omitempty"`
+}
+
+// GetStream sends to out every item of the index whose similarity to the query is at least threshold,
+// as soon as it is scored. Since results are streamed, they are ordered by discovery rather than by similarity.
+// out is always closed on return: when done, on error, or when ctx is cancelled (in which case ctx's error is returned).
+func (db *DB) GetStream(ctx context.Context, queryVec []float64, threshold float64, indexName string, out chan<- Neighbor) error {
+	defer close(out)
+
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.getStream(ctx, queryVec, threshold, func(neighbor Neighbor) error {
+		select {
+		case out <- neighbor:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// GetExplained returns up to k neighbors of the query in the index, sorted by descending similarity, along with
+// their similarity and the number of rounds in which they shared the query's bucket. Neighbors found in many rounds
+// are more trustworthy than the ones found in a single round.
+func (db *DB) GetExplained(queryVec []float64, threshold float64, k uint32, indexName string) ([]Neighbor, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.getExplained(queryVec, threshold, db.cappedK(k))
+}
+
+// GetPercentile returns the items of the index whose similarity to the query is at or above
+// the given percentile (0 to 100) of all candidates' similarities, sorted by descending similarity.
+// For instance, 90 returns the top 10% of candidates, 0 returns all of them and 100 only the most similar.
+// Like Get, it returns no more than DBConfig.MaxResults of them.
+func (db *DB) GetPercentile(queryVec []float64, percentile float64, indexName string) ([]string, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	ids, err := idx.getPercentile(queryVec, percentile)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.maxResults != 0 && uint32(len(ids)) > db.maxResults {
+		ids = ids[:db.maxResults]
+	}
+
+	return nonNilIDs(ids), nil
+}
+
+// GetMulti returns up to k neighbors of several query vectors, combined according to mode,
+// sorted by descending similarity. Every query must match the index's space dimension.
+func (db *DB) GetMulti(queries [][]float64, mode MultiMode, threshold float64, k uint32, indexName string) ([]string, error) {
+	for _, queryVec := range queries {
+		if err := db.checkSpaceDim(queryVec); err != nil {
+			return nil, err
+		}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	if db.maxResults != 0 && (k == 0 || k > db.maxResults) {
+		k = db.maxResults
+	}
+
+	ids, err := idx.getMulti(queries, mode, threshold, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return nonNilIDs(ids), nil
+}
+
+// GetPage returns the neighbors ranked offset+1 to offset+limit on a single index, e.g. to paginate results.
+// A limit of 0 returns every neighbor after offset, up to DBConfig.MaxResults. An offset past the last neighbor
+// returns an empty page.
+func (db *DB) GetPage(queryVec []float64, threshold float64, offset, limit uint32, indexName string) ([]string, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	if db.maxResults != 0 && (limit == 0 || limit > db.maxResults) {
+		limit = db.maxResults
+	}
+
+	// Zero asks for every neighbor, as does a window reaching past the largest k.
+	var k uint32
+	if limit != 0 && offset <= math.MaxUint32-limit {
+		k = offset + limit
+	}
+
+	ids, err := idx.get(queryVec, threshold, k)
+	if err != nil {
+		return nil, err
+	}
+
+	// An offset past the last neighbor leaves the page empty.
+	if offset > uint32(len(ids)) {
+		offset = uint32(len(ids))
+	}
+
+	ids = ids[offset:]
+	if limit != 0 && limit < uint32(len(ids)) {
+		ids = ids[:limit]
+	}
+
+	return nonNilIDs(ids), nil
+}
+
+// GetSimilarToID returns up to k neighbors of a stored item of an index, the item itself excluded,
+// e.g. for "more like this" features. The index must store vectors.
+func (db *DB) GetSimilarToID(itemID string, threshold float64, k uint32, indexName string) ([]string, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	ids, _, err := db.capped(k, func(k uint32) ([]string, error) {
+		return idx.getSimilarToID(itemID, threshold, k)
+	})
+
+	return ids, err
+}
+
+// GetWithGroundTruth returns, side by side, the approximate k nearest neighbors Get finds in an index (approx) and
+// the true k nearest neighbors among all of its items (exact), both without threshold, to measure recall offline.
+// exact scans every stored vector, so it is expensive and meant for evaluation only. The index must store vectors.
+// Like Get, k is capped by DBConfig.MaxResults.
+func (db *DB) GetWithGroundTruth(queryVec []float64, k uint32, indexName string) (approx, exact []string, err error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, nil, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	approx, exact, err = idx.getWithGroundTruth(queryVec, db.cappedK(k))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nonNilIDs(approx), nonNilIDs(exact), nil
+}
+
+// GetRounds is like Get on a single index, only probing the buckets of the given rounds (0 to NumRounds-1).
+// In a sharded deployment, each node can query the rounds it owns and a coordinator merge their results.
+func (db *DB) GetRounds(queryVec []float64, rounds []int, threshold float64, k uint32, indexName string) ([]string, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	ids, _, err := db.capped(k, func(k uint32) ([]string, error) {
+		return idx.getRounds(queryVec, rounds, threshold, k)
+	})
+
+	return ids, err
+}
+
+// GetBiased is like Get on a single index, querying with normalize(queryVec + alpha*bias) instead of queryVec,
+// e.g. to lean results toward a user's preferences. The bias must have the query's length.
+func (db *DB) GetBiased(queryVec, bias []float64, alpha, threshold float64, k uint32, indexName string) ([]string, error) {
+	if err := db.checkSpaceDim(queryVec); err != nil {
+		return nil, err
+	}
+
+	if len(bias) != len(queryVec) {
+		return nil, &biasLenError{len(queryVec), len(bias)}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	ids, _, err := db.getCapped(idx, blend(queryVec, bias, alpha), threshold, k)
+
+	return ids, err
+}
+
+// blend returns vec + alpha*bias as a unit vector, or unnormalized when it is the zero vector.
+func blend(vec, bias []float64, alpha float64) []float64 {
+	blended := make([]float64, len(vec))
+
+	var norm float64
+	for i := range vec {
+		blended[i] = vec[i] + alpha*bias[i]
+		norm += blended[i] * blended[i]
+	}
+	norm = math.Sqrt(norm)
+
+	if norm <= semantic.EPSILON {
+		return blended
+	}
+
+	for i := range blended {
+		blended[i] /= norm
+	}
+
+	return blended
+}
+
+// Footprint is the approximate storage used by an index, per key category.
+type Footprint struct {
+	Embeddings  FootprintCategory `json:"embeddings"`
+	Sketches    FootprintCategory `json:"sketches"`
+	HyperPlanes FootprintCategory `json:"hyperplanes"`
+}
+
+type FootprintCategory struct {
+	// Number of keys.
+	Count int `json:"count"`
+
+	// Bytes taken by keys and values, before any storage overhead.
+	KeyBytes   int64 `json:"key_bytes"`
+	ValueBytes int64 `json:"value_bytes"`
+}
+
+// Footprint sums the sizes of the index's keys and values, broken down by category, without reading values.
+func (db *DB) Footprint(indexName string) (Footprint, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return Footprint{}, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.footprint()
+}
+
+// BucketStats describes how an LSH index's items spread over its buckets.
+type BucketStats struct {
+	// Number of non-empty buckets.
+	NumBuckets int `json:"num_buckets"`
+
+	// Sizes of the buckets, in items. Zero when there are none.
+	MinSize  int     `json:"min_size"`
+	MaxSize  int     `json:"max_size"`
+	MeanSize float64 `json:"mean_size"`
+
+	// Number of buckets holding a single item.
+	Singletons int `json:"singletons"`
+}
+
+// BucketStats reports the distribution of bucket sizes of an LSH index, scanning all of its sketch keys,
+// to tune NumHyperPlanes: a few large buckets call for more hyperplanes, many singletons for fewer.
+// Buckets are shared by all rounds.
+func (db *DB) BucketStats(indexName string) (BucketStats, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return BucketStats{}, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.bucketStats()
+}
+
+// FindDuplicateClusters reports the clusters of near-identical items of the index: items whose similarity
+// is at least threshold are linked, and linked items form a cluster, even when only transitively similar.
+// Only items sharing a bucket are compared, so it doesn't compare every pair. Clusters have at least two items.
+func (db *DB) FindDuplicateClusters(indexName string, threshold float64) ([][]string, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.findDuplicateClusters(threshold)
+}
+
+// SimilarityMatrix returns the cosine similarities between every pair of the given items of an index:
+// row i and column j hold the similarity of ids[i] and ids[j]. Every item must exist.
+// Time and memory grow with the square of len(ids), so it's meant for small sets.
+func (db *DB) SimilarityMatrix(ids []string, indexName string) ([][]float64, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.similarityMatrix(ids)
+}
+
+// RepairReport counts the inconsistencies fixed by Repair.
+type RepairReport = lsh.RepairReport
+
+// Repair restores the consistency of an index after an interrupted write: it removes bucket entries of
+// missing items or of buckets their item doesn't hash to, and re-sketches items missing from some of their buckets.
+// Indexes that don't store embeddings are left as they are. It must not run concurrently with writes to the index.
+func (db *DB) Repair(indexName string) (RepairReport, error) {
+	if db.readOnly {
+		return RepairReport{}, &readOnlyError{}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return RepairReport{}, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.repair()
+}
+
+// ListIDs returns the IDs of every item of an index, sorted by their escaped form, which is their byte order
+// unless they contain 0x1E or 0x1F. It reads keys only, but holds all of the IDs in memory.
+func (db *DB) ListIDs(indexName string) ([]string, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.listIDs()
+}
+
+// Exists tells whether the item is in the index, e.g. to choose between Add and Update. It reads a single key.
+func (db *DB) Exists(itemID string, indexName string) (bool, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return false, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.exists(itemID)
+}
+
+// Count returns the number of items of an index. It is kept up to date on every write, so it's cheap to call.
+func (db *DB) Count(indexName string) (uint64, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return 0, &indexDoesNotExistError{name: indexName}
+	}
+
+	return uint64(idx.count()), nil
+}
+
+// Centroid returns the mean vector of an index, or nil when it is empty. Like Count, it is kept up to date
+// on every write, so it's cheap to call. The index must store vectors.
+func (db *DB) Centroid(indexName string) ([]float64, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.centroid()
+}
+
+// IndexOverview summarizes an index's config, size and usage.
+type IndexOverview struct {
+	Name           string `json:"name"`
+	NumRounds      uint32 `json:"num_rounds"`
+	NumHyperPlanes uint32 `json:"num_hyper_planes"`
+	SpaceDim       uint32 `json:"space_dim"`
+	NumItems       int    `json:"num_items"`
+
+	// Items added and queries run since the index was created, across restarts. See DBConfig.StatsInterval.
+	NumAdds uint64 `json:"num_adds"`
+	NumGets uint64 `json:"num_gets"`
+}
+
+// Overview summarizes every index, sorted by name. Items of all LSH indexes are counted
+// in a single pass over the DB's keys, without reading values.
+func (db *DB) Overview() ([]IndexOverview, error) {
+	indexes := db.indexRef.snapshot()
+
+	localities := make([]*lsh.LSH, 0, len(indexes))
+	for _, idx := range indexes {
+		if l, ok := idx.(*lshIndex); ok {
+			localities = append(localities, l.locality)
+		}
+	}
+
+	counts, err := lsh.CountItems(localities...)
+	if err != nil {
+		return nil, err
+	}
+
+	overview := make([]IndexOverview, 0, len(indexes))
+	for name, idx := range indexes {
+		info := idx.info()
+
+		// Flat indexes have no rounds, hyperplanes nor counters, which stay zero.
+		numRounds, _ := info["numRounds"].(uint32)
+		numHyperPlanes, _ := info["numHyperPlanes"].(uint32)
+		numAdds, _ := info["numAdds"].(uint64)
+		numGets, _ := info["numGets"].(uint64)
+
+		numItems, ok := counts[name]
+		if !ok {
+			numItems = idx.count()
+		}
+
+		overview = append(overview, IndexOverview{
+			Name:           name,
+			NumRounds:      numRounds,
+			NumHyperPlanes: numHyperPlanes,
+			SpaceDim:       info["spaceDim"].(uint32),
+			NumItems:       numItems,
+			NumAdds:        numAdds,
+			NumGets:        numGets,
+		})
+	}
+
+	sort.Slice(overview, func(i, j int) bool {
+		return overview[i].Name < overview[j].Name
+	})
+
+	return overview, nil
+}
+
+// Drift compares the vectors added to an index before and after a point in time.
+type Drift struct {
+	NumBefore int `json:"num_before"`
+	NumAfter  int `json:"num_after"`
+
+	// Cosine similarity between the centroids of the vectors added before and after.
+	// 1 means no drift. The lower it gets, the more the distribution has shifted.
+	CentroidSimilarity float64 `json:"centroid_similarity"`
+}
+
+// DriftReport compares the centroid of the vectors added to the index before since with the centroid
+// of the ones added at or after it. Both groups must be non-empty. Vectors added before insertion
+// timestamps were stored are ignored. It scans the whole index.
+func (db *DB) DriftReport(ctx context.Context, indexName string, since time.Time) (Drift, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return Drift{}, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.drift(ctx, since)
+}
+
+// MigrateNormalize rewrites every stored vector of the index as a unit vector, in batches. Query results are unchanged,
+// as cosine similarity doesn't depend on magnitude; original norms are kept. It fails on indexes scored by any other
+// metric, whose results would change. An interrupted migration resumes when rerun.
+// Zero vectors are left as they are, and items added afterwards are not normalized.
+func (db *DB) MigrateNormalize(indexName string) error {
+	if db.readOnly {
+		return &readOnlyError{}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.migrateNormalize()
+}
+
+// Reembed replaces every vector of the index with the one fn returns for it, e.g. after upgrading the embedding
+// model, keeping item IDs and re-sketching each item. New vectors must have the index's SpaceDim: a model with
+// another dimension needs a new index instead. It writes in batches and stops when fn fails or ctx is done,
+// leaving the items of earlier batches re-embedded.
+func (db *DB) Reembed(ctx context.Context, indexName string, fn func(itemID string, oldVec []float64) ([]float64, error)) error {
+	if db.readOnly {
+		return &readOnlyError{}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.reembed(ctx, fn)
+}
+
+// Number of stored embeddings sampled as queries by Optimize.
+const OPTIMIZE_NUM_QUERIES int = 100
+
+// Maximum fraction of candidates Optimize accepts to lose when flagging rounds as redundant.
+const OPTIMIZE_MAX_LOSS float64 = 0.01
+
+// OptimizeReport measures how much each round of an LSH index contributes to the candidates gathered on Get.
+// Dropping every round in Redundant loses Loss (a fraction) of the candidates found with all rounds.
+type OptimizeReport = lsh.OptimizeReport
+
+// RoundContribution is how many candidates a round yielded over the sampled queries, and how many no other round did.
+type RoundContribution = lsh.RoundContribution
+
+// Optimize measures each round's unique-candidate contribution over a sample of the stored items used as queries,
+// and reports the rounds that can be dropped with minimal recall loss. Pass them to PruneRounds to drop them.
+func (db *DB) Optimize(indexName string) (OptimizeReport, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return OptimizeReport{}, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.optimize(OPTIMIZE_NUM_QUERIES, OPTIMIZE_MAX_LOSS)
+}
+
+// PruneRounds drops the given rounds of the index, deleting their hyperplanes and sketches.
+// Afterwards, the index's seed is unknown. It must not run concurrently with other operations on the index.
+func (db *DB) PruneRounds(ctx context.Context, indexName string, rounds ...int) error {
+	if db.readOnly {
+		return &readOnlyError{}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.pruneRounds(ctx, rounds...)
+}
+
+// Seed returns the seed the index's hyperplanes were generated from.
+// Together with the index's hyperparameters, it is enough to recreate an index with identical sketches.
+func (db *DB) Seed(indexName string) (int64, error) {
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return 0, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.seed()
+}
+
+// Sample returns up to n items of the index picked uniformly at random, holding at most n of them in memory.
+// The same seed yields the same sample as long as the index is unchanged.
+func (db *DB) Sample(indexName string, n int, seed int64) (map[string][]float64, error) {
+	if n < 0 {
+		return nil, &invalidSampleSizeError{n}
+	}
+
+	idx, ok := db.indexRef.get(indexName)
+	if !ok {
+		return nil, &indexDoesNotExistError{name: indexName}
+	}
+
+	return idx.sample(n, seed)
+}
+
+// MaxSpaceDim returns the largest space dimension (vector length) the DB accepts.
+func (db *DB) MaxSpaceDim() uint32 {
+	return db.maxSpaceDim
+}
+
+func (db *DB) checkSpaceDim(vec []float64) error {
+	if len(vec) > int(db.maxSpaceDim) {
+		return &spaceDimTooLargeError{len(vec), db.maxSpaceDim}
+	}
+
+	return nil
+}
+
+func (db *DB) clean(itemID string, indexNames ...string) {
+	// TODO: delete all
+}
+
+func (db *DB) indexExists(indexName string) bool {
+	return db.indexRef.keyExists(indexName)
+}
+
+// =================================== INDEXES ===================================
+
+type index interface {
+	add(itemID string, itemVec []float64) error
+	addBatch(items []Item) error
+	addBatchIfAbsent(items []Item) (inserted int, err error)
+	update(itemID string, itemVec []float64) error
+	delete(itemID string) error
+	embeddings(fn func(itemID string, itemVec []float64) error) error
+	streamEmbeddings(ctx context.Context, fn func(itemID string, itemVec []float64) error) error
+	get(queryVec []float64, threshold float64, k uint32) (ids []string, err error)
+	getPrepared(pq PreparedQuery, threshold float64, k uint32) (ids []string, err error)
+	getRounds(queryVec []float64, rounds []int, threshold float64, k uint32) (ids []string, err error)
+	getSimilarToID(itemID string, threshold float64, k uint32) (ids []string, err error)
+	getWithGroundTruth(queryVec []float64, k uint32) (approx, exact []string, err error)
+	getWithScores(queryVec []float64, threshold float64, k uint32) (neighbors []Neighbor, err error)
+	getExplained(queryVec []float64, threshold float64, k uint32) (neighbors []Neighbor, err error)
+	getPercentile(queryVec []float64, percentile float64) (ids []string, err error)
+	getMulti(queries [][]float64, mode MultiMode, threshold float64, k uint32) (ids []string, err error)
+	findDuplicateClusters(threshold float64) (clusters [][]string, err error)
+	similarityMatrix(ids []string) ([][]float64, error)
+	getStream(ctx context.Context, queryVec []float64, threshold float64, fn func(neighbor Neighbor) error) error
+	getTopK(queryVec []float64, k, overFetch uint32) ([]string, error)
+	getFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool) ([]string, error)
+	getWithMeta(queryVec []float64, threshold float64, k uint32) (ids []string, metas [][]byte, err error)
+	getPreFiltered(queryVec []float64, threshold float64, k, preFilterTopN uint32) ([]string, error)
+	footprint() (Footprint, error)
+	bucketStats() (BucketStats, error)
+	drift(ctx context.Context, since time.Time) (Drift, error)
+	sample(n int, seed int64) (map[string][]float64, error)
+	seed() (int64, error)
+	optimize(numQueries int, maxLoss float64) (OptimizeReport, error)
+	pruneRounds(ctx context.Context, rounds ...int) error
+	migrateNormalize() error
+	reembed(ctx context.Context, fn func(itemID string, oldVec []float64) ([]float64, error)) error
+	repair() (RepairReport, error)
+	info() map[string]any
+	spaceDim() uint32
+	metric() Metric
+	drop() error
+	listIDs() ([]string, error)
+	exists(itemID string) (bool, error)
+	embedding(itemID string) ([]float64, error)
+	meta(ids []string) ([][]byte, error)
+	count() int
+	centroid() ([]float64, error)
+	flushStats() error
+
+	// Drops what the index keeps in memory of its stored data, and reads its stats again, after the storage
+	// was written to behind its back.
+	reload() error
+}
+
+type LSHConfig struct {
+	IndexName string `json:"index_name"`
+
+	// Number of rounds. More rounds improve quality, but also adds computation overhead.
+	// It must be at least 1 and at most 256. Zero uses the default value.
+	NumRounds uint32 `json:"num_rounds"`
+
+	// Number of hyperplanes to split the space on. It must be at least 1 and at most 256. Zero uses the default value.
+	NumHyperPlanes uint32 `json:"num_hyper_planes"`
+
+	// Dimension of the space (vector length). It must be at least 2. Zero takes the length of the first vector
+	// added to the index, and then keeps it.
+	SpaceDim uint32 `json:"space_dim"`
+
+	// Order in which the rounds' buckets are read on Get. Defaults to NaturalOrder.
+	RoundOrder RoundOrder `json:"round_order"`
+
+	// Maximum number of candidates gathered from buckets on Get. Zero means no cap.
+	// Pairs well with SelectiveFirst, which reads the smallest buckets first.
+	MaxCandidates uint32 `json:"max_candidates"`
+
+	// Whether raw embeddings are persisted. Nil stores them, as true does. When false, Add only writes sketches
+	// (bucket membership), and Get returns up to k bucket members in discovery order, ignoring threshold.
+	// Without embeddings there is no similarity rerank, so results include every false positive
+	// LSH lets through and precision drops; recall is unchanged. Rerank them externally if needed.
+	// Scoring features, such as GetPercentile and GetStream, are unavailable.
+	// It only applies when the index is created.
+	StoreEmbeddings *bool `json:"store_embeddings"`
+
+	// When true, Add stores each vector's norm next to it, and Get reads it instead of computing it per candidate,
+	// at the cost of 8 bytes per item. It only speeds up MetricCosine, and only applies when the index is created.
+	PrecomputeNorms bool `json:"precompute_norms"`
+
+	// When a round's bucket for the query is empty (common with many hyperplanes), Get falls back to the
+	// Hamming-nearest non-empty buckets, up to this many bit flips away. Each radius r costs C(NumHyperPlanes, r)
+	// bucket probes, so keep it small. Zero disables the fallback.
+	FallbackRadius uint32 `json:"fallback_radius"`
+
+	// Tolerance when comparing similarities to the threshold on Get, so that identical vectors meet a
+	// threshold of 1 despite floating-point rounding. Zero uses a small default, negative makes it exact.
+	SimilarityEpsilon float64 `json:"similarity_epsilon"`
+
+	// Seed for the hyperplanes' generation. Zero picks a random one, which DB.Seed reports afterwards.
+	// An index created with the same seed and hyperparameters produces identical sketches.
+	Seed int64 `json:"seed"`
+
+	// When true, Get skips and logs candidates whose stored embedding is corrupt, returning the rest,
+	// instead of failing the whole query because of a single bad record.
+	SkipCorrupt bool `json:"skip_corrupt"`
+
+	// Number of decoded vectors kept in memory, the most recently read ones, so that hot candidates aren't read
+	// from storage and decoded again on every Get. Each takes about 8*SpaceDim bytes. Writes of an item evict it.
+	// Zero disables the cache.
+	EmbeddingCacheSize uint32 `json:"embedding_cache_size"`
+
+	// Encoding of stored embeddings. DeltaVarintCodec shrinks sparse embeddings (mostly zeros) about threefold,
+	// but grows dense ones by about 10%. Float32Codec halves every embedding, rounding it to float32 precision,
+	// which suits float32 models (see AddF32). Defaults to RawCodec. It only applies when the index is created.
+	EmbeddingCodec EmbeddingCodec `json:"embedding_codec"`
+
+	// When true, the index keeps in memory the set of its non-empty buckets, loaded with a scan of every
+	// bucket key when the index is opened, and Get skips reading the buckets outside it. It saves storage
+	// reads on sparse indexes (many hyperplanes), where most probed buckets are empty.
+	BucketFilter bool `json:"bucket_filter"`
+
+	// How vectors are compared on Get. Nil defaults to MetricCosine. With MetricEuclidean, threshold is a maximum
+	// distance instead of a minimum similarity, and results are sorted by ascending distance. With MetricL1,
+	// it is a non-positive negated distance.
+	// Buckets group vectors by angle whatever the metric. It is stored with the index, so that New reopens the
+	// index with it when nil, and fails when it is set to another one.
+	Metric *Metric `json:"metric"`
+}
+
+// FlatConfig configures an exact index, which compares queries with every stored vector instead of looking them up
+// in buckets. Its recall is always 100%, but every query scans the whole index, so it suits small collections.
+// Operations specific to buckets (such as GetRounds, GetExplained or Optimize) fail with an unsupportedOperationError.
+type FlatConfig struct {
+	IndexName string `json:"index_name"`
+
+	// Dimension of the space (vector length). It must be at least 2. Zero uses the default value.
+	SpaceDim uint32 `json:"space_dim"`
+
+	// How vectors are compared on Get, as for LSHConfig.Metric. Defaults to MetricCosine.
+	Metric Metric `json:"metric"`
+
+	// When true, the index keeps every vector in memory, in a single contiguous block maintained on writes, which
+	// Get and GetWithScores scan instead of reading every vector from storage. It speeds up exact search on large
+	// indexes, at the cost of holding them in memory. It isn't recorded in the manifest, so an index reopened by
+	// New reads from storage.
+	Columnar bool `json:"columnar"`
+}
+
+// RoundOrder defines the order in which an LSH index reads its rounds' buckets on Get.
+type RoundOrder = lsh.RoundOrder
+
+const (
+	// NaturalOrder reads buckets following the rounds' order.
+	NaturalOrder RoundOrder = lsh.NaturalOrder
+
+	// SelectiveFirst reads the smallest buckets first, estimating their sizes by key count.
+	SelectiveFirst RoundOrder = lsh.SelectiveFirst
+)
+
+// EmbeddingCodec defines how an LSH index encodes its stored embeddings.
+type EmbeddingCodec = lsh.EmbeddingCodec
+
+const (
+	// RawCodec stores every value as its 8 bytes.
+	RawCodec EmbeddingCodec = lsh.RawCodec
+
+	// DeltaVarintCodec stores the difference between the bits of consecutive values, varint encoded. It's lossless.
+	DeltaVarintCodec EmbeddingCodec = lsh.DeltaVarintCodec
+
+	// Float32Codec stores every value as a float32, in 4 bytes. It's lossless for vectors given to AddF32.
+	Float32Codec EmbeddingCodec = lsh.Float32Codec
+)
+
+// Metric defines how an index compares vectors on Get.
+type Metric = semantic.Metric
+
+const (
+	// MetricCosine scores by the cosine of the angle between vectors. Thresholds range from 0 to 1.
+	MetricCosine Metric = semantic.Cosine
+
+	// MetricPearson scores by the Pearson correlation, the cosine between mean-centered vectors, so that vectors
+	// differing by a constant offset are identical. Thresholds range from 0 to 1, as for MetricCosine.
+	MetricPearson Metric = semantic.Pearson
+
+	// MetricDotProduct scores by the dot product, which equals the cosine on normalized vectors but is cheaper.
+	// Thresholds are unbounded.
+	MetricDotProduct Metric = semantic.DotProduct
+
+	// MetricEuclidean scores by the Euclidean distance, lower being closer. Thresholds are maximum distances.
+	MetricEuclidean Metric = semantic.Euclidean
+
+	// MetricL1 scores by the negated Manhattan distance, so that higher is still closer and identical vectors
+	// score 0. Thresholds are non-positive: -2 keeps neighbors within a Manhattan distance of 2.
+	MetricL1 Metric = semantic.L1
+)
+
+// Observer is notified of queries, so that they can be measured without vectoria depending on a metrics library.
+// OnQuery is called, concurrently, when a Get on an LSH index succeeds, with the number of candidates gathered
+// from its buckets, the number of neighbors returned and the query's duration.
+type Observer = lsh.Observer
+
+// MultiMode defines how GetMulti combines several query vectors.
+type MultiMode = lsh.MultiMode
+
+const (
+	// Union runs every query and merges their neighbors, keeping each item's best similarity.
+	// It requires stored embeddings.
+	Union MultiMode = lsh.Union
+
+	// Centroid runs a single query with the mean of the query vectors.
+	Centroid MultiMode = lsh.Centroid
+)
+
+type lshIndex struct {
+	locality *lsh.LSH
+}
+
+func (l *lshIndex) add(itemID string, itemVec []float64) error {
+	return l.locality.Add(itemID, itemVec)
+}
+
+func (l *lshIndex) addBatch(items []Item) error {
+	return l.locality.AddBatch(toLSHItems(items))
+}
+
+func (l *lshIndex) update(itemID string, itemVec []float64) error {
+	return l.locality.Update(itemID, itemVec)
+}
+
+func (l *lshIndex) delete(itemID string) error {
+	return l.locality.Delete(itemID)
+}
+
+func (l *lshIndex) addBatchIfAbsent(items []Item) (inserted int, err error) {
+	return l.locality.AddBatchIfAbsent(toLSHItems(items))
+}
+
+func toLSHItems(items []Item) []lsh.Item {
+	lshItems := make([]lsh.Item, len(items))
+	for i, item := range items {
+		lshItems[i] = lsh.Item{ID: item.ID, Embedding: item.Vec, Meta: item.Meta}
+	}
+
+	return lshItems
+}
+
+func (l *lshIndex) embeddings(fn func(itemID string, itemVec []float64) error) error {
+	return l.locality.Embeddings(fn)
+}
+
+func (l *lshIndex) streamEmbeddings(ctx context.Context, fn func(itemID string, itemVec []float64) error) error {
+	return l.locality.StreamEmbeddings(ctx, fn)
+}
+
+func (l *lshIndex) get(queryVec []float64, threshold float64, k uint32) (ids []string, err error) {
+	return l.locality.Get(queryVec, threshold, k)
+}
+
+func (l *lshIndex) getPrepared(pq PreparedQuery, threshold float64, k uint32) (ids []string, err error) {
+	return l.locality.GetPrepared(pq.vec, pq.query, threshold, k)
+}
+
+func (l *lshIndex) getWithScores(queryVec []float64, threshold float64, k uint32) ([]Neighbor, error) {
+	scored, err := l.locality.GetWithScores(queryVec, threshold, k)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors := make([]Neighbor, len(scored))
+	for i, neighbor := range scored {
+		neighbors[i] = Neighbor{ID: neighbor.ID, Score: neighbor.Score}
+	}
+
+	return neighbors, nil
+}
+
+func (l *lshIndex) getExplained(queryVec []float64, threshold float64, k uint32) ([]Neighbor, error) {
+	explained, err := l.locality.GetExplained(queryVec, threshold, k)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors := make([]Neighbor, len(explained))
+	for i, neighbor := range explained {
+		neighbors[i] = Neighbor{ID: neighbor.ID, Score: neighbor.Score, RoundMatches: neighbor.RoundMatches}
+	}
+
+	return neighbors, nil
+}
+
+func (l *lshIndex) getPercentile(queryVec []float64, percentile float64) (ids []string, err error) {
+	return l.locality.GetPercentile(queryVec, percentile)
+}
+
+func (l *lshIndex) getMulti(queries [][]float64, mode MultiMode, threshold float64, k uint32) (ids []string, err error) {
+	return l.locality.GetMulti(queries, mode, threshold, k)
+}
+
+func (l *lshIndex) findDuplicateClusters(threshold float64) (clusters [][]string, err error) {
+	return l.locality.FindDuplicateClusters(threshold)
+}
+
+func (l *lshIndex) getSimilarToID(itemID string, threshold float64, k uint32) (ids []string, err error) {
+	return l.locality.GetSimilarToID(itemID, threshold, k)
+}
+
+func (l *lshIndex) getWithGroundTruth(queryVec []float64, k uint32) (approx, exact []string, err error) {
+	return l.locality.GetWithGroundTruth(queryVec, k)
+}
+
+func (l *lshIndex) getRounds(queryVec []float64, rounds []int, threshold float64, k uint32) (ids []string, err error) {
+	return l.locality.GetRounds(queryVec, rounds, threshold, k)
+}
+
+func (l *lshIndex) similarityMatrix(ids []string) ([][]float64, error) {
+	return l.locality.SimilarityMatrix(ids)
+}
+
+func (l *lshIndex) getStream(ctx context.Context, queryVec []float64, threshold float64, fn func(neighbor Neighbor) error) error {
+	return l.locality.GetStream(ctx, queryVec, threshold, func(neighbor semantic.Neighbor) error {
+		return fn(Neighbor{ID: neighbor.ID, Score: neighbor.Score})
+	})
+}
+
+func (l *lshIndex) footprint() (Footprint, error) {
+	fp, err := l.locality.Footprint()
+	if err != nil {
+		return Footprint{}, err
+	}
+
+	return Footprint{
+		Embeddings:  FootprintCategory(fp.Embeddings),
+		Sketches:    FootprintCategory(fp.Sketches),
+		HyperPlanes: FootprintCategory(fp.HyperPlanes),
+	}, nil
+}
+
+func (l *lshIndex) getTopK(queryVec []float64, k, overFetch uint32) ([]string, error) {
+	return l.locality.GetTopK(queryVec, k, overFetch)
+}
+
+func (l *lshIndex) getFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool) ([]string, error) {
+	return l.locality.GetFiltered(queryVec, threshold, k, filter)
+}
+
+func (l *lshIndex) getPreFiltered(queryVec []float64, threshold float64, k, preFilterTopN uint32) ([]string, error) {
+	return l.locality.GetPreFiltered(queryVec, threshold, k, preFilterTopN)
+}
+
+func (l *lshIndex) bucketStats() (BucketStats, error) {
+	stats, err := l.locality.BucketStats()
+
+	return BucketStats(stats), err
+}
+
+func (l *lshIndex) drift(ctx context.Context, since time.Time) (Drift, error) {
+	drift, err := l.locality.Drift(ctx, since)
+
+	return Drift(drift), err
+}
+
+func (l *lshIndex) sample(n int, seed int64) (map[string][]float64, error) {
+	return l.locality.Sample(n, seed)
+}
+
+func (l *lshIndex) seed() (int64, error) {
+	return l.locality.Seed()
+}
+
+func (l *lshIndex) optimize(numQueries int, maxLoss float64) (OptimizeReport, error) {
+	return l.locality.Optimize(numQueries, maxLoss)
+}
+
+func (l *lshIndex) pruneRounds(ctx context.Context, rounds ...int) error {
+	return l.locality.PruneRounds(ctx, rounds...)
+}
+
+func (l *lshIndex) reembed(ctx context.Context, fn func(itemID string, oldVec []float64) ([]float64, error)) error {
+	return l.locality.Reembed(ctx, fn)
+}
+
+func (l *lshIndex) migrateNormalize() error {
+	return l.locality.MigrateNormalize()
+}
+
+func (l *lshIndex) repair() (RepairReport, error) {
+	return l.locality.Repair()
+}
+
+func (l *lshIndex) info() map[string]any {
+	info := l.locality.Info()
+	info["type"] = IndexTypeLSH
+
+	return info
+}
+
+func (l *lshIndex) drop() error {
+	return l.locality.Drop()
+}
+
+func (l *lshIndex) spaceDim() uint32 {
+	return l.locality.SpaceDim()
+}
+
+func (l *lshIndex) metric() Metric {
+	return l.locality.Metric()
+}
+
+func (l *lshIndex) listIDs() ([]string, error) {
+	return l.locality.ListIDs()
+}
+
+func (l *lshIndex) exists(itemID string) (bool, error) {
+	return l.locality.Exists(itemID)
+}
+
+// embedding returns nil when the index doesn't store embeddings.
+func (l *lshIndex) embedding(itemID string) ([]float64, error) {
+	if !l.locality.StoresEmbeddings() {
+		return nil, nil
+	}
+
+	return l.locality.Embedding(itemID)
+}
+
+func (l *lshIndex) getWithMeta(queryVec []float64, threshold float64, k uint32) ([]string, [][]byte, error) {
+	return l.locality.GetWithMeta(queryVec, threshold, k)
+}
+
+func (l *lshIndex) meta(ids []string) ([][]byte, error) {
+	return l.locality.Meta(ids)
+}
+
+func (l *lshIndex) count() int {
+	return l.locality.Count()
+}
+
+func (l *lshIndex) centroid() ([]float64, error) {
+	return l.locality.Centroid()
+}
+
+func (l *lshIndex) flushStats() error {
+	return l.locality.FlushStats()
+}
+
+func (l *lshIndex) reload() error {
+	l.locality.PurgeEmbeddingCache()
+	return l.locality.ReloadStats()
+}
+
+type flatIndex struct {
+	exact *flat.Flat
+}
+
+func (f *flatIndex) add(itemID string, itemVec []float64) error {
+	return f.exact.Add(itemID, itemVec)
+}
+
+func (f *flatIndex) addBatch(items []Item) error {
+	return f.exact.AddBatch(toFlatItems(items))
+}
+
+func (f *flatIndex) addBatchIfAbsent(items []Item) (inserted int, err error) {
+	return f.exact.AddBatchIfAbsent(toFlatItems(items))
+}
+
+func toFlatItems(items []Item) []flat.Item {
+	flatItems := make([]flat.Item, len(items))
+	for i, item := range items {
+		flatItems[i] = flat.Item{ID: item.ID, Embedding: item.Vec, Meta: item.Meta}
+	}
+
+	return flatItems
+}
+
+func (f *flatIndex) update(itemID string, itemVec []float64) error {
+	return f.exact.Update(itemID, itemVec)
+}
+
+func (f *flatIndex) delete(itemID string) error {
+	return f.exact.Delete(itemID)
+}
+
+func (f *flatIndex) embeddings(fn func(itemID string, itemVec []float64) error) error {
+	return f.exact.Embeddings(fn)
+}
+
+func (f *flatIndex) streamEmbeddings(ctx context.Context, fn func(itemID string, itemVec []float64) error) error {
+	return f.exact.Embeddings(func(itemID string, itemVec []float64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fn(itemID, itemVec)
+	})
+}
+
+func (f *flatIndex) get(queryVec []float64, threshold float64, k uint32) (ids []string, err error) {
+	return f.exact.Get(queryVec, threshold, k)
+}
+
+func (f *flatIndex) getPrepared(pq PreparedQuery, threshold float64, k uint32) (ids []string, err error) {
+	return f.exact.GetPrepared(pq.vec, pq.query, threshold, k)
+}
+
+func (f *flatIndex) getSimilarToID(itemID string, threshold float64, k uint32) (ids []string, err error) {
+	return f.exact.GetSimilarToID(itemID, threshold, k)
+}
+
+// getWithGroundTruth returns the same neighbors twice, as a flat index's results are exact.
+func (f *flatIndex) getWithGroundTruth(queryVec []float64, k uint32) (approx, exact []string, err error) {
+	exact, err = f.exact.Nearest(queryVec, k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return slices.Clone(exact), exact, nil
+}
+
+func (f *flatIndex) getWithScores(queryVec []float64, threshold float64, k uint32) ([]Neighbor, error) {
+	scored, err := f.exact.GetWithScores(queryVec, threshold, k)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors := make([]Neighbor, len(scored))
+	for i, neighbor := range scored {
+		neighbors[i] = Neighbor{ID: neighbor.ID, Score: neighbor.Score}
+	}
+
+	return neighbors, nil
+}
+
+func (f *flatIndex) similarityMatrix(ids []string) ([][]float64, error) {
+	return f.exact.SimilarityMatrix(ids)
+}
+
+func (f *flatIndex) getStream(ctx context.Context, queryVec []float64, threshold float64, fn func(neighbor Neighbor) error) error {
+	return f.exact.GetStream(ctx, queryVec, threshold, func(neighbor semantic.Neighbor) error {
+		return fn(Neighbor{ID: neighbor.ID, Score: neighbor.Score})
+	})
+}
+
+func (f *flatIndex) getRounds([]float64, []int, float64, uint32) ([]string, error) {
+	return nil, &unsupportedOperationError{"GetRounds", "flat"}
+}
+
+func (f *flatIndex) getExplained([]float64, float64, uint32) ([]Neighbor, error) {
+	return nil, &unsupportedOperationError{"GetExplained", "flat"}
+}
+
+func (f *flatIndex) getPercentile([]float64, float64) ([]string, error) {
+	return nil, &unsupportedOperationError{"GetPercentile", "flat"}
+}
+
+func (f *flatIndex) getMulti([][]float64, MultiMode, float64, uint32) ([]string, error) {
+	return nil, &unsupportedOperationError{"GetMulti", "flat"}
+}
+
+func (f *flatIndex) findDuplicateClusters(float64) ([][]string, error) {
+	return nil, &unsupportedOperationError{"FindDuplicateClusters", "flat"}
+}
+
+func (f *flatIndex) footprint() (Footprint, error) {
+	return Footprint{}, &unsupportedOperationError{"Footprint", "flat"}
+}
+
+func (f *flatIndex) getTopK(queryVec []float64, k, _ uint32) ([]string, error) {
+	return f.exact.Nearest(queryVec, k)
+}
+
+func (f *flatIndex) getFiltered(queryVec []float64, threshold float64, k uint32, filter func(meta []byte) bool) ([]string, error) {
+	return f.exact.GetFiltered(queryVec, threshold, k, filter)
+}
+
+// Flat indexes have no sketches to pre-filter with.
+func (f *flatIndex) getPreFiltered(queryVec []float64, threshold float64, k, _ uint32) ([]string, error) {
+	return f.exact.Get(queryVec, threshold, k)
+}
+
+func (f *flatIndex) bucketStats() (BucketStats, error) {
+	return BucketStats{}, &unsupportedOperationError{"BucketStats", "flat"}
+}
+
+func (f *flatIndex) drift(context.Context, time.Time) (Drift, error) {
+	return Drift{}, &unsupportedOperationError{"DriftReport", "flat"}
+}
+
+func (f *flatIndex) sample(int, int64) (map[string][]float64, error) {
+	return nil, &unsupportedOperationError{"Sample", "flat"}
+}
+
+func (f *flatIndex) seed() (int64, error) {
+	return 0, &unsupportedOperationError{"Seed", "flat"}
+}
+
+func (f *flatIndex) optimize(int, float64) (OptimizeReport, error) {
+	return OptimizeReport{}, &unsupportedOperationError{"Optimize", "flat"}
+}
+
+func (f *flatIndex) pruneRounds(context.Context, ...int) error {
+	return &unsupportedOperationError{"PruneRounds", "flat"}
+}
+
+func (f *flatIndex) migrateNormalize() error {
+	return &unsupportedOperationError{"MigrateNormalize", "flat"}
+}
+
+func (f *flatIndex) reembed(context.Context, func(itemID string, oldVec []float64) ([]float64, error)) error {
+	return &unsupportedOperationError{"Reembed", "flat"}
+}
+
+// repair has nothing to fix: every item is a single key, written atomically.
+func (f *flatIndex) repair() (RepairReport, error) {
+	return RepairReport{}, nil
+}
+
+func (f *flatIndex) info() map[string]any {
+	info := f.exact.Info()
+	info["type"] = IndexTypeFlat
+	info["count"] = f.count()
+
+	return info
+}
+
+func (f *flatIndex) drop() error {
+	return f.exact.Drop()
+}
+
+func (f *flatIndex) spaceDim() uint32 {
+	return f.exact.SpaceDim()
+}
+
+func (f *flatIndex) metric() Metric {
+	return f.exact.Metric()
+}
+
+func (f *flatIndex) listIDs() ([]string, error) {
+	return f.exact.ListIDs()
+}
+
+func (f *flatIndex) exists(itemID string) (bool, error) {
+	return f.exact.Exists(itemID)
+}
+
+func (f *flatIndex) embedding(itemID string) ([]float64, error) {
+	return f.exact.Embedding(itemID)
+}
+
+func (f *flatIndex) getWithMeta(queryVec []float64, threshold float64, k uint32) ([]string, [][]byte, error) {
+	return f.exact.GetWithMeta(queryVec, threshold, k)
+}
+
+func (f *flatIndex) meta(ids []string) ([][]byte, error) {
+	return f.exact.Meta(ids)
+}
+
+// count returns 0 when counting fails, which flat.Flat.Count logs.
+func (f *flatIndex) count() int {
+	count, _ := f.exact.Count()
+
+	return count
+}
+
+func (f *flatIndex) centroid() ([]float64, error) {
+	return f.exact.Centroid()
+}
+
+// flushStats has nothing to save: a flat index keeps no counters.
+func (f *flatIndex) flushStats() error {
+	return nil
+}
+
+// Flat indexes drop their columnar block, if any, to be rebuilt from storage on the next query. They keep no stats.
+func (f *flatIndex) reload() error {
+	f.exact.PurgeBlock()
+	return nil
+}
+
+// closable makes every operation on a storage fail with a dbClosedError once it is closed,
+// instead of reaching the closed badger instance. Closing it again is a no-op.
+type closable struct {
+	storage.Contract
+	closed atomic.Bool
+}
+
+func (c *closable) CloseDB() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	return c.Contract.CloseDB()
+}
+
+func (c *closable) Add(data map[string][]byte) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Add(data)
+}
+
+func (c *closable) Get(key string) (val []byte, err error) {
+	if c.closed.Load() {
+		return nil, &dbClosedError{}
+	}
+
+	return c.Contract.Get(key)
+}
+
+func (c *closable) GetWithPrefix(prefix string) (values [][]byte, err error) {
+	if c.closed.Load() {
+		return nil, &dbClosedError{}
+	}
+
+	return c.Contract.GetWithPrefix(prefix)
+}
+
+func (c *closable) GetWithPrefixFunc(prefix string, fn func(val []byte) error) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.GetWithPrefixFunc(prefix, fn)
+}
+
+func (c *closable) GetKeysWithPrefix(prefix string) (keys []string, err error) {
+	if c.closed.Load() {
+		return nil, &dbClosedError{}
+	}
+
+	return c.Contract.GetKeysWithPrefix(prefix)
+}
+
+func (c *closable) CountWithPrefix(prefix string) (count int, err error) {
+	if c.closed.Load() {
+		return 0, &dbClosedError{}
+	}
+
+	return c.Contract.CountWithPrefix(prefix)
+}
+
+func (c *closable) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.IterateWithPrefix(prefix, fn)
+}
+
+func (c *closable) IterateKeysWithPrefix(prefix string, fn func(key string) error) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.IterateKeysWithPrefix(prefix, fn)
+}
+
+func (c *closable) Stream(ctx context.Context, prefix string, fn func(key string, val []byte) error) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Stream(ctx, prefix, fn)
+}
+
+func (c *closable) UsageWithPrefix(prefix string) (usage storage.Usage, err error) {
+	if c.closed.Load() {
+		return storage.Usage{}, &dbClosedError{}
+	}
+
+	return c.Contract.UsageWithPrefix(prefix)
+}
+
+func (c *closable) View(fn func(tx storage.ReadTx) error) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.View(fn)
+}
+
+func (c *closable) Del(keys ...string) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Del(keys...)
+}
+
+func (c *closable) DelWithPrefix(prefix string) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.DelWithPrefix(prefix)
+}
+
+func (c *closable) Write(set map[string][]byte, del []string) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Write(set, del)
+}
+
+func (c *closable) KeyExists(key string) (exists bool, err error) {
+	if c.closed.Load() {
+		return false, &dbClosedError{}
+	}
+
+	return c.Contract.KeyExists(key)
+}
+
+func (c *closable) KeysExist(keys ...string) (exists map[string]bool, err error) {
+	if c.closed.Load() {
+		return nil, &dbClosedError{}
+	}
+
+	return c.Contract.KeysExist(keys...)
+}
+
+func (c *closable) Backup(w io.Writer, since uint64) (version uint64, err error) {
+	if c.closed.Load() {
+		return 0, &dbClosedError{}
+	}
+
+	return c.Contract.Backup(w, since)
+}
+
+func (c *closable) Load(r io.Reader) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Load(r)
+}
+
+func (c *closable) RunGC(discardRatio float64) (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.RunGC(discardRatio)
+}
+
+func (c *closable) Sync() (err error) {
+	if c.closed.Load() {
+		return &dbClosedError{}
+	}
+
+	return c.Contract.Sync()
+}
+
+// breaker is a circuit breaker around a storage. See CircuitBreakerConfig.
+type breaker struct {
+	storage.Contract
+
+	threshold uint32
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+
+	// Consecutive storage errors.
+	failures uint32
+
+	// When the breaker last opened.
+	openedAt time.Time
+
+	// Whether a probe is in flight, while other operations keep failing fast.
+	probing bool
+}
+
+func newBreaker(stg storage.Contract, config CircuitBreakerConfig) *breaker {
+	b := &breaker{
+		Contract:  stg,
+		threshold: config.Threshold,
+		cooldown:  config.Cooldown,
+		now:       time.Now,
+	}
+
+	if b.cooldown == 0 {
+		b.cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+
+	return b
+}
+
+// allow reports whether an operation may reach the storage, turning it into the probe once the cooldown is over.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return &storageUnavailableError{retryAt: b.openedAt.Add(b.cooldown)}
+	}
+
+	b.probing = true
+
+	return nil
+}
+
+// record tracks an operation's outcome. Missing keys are regular answers, not storage failures.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if err == nil || errors.Is(err, storage.ErrNotFound) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// guard runs op if the breaker allows it, and records its outcome.
+func (b *breaker) guard(op func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := op()
+	b.record(err)
+
+	return err
+}
+
+// guardCallback is like guard for operations calling back a function, whose own errors, stored in fnErr,
+// are the caller's and not storage failures.
+func (b *breaker) guardCallback(op func() error, fnErr *error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := op()
+	if err != nil && err == *fnErr {
+		b.record(nil)
+	} else {
+		b.record(err)
+	}
+
+	return err
+}
+
+func (b *breaker) Add(data map[string][]byte) error {
+	return b.guard(func() error {
+		return b.Contract.Add(data)
+	})
+}
+
+func (b *breaker) Get(key string) (val []byte, err error) {
+	err = b.guard(func() (err error) {
+		val, err = b.Contract.Get(key)
+		return err
+	})
+
+	return val, err
+}
+
+func (b *breaker) GetWithPrefix(prefix string) (values [][]byte, err error) {
+	err = b.guard(func() (err error) {
+		values, err = b.Contract.GetWithPrefix(prefix)
+		return err
+	})
+
+	return values, err
+}
+
+func (b *breaker) GetWithPrefixFunc(prefix string, fn func(val []byte) error) error {
+	var fnErr error
+
+	return b.guardCallback(func() error {
+		return b.Contract.GetWithPrefixFunc(prefix, func(val []byte) error {
+			fnErr = fn(val)
+			return fnErr
+		})
+	}, &fnErr)
+}
+
+func (b *breaker) GetKeysWithPrefix(prefix string) (keys []string, err error) {
+	err = b.guard(func() (err error) {
+		keys, err = b.Contract.GetKeysWithPrefix(prefix)
+		return err
+	})
+
+	return keys, err
+}
+
+func (b *breaker) CountWithPrefix(prefix string) (count int, err error) {
+	err = b.guard(func() (err error) {
+		count, err = b.Contract.CountWithPrefix(prefix)
+		return err
+	})
+
+	return count, err
+}
+
+func (b *breaker) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) error {
+	var fnErr error
+
+	return b.guardCallback(func() error {
+		return b.Contract.IterateWithPrefix(prefix, func(key string, val []byte) error {
+			fnErr = fn(key, val)
+			return fnErr
+		})
+	}, &fnErr)
+}
+
+func (b *breaker) Stream(ctx context.Context, prefix string, fn func(key string, val []byte) error) error {
+	var fnErr error
+
+	return b.guardCallback(func() error {
+		return b.Contract.Stream(ctx, prefix, func(key string, val []byte) error {
+			fnErr = fn(key, val)
+			return fnErr
+		})
+	}, &fnErr)
+}
+
+func (b *breaker) IterateKeysWithPrefix(prefix string, fn func(key string) error) error {
+	var fnErr error
+
+	return b.guardCallback(func() error {
+		return b.Contract.IterateKeysWithPrefix(prefix, func(key string) error {
+			fnErr = fn(key)
+			return fnErr
+		})
+	}, &fnErr)
+}
+
+func (b *breaker) UsageWithPrefix(prefix string) (usage storage.Usage, err error) {
+	err = b.guard(func() (err error) {
+		usage, err = b.Contract.UsageWithPrefix(prefix)
+		return err
+	})
+
+	return usage, err
+}
+
+// View records the storage errors of the reads made through its ReadTx as failures, even when fn returns them,
+// while the errors fn makes up itself are the caller's.
+func (b *breaker) View(fn func(tx storage.ReadTx) error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	var (
+		btx   *breakerTx
+		fnErr error
+	)
+
+	err := b.Contract.View(func(tx storage.ReadTx) error {
+		btx = &breakerTx{ReadTx: tx}
+		fnErr = fn(btx)
+		return fnErr
+	})
+
+	switch {
+	case btx != nil && btx.failure != nil:
+		b.record(btx.failure)
+	case err != nil && err == fnErr:
+		b.record(nil)
+	default:
+		b.record(err)
+	}
+
+	return err
+}
+
+// breakerTx is the ReadTx of breaker.View. It keeps the first storage error of its reads,
+// apart from the errors returned by the callbacks it calls.
+type breakerTx struct {
+	storage.ReadTx
+	failure error
+}
+
+// fail keeps err as the transaction's failure, unless it's a missing key or a failure was already kept.
+func (tx *breakerTx) fail(err error) error {
+	if err != nil && tx.failure == nil && !errors.Is(err, storage.ErrNotFound) {
+		tx.failure = err
+	}
+
+	return err
+}
+
+func (tx *breakerTx) Get(key string) (val []byte, err error) {
+	val, err = tx.ReadTx.Get(key)
+	return val, tx.fail(err)
+}
+
+func (tx *breakerTx) GetWithPrefix(prefix string) (values [][]byte, err error) {
+	values, err = tx.ReadTx.GetWithPrefix(prefix)
+	return values, tx.fail(err)
+}
+
+func (tx *breakerTx) GetWithPrefixFunc(prefix string, fn func(val []byte) error) error {
+	var fnErr error
+
+	err := tx.ReadTx.GetWithPrefixFunc(prefix, func(val []byte) error {
+		fnErr = fn(val)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		return err
+	}
+
+	return tx.fail(err)
+}
+
+func (tx *breakerTx) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) error {
+	var fnErr error
+
+	err := tx.ReadTx.IterateWithPrefix(prefix, func(key string, val []byte) error {
+		fnErr = fn(key, val)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		return err
+	}
+
+	return tx.fail(err)
+}
+
+func (tx *breakerTx) CountWithPrefix(prefix string) (count int, err error) {
+	count, err = tx.ReadTx.CountWithPrefix(prefix)
+	return count, tx.fail(err)
+}
+
+func (b *breaker) Backup(w io.Writer, since uint64) (version uint64, err error) {
+	err = b.guard(func() (err error) {
+		version, err = b.Contract.Backup(w, since)
+		return err
+	})
+
+	return version, err
+}
+
+func (b *breaker) Load(r io.Reader) error {
+	return b.guard(func() error {
+		return b.Contract.Load(r)
+	})
+}
+
+func (b *breaker) RunGC(discardRatio float64) error {
+	return b.guard(func() error {
+		return b.Contract.RunGC(discardRatio)
+	})
+}
+
+func (b *breaker) Sync() error {
+	return b.guard(func() error {
+		return b.Contract.Sync()
+	})
+}
+
+func (b *breaker) Del(keys ...string) error {
+	return b.guard(func() error {
+		return b.Contract.Del(keys...)
+	})
+}
+
+func (b *breaker) DelWithPrefix(prefix string) error {
+	return b.guard(func() error {
+		return b.Contract.DelWithPrefix(prefix)
+	})
+}
+
+func (b *breaker) Write(set map[string][]byte, del []string) error {
+	return b.guard(func() error {
+		return b.Contract.Write(set, del)
+	})
+}
+
+func (b *breaker) KeyExists(key string) (exists bool, err error) {
+	err = b.guard(func() (err error) {
+		exists, err = b.Contract.KeyExists(key)
+		return err
+	})
+
+	return exists, err
+}
+
+func (b *breaker) KeysExist(keys ...string) (exists map[string]bool, err error) {
+	err = b.guard(func() (err error) {
+		exists, err = b.Contract.KeysExist(keys...)
+		return err
+	})
+
+	return exists, err
+}
+
+// =================================== ERRORS ===================================
+
+// Errors returned by the DB unwrap to one of these types when they are of its kind, so that
+// errors.As extracts their details, and errors.Is matches them against the sentinel of that kind.
+type (
+	// DimensionMismatchError reports a vector whose length differs from the expected one.
+	DimensionMismatchError = errs.DimensionMismatchError
+
+	// EmptyVectorError reports a vector without values.
+	EmptyVectorError = errs.EmptyVectorError
+
+	// InvalidThresholdError reports a threshold outside the range the index's metric accepts.
+	InvalidThresholdError = errs.InvalidThresholdError
+
+	// NotFoundError reports a missing index (KindIndex) or item (KindItem).
+	NotFoundError = errs.NotFoundError
+
+	// AlreadyExistsError reports an index (KindIndex) that can't be created twice.
+	AlreadyExistsError = errs.AlreadyExistsError
+)
+
+var (
+	ErrDimensionMismatch = errs.ErrDimensionMismatch
+	ErrEmptyVector       = errs.ErrEmptyVector
+	ErrInvalidThreshold  = errs.ErrInvalidThreshold
+	ErrNotFound          = errs.ErrNotFound
+	ErrAlreadyExists     = errs.ErrAlreadyExists
+)
+
+// Kinds of resource reported by NotFoundError and AlreadyExistsError.
+const (
+	KindIndex = errs.KindIndex
+	KindItem  = errs.KindItem
+)
+
+// ConfigValidationError gathers every problem found in a configuration, so they can all be fixed at once.
+// Nothing is created when it is returned.
+type ConfigValidationError struct {
+	Errs []error
+}
+
+func (e *ConfigValidationError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+func (e *ConfigValidationError) Unwrap() []error {
+	return e.Errs
+}
+
+type invalidLSHConfigError struct {
+	position  int
+	indexName string
+	field     string
+	reason    string
+}
+
+func (e *invalidLSHConfigError) Error() string {
+	return fmt.Sprintf("LSH config %d (%q): %s %s", e.position, e.indexName, e.field, e.reason)
+}
+
+type invalidFlatConfigError struct {
+	position  int
+	indexName string
+	field     string
+	reason    string
+}
+
+func (e *invalidFlatConfigError) Error() string {
+	return fmt.Sprintf("flat config %d (%q): %s %s", e.position, e.indexName, e.field, e.reason)
+}
+
+type unsupportedOperationError struct {
+	operation string
+	indexType string
+}
+
+func (e *unsupportedOperationError) Error() string {
+	return fmt.Sprintf("%s is not supported by %s indexes.", e.operation, e.indexType)
+}
+
+type spaceDimTooLargeError struct {
+	got int
+	max uint32
+}
+
+func (e *spaceDimTooLargeError) Error() string {
+	return fmt.Sprintf("space dimension cannot exceed %d, but got: %d", e.max, e.got)
+}
+
+type indexAlreadyExistsError struct {
+	name string
+}
+
+func (e *indexAlreadyExistsError) Error() string {
+	return fmt.Sprintf("index %s already exists.", e.name)
+}
+
+func (e *indexAlreadyExistsError) Unwrap() error {
+	return &AlreadyExistsError{Kind: KindIndex, Name: e.name}
+}
+
+type indexDoesNotExistError struct {
+	name string
+}
+
+func (e *indexDoesNotExistError) Error() string {
+	return fmt.Sprintf("index %s does not exist.", e.name)
+}
+
+func (e *indexDoesNotExistError) Unwrap() error {
+	return &NotFoundError{Kind: KindIndex, Name: e.name}
+}
+
+type malformedLineError struct {
+	line   int
+	reason string
+}
+
+func (e *malformedLineError) Error() string {
+	return fmt.Sprintf("malformed line %d: %s", e.line, e.reason)
+}
+
+type checkpointOnDiskError struct {
+	path string
+}
+
+func (e *checkpointOnDiskError) Error() string {
+	return fmt.Sprintf("checkpoints require an in-memory DB, but got path: %s", e.path)
+}
+
+type invalidDiscardRatioError struct {
+	discardRatio float64
+}
+
+func (e *invalidDiscardRatioError) Error() string {
+	return fmt.Sprintf("GC discard ratio must be between 0 and 1, both excluded, but got: %v", e.discardRatio)
+}
+
+type invalidSampleSizeError struct {
+	got int
+}
+
+func (e *invalidSampleSizeError) Error() string {
+	return fmt.Sprintf("sample size cannot be negative, but got: %d", e.got)
+}
+
+type readOnlyError struct{}
+
+func (e *readOnlyError) Error() string {
+	return "database is read-only"
+}
+
+type legacyKeysReadOnlyError struct{}
+
+func (e *legacyKeysReadOnlyError) Error() string {
+	return "database keys use the legacy \"/\" separator, open it once without ReadOnly to migrate them"
+}
+
+type readOnlyInMemoryError struct{}
+
+func (e *readOnlyInMemoryError) Error() string {
+	return "read-only DBs require a path"
+}
+
+type storageUnavailableError struct {
+	retryAt time.Time
+}
+
+func (e *storageUnavailableError) Error() string {
+	return fmt.Sprintf("storage unavailable after repeated failures, retrying after %s", e.retryAt.Format(time.RFC3339))
+}
+
+type indexNamesRequiredError struct{}
+
+func (e *indexNamesRequiredError) Error() string {
+	return "index names are required in strict mode, use AddAll to add to every index."
+}
+
+type biasLenError struct {
+	queryLen int
+	biasLen  int
+}
+
+func (e *biasLenError) Error() string {
+	return fmt.Sprintf("bias length must match query length (expected: %d, got: %d)", e.queryLen, e.biasLen)
+}
+
+func (e *biasLenError) Unwrap() error {
+	return &DimensionMismatchError{Expected: e.queryLen, Got: e.biasLen}
+}
+
+type itemLenError struct {
+	indexName string
+	itemID    string
+	expected  uint32
+	got       int
+}
+
+func (e *itemLenError) Error() string {
+	return fmt.Sprintf("item %s: vector length must match the space dimension of index %s (expected: %d, got: %d)",
+		e.itemID, e.indexName, e.expected, e.got)
+}
+
+func (e *itemLenError) Unwrap() error {
+	return &DimensionMismatchError{Expected: int(e.expected), Got: e.got}
+}
+
+type mixedMetricsError struct {
+	indexName      string
+	otherIndexName string
+}
+
+func (e *mixedMetricsError) Error() string {
+	return fmt.Sprintf("indexes %s and %s use different metrics, so their scores can't be merged", e.indexName, e.otherIndexName)
+}
+
+type healthCheckError struct{}
+
+func (e *healthCheckError) Error() string {
+	return "health check read back a different value than it wrote."
+}
+
+type dbClosedError struct{}
+
+func (e *dbClosedError) Error() string {
+	return "database closed."
 }
 
 type dbHasNoIndexError struct{}
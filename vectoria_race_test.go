@@ -3,6 +3,9 @@
 package vectoria
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/brianvoe/gofakeit/v6"
@@ -36,3 +39,129 @@ func TestRaceAdd(t *testing.T) {
 		}()
 	}
 }
+
+func TestRaceMixed(t *testing.T) {
+	var (
+		spaceDim   uint32 = 3
+		indexNames        = []string{"first", "second", "third"}
+	)
+
+	configs := make([]LSHConfig, len(indexNames))
+	for i, indexName := range indexNames {
+		configs[i] = LSHConfig{IndexName: indexName, SpaceDim: spaceDim}
+	}
+
+	db, err := New(DBConfig{LSH: configs})
+	assert.NoError(t, err)
+
+	randomVec := func() []float64 {
+		vec := make([]float64, spaceDim)
+		gofakeit.Slice(&vec)
+		return vec
+	}
+
+	var (
+		wg      sync.WaitGroup
+		dropped = make([]string, 50)
+	)
+
+	for i := 0; i < 50; i++ {
+		indexName := indexNames[i%len(indexNames)]
+
+		// Dropped while written to and queried: writes finish before the drop or fail, reads see it or not.
+		droppedName := fmt.Sprintf("dropped-%d", i)
+		dropped[i] = droppedName
+		assert.NoError(t, db.addLSH(LSHConfig{IndexName: droppedName, SpaceDim: spaceDim}))
+
+		wg.Add(9)
+
+		go func() {
+			defer wg.Done()
+
+			itemID := uuid.NewString()
+
+			err := db.Add(itemID, randomVec(), indexName)
+			assert.NoError(t, err)
+
+			err = db.Delete(itemID, indexName)
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			_, err := db.AddBatchIfAbsent([]Item{{ID: uuid.NewString(), Vec: randomVec()}}, indexName)
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			_, err := db.Get(randomVec(), 0, 0)
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			out := make(chan Neighbor)
+			go func() {
+				for range out {
+				}
+			}()
+
+			err := db.GetStream(context.Background(), randomVec(), 0, indexName, out)
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			assert.Subset(t, db.Indexes(), indexNames)
+
+			_, err := db.Overview()
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			assert.NoError(t, db.Ping())
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			err := db.Add(uuid.NewString(), randomVec(), droppedName)
+			if err != nil {
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			_, err := db.Get(randomVec(), 0, 0, droppedName)
+			if err != nil {
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			assert.NoError(t, db.DropIndex(droppedName))
+		}()
+	}
+
+	wg.Wait()
+
+	// An index created under a dropped name inherits nothing written during the drop.
+	for _, indexName := range dropped {
+		assert.NoError(t, db.addLSH(LSHConfig{IndexName: indexName, SpaceDim: spaceDim}))
+
+		ids, err := db.ListIDs(indexName)
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+	}
+}
@@ -1,14 +1,29 @@
 package vectoria
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/brianvoe/gofakeit/v6"
 	"github.com/google/uuid"
+	"github.com/mastrasec/vectoria/internal/flat"
+	"github.com/mastrasec/vectoria/internal/lsh"
 	"github.com/mastrasec/vectoria/internal/storage"
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/exp/slog"
 )
 
 func TestMain(m *testing.M) {
@@ -73,7 +88,7 @@ func TestNew(t *testing.T) {
 				},
 			},
 			wantNumIndexes: 0,
-			err:            &indexAlreadyExistsError{},
+			err:            &ConfigValidationError{},
 		},
 	}
 
@@ -122,7 +137,7 @@ func TestAddLSH(t *testing.T) {
 					IndexName: "duplicated-index-name",
 				},
 			},
-			err:            &indexAlreadyExistsError{},
+			err:            &ConfigValidationError{},
 			wantNumIndexes: 0,
 		},
 	}
@@ -133,6 +148,7 @@ func TestAddLSH(t *testing.T) {
 			func(t *testing.T) {
 				stg, err := storage.New("")
 				assert.NoError(t, err)
+				defer stg.CloseDB()
 
 				db := newDB(stg)
 
@@ -159,6 +175,94 @@ func TestAddLSH(t *testing.T) {
 	}
 }
 
+func TestConfigValidation(t *testing.T) {
+	_, err := New(DBConfig{
+		LSH: []LSHConfig{
+			{IndexName: "valid", SpaceDim: 3},
+			{IndexName: "duplicated"},
+			{IndexName: "duplicated"},
+			{IndexName: "one-dim", SpaceDim: 1},
+			{IndexName: "far-fallback", NumHyperPlanes: 2, FallbackRadius: 3},
+			{RoundOrder: RoundOrder(9)},
+			{EmbeddingCodec: EmbeddingCodec(9)},
+			{Metric: metricOf(Metric(9))},
+			{IndexName: "huge", NumRounds: 100000, NumHyperPlanes: 100000},
+		},
+	})
+
+	var validationErr *ConfigValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr.Errs, 8)
+
+	var alreadyExistsErr *indexAlreadyExistsError
+	assert.ErrorAs(t, err, &alreadyExistsErr)
+	assert.Equal(t, "duplicated", alreadyExistsErr.name)
+
+	fields := []string{}
+	for _, err := range validationErr.Errs {
+		if configErr, ok := err.(*invalidLSHConfigError); ok {
+			fields = append(fields, configErr.field)
+		}
+	}
+	assert.Equal(t, []string{"SpaceDim", "FallbackRadius", "RoundOrder", "EmbeddingCodec", "Metric", "NumRounds", "NumHyperPlanes"}, fields)
+
+	// Indexes already in the DB count as duplicates, and nothing is created on failure.
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: "existing"}}})
+	assert.NoError(t, err)
+
+	err = db.addLSH(LSHConfig{IndexName: "new"}, LSHConfig{IndexName: "existing"})
+	assert.ErrorAs(t, err, &alreadyExistsErr)
+	assert.False(t, db.indexExists("new"))
+}
+
+// manifestlessStorage fails to write the manifest, after the indexes were created.
+type manifestlessStorage struct {
+	storage.Contract
+}
+
+func (s *manifestlessStorage) Add(data map[string][]byte) error {
+	if _, ok := data["manifest"]; ok {
+		return errors.New("disk full")
+	}
+
+	return s.Contract.Add(data)
+}
+
+func TestAddIndexesRollback(t *testing.T) {
+	stg, err := storage.New("")
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	// Stored, but not in the manifest, as after a crash: reopened by the failing call, and kept by its rollback.
+	_, err = lsh.New("reopened", stg, 2, 2, 2)
+	assert.NoError(t, err)
+
+	db := newDB(&manifestlessStorage{Contract: stg})
+	err = db.addIndexes(
+		[]LSHConfig{{IndexName: "created", NumRounds: 3, SpaceDim: 2}, {IndexName: "reopened"}},
+		[]FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	)
+	assert.EqualError(t, err, "disk full")
+	assert.Empty(t, db.Indexes())
+
+	lshNames, err := lsh.StoredIndexNames(stg, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reopened"}, lshNames)
+
+	flatNames, err := flat.StoredIndexNames(stg, "")
+	assert.NoError(t, err)
+	assert.Empty(t, flatNames)
+
+	// The name is free again, so a new config applies instead of the rolled back one.
+	db = newDB(stg)
+	err = db.addLSH(LSHConfig{IndexName: "created", NumRounds: 5, SpaceDim: 2})
+	assert.NoError(t, err)
+
+	idx, ok := db.indexRef.get("created")
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, idx.info()["numRounds"])
+}
+
 func TestAdd(t *testing.T) {
 	testCases := []struct {
 		testName   string
@@ -241,3 +345,3029 @@ func TestAdd(t *testing.T) {
 		)
 	}
 }
+
+func TestAddBatch(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	items := []Item{
+		{ID: uuid.NewString(), Vec: []float64{1, 2, 3}},
+		{ID: uuid.NewString(), Vec: []float64{-4, 5, 6}},
+	}
+
+	err = db.AddBatch(items, indexName)
+	assert.NoError(t, err)
+
+	for _, item := range items {
+		res, err := db.Get(item.Vec, 0.9, 1, indexName)
+		assert.NoError(t, err)
+		assert.Contains(t, res[indexName], item.ID)
+	}
+
+	// A single invalid vector fails the whole batch.
+	invalid := []Item{
+		{ID: uuid.NewString(), Vec: []float64{7, 8, 9}},
+		{ID: uuid.NewString(), Vec: []float64{1, 2}},
+	}
+
+	err = db.AddBatch(invalid, indexName)
+	assert.Error(t, err)
+
+	res, err := db.Get(invalid[0].Vec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.NotContains(t, res[indexName], invalid[0].ID)
+
+	// Lengths are checked against every index before writing to any of them.
+	assert.NoError(t, db.addLSH(LSHConfig{IndexName: "two-dim", SpaceDim: 2}))
+
+	err = db.AddBatch([]Item{{ID: "three-dim", Vec: []float64{1, 2, 3}}}, indexName, "two-dim")
+	assert.ErrorIs(t, err, ErrDimensionMismatch)
+	assert.IsType(t, &itemLenError{}, err)
+
+	count, err := db.Count(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(items)), count)
+}
+
+func TestAddBatchIfAbsent(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	items := []Item{
+		{ID: uuid.NewString(), Vec: []float64{1, 2, 3}},
+		{ID: uuid.NewString(), Vec: []float64{-4, 5, 6}},
+	}
+
+	inserted, err := db.AddBatchIfAbsent(items, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inserted)
+
+	inserted, err = db.AddBatchIfAbsent(items, indexName)
+	assert.NoError(t, err)
+	assert.Zero(t, inserted)
+
+	items = append(items, Item{ID: uuid.NewString(), Vec: []float64{7, 8, 9}})
+
+	inserted, err = db.AddBatchIfAbsent(items, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inserted)
+
+	_, err = db.AddBatchIfAbsent(items, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestExportImportJSONL(t *testing.T) {
+	config := DBConfig{
+		LSH: []LSHConfig{{IndexName: "fake-index-name", SpaceDim: 3}},
+	}
+
+	src, err := New(config)
+	assert.NoError(t, err)
+
+	items := []Item{
+		{ID: "a", Vec: []float64{1.5, -2, 3}},
+		{ID: "b", Vec: []float64{0.1, 0.2, 0.3}},
+		{ID: "c", Vec: []float64{-7, 8.25, 1e-9}},
+	}
+
+	err = src.AddBatch(items)
+	assert.NoError(t, err)
+
+	var exported bytes.Buffer
+	err = src.ExportJSONL("fake-index-name", &exported)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(exported.String()), "\n")
+	assert.Len(t, lines, len(items))
+	assert.JSONEq(t, `{"id":"a","vec":[1.5,-2,3]}`, lines[0])
+
+	var unordered bytes.Buffer
+	err = src.ExportJSONLUnordered(context.Background(), "fake-index-name", &unordered)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, lines, strings.Split(strings.TrimSpace(unordered.String()), "\n"))
+
+	dst, err := New(config)
+	assert.NoError(t, err)
+
+	err = dst.ImportJSONL("fake-index-name", bytes.NewReader(exported.Bytes()))
+	assert.NoError(t, err)
+
+	var reexported bytes.Buffer
+	err = dst.ExportJSONL("fake-index-name", &reexported)
+	assert.NoError(t, err)
+	assert.Equal(t, exported.String(), reexported.String())
+
+	for _, item := range items {
+		res, err := dst.Get(item.Vec, 0.9, 1, "fake-index-name")
+		assert.NoError(t, err)
+		assert.Contains(t, res["fake-index-name"], item.ID)
+	}
+}
+
+func TestImportJSONL_Errors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		indexName string
+		input     string
+		wantLine  int
+		err       error
+	}{
+		{
+			name:      "unknown index",
+			indexName: "missing-index-name",
+			input:     `{"id":"a","vec":[1,2,3]}`,
+			err:       &indexDoesNotExistError{},
+		},
+		{
+			name:      "invalid json",
+			indexName: "fake-index-name",
+			input:     "{\"id\":\"a\",\"vec\":[1,2,3]}\n{\"id\":\"b\",\"vec\":[1,2,\n",
+			wantLine:  2,
+			err:       &malformedLineError{},
+		},
+		{
+			name:      "missing id",
+			indexName: "fake-index-name",
+			input:     "{\"id\":\"a\",\"vec\":[1,2,3]}\n\n{\"vec\":[1,2,3]}\n",
+			wantLine:  3,
+			err:       &malformedLineError{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := New(DBConfig{
+				LSH: []LSHConfig{{IndexName: "fake-index-name", SpaceDim: 3}},
+			})
+			assert.NoError(t, err)
+
+			err = db.ImportJSONL(tc.indexName, strings.NewReader(tc.input))
+			assert.IsType(t, tc.err, err)
+
+			if lineErr, ok := err.(*malformedLineError); ok {
+				assert.Equal(t, tc.wantLine, lineErr.line)
+			}
+		})
+	}
+}
+
+func TestGetPercentile(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	itemVec := []float64{1, 2, 3}
+	err = db.Add("a", itemVec, indexName)
+	assert.NoError(t, err)
+
+	got, err := db.GetPercentile(itemVec, 100, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got)
+
+	_, err = db.GetPercentile(itemVec, 100, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	indexName := "fake-index-name"
+
+	stg, err := storage.New("")
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	dbs := make([]*DB, 2)
+	for i, keyPrefix := range []string{"app-a", "app-b"} {
+		dbs[i] = newDB(stg)
+		dbs[i].keyPrefix = keyPrefix
+
+		err = dbs[i].addLSH(LSHConfig{IndexName: indexName, NumRounds: 2, SpaceDim: 3})
+		assert.NoError(t, err)
+	}
+
+	itemVec := []float64{1, 2, 3}
+
+	err = dbs[0].Add("item-a", itemVec, indexName)
+	assert.NoError(t, err)
+
+	err = dbs[1].Add("item-b", itemVec, indexName)
+	assert.NoError(t, err)
+
+	res, err := dbs[0].Get(itemVec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"item-a"}, res[indexName])
+
+	res, err = dbs[1].Get(itemVec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"item-b"}, res[indexName])
+
+	var exported bytes.Buffer
+	err = dbs[0].ExportJSONL(indexName, &exported)
+	assert.NoError(t, err)
+	assert.NotContains(t, exported.String(), "item-b")
+}
+
+func TestGetStream(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumHyperPlanes: 4, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	// Positive multiples share the query's direction, hence its buckets.
+	items := []Item{
+		{ID: "a", Vec: []float64{1, 2, 3}},
+		{ID: "b", Vec: []float64{2, 4, 6}},
+		{ID: "c", Vec: []float64{3, 6, 9}},
+		{ID: "opposite", Vec: []float64{-1, -2, -3}},
+	}
+
+	err = db.AddBatch(items, indexName)
+	assert.NoError(t, err)
+
+	t.Run("all expected ids arrive", func(t *testing.T) {
+		out := make(chan Neighbor)
+		errc := make(chan error, 1)
+
+		go func() {
+			errc <- db.GetStream(context.Background(), []float64{1, 2, 3}, 0.9, indexName, out)
+		}()
+
+		var ids []string
+		for neighbor := range out {
+			assert.InDelta(t, 1.0, neighbor.Score, 1e-9)
+			ids = append(ids, neighbor.ID)
+		}
+
+		assert.NoError(t, <-errc)
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, ids)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		out := make(chan Neighbor)
+
+		err := db.GetStream(ctx, []float64{1, 2, 3}, 0.9, indexName, out)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, open := <-out
+		assert.False(t, open)
+	})
+
+	t.Run("unknown index", func(t *testing.T) {
+		out := make(chan Neighbor)
+
+		err := db.GetStream(context.Background(), []float64{1, 2, 3}, 0.9, "missing-index-name", out)
+		assert.IsType(t, &indexDoesNotExistError{}, err)
+
+		_, open := <-out
+		assert.False(t, open)
+	})
+}
+
+func TestStoreEmbeddings(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumHyperPlanes: 4, SpaceDim: 3, StoreEmbeddings: new(bool)}},
+	})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 2, 3}},
+		{ID: "b", Vec: []float64{2, 4, 6}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	// Bucket members are returned, even though threshold can't be checked without embeddings.
+	res, err := db.Get([]float64{1, 2, 3}, 1, 0, indexName)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, res[indexName])
+
+	res, err = db.Get([]float64{1, 2, 3}, 1, 1, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, res[indexName], 1)
+
+	var exported bytes.Buffer
+	err = db.ExportJSONL(indexName, &exported)
+	assert.NoError(t, err)
+	assert.Empty(t, exported.String())
+}
+
+func TestFootprint(t *testing.T) {
+	var (
+		indexName      string = "fake-index-name"
+		numItems       int    = 10
+		numRounds      uint32 = 3
+		numHyperPlanes uint32 = 4
+		spaceDim       uint32 = 5
+	)
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{
+			IndexName:      indexName,
+			NumRounds:      numRounds,
+			NumHyperPlanes: numHyperPlanes,
+			SpaceDim:       spaceDim,
+		}},
+	})
+	assert.NoError(t, err)
+
+	items := make([]Item, numItems)
+	for i := range items {
+		items[i] = Item{ID: uuid.NewString(), Vec: make([]float64, spaceDim)}
+		gofakeit.Slice(&items[i].Vec)
+	}
+
+	err = db.AddBatch(items, indexName)
+	assert.NoError(t, err)
+
+	fp, err := db.Footprint(indexName)
+	assert.NoError(t, err)
+
+	assert.Equal(t, numItems, fp.Embeddings.Count)
+	assert.Equal(t, int64(numItems)*int64(spaceDim)*8, fp.Embeddings.ValueBytes)
+	assert.Positive(t, fp.Embeddings.KeyBytes)
+
+	// Rounds yielding the same sketch for an item share its sketch key.
+	assert.GreaterOrEqual(t, fp.Sketches.Count, numItems)
+	assert.LessOrEqual(t, fp.Sketches.Count, numItems*int(numRounds))
+
+	assert.Equal(t, int(numRounds), fp.HyperPlanes.Count)
+	assert.Equal(t, int64(numRounds)*int64(numHyperPlanes)*int64(spaceDim)*8, fp.HyperPlanes.ValueBytes)
+
+	_, err = db.Footprint("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetDefaultK(t *testing.T) {
+	var (
+		defaultK   uint32 = 1
+		indexNames        = []string{"fake-index-a", "fake-index-b"}
+		queryVec          = []float64{1, 2, 3}
+	)
+
+	db, err := New(DBConfig{
+		DefaultK: defaultK,
+		LSH: []LSHConfig{
+			{IndexName: indexNames[0], SpaceDim: 3},
+			{IndexName: indexNames[1], SpaceDim: 3},
+		},
+	})
+	assert.NoError(t, err)
+
+	// Positive multiples share the query's direction, hence its buckets.
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 2, 3}},
+		{ID: "b", Vec: []float64{2, 4, 6}},
+		{ID: "c", Vec: []float64{3, 6, 9}},
+	})
+	assert.NoError(t, err)
+
+	res, err := db.GetDefaultK(queryVec, 0.9)
+	assert.NoError(t, err)
+	assert.Len(t, res, len(indexNames))
+
+	for _, indexName := range indexNames {
+		assert.Len(t, res[indexName], int(defaultK))
+	}
+
+	res, err = db.Get(queryVec, 0.9, 2)
+	assert.NoError(t, err)
+
+	for _, indexName := range indexNames {
+		assert.Len(t, res[indexName], 2)
+	}
+}
+
+func TestDriftReport(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a1", Vec: []float64{1, 0.1, 0}},
+		{ID: "a2", Vec: []float64{0.9, 0, 0.1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// Nothing was added after since yet.
+	_, err = db.DriftReport(context.Background(), indexName, since)
+	assert.Error(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "b1", Vec: []float64{0, 0.1, 1}},
+		{ID: "b2", Vec: []float64{0.1, 0, 0.9}},
+		{ID: "b3", Vec: []float64{0, 0, 1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	drift, err := db.DriftReport(context.Background(), indexName, since)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, drift.NumBefore)
+	assert.Equal(t, 3, drift.NumAfter)
+	assert.Less(t, drift.CentroidSimilarity, 0.5)
+
+	_, err = db.DriftReport(context.Background(), "missing-index-name", since)
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestSample(t *testing.T) {
+	var (
+		indexName string = "fake-index-name"
+		numItems  int    = 20
+	)
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	items := make([]Item, numItems)
+	for i := range items {
+		items[i] = Item{ID: uuid.NewString(), Vec: make([]float64, 3)}
+		gofakeit.Slice(&items[i].Vec)
+	}
+
+	err = db.AddBatch(items, indexName)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		n    int
+		want int
+	}{
+		{0, 0},
+		{5, 5},
+		{numItems, numItems},
+		{numItems + 5, numItems},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("n=%d", tc.n), func(t *testing.T) {
+			sample, err := db.Sample(indexName, tc.n, 42)
+			assert.NoError(t, err)
+			assert.Len(t, sample, tc.want)
+
+			again, err := db.Sample(indexName, tc.n, 42)
+			assert.NoError(t, err)
+			assert.Equal(t, sample, again)
+		})
+	}
+
+	_, err = db.Sample(indexName, -1, 42)
+	assert.IsType(t, &invalidSampleSizeError{}, err)
+
+	sample, err := db.Sample(indexName, math.MaxInt, 42)
+	assert.NoError(t, err)
+	assert.Len(t, sample, numItems)
+
+	_, err = db.Sample("missing-index-name", 1, 42)
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestSimilarityEpsilon(t *testing.T) {
+	// The cosine of these parallel vectors rounds to 0.9999999999999998.
+	itemVec := []float64{2.2, 4.6, 7.4}
+	queryVec := []float64{1.1, 2.3, 3.7}
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{
+			{IndexName: "default", SpaceDim: 3},
+			{IndexName: "exact", SpaceDim: 3, SimilarityEpsilon: -1},
+		},
+	})
+	assert.NoError(t, err)
+
+	err = db.Add("a", itemVec, "default", "exact")
+	assert.NoError(t, err)
+
+	got, err := db.Get(queryVec, 1.0, 1, "default", "exact")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got["default"])
+	assert.Empty(t, got["exact"])
+}
+
+func TestSeed(t *testing.T) {
+	config := LSHConfig{IndexName: "original", NumRounds: 2, NumHyperPlanes: 6, SpaceDim: 3}
+
+	db, err := New(DBConfig{LSH: []LSHConfig{config}})
+	assert.NoError(t, err)
+
+	seed, err := db.Seed(config.IndexName)
+	assert.NoError(t, err)
+	assert.NotZero(t, seed)
+
+	config.IndexName = "recreated"
+	config.Seed = seed
+
+	err = db.addLSH(config)
+	assert.NoError(t, err)
+
+	got, err := db.Seed(config.IndexName)
+	assert.NoError(t, err)
+	assert.Equal(t, seed, got)
+
+	// Identical hyperplanes put every item in the same buckets in both indexes.
+	for i := 0; i < 20; i++ {
+		vec := make([]float64, 3)
+		gofakeit.Slice(&vec)
+
+		err = db.Add(uuid.NewString(), vec, "original", "recreated")
+		assert.NoError(t, err)
+	}
+
+	sketches := func(indexName string) []string {
+		prefix := "index" + lsh.KEY_SEPARATOR + indexName + lsh.KEY_SEPARATOR + "sketch" + lsh.KEY_SEPARATOR
+
+		var keys []string
+		err := db.stg.IterateWithPrefix(prefix, func(key string, _ []byte) error {
+			keys = append(keys, strings.TrimPrefix(key, prefix))
+			return nil
+		})
+		assert.NoError(t, err)
+
+		return keys
+	}
+
+	assert.ElementsMatch(t, sketches("original"), sketches("recreated"))
+
+	_, err = db.Seed("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestIDGenerator(t *testing.T) {
+	var next int
+
+	db, err := New(DBConfig{
+		IDGenerator: func() string {
+			next++
+			return fmt.Sprintf("id-%d", next)
+		},
+		LSH: []LSHConfig{{}, {}},
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"id-1", "id-2"}, db.Indexes())
+}
+
+func TestOptimize(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumRounds: 4, NumHyperPlanes: 2, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		vec := make([]float64, 3)
+		gofakeit.Slice(&vec)
+
+		err = db.Add(uuid.NewString(), vec, indexName)
+		assert.NoError(t, err)
+	}
+
+	report, err := db.Optimize(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, report.NumQueries)
+	assert.Len(t, report.Rounds, 4)
+	assert.Less(t, len(report.Redundant), 4)
+
+	err = db.PruneRounds(context.Background(), indexName, report.Redundant...)
+	assert.NoError(t, err)
+	idx, _ := db.indexRef.get(indexName)
+	assert.Equal(t, uint32(4-len(report.Redundant)), idx.info()["numRounds"])
+
+	_, err = db.Optimize("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestMigrateNormalize(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}, {IndexName: "euclidean", SpaceDim: 3, Metric: metricOf(MetricEuclidean)}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.Add("a", []float64{3, 0, 4}, indexName)
+	assert.NoError(t, err)
+
+	err = db.MigrateNormalize(indexName)
+	assert.NoError(t, err)
+
+	var exported bytes.Buffer
+	err = db.ExportJSONL(indexName, &exported)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"a","vec":[0.6,0,0.8]}`, exported.String())
+
+	err = db.MigrateNormalize("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+
+	// Normalizing would change Euclidean distances, so the vectors are left as they are.
+	err = db.Add("a", []float64{3, 0, 4}, "euclidean")
+	assert.NoError(t, err)
+
+	err = db.MigrateNormalize("euclidean")
+	assert.Error(t, err)
+
+	exported.Reset()
+	err = db.ExportJSONL("euclidean", &exported)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"a","vec":[3,0,4]}`, exported.String())
+}
+
+func TestDelete(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{
+			{IndexName: "first", SpaceDim: 3},
+			{IndexName: "second", SpaceDim: 3},
+		},
+	})
+	assert.NoError(t, err)
+
+	vec := []float64{1, 2, 3}
+
+	err = db.Add("a", vec)
+	assert.NoError(t, err)
+
+	err = db.Delete("a", "first")
+	assert.NoError(t, err)
+
+	res, err := db.Get(vec, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, res["first"])
+	assert.Equal(t, []string{"a"}, res["second"])
+
+	err = db.Delete("a", "first")
+	assert.Error(t, err)
+
+	err = db.Delete("a", "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestMaxSpaceDim(t *testing.T) {
+	indexName := "fake-index-name"
+
+	_, err := New(DBConfig{
+		MaxSpaceDim: 4,
+		LSH:         []LSHConfig{{IndexName: indexName, SpaceDim: 5}},
+	})
+	assert.ErrorAs(t, err, new(*spaceDimTooLargeError))
+
+	_, err = New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: DEFAULT_MAX_SPACE_DIM + 1}},
+	})
+	assert.ErrorAs(t, err, new(*spaceDimTooLargeError))
+
+	db, err := New(DBConfig{
+		MaxSpaceDim: 4,
+		LSH:         []LSHConfig{{IndexName: indexName, SpaceDim: 4}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), db.MaxSpaceDim())
+
+	atLimit := []float64{1, 2, 3, 4}
+	beyond := []float64{1, 2, 3, 4, 5}
+
+	err = db.Add("a", atLimit, indexName)
+	assert.NoError(t, err)
+
+	_, err = db.Get(atLimit, 0.9, 1, indexName)
+	assert.NoError(t, err)
+
+	err = db.Add("b", beyond, indexName)
+	assert.IsType(t, &spaceDimTooLargeError{}, err)
+
+	err = db.AddBatch([]Item{{ID: "b", Vec: beyond}}, indexName)
+	assert.IsType(t, &spaceDimTooLargeError{}, err)
+
+	_, err = db.Get(beyond, 0.9, 1, indexName)
+	assert.IsType(t, &spaceDimTooLargeError{}, err)
+
+	_, err = db.GetPercentile(beyond, 50, indexName)
+	assert.IsType(t, &spaceDimTooLargeError{}, err)
+}
+
+func TestGetMulti(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumRounds: 3, NumHyperPlanes: 2, SpaceDim: 3, Seed: 42}},
+	})
+	assert.NoError(t, err)
+
+	var items []Item
+	for i := 0; i < 5; i++ {
+		items = append(items,
+			Item{ID: fmt.Sprintf("a%d", i), Vec: []float64{10, 0.1 * float64(i), 0}},
+			Item{ID: fmt.Sprintf("b%d", i), Vec: []float64{0, 10, 0.1 * float64(i)}},
+		)
+	}
+	items = append(items, Item{ID: "mid", Vec: []float64{1, 1, 0.05}})
+
+	err = db.AddBatch(items, indexName)
+	assert.NoError(t, err)
+
+	queries := [][]float64{{1, 0, 0}, {0, 1, 0}}
+
+	got, err := db.GetMulti(queries, Union, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a0", "a1", "a2", "a3", "a4", "b0", "b1", "b2", "b3", "b4"}, got)
+
+	got, err = db.GetMulti(queries, Centroid, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mid"}, got)
+
+	_, err = db.GetMulti(queries, Union, 0.9, 0, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+// flakyStorage fails every write, and the reads writes start with, while failing is set.
+type flakyStorage struct {
+	storage.Contract
+	failing bool
+}
+
+func (s *flakyStorage) Add(data map[string][]byte) error {
+	if s.failing {
+		return errors.New("disk full")
+	}
+
+	return s.Contract.Add(data)
+}
+
+func (s *flakyStorage) Write(set map[string][]byte, del []string) error {
+	if s.failing {
+		return errors.New("disk full")
+	}
+
+	return s.Contract.Write(set, del)
+}
+
+func (s *flakyStorage) KeysExist(keys ...string) (map[string]bool, error) {
+	if s.failing {
+		return nil, errors.New("disk full")
+	}
+
+	return s.Contract.KeysExist(keys...)
+}
+
+func (s *flakyStorage) KeyExists(key string) (bool, error) {
+	if s.failing {
+		return false, errors.New("disk full")
+	}
+
+	return s.Contract.KeyExists(key)
+}
+
+func (s *flakyStorage) View(fn func(tx storage.ReadTx) error) error {
+	return s.Contract.View(func(tx storage.ReadTx) error {
+		return fn(&flakyTx{ReadTx: tx, storage: s})
+	})
+}
+
+// flakyTx is the ReadTx of flakyStorage, whose reads fail along with it.
+type flakyTx struct {
+	storage.ReadTx
+	storage *flakyStorage
+}
+
+func (tx *flakyTx) Get(key string) ([]byte, error) {
+	if tx.storage.failing {
+		return nil, errors.New("disk full")
+	}
+
+	return tx.ReadTx.Get(key)
+}
+
+func (tx *flakyTx) GetWithPrefix(prefix string) ([][]byte, error) {
+	if tx.storage.failing {
+		return nil, errors.New("disk full")
+	}
+
+	return tx.ReadTx.GetWithPrefix(prefix)
+}
+
+func (tx *flakyTx) GetWithPrefixFunc(prefix string, fn func(val []byte) error) error {
+	if tx.storage.failing {
+		return errors.New("disk full")
+	}
+
+	return tx.ReadTx.GetWithPrefixFunc(prefix, fn)
+}
+
+func (tx *flakyTx) IterateWithPrefix(prefix string, fn func(key string, val []byte) error) error {
+	if tx.storage.failing {
+		return errors.New("disk full")
+	}
+
+	return tx.ReadTx.IterateWithPrefix(prefix, fn)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	indexName := "fake-index-name"
+	vec := []float64{1, 2, 3}
+
+	stg, err := storage.New("")
+	assert.NoError(t, err)
+	defer stg.CloseDB()
+
+	flaky := &flakyStorage{Contract: stg}
+	brk := newBreaker(flaky, CircuitBreakerConfig{Threshold: 2, Cooldown: time.Minute})
+
+	now := time.Now()
+	brk.now = func() time.Time { return now }
+
+	db := newDB(brk)
+	err = db.addLSH(LSHConfig{IndexName: indexName, SpaceDim: 3})
+	assert.NoError(t, err)
+
+	// Missing keys aren't failures.
+	for i := 0; i < 3; i++ {
+		_, err = brk.Get("missing-key")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	}
+
+	flaky.failing = true
+
+	for i := 0; i < 2; i++ {
+		err = db.Add("a", vec, indexName)
+		assert.EqualError(t, err, "disk full")
+	}
+
+	// Open: operations fail fast, whether they would fail or not.
+	err = db.Add("a", vec, indexName)
+	assert.IsType(t, &storageUnavailableError{}, err)
+
+	_, err = db.Get(vec, 0.9, 0, indexName)
+	assert.IsType(t, &storageUnavailableError{}, err)
+
+	// The probe fails: open again.
+	now = now.Add(time.Minute)
+
+	err = db.Add("a", vec, indexName)
+	assert.EqualError(t, err, "disk full")
+
+	err = db.Add("a", vec, indexName)
+	assert.IsType(t, &storageUnavailableError{}, err)
+
+	// The storage recovers and the probe succeeds: closed.
+	flaky.failing = false
+	now = now.Add(time.Minute)
+
+	err = db.Add("a", vec, indexName)
+	assert.NoError(t, err)
+
+	res, err := db.Get(vec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res[indexName])
+
+	// Reads failing within a snapshot open it too, although they reach Get through its callback.
+	flaky.failing = true
+
+	for i := 0; i < 2; i++ {
+		_, err = db.Get(vec, 0.9, 0, indexName)
+		assert.ErrorContains(t, err, "disk full")
+	}
+
+	_, err = db.Get(vec, 0.9, 0, indexName)
+	assert.IsType(t, &storageUnavailableError{}, err)
+
+	// Errors made up by the caller's callback aren't failures.
+	flaky.failing = false
+	now = now.Add(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		err = brk.View(func(tx storage.ReadTx) error {
+			return errors.New("caller error")
+		})
+		assert.EqualError(t, err, "caller error")
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		MaxResults: 3,
+		LSH:        []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	})
+	assert.NoError(t, err)
+
+	vec := []float64{1, 2, 3}
+	for i := 0; i < 5; i++ {
+		err = db.Add(fmt.Sprint(i), vec, indexName)
+		assert.NoError(t, err)
+	}
+
+	testCases := []struct {
+		k         uint32
+		wantLen   int
+		truncated bool
+	}{
+		{k: 0, wantLen: 3, truncated: true},
+		{k: 10, wantLen: 3, truncated: true},
+		{k: 3, wantLen: 3, truncated: false},
+		{k: 2, wantLen: 2, truncated: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("k=%d", tc.k), func(t *testing.T) {
+			ids, truncated, err := db.GetCapped(vec, 0.9, tc.k, indexName)
+			assert.NoError(t, err)
+			assert.Len(t, ids, tc.wantLen)
+			assert.Equal(t, tc.truncated, truncated)
+
+			res, err := db.Get(vec, 0.9, tc.k, indexName)
+			assert.NoError(t, err)
+			assert.Len(t, res[indexName], tc.wantLen)
+		})
+	}
+
+	// The percentile cutoff is capped too, even at 0, which asks for every candidate.
+	top, err := db.GetPercentile(vec, 0, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, top, 3)
+
+	explained, err := db.GetExplained(vec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, explained, 3)
+
+	// Exactly as many neighbors as the cap isn't a truncation.
+	err = db.Delete("0")
+	assert.NoError(t, err)
+	err = db.Delete("1")
+	assert.NoError(t, err)
+
+	ids, truncated, err := db.GetCapped(vec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 3)
+	assert.False(t, truncated)
+}
+
+func TestOverview(t *testing.T) {
+	db, err := New(DBConfig{
+		KeyPrefix: "fake-prefix",
+		LSH: []LSHConfig{
+			{IndexName: "empty", SpaceDim: 2},
+			{IndexName: "small", NumRounds: 2, SpaceDim: 3},
+			{IndexName: "unstored", NumHyperPlanes: 4, SpaceDim: 3, StoreEmbeddings: new(bool)},
+		},
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		err = db.Add(fmt.Sprint(i), []float64{1, 2, float64(i)}, "unstored")
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = db.Add(fmt.Sprint(i), []float64{1, 2, float64(i)}, "small")
+		assert.NoError(t, err)
+	}
+
+	overview, err := db.Overview()
+	assert.NoError(t, err)
+	assert.Equal(t, []IndexOverview{
+		{Name: "empty", NumRounds: lsh.MIN_NUM_ROUNDS, NumHyperPlanes: lsh.MIN_NUM_HYPERPLANES, SpaceDim: 2, NumItems: 0},
+		{Name: "small", NumRounds: 2, NumHyperPlanes: lsh.MIN_NUM_HYPERPLANES, SpaceDim: 3, NumItems: 2, NumAdds: 2},
+		{Name: "unstored", NumRounds: lsh.MIN_NUM_ROUNDS, NumHyperPlanes: 4, SpaceDim: 3, NumItems: 5, NumAdds: 5},
+	}, overview)
+}
+
+func TestFindDuplicateClusters(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumRounds: 3, NumHyperPlanes: 2, SpaceDim: 3, Seed: 42}},
+	})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a1", Vec: []float64{1, 2, 3}},
+		{ID: "a2", Vec: []float64{1, 2, 3.001}},
+		{ID: "b1", Vec: []float64{-3, 1, 0}},
+		{ID: "b2", Vec: []float64{-6, 2, 0}},
+		{ID: "c", Vec: []float64{0, -1, 5}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	clusters, err := db.FindDuplicateClusters(indexName, 0.999)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"b1", "b2"}}, clusters)
+
+	_, err = db.FindDuplicateClusters("missing-index-name", 0.999)
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestCheckpoint(t *testing.T) {
+	indexName := "fake-index-name"
+	vec := []float64{1, 2, 3}
+
+	config := DBConfig{
+		Checkpoint: CheckpointConfig{
+			Path:     filepath.Join(t.TempDir(), "checkpoint"),
+			Interval: 10 * time.Millisecond,
+		},
+		LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}},
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+
+	err = db.Add("a", vec, indexName)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(config.Checkpoint.Path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	err = db.Add("b", vec, indexName)
+	assert.NoError(t, err)
+
+	err = db.Close()
+	assert.NoError(t, err)
+
+	restored, err := New(config)
+	assert.NoError(t, err)
+	defer restored.Close()
+
+	res, err := restored.Get(vec, 0.9, 0, indexName)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, res[indexName])
+
+	_, err = New(DBConfig{Path: t.TempDir(), Checkpoint: config.Checkpoint})
+	assert.ErrorAs(t, err, new(*checkpointOnDiskError))
+}
+
+func TestStrictIndexNames(t *testing.T) {
+	vec := []float64{1, 2, 3}
+	lshConfigs := []LSHConfig{
+		{IndexName: "first", SpaceDim: 3},
+		{IndexName: "second", SpaceDim: 3},
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		db, err := New(DBConfig{LSH: lshConfigs})
+		assert.NoError(t, err)
+
+		err = db.Add("a", vec)
+		assert.NoError(t, err)
+
+		res, err := db.Get(vec, 0.9, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"first": {"a"}, "second": {"a"}}, res)
+
+		err = db.Delete("a")
+		assert.NoError(t, err)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		db, err := New(DBConfig{StrictIndexNames: true, LSH: lshConfigs})
+		assert.NoError(t, err)
+
+		err = db.Add("a", vec)
+		assert.IsType(t, &indexNamesRequiredError{}, err)
+
+		err = db.AddBatch([]Item{{ID: "a", Vec: vec}})
+		assert.IsType(t, &indexNamesRequiredError{}, err)
+
+		err = db.Add("a", vec, "first")
+		assert.NoError(t, err)
+
+		err = db.AddAll("b", vec)
+		assert.NoError(t, err)
+
+		res, err := db.Get(vec, 0.9, 0)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, res["first"])
+		assert.Equal(t, []string{"b"}, res["second"])
+
+		err = db.Delete("b")
+		assert.IsType(t, &indexNamesRequiredError{}, err)
+	})
+}
+
+func TestGetPrepared(t *testing.T) {
+	db := setupManyIndexes(t, 3, 200)
+
+	for i := 0; i < 10; i++ {
+		queryVec := randomVec(8)
+
+		want, err := db.Get(queryVec, 0.5, 5)
+		assert.NoError(t, err)
+
+		pq, err := db.Prepare(queryVec)
+		assert.NoError(t, err)
+
+		// Mutating the vector after preparing it doesn't change the prepared query.
+		queryVec[0] += 1
+
+		got, err := db.GetPrepared(pq, 0.5, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := db.Prepare(make([]float64, DEFAULT_MAX_SPACE_DIM+1))
+	assert.ErrorAs(t, err, new(*spaceDimTooLargeError))
+}
+
+func BenchmarkGet_ManyIndexes(b *testing.B) {
+	db := setupManyIndexes(b, 50, 100)
+	queryVec := randomVec(8)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(queryVec, 0.5, 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetPrepared_ManyIndexes(b *testing.B) {
+	db := setupManyIndexes(b, 50, 100)
+	queryVec := randomVec(8)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pq, err := db.Prepare(queryVec)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := db.GetPrepared(pq, 0.5, 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// setupManyIndexes creates numIndexes indexes of dimension 8, each holding the same numItems random vectors.
+func setupManyIndexes(tb testing.TB, numIndexes, numItems int) *DB {
+	configs := make([]LSHConfig, numIndexes)
+	for i := range configs {
+		configs[i] = LSHConfig{IndexName: fmt.Sprint("index-", i), NumRounds: 2, NumHyperPlanes: 2, SpaceDim: 8}
+	}
+
+	db, err := New(DBConfig{LSH: configs})
+	assert.NoError(tb, err)
+
+	items := make([]Item, numItems)
+	for i := range items {
+		items[i] = Item{ID: fmt.Sprint(i), Vec: randomVec(8)}
+	}
+
+	err = db.AddBatch(items)
+	assert.NoError(tb, err)
+
+	return db
+}
+
+func randomVec(dim int) []float64 {
+	vec := make([]float64, dim)
+	for i := range vec {
+		vec[i] = gofakeit.Float64Range(-1, 1)
+	}
+
+	return vec
+}
+
+func TestAutoRepair(t *testing.T) {
+	indexName := "fake-index-name"
+	sketchPrefix := "index" + lsh.KEY_SEPARATOR + indexName + lsh.KEY_SEPARATOR + "sketch" + lsh.KEY_SEPARATOR
+
+	config := DBConfig{
+		Path: t.TempDir(),
+		LSH:  []LSHConfig{{IndexName: indexName, NumRounds: 3, NumHyperPlanes: 4, SpaceDim: 3}},
+	}
+
+	sketchKeys := func(stg storage.Contract) (keys []string) {
+		err := stg.IterateKeysWithPrefix(sketchPrefix, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		assert.NoError(t, err)
+
+		return keys
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 2, 3}},
+		{ID: "b", Vec: []float64{-3, 2, 1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	want := sketchKeys(db.stg)
+
+	// Fabricates a crash mid-write: a sketch key of a is lost and one of a never added item remains.
+	var lost string
+	for _, key := range want {
+		if strings.HasSuffix(key, lsh.KEY_SEPARATOR+"a") {
+			lost = key
+			break
+		}
+	}
+
+	err = db.stg.Del(lost)
+	assert.NoError(t, err)
+	err = db.stg.Add(map[string][]byte{sketchPrefix + "0000" + lsh.KEY_SEPARATOR + "ghost": []byte("ghost")})
+	assert.NoError(t, err)
+
+	err = db.Close()
+	assert.NoError(t, err)
+
+	config.AutoRepair = true
+
+	db, err = New(config)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, want, sketchKeys(db.stg))
+
+	report, err := db.Repair(indexName)
+	assert.NoError(t, err)
+	assert.Zero(t, report)
+}
+
+// Size of the dataset indexed by BenchmarkGet, e.g. go test -bench Get -args -bench-items=100000
+var benchNumItems = flag.Int("bench-items", 1000, "number of items indexed by BenchmarkGet")
+
+const BENCH_SEED int64 = 42
+
+var benchConfigs = []LSHConfig{
+	{NumRounds: 4, NumHyperPlanes: 8, SpaceDim: 64},
+	{NumRounds: 16, NumHyperPlanes: 8, SpaceDim: 64},
+	{NumRounds: 16, NumHyperPlanes: 16, SpaceDim: 64},
+	{NumRounds: 16, NumHyperPlanes: 16, SpaceDim: 768},
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, config := range benchConfigs {
+		b.Run(benchName(config), func(b *testing.B) {
+			config.IndexName = "fake-index-name"
+			rng := rand.New(rand.NewSource(BENCH_SEED))
+			db := setupBench(b, config)
+
+			items := make([]Item, *benchNumItems)
+			for i := range items {
+				items[i] = Item{ID: fmt.Sprint(i), Vec: seededVec(rng, int(config.SpaceDim))}
+			}
+
+			for start := 0; start < len(items); start += IMPORT_BATCH_SIZE {
+				err := db.AddBatch(items[start:min(start+IMPORT_BATCH_SIZE, len(items))], config.IndexName)
+				assert.NoError(b, err)
+			}
+
+			queries := make([][]float64, 100)
+			for i := range queries {
+				queries[i] = seededVec(rng, int(config.SpaceDim))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(queries[i%len(queries)], 0.5, 10, config.IndexName); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _, config := range benchConfigs {
+		b.Run(benchName(config), func(b *testing.B) {
+			config.IndexName = "fake-index-name"
+			rng := rand.New(rand.NewSource(BENCH_SEED))
+			db := setupBench(b, config)
+
+			vecs := make([][]float64, 1000)
+			for i := range vecs {
+				vecs[i] = seededVec(rng, int(config.SpaceDim))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := db.Add(fmt.Sprint(i), vecs[i%len(vecs)], config.IndexName); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchName(config LSHConfig) string {
+	return fmt.Sprintf("rounds=%d/hyperplanes=%d/dim=%d", config.NumRounds, config.NumHyperPlanes, config.SpaceDim)
+}
+
+// setupBench creates an in-memory DB with a single, seeded index built from config.
+func setupBench(b *testing.B, config LSHConfig) *DB {
+	config.Seed = BENCH_SEED
+
+	db, err := New(DBConfig{LSH: []LSHConfig{config}})
+	assert.NoError(b, err)
+
+	return db
+}
+
+// seededVec returns a normally distributed vector, the same for the same rng state.
+func seededVec(rng *rand.Rand, dim int) []float64 {
+	vec := make([]float64, dim)
+	for i := range vec {
+		vec[i] = rng.NormFloat64()
+	}
+
+	return vec
+}
+
+func TestGetExplained(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: indexName, NumRounds: 40, NumHyperPlanes: 8, SpaceDim: 3, Seed: 42}},
+	})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "near-duplicate", Vec: []float64{1, 0.01, 0}},
+		{ID: "weak", Vec: []float64{1, 1, 0}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	neighbors, err := db.GetExplained([]float64{1, 0, 0}, 0, 0, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, neighbors, 2)
+	assert.Equal(t, "near-duplicate", neighbors[0].ID)
+	assert.InDelta(t, 1, neighbors[0].Score, 0.001)
+	assert.Greater(t, neighbors[0].RoundMatches, neighbors[1].RoundMatches)
+
+	_, err = db.GetExplained([]float64{1, 0, 0}, 0, 0, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 0, 0}},
+		{ID: "b", Vec: []float64{1, 1, 0}},
+		{ID: "c", Vec: []float64{0, 0, 3}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	matrix, err := db.SimilarityMatrix([]string{"a", "b", "c"}, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, matrix, 3)
+
+	for i := range matrix {
+		assert.InDelta(t, 1, matrix[i][i], 1e-9)
+		for j := range matrix {
+			assert.Equal(t, matrix[i][j], matrix[j][i])
+		}
+	}
+	assert.InDelta(t, 0, matrix[0][2], 1e-9)
+
+	_, err = db.SimilarityMatrix([]string{"a", "missing"}, indexName)
+	assert.Error(t, err)
+
+	_, err = db.SimilarityMatrix([]string{"a"}, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetBiased(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 20, NumHyperPlanes: 2, SpaceDim: 2, Seed: 42}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "toward-x", Vec: []float64{1, 0.2}},
+		{ID: "toward-y", Vec: []float64{0.2, 1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	query := []float64{1, 0.9}
+
+	ids, err := db.GetBiased(query, []float64{0, 1}, 0, 0, 1, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"toward-x"}, ids)
+
+	// The bias pulls the query toward the y axis.
+	ids, err = db.GetBiased(query, []float64{0, 1}, 1, 0, 1, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"toward-y"}, ids)
+
+	_, err = db.GetBiased(query, []float64{0, 1, 0}, 1, 0, 1, indexName)
+	assert.IsType(t, &biasLenError{}, err)
+
+	_, err = db.GetBiased(query, []float64{0, 1}, 1, 0, 1, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGet_EmptyNotNil(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{
+			{IndexName: "stored", SpaceDim: 3},
+			{IndexName: "unstored", SpaceDim: 3, StoreEmbeddings: new(bool)},
+		},
+	})
+	assert.NoError(t, err)
+
+	res, err := db.Get([]float64{1, 2, 3}, 0.9, 10)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+
+	for indexName, ids := range res {
+		assert.NotNil(t, ids, indexName)
+		assert.Empty(t, ids, indexName)
+	}
+
+	ids, _, err := db.GetCapped([]float64{1, 2, 3}, 0.9, 10, "stored")
+	assert.NoError(t, err)
+	assert.NotNil(t, ids)
+
+	pq, err := db.Prepare([]float64{1, 2, 3})
+	assert.NoError(t, err)
+
+	res, err = db.GetPrepared(pq, 0.9, 10)
+	assert.NoError(t, err)
+	for indexName, ids := range res {
+		assert.NotNil(t, ids, indexName)
+	}
+
+	ids, err = db.GetRounds([]float64{1, 2, 3}, []int{0}, 0.9, 10, "stored")
+	assert.NoError(t, err)
+	assert.NotNil(t, ids)
+
+	// The only item is the query's, which is excluded.
+	assert.NoError(t, db.Add("a", []float64{1, 2, 3}, "stored"))
+	ids, err = db.GetSimilarToID("a", 0.9, 10, "stored")
+	assert.NoError(t, err)
+	assert.NotNil(t, ids)
+	assert.Empty(t, ids)
+}
+
+func TestGetRounds(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 4, NumHyperPlanes: 2, SpaceDim: 2, Seed: 42}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 0.1}},
+		{ID: "b", Vec: []float64{0.1, 1}},
+		{ID: "c", Vec: []float64{1, 1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	query := []float64{1, 0.5}
+
+	want, err := db.Get(query, 0, 0, indexName)
+	assert.NoError(t, err)
+
+	first, err := db.GetRounds(query, []int{0, 1}, 0, 0, indexName)
+	assert.NoError(t, err)
+
+	second, err := db.GetRounds(query, []int{2, 3}, 0, 0, indexName)
+	assert.NoError(t, err)
+
+	union := append(first, second...)
+	slices.Sort(union)
+	union = slices.Compact(union)
+
+	got := slices.Clone(want[indexName])
+	slices.Sort(got)
+	assert.Equal(t, got, union)
+
+	_, err = db.GetRounds(query, []int{0}, 0, 0, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestReembed(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 2}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 2}},
+		{ID: "b", Vec: []float64{-3, 1}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	err = db.Reembed(context.Background(), indexName, func(itemID string, oldVec []float64) ([]float64, error) {
+		return []float64{2 * oldVec[0], 2 * oldVec[1]}, nil
+	})
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = db.ExportJSONL(indexName, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"id\":\"a\",\"vec\":[2,4]}\n{\"id\":\"b\",\"vec\":[-6,2]}\n", buf.String())
+
+	res, err := db.Get([]float64{2, 4}, 0.99, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res[indexName])
+
+	err = db.Reembed(context.Background(), "missing-index-name", nil)
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetPage(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 1, NumHyperPlanes: 1, SpaceDim: 2, Seed: 42}}})
+	assert.NoError(t, err)
+
+	// Every item lies in the query's half-plane, with strictly decreasing similarity to it.
+	var items []Item
+	for i := 0; i < 25; i++ {
+		angle := float64(i) * math.Pi / 60
+		items = append(items, Item{ID: fmt.Sprint(i), Vec: []float64{math.Cos(angle), math.Sin(angle)}})
+	}
+	assert.NoError(t, db.AddBatch(items, indexName))
+
+	query := []float64{1, 0}
+
+	all, err := db.Get(query, 0, 0, indexName)
+	assert.NoError(t, err)
+	assert.Len(t, all[indexName], 25)
+
+	var paged []string
+	for offset := uint32(0); offset < 30; offset += 10 {
+		page, err := db.GetPage(query, 0, offset, 10, indexName)
+		assert.NoError(t, err)
+		paged = append(paged, page...)
+	}
+	assert.Equal(t, all[indexName], paged)
+
+	page, err := db.GetPage(query, 0, 10, 10, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, all[indexName][10:20], page)
+
+	page, err = db.GetPage(query, 0, 100, 10, indexName)
+	assert.NoError(t, err)
+	assert.NotNil(t, page)
+	assert.Empty(t, page)
+
+	page, err = db.GetPage(query, 0, 20, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, all[indexName][20:], page)
+
+	_, err = db.GetPage(query, 0, 0, 10, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestPrepareWithTieBreaker(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 1, NumHyperPlanes: 1, SpaceDim: 2, Seed: 42}}})
+	assert.NoError(t, err)
+
+	// Mirrored around the query, so both are equally similar to it.
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 0.001}},
+		{ID: "b", Vec: []float64{1, -0.001}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	res, err := db.Get([]float64{1, 0}, 0, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, res[indexName])
+
+	pq, err := db.PrepareWithTieBreaker([]float64{1, 0}, []float64{0, -1})
+	assert.NoError(t, err)
+
+	res, err = db.GetPrepared(pq, 0, 0, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, res[indexName])
+}
+
+func TestStats_SurviveReopen(t *testing.T) {
+	config := DBConfig{
+		Path:          t.TempDir(),
+		StatsInterval: time.Millisecond,
+		LSH:           []LSHConfig{{IndexName: "fake-index-name", SpaceDim: 3}},
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = db.Add(fmt.Sprint(i), []float64{1, 2, float64(i)}, "fake-index-name")
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err = db.Get([]float64{1, 2, 3}, 0.5, 1, "fake-index-name")
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, db.Close())
+
+	db, err = New(config)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	overview, err := db.Overview()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), overview[0].NumAdds)
+	assert.Equal(t, uint64(4), overview[0].NumGets)
+}
+
+func TestGetSimilarToID(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 4, NumHyperPlanes: 2, SpaceDim: 3, Seed: 42}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "x", Vec: []float64{1, 2, 3}},
+		{ID: "near-duplicate", Vec: []float64{1, 2, 3.01}},
+		{ID: "close", Vec: []float64{1, 2.5, 3}},
+		{ID: "opposite", Vec: []float64{-1, -2, -3}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	ids, err := db.GetSimilarToID("x", 0.5, 10, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near-duplicate", "close"}, ids)
+
+	_, err = db.GetSimilarToID("x", 0.5, 10, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestCountAndCentroid(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{
+		{IndexName: indexName, SpaceDim: 2},
+		{IndexName: "unstored", SpaceDim: 2, StoreEmbeddings: new(bool)},
+	}})
+	assert.NoError(t, err)
+
+	centroid, err := db.Centroid(indexName)
+	assert.NoError(t, err)
+	assert.Nil(t, centroid)
+
+	err = db.AddBatch([]Item{
+		{ID: "a", Vec: []float64{1, 2}},
+		{ID: "b", Vec: []float64{3, 4}},
+		{ID: "c", Vec: []float64{5, 0}},
+	}, indexName, "unstored")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Delete("c", indexName, "unstored"))
+
+	count, err := db.Count(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+
+	count, err = db.Count("unstored")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+
+	centroid, err = db.Centroid(indexName)
+	assert.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{2, 3}, centroid, 1e-9)
+
+	_, err = db.Centroid("unstored")
+	assert.Error(t, err)
+
+	_, err = db.Count("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestPublicErrors(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3}}})
+	assert.NoError(t, err)
+
+	t.Run("dimension_mismatch", func(t *testing.T) {
+		err := db.Add("a", []float64{1, 2}, indexName)
+
+		var dimErr *DimensionMismatchError
+		assert.ErrorAs(t, err, &dimErr)
+		assert.Equal(t, 3, dimErr.Expected)
+		assert.Equal(t, 2, dimErr.Got)
+		assert.ErrorIs(t, err, ErrDimensionMismatch)
+
+		_, err = db.GetBiased([]float64{1, 2, 3}, []float64{1}, 0.5, 0, 1, indexName)
+		assert.ErrorAs(t, err, &dimErr)
+		assert.Equal(t, &DimensionMismatchError{Expected: 3, Got: 1}, dimErr)
+	})
+
+	t.Run("invalid_threshold", func(t *testing.T) {
+		_, err := db.Get([]float64{1, 2, 3}, 1.5, 1, indexName)
+
+		var thresholdErr *InvalidThresholdError
+		assert.ErrorAs(t, err, &thresholdErr)
+		assert.Equal(t, &InvalidThresholdError{Expected: "between 0 and 1", Got: 1.5}, thresholdErr)
+		assert.ErrorIs(t, err, ErrInvalidThreshold)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		_, err := db.Get([]float64{1, 2, 3}, 0, 1, "missing-index-name")
+
+		var notFoundErr *NotFoundError
+		assert.ErrorAs(t, err, &notFoundErr)
+		assert.Equal(t, &NotFoundError{Kind: KindIndex, Name: "missing-index-name"}, notFoundErr)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		_, err = db.GetSimilarToID("missing-item", 0, 1, indexName)
+		assert.ErrorAs(t, err, &notFoundErr)
+		assert.Equal(t, &NotFoundError{Kind: KindItem, Name: "missing-item"}, notFoundErr)
+	})
+
+	t.Run("already_exists", func(t *testing.T) {
+		_, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName}, {IndexName: indexName}}})
+
+		var existsErr *AlreadyExistsError
+		assert.ErrorAs(t, err, &existsErr)
+		assert.Equal(t, &AlreadyExistsError{Kind: KindIndex, Name: indexName}, existsErr)
+		assert.ErrorIs(t, err, ErrAlreadyExists)
+		assert.NotErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestBucketFilter(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumHyperPlanes: 16, SpaceDim: 2, BucketFilter: true}}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("a", []float64{1, 0}, indexName))
+	assert.NoError(t, db.Add("b", []float64{-1, 0}, indexName))
+	assert.NoError(t, db.Delete("b", indexName))
+
+	res, err := db.Get([]float64{1, 0}, 0.9, 1, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res[indexName])
+
+	res, err = db.Get([]float64{-1, 0}, 0.9, 1, indexName)
+	assert.NoError(t, err)
+	assert.Empty(t, res[indexName])
+}
+
+func TestGetWithGroundTruth(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, NumRounds: 2, NumHyperPlanes: 4, SpaceDim: 2}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "east", Vec: []float64{1, 0}},
+		{ID: "north-east", Vec: []float64{1, 1}},
+		{ID: "north", Vec: []float64{0, 1}},
+		{ID: "west", Vec: []float64{-1, 0}},
+	}, indexName)
+	assert.NoError(t, err)
+
+	approx, exact, err := db.GetWithGroundTruth([]float64{1, 0}, 3, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"east", "north-east", "north"}, exact)
+
+	// The query shares every bucket with "east", so approx always finds it first, while the others depend on
+	// the hyperplanes.
+	assert.LessOrEqual(t, len(approx), 3)
+	assert.Equal(t, "east", approx[0])
+
+	_, _, err = db.GetWithGroundTruth([]float64{1, 0}, 3, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+
+	_, _, err = db.GetWithGroundTruth(make([]float64, DEFAULT_MAX_SPACE_DIM+1), 3, indexName)
+	assert.IsType(t, &spaceDimTooLargeError{}, err)
+}
+
+func TestUpdate(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 2}}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("a", []float64{1, 0}, indexName))
+	assert.NoError(t, db.Update("a", []float64{0, 1}, indexName))
+
+	res, err := db.Get([]float64{0, 1}, 0.99, 1, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res[indexName])
+
+	res, err = db.Get([]float64{1, 0}, 0.99, 1, indexName)
+	assert.NoError(t, err)
+	assert.Empty(t, res[indexName])
+
+	err = db.Update("missing", []float64{0, 1}, indexName)
+	var notFoundErr *NotFoundError
+	assert.ErrorAs(t, err, &notFoundErr)
+	assert.Equal(t, KindItem, notFoundErr.Kind)
+
+	err = db.Update("a", []float64{0, 1}, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestReloadStoredIndexes(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := New(DBConfig{
+		Path:      path,
+		KeyPrefix: "app",
+		LSH: []LSHConfig{
+			{IndexName: "first", NumRounds: 3, NumHyperPlanes: 5, SpaceDim: 2},
+			{IndexName: "with/slash", SpaceDim: 3},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("a", []float64{1, 0}, "first"))
+	assert.NoError(t, db.Add("b", []float64{1, 2, 3}, "with/slash"))
+	assert.NoError(t, db.Close())
+
+	// Only the listed index is opened with the given settings, the other one is rediscovered.
+	db, err = New(DBConfig{
+		Path:      path,
+		KeyPrefix: "app",
+		LSH:       []LSHConfig{{IndexName: "first", MaxCandidates: 10}},
+	})
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"first", "with/slash"}, db.Indexes())
+
+	res, err := db.Get([]float64{1, 2, 3}, 0.9, 1, "with/slash")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, res["with/slash"])
+
+	overview, err := db.Overview()
+	assert.NoError(t, err)
+	for _, idx := range overview {
+		if idx.Name == "first" {
+			assert.Equal(t, uint32(3), idx.NumRounds)
+			assert.Equal(t, uint32(5), idx.NumHyperPlanes)
+		}
+	}
+	assert.NoError(t, db.Close())
+
+	// Indexes under another key prefix aren't this DB's.
+	db, err = New(DBConfig{Path: path})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Empty(t, db.Indexes())
+}
+
+func TestListIDs(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 2}}})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{{ID: "b", Vec: []float64{1, 2}}, {ID: "a", Vec: []float64{3, 4}}}, indexName)
+	assert.NoError(t, err)
+
+	ids, err := db.ListIDs(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	_, err = db.ListIDs("missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestClose(t *testing.T) {
+	indexName := "fake-index-name"
+	config := DBConfig{Path: t.TempDir(), LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 2}}}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("a", []float64{1, 2}, indexName))
+
+	assert.NoError(t, db.Close())
+	assert.NoError(t, db.Close())
+
+	err = db.Add("b", []float64{1, 2}, indexName)
+	assert.IsType(t, &dbClosedError{}, err)
+
+	_, err = db.Get([]float64{1, 2}, 0.5, 1, indexName)
+	assert.IsType(t, &dbClosedError{}, err)
+
+	_, err = db.ListIDs(indexName)
+	assert.IsType(t, &dbClosedError{}, err)
+
+	// The directory is released.
+	db, err = New(config)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	ids, err := db.ListIDs(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+}
+
+func TestClose_Concurrent(t *testing.T) {
+	db, err := New(DBConfig{
+		Path:          t.TempDir(),
+		StatsInterval: time.Hour,
+		GC:            GCConfig{Interval: time.Hour},
+		LSH:           []LSHConfig{{IndexName: "fake-index-name", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+
+	// Every call stopping the goroutines would close their channels twice, and panic.
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			assert.NoError(t, db.Close())
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	assert.True(t, db.closed())
+}
+
+func TestGetWithScores(t *testing.T) {
+	db, err := New(DBConfig{
+		MaxResults: 1,
+		LSH: []LSHConfig{
+			{IndexName: "first", NumHyperPlanes: 1, SpaceDim: 2},
+			{IndexName: "second", NumHyperPlanes: 1, SpaceDim: 2},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.AddBatch([]Item{{ID: "a", Vec: []float64{1, 0}}, {ID: "b", Vec: []float64{1, 0.1}}}))
+
+	res, err := db.GetWithScores([]float64{1, 0}, 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+
+	for _, name := range []string{"first", "second"} {
+		assert.Len(t, res[name], 1)
+		assert.Equal(t, "a", res[name][0].ID)
+		assert.Equal(t, 1.0, res[name][0].Score)
+	}
+
+	_, err = db.GetWithScores([]float64{1, 0}, 0, 10, "missing-index-name")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestFlatIndex(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := New(DBConfig{
+		Path: path,
+		LSH:  []LSHConfig{{IndexName: "approx", SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}, {IndexName: "columnar", SpaceDim: 2, Columnar: true}},
+	})
+	assert.NoError(t, err)
+
+	err = db.AddBatch([]Item{
+		{ID: "east", Vec: []float64{1, 0}},
+		{ID: "north-east", Vec: []float64{1, 1}},
+		{ID: "north", Vec: []float64{0, 1}},
+	})
+	assert.NoError(t, err)
+
+	res, err := db.Get([]float64{1, 0.1}, 0, 2, "exact", "columnar")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"east", "north-east"}, res["exact"])
+	assert.Equal(t, res["exact"], res["columnar"])
+
+	approx, exact, err := db.GetWithGroundTruth([]float64{1, 0.1}, 2, "exact")
+	assert.NoError(t, err)
+	assert.Equal(t, exact, approx)
+
+	idx, _ := db.indexRef.get("exact")
+	assert.Equal(t, map[string]any{"type": "flat", "spaceDim": uint32(2), "count": 3}, idx.info())
+
+	idx, _ = db.indexRef.get("approx")
+	assert.Equal(t, "lsh", idx.info()["type"])
+
+	_, err = db.GetRounds([]float64{1, 0}, []int{0}, 0.5, 1, "exact")
+	assert.IsType(t, &unsupportedOperationError{}, err)
+
+	overview, err := db.Overview()
+	assert.NoError(t, err)
+	assert.Equal(t, IndexOverview{Name: "exact", SpaceDim: 2, NumItems: 3}, overview[2])
+
+	assert.NoError(t, db.Close())
+
+	// Names are shared with LSH indexes.
+	_, err = New(DBConfig{Path: path, LSH: []LSHConfig{{IndexName: "x"}}, Flat: []FlatConfig{{IndexName: "x"}}})
+	assert.ErrorAs(t, err, new(*indexAlreadyExistsError))
+
+	_, err = New(DBConfig{Path: path, Flat: []FlatConfig{{SpaceDim: 1}}})
+	assert.ErrorAs(t, err, new(*invalidFlatConfigError))
+
+	// Stored flat indexes are reopened.
+	db, err = New(DBConfig{Path: path})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	count, err := db.Count("exact")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), count)
+}
+
+func TestMetric(t *testing.T) {
+	db, err := New(DBConfig{LSH: []LSHConfig{
+		// Seeded, so that every item shares the query's bucket.
+		{IndexName: "cosine", SpaceDim: 2, NumRounds: 1, NumHyperPlanes: 1, Seed: 1},
+		{IndexName: "dot", SpaceDim: 2, NumRounds: 1, NumHyperPlanes: 1, Seed: 1, Metric: metricOf(MetricDotProduct)},
+		{IndexName: "euclidean", SpaceDim: 2, NumRounds: 1, NumHyperPlanes: 1, Seed: 1, Metric: metricOf(MetricEuclidean)},
+		{IndexName: "l1", SpaceDim: 2, NumRounds: 1, NumHyperPlanes: 1, Seed: 1, Metric: metricOf(MetricL1)},
+	}, Flat: []FlatConfig{
+		{IndexName: "exact-l1", SpaceDim: 2, Metric: MetricL1},
+	}})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.AddBatch([]Item{
+		{ID: "unit", Vec: []float64{1, 0.1}},
+		{ID: "scaled", Vec: []float64{10, 1}},
+		{ID: "near", Vec: []float64{2, 0.5}},
+	})
+	assert.NoError(t, err)
+
+	query := []float64{2, 0.2}
+
+	res, err := db.GetWithScores(query, 0.99, 0, "cosine")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"unit", "scaled"}, neighborIDs(res["cosine"]))
+
+	// Dot products favor long vectors, and thresholds aren't bounded by 1.
+	res, err = db.GetWithScores(query, 4, 0, "dot")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scaled", "near"}, neighborIDs(res["dot"]))
+
+	// Euclidean thresholds are maximum distances, and results are sorted by ascending distance.
+	res, err = db.GetWithScores(query, 1.5, 0, "euclidean")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near", "unit"}, neighborIDs(res["euclidean"]))
+	assert.InDelta(t, 0.3, res["euclidean"][0].Score, 1e-9)
+
+	// The error tells the range the metric accepts, rather than the one of similarities.
+	_, err = db.Get(query, -1, 0, "euclidean")
+	assert.ErrorIs(t, err, ErrInvalidThreshold)
+
+	var thresholdErr *InvalidThresholdError
+	assert.ErrorAs(t, err, &thresholdErr)
+	assert.Equal(t, &InvalidThresholdError{Expected: "non-negative", Got: -1}, thresholdErr)
+
+	approx, exact, err := db.GetWithGroundTruth(query, 1, "euclidean")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"near"}, exact)
+	assert.Equal(t, exact, approx)
+
+	// L1 scores are negated Manhattan distances, so thresholds are non-positive, whatever the index type.
+	for _, indexName := range []string{"l1", "exact-l1"} {
+		res, err = db.GetWithScores(query, -2, 0, indexName)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"near", "unit"}, neighborIDs(res[indexName]), indexName)
+		assert.InDelta(t, -0.3, res[indexName][0].Score, 1e-9)
+
+		_, err = db.Get(query, 0.5, 0, indexName)
+		assert.ErrorAs(t, err, &thresholdErr)
+		assert.Equal(t, &InvalidThresholdError{Expected: "non-positive", Got: 0.5}, thresholdErr, indexName)
+	}
+
+	manifest, err := db.Manifest()
+	assert.NoError(t, err)
+
+	for _, entry := range manifest {
+		if entry.Name == "exact-l1" {
+			assert.Equal(t, MetricL1, entry.Metric)
+		}
+	}
+}
+
+func TestMetric_Reopen(t *testing.T) {
+	config := DBConfig{
+		Path: t.TempDir(),
+		LSH:  []LSHConfig{{IndexName: "euclidean", SpaceDim: 2, Metric: metricOf(MetricEuclidean)}},
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// Another metric fails, naming both.
+	config.LSH[0].Metric = metricOf(MetricCosine)
+	_, err = New(config)
+	assert.ErrorContains(t, err, "created with metric euclidean, but got: cosine")
+
+	// Unset, the stored one applies, as do the stored hyperparameters.
+	config.LSH[0].Metric = nil
+	db, err = New(config)
+	assert.NoError(t, err)
+	idx, ok := db.indexRef.get("euclidean")
+	assert.True(t, ok)
+	assert.Equal(t, MetricEuclidean, idx.metric())
+	assert.NoError(t, db.Close())
+
+	// Without the config, the stored metric applies, as it does without the manifest.
+	db, err = New(DBConfig{Path: config.Path})
+	assert.NoError(t, err)
+	assert.NoError(t, db.stg.Del(db.manifestKey()))
+	assert.NoError(t, db.Close())
+
+	db, err = New(DBConfig{Path: config.Path})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	idx, ok = db.indexRef.get("euclidean")
+	assert.True(t, ok)
+	assert.Equal(t, MetricEuclidean, idx.metric())
+}
+
+func TestMetric_Pearson(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", SpaceDim: 3, NumRounds: 1, NumHyperPlanes: 1, Seed: 1, Metric: metricOf(MetricPearson)}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 3, Metric: MetricPearson}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.AddBatch([]Item{
+		{ID: "shifted", Vec: []float64{11, 12, 13}},
+		{ID: "reversed", Vec: []float64{3, 2, 1}},
+	})
+	assert.NoError(t, err)
+
+	// A constant offset doesn't change the correlation, although it lowers the cosine to about 0.96.
+	res, err := db.GetWithScores([]float64{1, 2, 3}, 0.99, 0)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"locality", "exact"} {
+		assert.Equal(t, []string{"shifted"}, neighborIDs(res[name]))
+		assert.InDelta(t, 1, res[name][0].Score, 1e-9)
+	}
+}
+
+func metricOf(metric Metric) *Metric {
+	return &metric
+}
+
+func neighborIDs(neighbors []Neighbor) []string {
+	ids := make([]string, len(neighbors))
+	for i, neighbor := range neighbors {
+		ids[i] = neighbor.ID
+	}
+
+	return ids
+}
+
+func TestAddF32(t *testing.T) {
+	indexName := "fake-index-name"
+
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: indexName, SpaceDim: 3, EmbeddingCodec: Float32Codec}}})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	vec := []float32{0.1, -0.2, 0.3}
+	assert.NoError(t, db.AddF32("a", vec, indexName))
+
+	res, err := db.Get([]float64{0.1, -0.2, 0.3}, 0.99, 1, indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res[indexName])
+
+	sample, err := db.Sample(indexName, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, float32To64(vec), sample["a"])
+
+	fp, err := db.Footprint(indexName)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(vec)*4), fp.Embeddings.ValueBytes)
+}
+
+func TestDropIndex(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := New(DBConfig{
+		Path: path,
+		LSH:  []LSHConfig{{IndexName: "temp", SpaceDim: 2}, {IndexName: "kept", SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.AddBatch([]Item{{ID: "a", Vec: []float64{1, 2}}, {ID: "b", Vec: []float64{3, 4}}}))
+
+	assert.NoError(t, db.DropIndex("temp"))
+	assert.NoError(t, db.DropIndex("exact"))
+	assert.IsType(t, &indexDoesNotExistError{}, db.DropIndex("temp"))
+	assert.ElementsMatch(t, []string{"kept"}, db.Indexes())
+
+	// The name can be reused right away, for an empty index.
+	assert.NoError(t, db.addLSH(LSHConfig{IndexName: "temp", SpaceDim: 3}))
+
+	count, err := db.Count("temp")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), count)
+
+	assert.NoError(t, db.Close())
+
+	// Dropped indexes aren't reopened.
+	db, err = New(DBConfig{Path: path})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.ElementsMatch(t, []string{"kept", "temp"}, db.Indexes())
+
+	idx, _ := db.indexRef.get("temp")
+	assert.Equal(t, uint32(3), idx.spaceDim())
+}
+
+func TestManifest(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := New(DBConfig{
+		Path: path,
+		LSH:  []LSHConfig{{IndexName: "dot", SpaceDim: 3, Metric: metricOf(MetricDotProduct)}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.addLSH(LSHConfig{IndexName: "temp", SpaceDim: 2}))
+	assert.NoError(t, db.DropIndex("temp"))
+
+	entries, err := db.Manifest()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, "dot", entries[0].Name)
+	assert.Equal(t, IndexTypeLSH, entries[0].Type)
+	assert.Equal(t, uint32(3), entries[0].SpaceDim)
+	assert.Equal(t, MetricDotProduct, entries[0].Metric)
+	assert.False(t, entries[0].CreatedAt.IsZero())
+
+	assert.Equal(t, "exact", entries[1].Name)
+	assert.Equal(t, IndexTypeFlat, entries[1].Type)
+	assert.Equal(t, uint32(2), entries[1].SpaceDim)
+
+	// Drop the manifest, as in a DB created before it existed.
+	assert.NoError(t, db.stg.Del(db.manifestKey()))
+	assert.NoError(t, db.Close())
+
+	db, err = New(DBConfig{Path: path})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.ElementsMatch(t, []string{"dot", "exact"}, db.Indexes())
+
+	migrated, err := db.Manifest()
+	assert.NoError(t, err)
+	assert.Len(t, migrated, 2)
+	assert.Equal(t, IndexTypeFlat, migrated[1].Type)
+	assert.Equal(t, uint32(3), migrated[0].SpaceDim)
+	assert.True(t, migrated[0].CreatedAt.IsZero())
+}
+
+func TestMigrateKeySeparator(t *testing.T) {
+	path := t.TempDir()
+	config := DBConfig{
+		Path:      path,
+		KeyPrefix: "app",
+		LSH:       []LSHConfig{{IndexName: "ab", NumRounds: 2, SpaceDim: 2}},
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}))
+	assert.NoError(t, db.Add("z\x1f", []float64{2, 1}))
+	assert.NoError(t, db.Add("https://example.com/a", []float64{-1, 3}))
+	assert.NoError(t, db.Close())
+
+	// Rewrite every key as it was before KEY_SEPARATOR, elements joined with "/" as is.
+	stg, err := storage.New(path)
+	assert.NoError(t, err)
+
+	var keys []string
+	err = stg.IterateKeysWithPrefix("app"+lsh.KEY_SEPARATOR+"index"+lsh.KEY_SEPARATOR, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, keys)
+
+	unescaper := strings.NewReplacer("\x1ee", "\x1e", "\x1es", "\x1f")
+
+	legacy := map[string][]byte{}
+	for _, key := range keys {
+		val, err := stg.Get(key)
+		assert.NoError(t, err)
+
+		elems := strings.Split(key, lsh.KEY_SEPARATOR)
+		for i, elem := range elems {
+			elems[i] = unescaper.Replace(elem)
+		}
+
+		legacy[strings.Join(elems, "/")] = val
+	}
+
+	assert.NoError(t, stg.Add(legacy))
+	assert.NoError(t, stg.Del(keys...))
+	assert.NoError(t, stg.CloseDB())
+
+	// A read-only DB can't migrate them.
+	_, err = New(DBConfig{Path: path, KeyPrefix: "app", ReadOnly: true})
+	var readOnlyErr *legacyKeysReadOnlyError
+	assert.ErrorAs(t, err, &readOnlyErr)
+
+	db, err = New(config)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	res, err := db.Get([]float64{1, 2}, 0.99, 0, "ab")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, res["ab"])
+
+	res, err = db.Get([]float64{2, 1}, 0.99, 0, "ab")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"z\x1f"}, res["ab"])
+
+	// IDs holding "/" aren't split into elements of their keys.
+	res, err = db.Get([]float64{-1, 3}, 0.99, 0, "ab")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/a"}, res["ab"])
+
+	ids, err := db.ListIDs("ab")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"x", "z\x1f", "https://example.com/a"}, ids)
+
+	exists, err := db.Exists("https://example.com/a", "ab")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, db.Delete("https://example.com/a", "ab"))
+
+	count, err := db.stg.CountWithPrefix("app/")
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestInferredSpaceDim(t *testing.T) {
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: "inferred"}, {IndexName: "declared", SpaceDim: 3}}})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The declared index rejects it before anything is written, naming itself.
+	err = db.Add("a", []float64{1, 2, 3, 4})
+	var lenErr *itemLenError
+	assert.ErrorAs(t, err, &lenErr)
+	assert.Equal(t, "declared", lenErr.indexName)
+	var mismatch *DimensionMismatchError
+	assert.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, DimensionMismatchError{Expected: 3, Got: 4}, *mismatch)
+
+	assert.NoError(t, db.Add("a", []float64{1, 2, 3}))
+
+	entries, err := db.Manifest()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), entries[1].SpaceDim)
+
+	err = db.Add("b", []float64{1, 2}, "inferred")
+	assert.ErrorAs(t, err, &lenErr)
+	assert.Equal(t, "inferred", lenErr.indexName)
+}
+
+func TestPing(t *testing.T) {
+	db, err := New(DBConfig{KeyPrefix: "tenant"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Ping())
+
+	count, err := db.stg.CountWithPrefix(db.healthKey())
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	assert.NoError(t, db.Close())
+	assert.IsType(t, &dbClosedError{}, db.Ping())
+}
+
+type queryCounter struct {
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (c *queryCounter) OnQuery(indexName string, numCandidates, numReturned int, dur time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queries[indexName]++
+}
+
+func TestObserver(t *testing.T) {
+	counter := &queryCounter{queries: map[string]int{}}
+
+	db, err := New(DBConfig{
+		Observer: counter,
+		LSH:      []LSHConfig{{IndexName: "a", SpaceDim: 2}, {IndexName: "b", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}))
+
+	_, err = db.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+
+	_, err = db.Get([]float64{1, 2}, 0.9, 0, "a")
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, counter.queries)
+}
+
+func TestBucketStats(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 1, SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.AddBatch([]Item{{ID: "a", Vec: []float64{1, 2}}, {ID: "b", Vec: []float64{1, 2}}}))
+
+	// Every round puts both items in the same bucket, which rounds may share.
+	stats, err := db.BucketStats("locality")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.MinSize)
+	assert.Equal(t, 2, stats.MaxSize)
+	assert.Equal(t, 2.0, stats.MeanSize)
+	assert.Equal(t, 0, stats.Singletons)
+
+	_, err = db.BucketStats("exact")
+	assert.IsType(t, &unsupportedOperationError{}, err)
+
+	_, err = db.BucketStats("missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestURLItemIDs(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 4, NumHyperPlanes: 2, SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Slashes, spaces and empty segments, as in the demo's caption URLs.
+	ids := []string{"https://example.com/a.jpg", "https://example.com/a.jpg/", "https://example.com//a b.jpg", "/", "//"}
+
+	items := make([]Item, len(ids))
+	for i, id := range ids {
+		items[i] = Item{ID: id, Vec: []float64{1, float64(i + 1)}}
+	}
+	assert.NoError(t, db.AddBatch(items))
+
+	for _, indexName := range []string{"locality", "exact"} {
+		listed, err := db.ListIDs(indexName)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, ids, listed, indexName)
+	}
+
+	res, err := db.Get([]float64{1, 2}, 0.9999, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"https://example.com/a.jpg/"}, "exact": {"https://example.com/a.jpg/"}}, res)
+
+	assert.NoError(t, db.Delete("/"))
+	assert.NoError(t, db.Delete("https://example.com/a.jpg"))
+
+	for _, indexName := range []string{"locality", "exact"} {
+		count, err := db.Count(indexName)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), count, indexName)
+	}
+}
+
+func TestGetFrom(t *testing.T) {
+	db, err := New(DBConfig{LSH: []LSHConfig{{IndexName: "a", SpaceDim: 2}, {IndexName: "b", SpaceDim: 2}}})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}, "a"))
+
+	ids, err := db.GetFrom("a", []float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, ids)
+
+	ids, err = db.GetFrom("b", []float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, ids)
+
+	_, err = db.GetFrom("missing", []float64{1, 2}, 0.9, 0)
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetWithOptions(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 2, SpaceDim: 2, Seed: 1}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.AddBatch([]Item{{ID: "a", Vec: []float64{1, 2}}, {ID: "b", Vec: []float64{1, 2.5}}}))
+
+	res, err := db.GetWithOptions([]float64{1, 2}, QueryOptions{Threshold: 0.9999, K: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a"}, "exact": {"a"}}, res)
+
+	// OverFetch fills K whatever the threshold.
+	res, err = db.GetWithOptions([]float64{1, 2}, QueryOptions{Threshold: 0.9999, K: 2, OverFetch: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a", "b"}, "exact": {"a", "b"}}, res)
+
+	// Identical sketches all pass the pre-filter.
+	res, err = db.GetWithOptions([]float64{1, 2}, QueryOptions{Threshold: 0.9, K: 2, PreFilterTopN: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a", "b"}, "exact": {"a", "b"}}, res)
+
+	_, err = db.GetWithOptions([]float64{1, 2}, QueryOptions{K: 2, OverFetch: 4}, "missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetWithMeta(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 2, SpaceDim: 2, Seed: 1}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.AddWithMeta("a", []float64{1, 2}, []byte(`{"title":"a"}`)))
+	assert.NoError(t, db.Add("b", []float64{2, 4}))
+
+	res, err := db.GetWithMeta([]float64{1, 2}, 0.9999, 0)
+	assert.NoError(t, err)
+
+	want := []ItemMeta{{ID: "a", Meta: []byte(`{"title":"a"}`)}, {ID: "b"}}
+	for _, indexName := range []string{"locality", "exact"} {
+		assert.ElementsMatch(t, want, res[indexName])
+	}
+
+	assert.NoError(t, db.Delete("a"))
+	assert.NoError(t, db.Add("a", []float64{1, 2}))
+
+	res, err = db.GetWithMeta([]float64{1, 2}, 0.9999, 0, "exact")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ItemMeta{{ID: "a"}, {ID: "b"}}, res["exact"])
+
+	_, err = db.GetWithMeta([]float64{1, 2}, 0.9999, 0, "missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetWithMeta_ConcurrentWrites(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 2, SpaceDim: 2, Seed: 1}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}, {IndexName: "columnar", SpaceDim: 2, Columnar: true}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	meta := []byte("meta")
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	// Deleting the item also deletes its metadata, so a neighbor read apart from its metadata may lack it.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, db.AddWithMeta("a", []float64{1, 2}, meta))
+			assert.NoError(t, db.Delete("a"))
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				res, err := db.GetWithMeta([]float64{1, 2}, 0.9999, 0)
+				assert.NoError(t, err)
+
+				for indexName, items := range res {
+					for _, item := range items {
+						assert.Equal(t, meta, item.Meta, indexName)
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestGetFiltered(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 2, SpaceDim: 2, Seed: 1}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.AddWithMeta("a", []float64{1, 2}, []byte(`{"lang":"en"}`)))
+	assert.NoError(t, db.AddWithMeta("b", []float64{1, 2}, []byte(`{"lang":"fr"}`)))
+	assert.NoError(t, db.Add("c", []float64{1, 2}))
+
+	isEN := func(meta []byte) bool { return string(meta) == `{"lang":"en"}` }
+
+	res, err := db.GetFiltered([]float64{1, 2}, 0.9, 0, isEN)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a"}, "exact": {"a"}}, res)
+
+	res, err = db.GetFiltered([]float64{1, 2}, 0.9, 0, func([]byte) bool { return false }, "exact")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"exact": {}}, res)
+
+	_, err = db.GetFiltered([]float64{1, 2}, 0.9, 0, isEN, "missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+// failingIndex fails every add, to test that DB.Add rolls back the indexes written before.
+type failingIndex struct {
+	index
+}
+
+func (failingIndex) add(string, []float64) error {
+	return errors.New("add failed")
+}
+
+func TestAddRollback(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "a", SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "b", SpaceDim: 2}, {IndexName: "c", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	idx, ok := db.indexRef.get("c")
+	assert.True(t, ok)
+	db.indexRef.add("c", failingIndex{idx})
+
+	assert.EqualError(t, db.Add("x", []float64{1, 2}, "a", "b", "c"), "add failed")
+
+	for _, indexName := range []string{"a", "b", "c"} {
+		idx, _ := db.indexRef.get(indexName)
+
+		ids, err := idx.listIDs()
+		assert.NoError(t, err)
+		assert.Empty(t, ids, indexName)
+	}
+
+	// An item that was already in an index keeps its previous vector and metadata there.
+	assert.NoError(t, db.AddWithMeta("y", []float64{1, 2}, []byte("meta"), "a"))
+
+	assert.EqualError(t, db.Add("y", []float64{2, -1}, "a", "b", "c"), "add failed")
+
+	a, _ := db.indexRef.get("a")
+
+	vec, err := a.embedding("y")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 2}, vec)
+
+	metas, err := a.meta([]string{"y"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("meta")}, metas)
+
+	b, _ := db.indexRef.get("b")
+
+	exists, err := b.exists("y")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestBackupRestore(t *testing.T) {
+	src, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", NumRounds: 2, NumHyperPlanes: 3, SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer src.Close()
+
+	assert.NoError(t, src.AddBatch([]Item{{ID: "a", Vec: []float64{1, 2}}, {ID: "b", Vec: []float64{2, 1}}}))
+
+	var full bytes.Buffer
+
+	version, err := src.Backup(&full, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, src.Add("c", []float64{1, 2.1}))
+
+	var incremental bytes.Buffer
+
+	_, err = src.Backup(&incremental, version)
+	assert.NoError(t, err)
+
+	dst, err := New(DBConfig{})
+	assert.NoError(t, err)
+	defer dst.Close()
+
+	assert.NoError(t, dst.Restore(&full))
+	assert.NoError(t, dst.Restore(&incremental))
+	assert.ElementsMatch(t, []string{"locality", "exact"}, dst.Indexes())
+
+	want, err := src.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+
+	got, err := dst.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.Contains(t, got["exact"], "c")
+
+	// The incremental backup updates the item count of the index opened by the full one.
+	count, err := dst.Count("locality")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), count)
+
+	assert.NoError(t, dst.Add("d", []float64{3, 1}))
+
+	count, err = dst.Count("locality")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), count)
+}
+
+func TestRunGC(t *testing.T) {
+	db, err := New(DBConfig{
+		Path: t.TempDir(),
+		GC:   GCConfig{Interval: time.Millisecond},
+		LSH:  []LSHConfig{{IndexName: "a", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}))
+	assert.NoError(t, db.Delete("x"))
+	assert.NoError(t, db.RunGC(0.5))
+
+	// Close stops the GC goroutine.
+	assert.NoError(t, db.Close())
+	assert.Nil(t, db.stopGC)
+	assert.IsType(t, &dbClosedError{}, db.RunGC(0.5))
+
+	inMemory, err := New(DBConfig{})
+	assert.NoError(t, err)
+	defer inMemory.Close()
+
+	assert.NoError(t, inMemory.RunGC(0.5))
+
+	_, err = New(DBConfig{GC: GCConfig{Interval: time.Second, DiscardRatio: 1}})
+	assert.ErrorAs(t, err, new(*invalidDiscardRatioError))
+}
+
+func TestEmbeddingCacheSize(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH: []LSHConfig{{IndexName: "a", NumRounds: 1, NumHyperPlanes: 1, SpaceDim: 2, Seed: 1, EmbeddingCacheSize: 10}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}))
+
+	res, err := db.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, res["a"])
+
+	// Cached vectors follow updates.
+	assert.NoError(t, db.Update("x", []float64{2, -1}))
+
+	res, err = db.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, res["a"])
+
+	res, err = db.Get([]float64{2, -1}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, res["a"])
+}
+
+func TestSync(t *testing.T) {
+	db, err := New(DBConfig{
+		Path:       t.TempDir(),
+		SyncWrites: true,
+		LSH:        []LSHConfig{{IndexName: "a", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Add("x", []float64{1, 2}))
+	assert.NoError(t, db.Sync())
+
+	assert.NoError(t, db.Close())
+	assert.IsType(t, &dbClosedError{}, db.Sync())
+
+	inMemory, err := New(DBConfig{SyncWrites: true})
+	assert.NoError(t, err)
+	defer inMemory.Close()
+
+	assert.NoError(t, inMemory.Sync())
+}
+
+func TestReadOnly(t *testing.T) {
+	path := t.TempDir()
+	config := DBConfig{
+		Path: path,
+		LSH:  []LSHConfig{{IndexName: "locality", SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	}
+
+	db, err := New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Add("a", []float64{1, 2}))
+	assert.NoError(t, db.Close())
+
+	config.ReadOnly = true
+	config.StatsInterval = time.Millisecond
+
+	db, err = New(config)
+	assert.NoError(t, err)
+
+	res, err := db.Get([]float64{1, 2}, 0.9, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a"}, "exact": {"a"}}, res)
+
+	assert.IsType(t, &readOnlyError{}, db.Add("b", []float64{1, 2}))
+	assert.IsType(t, &readOnlyError{}, db.AddBatch([]Item{{ID: "b", Vec: []float64{1, 2}}}))
+	assert.IsType(t, &readOnlyError{}, db.Update("a", []float64{2, 1}))
+	assert.IsType(t, &readOnlyError{}, db.Delete("a"))
+	_, err = db.AddBatchIfAbsent([]Item{{ID: "b", Vec: []float64{1, 2}}}, "locality")
+	assert.IsType(t, &readOnlyError{}, err)
+	_, err = db.Repair("locality")
+	assert.IsType(t, &readOnlyError{}, err)
+	assert.IsType(t, &readOnlyError{}, db.MigrateNormalize("locality"))
+	assert.IsType(t, &readOnlyError{}, db.PruneRounds(context.Background(), "locality", 0))
+	assert.IsType(t, &readOnlyError{}, db.Restore(bytes.NewReader(nil)))
+	assert.IsType(t, &readOnlyError{}, db.DropIndex("exact"))
+	assert.ElementsMatch(t, []string{"locality", "exact"}, db.Indexes())
+	assert.NoError(t, db.Ping())
+	assert.NoError(t, db.RunGC(0.5))
+	assert.NoError(t, db.Close())
+
+	_, err = New(DBConfig{ReadOnly: true})
+	assert.ErrorAs(t, err, new(*readOnlyInMemoryError))
+}
+
+func TestReadOnly_PreManifest(t *testing.T) {
+	path := t.TempDir()
+
+	db, err := New(DBConfig{
+		Path: path,
+		LSH:  []LSHConfig{{IndexName: "locality", SpaceDim: 2}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AddBatch([]Item{{ID: "a", Vec: []float64{1, 2}}, {ID: "b", Vec: []float64{2, 1}}}))
+
+	// Drop the manifest and the item count, as in a DB created before they were stored.
+	countKey := "index" + lsh.KEY_SEPARATOR + "locality" + lsh.KEY_SEPARATOR + "stats" + lsh.KEY_SEPARATOR + "count"
+	assert.NoError(t, db.stg.Del(db.manifestKey(), countKey))
+	assert.NoError(t, db.Close())
+
+	db, err = New(DBConfig{Path: path, ReadOnly: true})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.ElementsMatch(t, []string{"locality", "exact"}, db.Indexes())
+
+	entries, err := db.Manifest()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "exact", entries[0].Name)
+
+	count, err := db.Count("locality")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+
+	res, err := db.Get([]float64{1, 2}, 0.99, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"locality": {"a"}, "exact": {"a"}}, res)
+
+	// Neither is stored.
+	for _, key := range []string{db.manifestKey(), countKey} {
+		exists, err := db.stg.KeyExists(key)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	db, err := New(DBConfig{
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+		LSH:    []LSHConfig{{IndexName: "a", SpaceDim: 2, StoreEmbeddings: new(bool)}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Top-k queries need stored embeddings, which the index logs when failing.
+	_, err = db.GetWithOptions([]float64{1, 2}, QueryOptions{K: 1, OverFetch: 2})
+	assert.Error(t, err)
+	assert.Contains(t, buf.String(), "vectoria:src:internal:lsh:GetTopK")
+}
+
+func TestExists(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "locality", SpaceDim: 2}, {IndexName: "unranked", SpaceDim: 2, StoreEmbeddings: new(bool)}},
+		Flat: []FlatConfig{{IndexName: "exact", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Add("a", []float64{1, 2}))
+
+	for _, indexName := range []string{"locality", "unranked", "exact"} {
+		exists, err := db.Exists("a", indexName)
+		assert.NoError(t, err)
+		assert.True(t, exists, indexName)
+
+		exists, err = db.Exists("b", indexName)
+		assert.NoError(t, err)
+		assert.False(t, exists, indexName)
+	}
+
+	assert.NoError(t, db.Delete("a", "exact"))
+
+	exists, err := db.Exists("a", "exact")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = db.Exists("a", "missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+}
+
+func TestGetMerged(t *testing.T) {
+	db, err := New(DBConfig{
+		LSH:  []LSHConfig{{IndexName: "euclidean", SpaceDim: 2, Seed: 1, Metric: metricOf(MetricEuclidean)}},
+		Flat: []FlatConfig{{IndexName: "shard1", SpaceDim: 2}, {IndexName: "shard2", SpaceDim: 2}},
+	})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Add("a", []float64{1, 0}, "shard1"))
+	assert.NoError(t, db.Add("b", []float64{1, 1}, "shard2"))
+	assert.NoError(t, db.Add("c", []float64{0, 1}, "shard1", "shard2"))
+
+	neighbors, err := db.GetMerged([]float64{1, 0.1}, 0, 0, "shard1", "shard2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, neighborIDs(neighbors))
+
+	neighbors, err = db.GetMerged([]float64{1, 0.1}, 0, 2, "shard1", "shard2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, neighborIDs(neighbors))
+
+	neighbors, err = db.GetMerged([]float64{1, 0.1}, 0.99, 0, "shard1", "shard2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, neighborIDs(neighbors))
+
+	_, err = db.GetMerged([]float64{1, 0}, 0, 0, "shard1", "missing")
+	assert.IsType(t, &indexDoesNotExistError{}, err)
+
+	_, err = db.GetMerged([]float64{1, 0}, 0, 0, "shard1", "euclidean")
+	assert.IsType(t, &mixedMetricsError{}, err)
+}